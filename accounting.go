@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/traffic"
+)
+
+// accountant counts the traffic of the server, if enabled by -traffic or -api.
+var accountant *traffic.Accountant
+
+// serveAPI serves the traffic counters over HTTP on addr, on the loopback
+// address if addr has no host.
+func serveAPI(addr string) {
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/traffic", accountant)
+	mux.Handle("/traffic/", accountant)
+	logger.Info("API listening", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Error("failed to serve API", "addr", addr, "err", err)
+	}
+}
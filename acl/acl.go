@@ -0,0 +1,438 @@
+// Package acl decides which destinations a server may connect to, with rules
+// on networks, domain names and ports. Other decisions on destinations, like
+// the routes of a client, use the same rules with actions of their own.
+package acl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Rule applies its action to the destinations it matches. A destination
+// matches if its address is in one of Networks or its name is one of Domains,
+// and its port is in one of Ports.
+type Rule struct {
+	// Action is allow or deny in a List that Check uses. Other users of the
+	// rules, like routing, have actions of their own.
+	Action string
+	// Any matches every address, for rules on ports only.
+	Any      bool
+	Networks []*net.IPNet
+	// Domains match a name and its subdomains: "example.com" matches
+	// example.com and www.example.com. ParseRule reads *.example.com the
+	// same.
+	Domains []string
+	// Ports match every port if empty.
+	Ports []PortRange
+
+	text string
+}
+
+// PortRange is the ports from From to To, both included.
+type PortRange struct {
+	From, To int
+}
+
+// String returns the rule as ParseRule reads it.
+func (r *Rule) String() string {
+	if r.text != "" {
+		return r.text
+	}
+	words := []string{r.Action}
+	var targets []string
+	if r.Any {
+		targets = append(targets, "*")
+	}
+	for _, n := range r.Networks {
+		targets = append(targets, n.String())
+	}
+	targets = append(targets, r.Domains...)
+	words = append(words, strings.Join(targets, ","))
+	if len(r.Ports) > 0 {
+		ports := make([]string, len(r.Ports))
+		for i, p := range r.Ports {
+			ports[i] = strconv.Itoa(p.From)
+			if p.To != p.From {
+				ports[i] += "-" + strconv.Itoa(p.To)
+			}
+		}
+		words = append(words, strings.Join(ports, ","))
+	}
+	return strings.Join(words, " ")
+}
+
+// ParseRule reads a rule like
+//
+//	deny 10.0.0.0/8,192.168.0.0/16
+//	allow example.com 80,443
+//	deny * 25,6000-6063
+//	deny @blocklist.txt
+//
+// The words are the action, allow or deny, the destinations, a comma-separated
+// list of CIDR networks, IP addresses, domain names, * for any or @ and the
+// path of a list file, and optionally the ports, a comma-separated list of
+// ports and ranges. A list file has a destination per line, like the GeoIP
+// and domain lists that are published for routing; empty lines and lines
+// that start with # are skipped.
+func ParseRule(s string) (Rule, error) {
+	return Parse(s, "allow", "deny")
+}
+
+// Parse reads a rule like ParseRule whose action is one of actions.
+func Parse(s string, actions ...string) (Rule, error) {
+	words := strings.Fields(s)
+	if len(words) < 2 || len(words) > 3 {
+		return Rule{}, fmt.Errorf("rule %q: want action, destinations and optional ports", s)
+	}
+
+	r := Rule{Action: words[0], text: strings.Join(words, " ")}
+	known := false
+	for _, action := range actions {
+		known = known || r.Action == action
+	}
+	if !known {
+		return Rule{}, fmt.Errorf("rule %q: unknown action %s, want %s", s, r.Action, strings.Join(actions, " or "))
+	}
+
+	for _, target := range strings.Split(words[1], ",") {
+		if strings.HasPrefix(target, "@") {
+			if err := r.readList(target[1:]); err != nil {
+				return Rule{}, fmt.Errorf("rule %q: %v", s, err)
+			}
+			continue
+		}
+		if err := r.addTarget(target); err != nil {
+			return Rule{}, fmt.Errorf("rule %q: %v", s, err)
+		}
+	}
+
+	if len(words) == 3 {
+		for _, ports := range strings.Split(words[2], ",") {
+			from, to := ports, ports
+			if i := strings.IndexByte(ports, '-'); i >= 0 {
+				from, to = ports[:i], ports[i+1:]
+			}
+			p, err := parsePortRange(from, to)
+			if err != nil {
+				return Rule{}, fmt.Errorf("rule %q: %v", s, err)
+			}
+			r.Ports = append(r.Ports, p)
+		}
+	}
+	return r, nil
+}
+
+// addTarget adds a destination to the rule.
+func (r *Rule) addTarget(target string) error {
+	switch {
+	case target == "*":
+		r.Any = true
+	case strings.Contains(target, "/"):
+		_, n, err := net.ParseCIDR(target)
+		if err != nil {
+			return err
+		}
+		r.Networks = append(r.Networks, n)
+	case net.ParseIP(target) != nil:
+		ip := net.ParseIP(target)
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		r.Networks = append(r.Networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	case target != "":
+		r.Domains = append(r.Domains, normalize(strings.TrimPrefix(target, "*.")))
+	default:
+		return errors.New("empty destination")
+	}
+	return nil
+}
+
+// readList adds the destinations of the list file at path to the rule.
+func (r *Rule) readList(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := r.addTarget(line); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+	}
+	return nil
+}
+
+func parsePortRange(from, to string) (PortRange, error) {
+	f, err := strconv.Atoi(from)
+	if err != nil || f < 0 || f > 65535 {
+		return PortRange{}, fmt.Errorf("invalid port %s", from)
+	}
+	t, err := strconv.Atoi(to)
+	if err != nil || t < f || t > 65535 {
+		return PortRange{}, fmt.Errorf("invalid port %s", to)
+	}
+	return PortRange{f, t}, nil
+}
+
+// normalize returns the comparable form of a domain name.
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func (r *Rule) matchPort(port int) bool {
+	if len(r.Ports) == 0 {
+		return true
+	}
+	for _, p := range r.Ports {
+		if p.From <= port && port <= p.To {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchName(name string) bool {
+	for _, domain := range r.Domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchIP(ip net.IP) bool {
+	for _, n := range r.Networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether r matches the destination named name, "" for an IP
+// address, at ips and port.
+func (r *Rule) match(name string, ips []net.IP, port int) bool {
+	if !r.matchPort(port) {
+		return false
+	}
+	if r.Any || (name != "" && r.matchName(name)) {
+		return true
+	}
+	for _, ip := range ips {
+		if r.matchIP(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultRules deny the destinations that are never meant to be reached
+// through a server: loopback, link-local, which includes the metadata
+// services of cloud providers, and the unspecified addresses that reach the
+// host itself.
+var DefaultRules = []string{
+	"deny 127.0.0.0/8,::1/128,localhost",
+	"deny 169.254.0.0/16,fe80::/10",
+	"deny 0.0.0.0/8,::/128",
+}
+
+// ErrDenied is the error of a denied destination, see DeniedError.
+var ErrDenied = errors.New("destination denied")
+
+// DeniedError is a destination that a rule denied.
+type DeniedError struct {
+	Address string
+	Rule    string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("destination %s denied by rule %q", e.Address, e.Rule)
+}
+
+// Is makes errors.Is(err, ErrDenied) true.
+func (e *DeniedError) Is(target error) bool { return target == ErrDenied }
+
+// List is an ordered list of rules. The first rule that matches a destination
+// decides; destinations that match no rule are allowed. A nil *List allows
+// everything.
+type List struct {
+	Rules []Rule
+	// Resolver looks up the addresses of domain names, for the rules on
+	// networks. nil is net.DefaultResolver.
+	Resolver *net.Resolver
+}
+
+// New returns the list of rules followed by DefaultRules. A rule "allow *"
+// allows what DefaultRules would deny.
+func New(rules []string) (*List, error) {
+	l := &List{}
+	for _, s := range append(append([]string(nil), rules...), DefaultRules...) {
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		l.Rules = append(l.Rules, r)
+	}
+	return l, nil
+}
+
+// Check returns a *DeniedError if the rules deny address, a host and port.
+// The addresses of a domain name are looked up before the first rule with
+// networks, so that a name cannot lead to a denied network; if the lookup
+// fails, so does Check.
+func (l *List) Check(ctx context.Context, address string) error {
+	r, err := l.Match(ctx, address)
+	if r != nil && r.Action == "deny" {
+		return &DeniedError{Address: address, Rule: r.String()}
+	}
+	return err
+}
+
+// CheckResolved is like Check, for a destination that is already resolved to
+// ip. name is its domain name, if it has one.
+func (l *List) CheckResolved(address, name string, ip net.IP, port int) error {
+	if r := l.MatchResolved(name, ip, port); r != nil && r.Action == "deny" {
+		return &DeniedError{Address: address, Rule: r.String()}
+	}
+	return nil
+}
+
+// Resolve is like Check, and returns the addresses to connect to. Once the
+// rules need the addresses of a domain name, it looks them up and returns
+// those that the rules allow, so that the connection does not depend on a
+// second lookup that could give other addresses. Otherwise, it returns
+// address itself.
+func (l *List) Resolve(ctx context.Context, address string) ([]string, error) {
+	if l == nil {
+		return []string{address}, nil
+	}
+	host, port, err := splitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{address}, l.CheckResolved(address, "", ip, port)
+	}
+
+	name := normalize(host)
+	for i := range l.Rules {
+		r := &l.Rules[i]
+		if len(r.Networks) > 0 {
+			break
+		}
+		if r.match(name, nil, port) {
+			if r.Action == "deny" {
+				return nil, &DeniedError{Address: address, Rule: r.String()}
+			}
+			return []string{address}, nil
+		}
+	}
+
+	ips, err := l.lookup(ctx, host)
+	if err != nil {
+		if r := l.MatchResolved(name, nil, port); r != nil && r.Action == "deny" {
+			return nil, &DeniedError{Address: address, Rule: r.String()}
+		}
+		return nil, err
+	}
+	var addrs []string
+	var denied error
+	for _, ip := range ips {
+		if err := l.CheckResolved(address, name, ip, port); err != nil {
+			if denied == nil {
+				denied = err
+			}
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+	if len(addrs) == 0 && denied == nil {
+		denied = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	return addrs, denied
+}
+
+// Match returns the first rule that matches address, a host and port, or nil
+// if none does. The addresses of a domain name are looked up before the first
+// rule with networks. If the lookup fails, Match returns its error with the
+// first rule that matches the name without them.
+func (l *List) Match(ctx context.Context, address string) (*Rule, error) {
+	if l == nil {
+		return nil, nil
+	}
+	host, port, err := splitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return l.MatchResolved("", ip, port), nil
+	}
+
+	name := normalize(host)
+	var ips []net.IP
+	var lookupErr error
+	resolved := false
+	for i := range l.Rules {
+		r := &l.Rules[i]
+		if !resolved && len(r.Networks) > 0 {
+			resolved = true
+			ips, lookupErr = l.lookup(ctx, host)
+		}
+		if r.match(name, ips, port) {
+			return r, lookupErr
+		}
+	}
+	return nil, lookupErr
+}
+
+// MatchResolved is like Match, for a destination that is already resolved to
+// ip. name is its domain name, if it has one.
+func (l *List) MatchResolved(name string, ip net.IP, port int) *Rule {
+	if l == nil {
+		return nil
+	}
+	name = normalize(name)
+	for i := range l.Rules {
+		if r := &l.Rules[i]; r.match(name, []net.IP{ip}, port) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (l *List) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	resolver := l.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+func splitHostPort(address string) (string, int, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in %s", address)
+	}
+	return host, port, nil
+}
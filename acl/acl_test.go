@@ -0,0 +1,174 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	for _, s := range []string{
+		"deny 10.0.0.0/8",
+		"allow example.com,192.0.2.1 80,443",
+		"deny * 6000-6063",
+		"allow 2001:db8::/32",
+	} {
+		r, err := ParseRule(s)
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+			continue
+		}
+		if r.String() != s {
+			t.Errorf("%q: String() = %q", s, r.String())
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"deny",
+		"block 10.0.0.0/8",
+		"deny 10.0.0.0/33",
+		"deny * 80 443",
+		"deny * 70000",
+		"deny * 443-80",
+		"deny 10.0.0.0/8,",
+	} {
+		if _, err := ParseRule(s); err == nil {
+			t.Errorf("%q: accepted", s)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	l, err := New([]string{
+		"allow 127.0.0.1 8080",
+		"deny 10.0.0.0/8,example.com",
+		"deny * 25",
+		"allow 192.0.2.0/24",
+		"deny 192.0.2.7 22",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for address, want := range map[string]string{
+		"127.0.0.1:8080":        "",
+		"127.0.0.1:22":          "deny 127.0.0.0/8,::1/128,localhost",
+		"[::1]:22":              "deny 127.0.0.0/8,::1/128,localhost",
+		"[::ffff:127.0.0.1]:22": "deny 127.0.0.0/8,::1/128,localhost",
+		"localhost:80":          "deny 127.0.0.0/8,::1/128,localhost",
+		"169.254.169.254:80":    "deny 169.254.0.0/16,fe80::/10",
+		"[fe80::1]:80":          "deny 169.254.0.0/16,fe80::/10",
+		"0.0.0.0:80":            "deny 0.0.0.0/8,::/128",
+		"10.1.2.3:443":          "deny 10.0.0.0/8,example.com",
+		"198.51.100.1:25":       "deny * 25",
+		"198.51.100.1:587":      "",
+		"192.0.2.7:22":          "", // the earlier allow decides
+		"[2001:db8::1]:443":     "",
+	} {
+		checkDenied(t, l.Check(context.Background(), address), address, want)
+	}
+
+	// Names, as if they resolved to a public address.
+	public := net.IPv4(198, 51, 100, 1)
+	for name, want := range map[string]string{
+		"example.com":      "deny 10.0.0.0/8,example.com",
+		"WWW.Example.COM.": "deny 10.0.0.0/8,example.com",
+		"notexample.com":   "",
+		"api.localhost":    "deny 127.0.0.0/8,::1/128,localhost",
+	} {
+		address := net.JoinHostPort(name, "443")
+		checkDenied(t, l.CheckResolved(address, name, public, 443), address, want)
+	}
+
+	var nilList *List
+	if err := nilList.Check(context.Background(), "127.0.0.1:22"); err != nil {
+		t.Errorf("nil list: %v", err)
+	}
+}
+
+// checkDenied checks that err denies address by the rule want, or allows it
+// if want is "".
+func checkDenied(t *testing.T, err error, address, want string) {
+	t.Helper()
+	var denied *DeniedError
+	switch {
+	case want == "" && err != nil:
+		t.Errorf("%s: %v, want allowed", address, err)
+	case want != "" && !errors.As(err, &denied):
+		t.Errorf("%s: %v, want denied by %q", address, err, want)
+	case want != "" && denied.Rule != want:
+		t.Errorf("%s: denied by %q, want %q", address, denied.Rule, want)
+	}
+}
+
+func TestCheckResolvesNames(t *testing.T) {
+	r, err := ParseRule("deny 127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &List{Rules: []Rule{r}}
+	// The name is allowed, but not what it resolves to.
+	if err := l.Check(context.Background(), "localhost:80"); !errors.Is(err, ErrDenied) {
+		t.Errorf("localhost: got %v, want %v", err, ErrDenied)
+	}
+	if err := l.CheckResolved("localhost:80", "localhost", net.IPv4(192, 0, 2, 1), 80); err != nil {
+		t.Errorf("resolved elsewhere: %v", err)
+	}
+}
+
+func TestListFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.txt")
+	list := "# private networks\n10.0.0.0/8\n\n  192.0.2.1  \n*.example.com\n"
+	if err := os.WriteFile(path, []byte(list), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Parse("direct @"+path+",example.net 443", "direct", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Action != "direct" || len(r.Networks) != 2 || len(r.Domains) != 2 {
+		t.Errorf("parsed %+v", r)
+	}
+	if r.String() != "direct @"+path+",example.net 443" {
+		t.Errorf("String() = %q", r.String())
+	}
+
+	l := &List{Rules: []Rule{r}}
+	for address, want := range map[string]bool{
+		"10.1.2.3:443":     true,
+		"192.0.2.1:443":    true,
+		"192.0.2.1:80":     false,
+		"198.51.100.1:443": false,
+	} {
+		if got, err := l.Match(context.Background(), address); err != nil || (got != nil) != want {
+			t.Errorf("%s: matched %v, %v, want %v", address, got, err, want)
+		}
+	}
+	public := net.IPv4(198, 51, 100, 1)
+	for name, want := range map[string]bool{
+		"www.example.com": true,
+		"example.net":     true,
+		"example.org":     false,
+	} {
+		if got := l.MatchResolved(name, public, 443); (got != nil) != want {
+			t.Errorf("%s: matched %v, want %v", name, got, want)
+		}
+	}
+
+	if _, err := Parse("direct @"+path, "allow", "deny"); err == nil {
+		t.Error("unknown action accepted")
+	}
+	if _, err := ParseRule("deny @" + filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("missing list file accepted")
+	}
+	if err := os.WriteFile(path, []byte("10.0.0.0/33\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseRule("deny @" + path); err == nil {
+		t.Error("invalid list file accepted")
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the format of the -config file, in JSON or, for files named
+// *.yaml or *.yml, YAML. For example
+//
+//	loglevel: info
+//	udptimeout: 5m
+//	clients:
+//	  - server: 192.0.2.1:8488
+//	    cipher: AEAD_CHACHA20_POLY1305
+//	    password: correct horse
+//	    socks: 127.0.0.1:1080
+//	    udpsocks: true
+//	    tcptun:
+//	      - {listen: ":8053", target: "8.8.8.8:53"}
+//	servers:
+//	  - listen: 192.0.2.1:8488
+//	    keyfile: /etc/shadowsocks/keys
+//	    udp: true
+//
+// Flags override the file. Flags that describe a client or a server apply to
+// the first client or server of the file.
+type Config struct {
+	Verbose          bool     `json:"verbose" yaml:"verbose"`
+	LogLevel         string   `json:"loglevel" yaml:"loglevel"`
+	LogFormat        string   `json:"logformat" yaml:"logformat"`
+	UDPTimeout       duration `json:"udptimeout" yaml:"udptimeout"`
+	HandshakeTimeout duration `json:"handshaketimeout" yaml:"handshaketimeout"`
+	TCPCork          bool     `json:"tcpcork" yaml:"tcpcork"`
+	Grace            duration `json:"grace" yaml:"grace"`
+	Metrics          string   `json:"metrics" yaml:"metrics"`
+	API              string   `json:"api" yaml:"api"`
+	APIToken         string   `json:"apitoken" yaml:"apitoken"`
+	Traffic          string   `json:"traffic" yaml:"traffic"`
+
+	Clients []ClientConfig `json:"clients" yaml:"clients"`
+	Servers []ServerConfig `json:"servers" yaml:"servers"`
+}
+
+// ClientConfig is a connection to a server and the listeners that use it.
+type ClientConfig struct {
+	Server     string `json:"server" yaml:"server"` // address or ss:// URL
+	Cipher     string `json:"cipher" yaml:"cipher"`
+	Key        string `json:"key" yaml:"key"` // base64url
+	Password   string `json:"password" yaml:"password"`
+	KeyFile    string `json:"keyfile" yaml:"keyfile"` // the public key of a DarkStar server
+	Plugin     string `json:"plugin" yaml:"plugin"`
+	PluginOpts string `json:"pluginopts" yaml:"pluginopts"`
+
+	Socks    string   `json:"socks" yaml:"socks"`
+	UDPSocks bool     `json:"udpsocks" yaml:"udpsocks"`
+	Redir    string   `json:"redir" yaml:"redir"`
+	Redir6   string   `json:"redir6" yaml:"redir6"`
+	TProxy   string   `json:"tproxy" yaml:"tproxy"`
+	TCPTun   []Tunnel `json:"tcptun" yaml:"tcptun"`
+	UDPTun   []Tunnel `json:"udptun" yaml:"udptun"`
+
+	// SocksUser and SocksPassword, if set, are the credentials that the SOCKS
+	// clients must give.
+	SocksUser     string `json:"socksuser" yaml:"socksuser"`
+	SocksPassword string `json:"sockspassword" yaml:"sockspassword"`
+	// ServerReplies has the server report the outcome of each SOCKS
+	// request, and relay BIND.
+	ServerReplies bool `json:"serverreplies" yaml:"serverreplies"`
+
+	// DNS is the address of a DNS server that forwards the queries to
+	// DNSUpstream, 8.8.8.8:53 if empty, through the server: over TCP, or
+	// through the UDP relay with DNSOverUDP. FakeIP, if set, is a network
+	// whose addresses stand for the names in the answers.
+	DNS         string `json:"dns" yaml:"dns"`
+	DNSUpstream string `json:"dnsupstream" yaml:"dnsupstream"`
+	DNSOverUDP  bool   `json:"dnsoverudp" yaml:"dnsoverudp"`
+	FakeIP      string `json:"fakeip" yaml:"fakeip"`
+
+	// Route are routing rules on the TCP targets, before the rules of
+	// RouteFile, which is read again on SIGHUP.
+	Route     []string `json:"route" yaml:"route"`
+	RouteFile string   `json:"routefile" yaml:"routefile"`
+
+	// Upstreams are more servers for the TCP connections, which Balance
+	// spreads over them and Server.
+	Upstreams   []Upstream `json:"upstreams" yaml:"upstreams"`
+	Balance     string     `json:"balance" yaml:"balance"` // round-robin (default), least-connections or latency
+	HealthCheck duration   `json:"healthcheck" yaml:"healthcheck"`
+
+	// Mux is the number of multiplexed sessions that carry the TCP
+	// connections to each server, 0 for a connection each.
+	Mux int `json:"mux" yaml:"mux"`
+	// UDPOverTCP carries the UDP associations in TCP connections.
+	UDPOverTCP bool `json:"udpovertcp" yaml:"udpovertcp"`
+}
+
+// Upstream is another server of a client. An upstream given by address takes
+// the cipher, key, password and key file it leaves empty from the client.
+type Upstream struct {
+	Server   string `json:"server" yaml:"server"` // address or ss:// URL
+	Cipher   string `json:"cipher" yaml:"cipher"`
+	Key      string `json:"key" yaml:"key"`
+	Password string `json:"password" yaml:"password"`
+	KeyFile  string `json:"keyfile" yaml:"keyfile"`
+}
+
+// client returns the client c with u as its server.
+func (u Upstream) client(c ClientConfig) ClientConfig {
+	c.Server = u.Server
+	if strings.HasPrefix(u.Server, "ss://") {
+		c.Cipher, c.Key, c.Password, c.KeyFile = "", "", "", ""
+	}
+	if u.Cipher != "" {
+		c.Cipher = u.Cipher
+	}
+	if u.Key != "" || u.KeyFile != "" {
+		c.Key, c.KeyFile = u.Key, u.KeyFile
+	}
+	if u.Password != "" {
+		c.Password = u.Password
+	}
+	return c
+}
+
+// Tunnel forwards a local address to a target through the server.
+type Tunnel struct {
+	Listen string `json:"listen" yaml:"listen"`
+	Target string `json:"target" yaml:"target"`
+}
+
+// ServerConfig is a server listener.
+type ServerConfig struct {
+	Listen     string `json:"listen" yaml:"listen"` // address or ss:// URL
+	Cipher     string `json:"cipher" yaml:"cipher"`
+	Key        string `json:"key" yaml:"key"` // base64url
+	Password   string `json:"password" yaml:"password"`
+	KeyFile    string `json:"keyfile" yaml:"keyfile"` // DarkStar private key, or a directory of *.priv keys
+	Users      string `json:"users" yaml:"users"`
+	Plugin     string `json:"plugin" yaml:"plugin"`
+	PluginOpts string `json:"pluginopts" yaml:"pluginopts"`
+	UDP        bool   `json:"udp" yaml:"udp"`
+	TCP        *bool  `json:"tcp" yaml:"tcp"` // default true
+
+	Outbound *Outbound `json:"outbound" yaml:"outbound"`
+	// ACL are rules on the targets, before acl.DefaultRules.
+	ACL []string `json:"acl" yaml:"acl"`
+}
+
+// Outbound is how a server connects to targets, directly if it is nil.
+type Outbound struct {
+	SourceIP  string `json:"sourceip" yaml:"sourceip"`
+	Interface string `json:"interface" yaml:"interface"` // Linux only
+	// Proxy is an upstream proxy: socks5://host:port, http://host:port or the
+	// ss:// URL of another Shadowsocks server.
+	Proxy   string `json:"proxy" yaml:"proxy"`
+	Key     string `json:"key" yaml:"key"`         // base64url, of a Shadowsocks upstream
+	KeyFile string `json:"keyfile" yaml:"keyfile"` // the public key of a DarkStar upstream
+}
+
+// TCPEnabled reports whether the server accepts TCP.
+func (s *ServerConfig) TCPEnabled() bool { return s.TCP == nil || *s.TCP }
+
+// duration is a time.Duration written like "90s" or "5m".
+type duration time.Duration
+
+func (d *duration) set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("durations are strings like \"5m\"")
+	}
+	return d.set(s)
+}
+
+func (d *duration) UnmarshalYAML(value *yaml.Node) error {
+	return d.set(value.Value)
+}
+
+func defaultConfig() *Config {
+	return &Config{LogLevel: "info", LogFormat: "logfmt", UDPTimeout: duration(5 * time.Minute), HandshakeTimeout: duration(time.Minute), Grace: duration(30 * time.Second)}
+}
+
+// loadConfig reads the config file at path. Unknown fields are errors, so that
+// typos do not go unnoticed.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := defaultConfig()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(cfg)
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(cfg)
+	}
+	if err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	return cfg, nil
+}
+
+// parseTunnels parses the tunnels of -tcptun and -udptun, laddr1=raddr1,laddr2=raddr2,...
+func parseTunnels(s string) ([]Tunnel, error) {
+	var tunnels []Tunnel
+	for _, tun := range strings.Split(s, ",") {
+		p := strings.Split(tun, "=")
+		if len(p) != 2 || p[0] == "" || p[1] == "" {
+			return nil, errors.New("invalid tunnel " + tun + ", want laddr=raddr")
+		}
+		tunnels = append(tunnels, Tunnel{Listen: p[0], Target: p[1]})
+	}
+	return tunnels, nil
+}
+
+// applyFlags overrides cfg with the flags in set, the names of the flags given
+// on the command line. -c and -s add a client or server if cfg has none; it
+// gets the defaults of all flags that were not given.
+func (cfg *Config) applyFlags(f *flagValues, set map[string]bool) error {
+	if set["verbose"] {
+		cfg.Verbose = f.Verbose
+	}
+	if set["loglevel"] {
+		cfg.LogLevel = f.LogLevel
+	}
+	if set["logformat"] {
+		cfg.LogFormat = f.LogFormat
+	}
+	if set["udptimeout"] {
+		cfg.UDPTimeout = duration(f.UDPTimeout)
+	}
+	if set["handshaketimeout"] {
+		cfg.HandshakeTimeout = duration(f.HandshakeTimeout)
+	}
+	if set["tcpcork"] {
+		cfg.TCPCork = f.TCPCork
+	}
+	if set["grace"] {
+		cfg.Grace = duration(f.Grace)
+	}
+	if set["metrics"] {
+		cfg.Metrics = f.Metrics
+	}
+	if set["api"] {
+		cfg.API = f.API
+	}
+	if set["apitoken"] {
+		cfg.APIToken = f.APIToken
+	}
+	if set["traffic"] {
+		cfg.Traffic = f.Traffic
+	}
+
+	newClient := set["c"] && len(cfg.Clients) == 0
+	if newClient {
+		cfg.Clients = []ClientConfig{{}}
+	}
+	if len(cfg.Clients) > 0 {
+		c := &cfg.Clients[0]
+		override := func(name string) bool { return newClient || set[name] }
+		if override("c") {
+			servers := strings.Split(f.Client, ",")
+			c.Server, c.Upstreams = servers[0], nil
+			for _, server := range servers[1:] {
+				c.Upstreams = append(c.Upstreams, Upstream{Server: server})
+			}
+		}
+		if override("cipher") {
+			c.Cipher = f.Cipher
+		}
+		if override("key") {
+			c.Key = f.Key
+		}
+		if override("password") {
+			c.Password = f.Password
+		}
+		if override("keyfile") {
+			c.KeyFile = f.KeyFile
+		}
+		if override("plugin") {
+			c.Plugin = f.Plugin
+		}
+		if override("plugin-opts") {
+			c.PluginOpts = f.PluginOpts
+		}
+		if override("socks") {
+			c.Socks = f.Socks
+		}
+		if override("u") {
+			c.UDPSocks = f.UDPSocks
+		}
+		if set["serverreplies"] {
+			c.ServerReplies = f.ServerReplies
+		}
+		if set["socksauth"] {
+			user, password, ok := strings.Cut(f.SocksAuth, ":")
+			if !ok {
+				return errors.New("invalid -socksauth, want username:password")
+			}
+			c.SocksUser, c.SocksPassword = user, password
+		}
+		if override("redir") {
+			c.Redir = f.RedirTCP
+		}
+		if override("redir6") {
+			c.Redir6 = f.RedirTCP6
+		}
+		if override("tproxy") {
+			c.TProxy = f.TProxy
+		}
+		if override("dns") {
+			c.DNS = f.DNS
+		}
+		if set["dnsupstream"] {
+			c.DNSUpstream = f.DNSUpstream
+		}
+		if set["dnsoverudp"] {
+			c.DNSOverUDP = f.DNSOverUDP
+		}
+		if set["fakeip"] {
+			c.FakeIP = f.FakeIP
+		}
+		if set["tcptun"] {
+			tunnels, err := parseTunnels(f.TCPTun)
+			if err != nil {
+				return err
+			}
+			c.TCPTun = tunnels
+		}
+		if set["udptun"] {
+			tunnels, err := parseTunnels(f.UDPTun)
+			if err != nil {
+				return err
+			}
+			c.UDPTun = tunnels
+		}
+		if set["balance"] {
+			c.Balance = f.Balance
+		}
+		if set["healthcheck"] {
+			c.HealthCheck = duration(f.HealthCheck)
+		}
+		if set["mux"] {
+			c.Mux = f.Mux
+		}
+		if set["udpovertcp"] {
+			c.UDPOverTCP = f.UDPOverTCP
+		}
+		if set["route"] {
+			c.Route = splitRules(f.Route)
+		}
+		if set["routefile"] {
+			c.RouteFile = f.RouteFile
+		}
+	}
+
+	newServer := set["s"] && len(cfg.Servers) == 0
+	if newServer {
+		cfg.Servers = []ServerConfig{{}}
+	}
+	if len(cfg.Servers) > 0 {
+		s := &cfg.Servers[0]
+		override := func(name string) bool { return newServer || set[name] }
+		if override("s") {
+			s.Listen = f.Server
+		}
+		if override("cipher") {
+			s.Cipher = f.Cipher
+		}
+		if override("key") {
+			s.Key = f.Key
+		}
+		if override("password") {
+			s.Password = f.Password
+		}
+		if override("keyfile") {
+			s.KeyFile = f.KeyFile
+		}
+		if override("users") {
+			s.Users = f.Users
+		}
+		if override("plugin") {
+			s.Plugin = f.Plugin
+		}
+		if override("plugin-opts") {
+			s.PluginOpts = f.PluginOpts
+		}
+		if override("udp") {
+			s.UDP = f.UDP
+		}
+		if override("tcp") {
+			tcp := f.TCP
+			s.TCP = &tcp
+		}
+		if set["acl"] {
+			s.ACL = splitRules(f.ACL)
+		}
+		if set["outbound"] || set["outbound-ip"] || set["outbound-interface"] {
+			if s.Outbound == nil {
+				s.Outbound = &Outbound{}
+			}
+			if set["outbound"] {
+				s.Outbound.Proxy = f.Outbound
+			}
+			if set["outbound-ip"] {
+				s.Outbound.SourceIP = f.OutboundIP
+			}
+			if set["outbound-interface"] {
+				s.Outbound.Interface = f.OutboundInterface
+			}
+		}
+	}
+	return nil
+}
+
+// splitRules splits the rules of the -acl and -route flags, separated by
+// semicolons.
+func splitRules(s string) []string {
+	var rules []string
+	for _, rule := range strings.Split(s, ";") {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, data string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigJSONAndYAML(t *testing.T) {
+	jsonPath := writeConfig(t, "config.json", `{
+		"udptimeout": "90s",
+		"clients": [{"server": "192.0.2.1:8488", "cipher": "AEAD_CHACHA20_POLY1305", "password": "pw",
+			"socks": ":1080", "tcptun": [{"listen": ":8053", "target": "8.8.8.8:53"}], "routefile": "routes.txt"}],
+		"servers": [{"listen": ":8488", "keyfile": "keys", "udp": true, "tcp": false,
+			"outbound": {"sourceip": "192.0.2.10"}, "pluginopts": "server"}]
+	}`)
+	yamlPath := writeConfig(t, "config.yaml", `
+udptimeout: 90s
+clients:
+  - server: 192.0.2.1:8488
+    cipher: AEAD_CHACHA20_POLY1305
+    password: pw
+    socks: ":1080"
+    tcptun:
+      - {listen: ":8053", target: "8.8.8.8:53"}
+    routefile: routes.txt
+servers:
+  - listen: ":8488"
+    keyfile: keys
+    udp: true
+    tcp: false
+    outbound:
+      sourceip: 192.0.2.10
+    pluginopts: server
+`)
+
+	fromJSON, err := loadConfig(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromYAML, err := loadConfig(yamlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromJSON, fromYAML) {
+		t.Fatalf("JSON %+v and YAML %+v differ", fromJSON, fromYAML)
+	}
+
+	cfg := fromJSON
+	if time.Duration(cfg.UDPTimeout) != 90*time.Second {
+		t.Errorf("udptimeout: got %v", time.Duration(cfg.UDPTimeout))
+	}
+	if cfg.LogLevel != "info" {
+		t.Errorf("loglevel: got %q, want the default", cfg.LogLevel)
+	}
+	if len(cfg.Clients) != 1 || cfg.Clients[0].TCPTun[0] != (Tunnel{":8053", "8.8.8.8:53"}) || cfg.Clients[0].RouteFile != "routes.txt" {
+		t.Errorf("clients: got %+v", cfg.Clients)
+	}
+	if len(cfg.Servers) != 1 || cfg.Servers[0].TCPEnabled() || !cfg.Servers[0].UDP {
+		t.Errorf("servers: got %+v", cfg.Servers)
+	}
+	if o := cfg.Servers[0].Outbound; o == nil || o.SourceIP != "192.0.2.10" {
+		t.Errorf("outbound: got %+v", o)
+	}
+	if got := cfg.Servers[0].PluginOpts; got != "server" {
+		t.Errorf("pluginopts: got %q", got)
+	}
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	for name, data := range map[string]string{
+		"config.json": `{"servers": [{"lisen": ":8488"}]}`,
+		"config.yml":  "servers:\n  - lisen: \":8488\"\n",
+	} {
+		if _, err := loadConfig(writeConfig(t, name, data)); err == nil {
+			t.Errorf("%s: misspelled field accepted", name)
+		}
+	}
+}
+
+func TestApplyFlags(t *testing.T) {
+	defaults := flagValues{Cipher: "DarkStar", TCP: true, LogLevel: "info", LogFormat: "logfmt", UDPTimeout: 5 * time.Minute}
+
+	// Flags override the first client and server of the file.
+	cfg := &Config{
+		Clients: []ClientConfig{{Server: "192.0.2.1:8488", Cipher: "AEAD_AES_128_GCM", Socks: ":1080"}, {Server: "192.0.2.2:8488"}},
+		Servers: []ServerConfig{{Listen: ":8488", UDP: true}},
+	}
+	f := defaults
+	f.Socks = ":1081"
+	f.TCPTun = ":1090=localhost:5201,:1091=localhost:5202"
+	f.Password = "pw"
+	f.LogLevel = "debug"
+	err := cfg.applyFlags(&f, map[string]bool{"socks": true, "tcptun": true, "password": true, "loglevel": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ClientConfig{Server: "192.0.2.1:8488", Cipher: "AEAD_AES_128_GCM", Password: "pw", Socks: ":1081",
+		TCPTun: []Tunnel{{":1090", "localhost:5201"}, {":1091", "localhost:5202"}}}
+	if !reflect.DeepEqual(cfg.Clients[0], want) {
+		t.Errorf("client: got %+v, want %+v", cfg.Clients[0], want)
+	}
+	if cfg.Clients[1].Password != "" {
+		t.Errorf("second client changed: %+v", cfg.Clients[1])
+	}
+	if s := cfg.Servers[0]; s.Password != "pw" || !s.UDP || s.TCP != nil {
+		t.Errorf("server: got %+v", s)
+	}
+	if cfg.LogLevel != "debug" {
+		t.Errorf("loglevel: got %q", cfg.LogLevel)
+	}
+
+	// -s without a file makes a server of all the flags.
+	cfg = defaultConfig()
+	f = defaults
+	f.Server = ":8488"
+	if err := cfg.applyFlags(&f, map[string]bool{"s": true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Clients) != 0 || len(cfg.Servers) != 1 || cfg.Servers[0].Cipher != "DarkStar" || !cfg.Servers[0].TCPEnabled() {
+		t.Errorf("got %+v", cfg)
+	}
+
+	// The outbound flags make an outbound for the server.
+	f.Outbound = "socks5://127.0.0.1:1080"
+	f.OutboundIP = "192.0.2.1"
+	if err := cfg.applyFlags(&f, map[string]bool{"outbound": true, "outbound-ip": true}); err != nil {
+		t.Fatal(err)
+	}
+	if o := cfg.Servers[0].Outbound; o == nil || *o != (Outbound{Proxy: f.Outbound, SourceIP: f.OutboundIP}) {
+		t.Errorf("outbound: got %+v", o)
+	}
+
+	f.ACL = "allow 127.0.0.1 8080; deny * ;"
+	if err := cfg.applyFlags(&f, map[string]bool{"acl": true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.Servers[0].ACL, []string{"allow 127.0.0.1 8080", "deny *"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("acl: got %q, want %q", got, want)
+	}
+
+	cfg = &Config{Clients: []ClientConfig{{Server: "192.0.2.1:8488"}}}
+	f.Route = "direct 192.168.0.0/16; block example.com"
+	f.RouteFile = "routes.txt"
+	if err := cfg.applyFlags(&f, map[string]bool{"route": true, "routefile": true}); err != nil {
+		t.Fatal(err)
+	}
+	if c := cfg.Clients[0]; !reflect.DeepEqual(c.Route, []string{"direct 192.168.0.0/16", "block example.com"}) || c.RouteFile != "routes.txt" {
+		t.Errorf("route: got %q and %q", c.Route, c.RouteFile)
+	}
+
+	f.SocksAuth = "alice:pass:word"
+	f.ServerReplies = true
+	if err := cfg.applyFlags(&f, map[string]bool{"socksauth": true, "serverreplies": true}); err != nil {
+		t.Fatal(err)
+	}
+	if c := cfg.Clients[0]; c.SocksUser != "alice" || c.SocksPassword != "pass:word" || !c.ServerReplies {
+		t.Errorf("socksauth: got %q and %q, serverreplies %v", c.SocksUser, c.SocksPassword, c.ServerReplies)
+	}
+	if err := cfg.applyFlags(&flagValues{SocksAuth: "alice"}, map[string]bool{"socksauth": true}); err == nil {
+		t.Error("-socksauth without a password accepted")
+	}
+
+	f.DNS, f.DNSUpstream, f.DNSOverUDP, f.FakeIP = ":5353", "1.1.1.1:53", true, "198.18.0.0/15"
+	if err := cfg.applyFlags(&f, map[string]bool{"dns": true, "dnsupstream": true, "dnsoverudp": true, "fakeip": true}); err != nil {
+		t.Fatal(err)
+	}
+	if c := cfg.Clients[0]; c.DNS != ":5353" || c.DNSUpstream != "1.1.1.1:53" || !c.DNSOverUDP || c.FakeIP != "198.18.0.0/15" {
+		t.Errorf("dns: got %q, %q, %v and %q", c.DNS, c.DNSUpstream, c.DNSOverUDP, c.FakeIP)
+	}
+
+	// -c takes a list of servers.
+	f.Client = "ss://AEAD_AES_128_GCM:a@192.0.2.1:8488,192.0.2.2:8488"
+	f.Balance = "least-connections"
+	f.Mux = 4
+	f.UDPOverTCP = true
+	if err := cfg.applyFlags(&f, map[string]bool{"c": true, "balance": true, "mux": true, "udpovertcp": true}); err != nil {
+		t.Fatal(err)
+	}
+	if c := cfg.Clients[0]; c.Server != "ss://AEAD_AES_128_GCM:a@192.0.2.1:8488" ||
+		!reflect.DeepEqual(c.Upstreams, []Upstream{{Server: "192.0.2.2:8488"}}) || c.Balance != f.Balance || c.Mux != 4 || !c.UDPOverTCP {
+		t.Errorf("servers: got %+v", c)
+	}
+
+	if err := cfg.applyFlags(&flagValues{TCPTun: ":1090"}, map[string]bool{"c": true, "tcptun": true}); err == nil {
+		t.Error("malformed -tcptun accepted")
+	}
+}
+
+func TestUpstreamClient(t *testing.T) {
+	c := ClientConfig{Server: "192.0.2.1:8488", Cipher: "AEAD_AES_128_GCM", Password: "pw", KeyFile: "key", Socks: ":1080"}
+	for _, tc := range []struct {
+		upstream Upstream
+		want     ClientConfig
+	}{
+		{Upstream{Server: "192.0.2.2:8488"},
+			ClientConfig{Server: "192.0.2.2:8488", Cipher: "AEAD_AES_128_GCM", Password: "pw", KeyFile: "key", Socks: ":1080"}},
+		{Upstream{Server: "192.0.2.2:8488", Cipher: "DarkStar", KeyFile: "other"},
+			ClientConfig{Server: "192.0.2.2:8488", Cipher: "DarkStar", Password: "pw", KeyFile: "other", Socks: ":1080"}},
+		{Upstream{Server: "ss://AEAD_CHACHA20_POLY1305:x@192.0.2.2:8488"},
+			ClientConfig{Server: "ss://AEAD_CHACHA20_POLY1305:x@192.0.2.2:8488", Socks: ":1080"}},
+	} {
+		if got := tc.upstream.client(c); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%+v: got %+v, want %+v", tc.upstream, got, tc.want)
+		}
+	}
+}
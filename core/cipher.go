@@ -2,11 +2,14 @@ package core
 
 import (
 	"crypto/md5"
+	"encoding/base64"
 	"errors"
 	"net"
 	"sort"
+	"strings"
 
 	"github.com/OperatorFoundation/go-shadowsocks2/shadowaead"
+	"github.com/OperatorFoundation/go-shadowsocks2/shadowaead2022"
 )
 
 type Cipher interface {
@@ -22,11 +25,36 @@ type PacketConnCipher interface {
 	PacketConn(net.PacketConn) net.PacketConn
 }
 
+// ServerPacketConnCipher is a PacketConnCipher whose packets differ between
+// clients and servers, like those of Shadowsocks 2022. Its PacketConn is the
+// client side.
+type ServerPacketConnCipher interface {
+	ServerPacketConn(net.PacketConn) net.PacketConn
+}
+
+// ServerPacketConn returns c with ciph for a server.
+func ServerPacketConn(ciph PacketConnCipher, c net.PacketConn) net.PacketConn {
+	if sc, ok := ciph.(ServerPacketConnCipher); ok {
+		return sc.ServerPacketConn(c)
+	}
+	return ciph.PacketConn(c)
+}
+
+// aeadTagSize is the overhead of every supported AEAD.
+const aeadTagSize = 16
+
 // ErrCipherNotSupported occurs when a cipher is not supported (likely because of security concerns).
 var ErrCipherNotSupported = errors.New("cipher not supported")
 
 const (
-	darkStar = "DarkStar"
+	darkStar             = "DarkStar"
+	aeadAes128Gcm        = "AEAD_AES_128_GCM"
+	aeadAes256Gcm        = "AEAD_AES_256_GCM"
+	aeadChacha20Poly1305 = "AEAD_CHACHA20_POLY1305"
+
+	blake3Aes128Gcm        = "2022-blake3-aes-128-gcm"
+	blake3Aes256Gcm        = "2022-blake3-aes-256-gcm"
+	blake3Chacha20Poly1305 = "2022-blake3-chacha20-poly1305"
 )
 
 // List of AEAD ciphers: key size in bytes and constructor
@@ -34,7 +62,19 @@ var aeadList = map[string]struct {
 	KeySize int
 	New     func([]byte) (shadowaead.Cipher, error)
 }{
-	//darkStar: {32, shadowaead.DarkStar},
+	aeadAes128Gcm:        {16, shadowaead.AESGCM},
+	aeadAes256Gcm:        {32, shadowaead.AESGCM},
+	aeadChacha20Poly1305: {32, shadowaead.Chacha20Poly1305},
+}
+
+// List of Shadowsocks 2022 ciphers: key size in bytes and constructor
+var aead2022List = map[string]struct {
+	KeySize int
+	New     func([]byte) (*shadowaead2022.Cipher, error)
+}{
+	blake3Aes128Gcm:        {16, shadowaead2022.AESGCM},
+	blake3Aes256Gcm:        {32, shadowaead2022.AESGCM},
+	blake3Chacha20Poly1305: {32, shadowaead2022.Chacha20Poly1305},
 }
 
 // ListCipher returns a list of available cipher names sorted alphabetically.
@@ -43,6 +83,9 @@ func ListCipher() []string {
 	for k := range aeadList {
 		l = append(l, k)
 	}
+	for k := range aead2022List {
+		l = append(l, k)
+	}
 
 	l = append(l, "DarkStar")
 
@@ -51,14 +94,39 @@ func ListCipher() []string {
 }
 
 // PickCipher returns a Cipher of the given name. Derive key from password if given key is empty.
+// Names are case-insensitive, and the names used by other Shadowsocks implementations
+// (e.g. aes-256-gcm, chacha20-ietf-poly1305) are accepted as aliases.
 func PickCipher(name string, key []byte, password string) (Cipher, error) {
-	// name = strings.ToUpper(name)
-
-	switch name {
+	switch strings.ToUpper(name) {
 	case "DUMMY":
 		return &dummy{}, nil
-	case "DarkStar":
+	case "DARKSTAR":
 		name = darkStar
+	case "CHACHA20-IETF-POLY1305", aeadChacha20Poly1305:
+		name = aeadChacha20Poly1305
+	case "AES-128-GCM", aeadAes128Gcm:
+		name = aeadAes128Gcm
+	case "AES-256-GCM", aeadAes256Gcm:
+		name = aeadAes256Gcm
+	}
+
+	// Shadowsocks 2022 has no key derivation: the password is the base64-encoded key.
+	if choice, ok := aead2022List[strings.ToLower(name)]; ok {
+		if len(key) == 0 {
+			k, err := base64.StdEncoding.DecodeString(password)
+			if err != nil {
+				return nil, err
+			}
+			key = k
+		}
+		if len(key) != choice.KeySize {
+			return nil, shadowaead.KeySizeError(choice.KeySize)
+		}
+		ciph, err := choice.New(key)
+		if err != nil {
+			return nil, err
+		}
+		return ciph, nil
 	}
 
 	if choice, ok := aeadList[name]; ok {
@@ -84,6 +152,24 @@ func (aead *aeadCipher) PacketConn(c net.PacketConn) net.PacketConn {
 	return shadowaead.NewPacketConn(c, aead)
 }
 
+// StreamHeaderSize is the length of the salt and the encrypted length of the first chunk.
+func (aead *aeadCipher) StreamHeaderSize() int { return aead.SaltSize() + 2 + aeadTagSize }
+
+// MatchStream reports whether header, the first StreamHeaderSize bytes of a
+// stream, was encrypted with this key.
+func (aead *aeadCipher) MatchStream(header []byte) bool {
+	if len(header) != aead.StreamHeaderSize() {
+		return false
+	}
+	salt := header[:aead.SaltSize()]
+	dec, err := aead.Decrypter(salt)
+	if err != nil {
+		return false
+	}
+	_, err = dec.Open(nil, make([]byte, dec.NonceSize()), header[len(salt):], nil)
+	return err == nil
+}
+
 // dummy cipher does not encrypt
 type dummy struct{}
 
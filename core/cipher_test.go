@@ -0,0 +1,155 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/shadowaead"
+)
+
+// Test vectors for SIP004 AEAD ciphers with the password "shadowsocks test vector"
+// and the salt 00 01 02 ... They were produced with OpenSSL, independently of this
+// package, following the Shadowsocks reference implementation: EVP_BytesToKey for
+// the key, HKDF-SHA1 with info "ss-subkey" for the subkey, and little-endian
+// counting nonces.
+//
+// packet is one UDP packet carrying 8.8.8.8:53 and "hello".
+// stream is the start of a TCP stream carrying 127.0.0.1:80 and an HTTP request
+// as a single chunk.
+var aeadVectors = []struct {
+	name   string
+	key    string
+	packet string
+	stream string
+}{
+	{
+		name:   "aes-128-gcm",
+		key:    "dd1b73dbd9ff06ec1ca3685242a5af13",
+		packet: "000102030405060708090a0b0c0d0e0fbc3eea90f0f5261847529647d61f083f3b0084d38725a12bb7da6ae6",
+		stream: "000102030405060708090a0b0c0d0e0fbd2ff85b50ed355414cd343411d1cd543a911b6cb52d863cc113c8ababb512c9fcf4e5017b47d6595470c5dd7c02c806cf010d296677f91b5e5842",
+	},
+	{
+		name:   "aes-256-gcm",
+		key:    "dd1b73dbd9ff06ec1ca3685242a5af13f48ac61662721ce480b5c137209262c0",
+		packet: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f3b461b19b109a01cfe38b11312f973f221f29be06102ef18dd1b4267",
+		stream: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f3a57ba8b89842e0af40ff634c6c2b280d9b9ca7e999006e270caa4eec0ca39511412eac7420f9f35ee67f497ab85807936b9b662e7be370d73fe73",
+	},
+	{
+		name:   "chacha20-ietf-poly1305",
+		key:    "dd1b73dbd9ff06ec1ca3685242a5af13f48ac61662721ce480b5c137209262c0",
+		packet: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f30b964c354affd98d4b8a10bdfe9fb0cc7b76bfaee67a5d65c2f38c7",
+		stream: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f31a89013ca30df3376dbd57f8027add382a025f62136d928aa120ff3b2c1d07fe90d6c53a17e5c768e86974d843d92f26c2ffc4cbf0726752b8a8b",
+	},
+}
+
+const aeadVectorPassword = "shadowsocks test vector"
+
+var (
+	aeadVectorPacketPlaintext = append([]byte{1, 8, 8, 8, 8, 0, 53}, "hello"...)
+	aeadVectorStreamPlaintext = append([]byte{1, 127, 0, 0, 1, 0, 80}, "GET / HTTP/1.0\r\n\r\n"...)
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func pickVectorCipher(t *testing.T, name string) shadowaead.Cipher {
+	ciph, err := PickCipher(name, nil, aeadVectorPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, ok := ciph.(*aeadCipher)
+	if !ok {
+		t.Fatalf("%s: got %T, want an AEAD cipher", name, ciph)
+	}
+	return aead.Cipher
+}
+
+func TestAEADKeyDerivation(t *testing.T) {
+	for _, v := range aeadVectors {
+		key := decodeHex(t, v.key)
+		if got := kdf(aeadVectorPassword, len(key)); !bytes.Equal(got, key) {
+			t.Errorf("%s: kdf = %x, want %x", v.name, got, key)
+		}
+	}
+}
+
+func TestAEADPacketVectors(t *testing.T) {
+	for _, v := range aeadVectors {
+		ciph := pickVectorCipher(t, v.name)
+		pkt := decodeHex(t, v.packet)
+
+		buf := make([]byte, len(pkt))
+		plaintext, err := shadowaead.Unpack(buf, pkt, ciph)
+		if err != nil {
+			t.Errorf("%s: unpack: %v", v.name, err)
+			continue
+		}
+		if !bytes.Equal(plaintext, aeadVectorPacketPlaintext) {
+			t.Errorf("%s: unpack = %x, want %x", v.name, plaintext, aeadVectorPacketPlaintext)
+		}
+
+		// Sealing with the same salt must reproduce the reference packet.
+		salt := pkt[:ciph.SaltSize()]
+		aead, err := ciph.Encrypter(salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed := aead.Seal(append([]byte{}, salt...), make([]byte, aead.NonceSize()), aeadVectorPacketPlaintext, nil)
+		if !bytes.Equal(sealed, pkt) {
+			t.Errorf("%s: seal = %x, want %x", v.name, sealed, pkt)
+		}
+	}
+}
+
+func TestAEADStreamVectors(t *testing.T) {
+	for _, v := range aeadVectors {
+		ciph := pickVectorCipher(t, v.name)
+		stream := decodeHex(t, v.stream)
+
+		left, right := net.Pipe()
+		go func() {
+			left.Write(stream)
+			left.Close()
+		}()
+
+		plaintext := make([]byte, len(aeadVectorStreamPlaintext))
+		_, err := io.ReadFull(shadowaead.NewConn(right, ciph), plaintext)
+		right.Close()
+		if err != nil {
+			t.Errorf("%s: read: %v", v.name, err)
+			continue
+		}
+		if !bytes.Equal(plaintext, aeadVectorStreamPlaintext) {
+			t.Errorf("%s: read = %q, want %q", v.name, plaintext, aeadVectorStreamPlaintext)
+		}
+	}
+}
+
+func TestListCipherIncludesAEAD(t *testing.T) {
+	want := map[string]bool{aeadAes128Gcm: true, aeadAes256Gcm: true, aeadChacha20Poly1305: true, darkStar: true,
+		blake3Aes128Gcm: true, blake3Aes256Gcm: true, blake3Chacha20Poly1305: true}
+	for _, name := range ListCipher() {
+		delete(want, name)
+	}
+	if len(want) != 0 {
+		t.Errorf("ListCipher is missing %v", want)
+	}
+}
+
+func TestPickCipher2022(t *testing.T) {
+	// Shadowsocks 2022 takes the base64-encoded key as password.
+	if _, err := PickCipher(blake3Aes256Gcm, nil, "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="); err != nil {
+		t.Error(err)
+	}
+	if _, err := PickCipher(blake3Aes128Gcm, nil, "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="); err == nil {
+		t.Error("accepted a 32 byte key for 2022-blake3-aes-128-gcm")
+	}
+}
@@ -1,15 +1,52 @@
 package core
 
-import "net"
+import (
+	"context"
+	"net"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/internal"
+)
+
+// StreamConnContextCipher is a StreamConnCipher whose handshake honors the
+// cancellation and the deadline of a context.
+type StreamConnContextCipher interface {
+	StreamConnContext(context.Context, net.Conn) (net.Conn, error)
+}
+
+// StreamConnContext is like ciph.StreamConn, but the handshake fails with
+// ctx.Err() when ctx is done before it completes.
+func StreamConnContext(ctx context.Context, ciph StreamConnCipher, c net.Conn) (net.Conn, error) {
+	if ciph, ok := ciph.(StreamConnContextCipher); ok {
+		return ciph.StreamConnContext(ctx, c)
+	}
+	stop := internal.WatchContext(ctx, c)
+	sc, err := ciph.StreamConn(c)
+	if ctxErr := stop(); err != nil && ctxErr != nil {
+		return nil, ctxErr
+	}
+	return sc, err
+}
 
 type listener struct {
 	net.Listener
 	StreamConnCipher
+	ctx context.Context
 }
 
 func Listen(network, address string, ciph StreamConnCipher) (net.Listener, error) {
-	l, err := net.Listen(network, address)
-	return &listener{l, ciph}, err
+	return ListenContext(context.Background(), network, address, ciph)
+}
+
+// ListenContext is like Listen, but ctx bounds the handshakes of the accepted
+// connections as well as opening the listener. Once ctx is done, Accept still
+// accepts connections but their handshakes fail.
+func ListenContext(ctx context.Context, network, address string, ciph StreamConnCipher) (net.Listener, error) {
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{l, ciph, ctx}, nil
 }
 
 func (l *listener) Accept() (net.Conn, error) {
@@ -17,13 +54,30 @@ func (l *listener) Accept() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return l.StreamConn(c)
+	sc, err := StreamConnContext(l.ctx, l.StreamConnCipher, c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return sc, nil
 }
 
 func Dial(network, address string, ciph StreamConnCipher) (net.Conn, error) {
-	c, err := net.Dial(network, address)
+	return DialContext(context.Background(), network, address, ciph)
+}
+
+// DialContext is like Dial, but gives up when ctx is done before the
+// connection is made and its handshake completes.
+func DialContext(ctx context.Context, network, address string, ciph StreamConnCipher) (net.Conn, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := StreamConnContext(ctx, ciph, c)
 	if err != nil {
+		c.Close()
 		return nil, err
 	}
-	return ciph.StreamConn(c)
+	return sc, nil
 }
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStreamConnContextSilentPeer(t *testing.T) {
+	pair := darkStarUserPair(t)
+	users, err := NewUsers([]*User{{Name: "alice", Cipher: pair.server}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, ciph := range map[string]StreamConnCipher{
+		"DarkStar client": pair.client,
+		"DarkStar server": pair.server,
+		"users":           users,
+	} {
+		left, right := net.Pipe()
+		go func() {
+			// A peer that reads but never answers.
+			buf := make([]byte, 1024)
+			for {
+				if _, err := right.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		_, err := StreamConnContext(ctx, ciph, left)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: got %v, want %v", name, err, context.DeadlineExceeded)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("%s: gave up after %v", name, d)
+		}
+		left.Close()
+		right.Close()
+	}
+}
+
+func TestDialContextCanceled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close() // accept, then stay silent
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err = DialContext(ctx, "tcp", l.Addr().String(), darkStarUserPair(t).client)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
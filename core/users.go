@@ -0,0 +1,301 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrUnknownUser means that a stream or packet was not made with the key of any user.
+var ErrUnknownUser = errors.New("no user matches")
+
+// StreamMatcher is a server cipher that can tell from the first bytes of a
+// stream whether the client used its key.
+type StreamMatcher interface {
+	StreamHeaderSize() int
+	MatchStream(header []byte) bool
+}
+
+// User is one account of a multi-user server. All users of a server share the
+// same method, each with their own key.
+type User struct {
+	Name   string
+	Cipher Cipher // must implement StreamMatcher
+}
+
+// Users is the server cipher of a multi-user server. It identifies the user of
+// each stream and packet by trying the cipher of every user, and tags
+// connections with the user name. Users can be replaced at runtime.
+type Users struct {
+	mutex sync.RWMutex
+	users []*User
+}
+
+// NewUsers returns a multi-user server cipher for users.
+func NewUsers(users []*User) (*Users, error) {
+	u := &Users{}
+	if err := u.SetUsers(users); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// SetUsers replaces the users. Users that are left out can no longer connect;
+// their established connections are not affected. Passing the same *User again
+// keeps its UDP sessions.
+func (u *Users) SetUsers(users []*User) error {
+	size := -1
+	for _, user := range users {
+		matcher, ok := user.Cipher.(StreamMatcher)
+		if !ok {
+			return errors.New("cipher of user " + user.Name + " does not support multiple users")
+		}
+		if size != -1 && matcher.StreamHeaderSize() != size {
+			return errors.New("all users must use the same cipher")
+		}
+		size = matcher.StreamHeaderSize()
+	}
+
+	u.mutex.Lock()
+	u.users = users
+	u.mutex.Unlock()
+	return nil
+}
+
+func (u *Users) list() []*User {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return u.users
+}
+
+// UserConn is a stream of a known user.
+type UserConn struct {
+	net.Conn
+	User string
+}
+
+// replayConn returns header before reading on from the embedded Conn.
+type replayConn struct {
+	net.Conn
+	header []byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.header) > 0 {
+		n := copy(b, c.header)
+		c.header = c.header[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// StreamConn reads the start of the stream, finds the user whose key it was
+// made with and returns a *UserConn wrapping the stream of that user.
+func (u *Users) StreamConn(c net.Conn) (net.Conn, error) {
+	users := u.list()
+	if len(users) == 0 {
+		return nil, ErrUnknownUser
+	}
+
+	header := make([]byte, users[0].Cipher.(StreamMatcher).StreamHeaderSize())
+	if _, err := io.ReadFull(c, header); err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		if !user.Cipher.(StreamMatcher).MatchStream(header) {
+			continue
+		}
+		sc, err := user.Cipher.StreamConn(&replayConn{Conn: c, header: header})
+		if err != nil {
+			return nil, err
+		}
+		return &UserConn{Conn: sc, User: user.Name}, nil
+	}
+	return nil, ErrUnknownUser
+}
+
+// UserPacketConn is a packet connection that knows the user of each peer.
+type UserPacketConn interface {
+	net.PacketConn
+	// User returns the name of the user last seen at addr.
+	User(addr net.Addr) string
+}
+
+// userPacketTimeout is how long the user of an idle peer address is remembered.
+const userPacketTimeout = 10 * time.Minute
+
+type userPeer struct {
+	user     *User
+	lastSeen time.Time
+}
+
+type usersPacketConn struct {
+	net.PacketConn
+	*Users
+
+	// readMutex guards the read buffer, which holds the packet being identified.
+	readMutex sync.Mutex
+	buf       []byte
+
+	mutex     sync.Mutex
+	conns     map[*User]*userSocket
+	peers     map[string]*userPeer
+	lastPrune time.Time
+}
+
+// PacketConn returns a UserPacketConn that decrypts every packet with the
+// cipher of the user it was made with, and encrypts the packets to a peer with
+// the cipher of its user.
+func (u *Users) PacketConn(c net.PacketConn) net.PacketConn {
+	return &usersPacketConn{
+		PacketConn: c,
+		Users:      u,
+		buf:        make([]byte, 64*1024),
+		conns:      make(map[*User]*userSocket),
+		peers:      make(map[string]*userPeer),
+		lastPrune:  time.Now(),
+	}
+}
+
+// userSocket is the view of the shared socket that the PacketConn of a single
+// user reads from and writes to. ReadFrom returns the packet that is being
+// identified.
+type userSocket struct {
+	net.PacketConn
+	shadow net.PacketConn // the PacketConn of the user on top of this socket
+
+	packet []byte
+	addr   net.Addr
+}
+
+func (s *userSocket) ReadFrom(b []byte) (int, net.Addr, error) {
+	return copy(b, s.packet), s.addr, nil
+}
+
+// Close leaves the shared socket open.
+func (s *userSocket) Close() error { return nil }
+
+// conn returns the PacketConn of user, creating it on first use.
+func (c *usersPacketConn) conn(user *User) *userSocket {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	s, ok := c.conns[user]
+	if !ok {
+		s = &userSocket{PacketConn: c.PacketConn}
+		s.shadow = ServerPacketConn(user.Cipher, s)
+		c.conns[user] = s
+	}
+	return s
+}
+
+// candidates returns the users in the order to try for a packet from addr:
+// the user last seen at addr first.
+func (c *usersPacketConn) candidates(addr net.Addr) []*User {
+	users := c.list()
+
+	c.mutex.Lock()
+	peer, ok := c.peers[addr.String()]
+	c.mutex.Unlock()
+	if !ok {
+		return users
+	}
+
+	ordered := make([]*User, 0, len(users))
+	for _, user := range users {
+		if user == peer.user {
+			ordered = append(ordered, user)
+		}
+	}
+	for _, user := range users {
+		if user != peer.user {
+			ordered = append(ordered, user)
+		}
+	}
+	return ordered
+}
+
+// ReadFrom reads a packet from the embedded PacketConn and decrypts it into b
+// with the cipher of the first user that accepts it.
+func (c *usersPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	n, addr, err := c.PacketConn.ReadFrom(c.buf)
+	if err != nil {
+		return n, addr, err
+	}
+
+	for _, user := range c.candidates(addr) {
+		s := c.conn(user)
+		s.packet, s.addr = c.buf[:n], addr
+		m, _, err := s.shadow.ReadFrom(b)
+		s.packet, s.addr = nil, nil
+		if err != nil {
+			continue
+		}
+
+		c.mutex.Lock()
+		c.prune()
+		c.peers[addr.String()] = &userPeer{user: user, lastSeen: time.Now()}
+		c.mutex.Unlock()
+		return m, addr, nil
+	}
+	return n, addr, ErrUnknownUser
+}
+
+// WriteTo encrypts b for the user of addr and writes it to addr.
+func (c *usersPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	peer, ok := c.peers[addr.String()]
+	c.mutex.Unlock()
+	if !ok {
+		return 0, ErrUnknownUser
+	}
+
+	for _, user := range c.list() {
+		if user == peer.user {
+			return c.conn(user).shadow.WriteTo(b, addr)
+		}
+	}
+	return 0, ErrUnknownUser // the user was removed
+}
+
+func (c *usersPacketConn) User(addr net.Addr) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if peer, ok := c.peers[addr.String()]; ok {
+		return peer.user.Name
+	}
+	return ""
+}
+
+// prune forgets idle peers and the PacketConns of removed users.
+// It does the work at most once per userPacketTimeout.
+func (c *usersPacketConn) prune() {
+	now := time.Now()
+	if now.Sub(c.lastPrune) < userPacketTimeout {
+		return
+	}
+	c.lastPrune = now
+
+	for a, peer := range c.peers {
+		if now.Sub(peer.lastSeen) > userPacketTimeout {
+			delete(c.peers, a)
+		}
+	}
+
+	active := make(map[*User]bool)
+	for _, user := range c.list() {
+		active[user] = true
+	}
+	for user := range c.conns {
+		if !active[user] {
+			delete(c.conns, user)
+		}
+	}
+}
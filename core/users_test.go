@@ -0,0 +1,254 @@
+package core
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/darkstar"
+	"github.com/OperatorFoundation/go-shadowsocks2/internal"
+	"github.com/OperatorFoundation/go-shadowsocks2/shadowaead"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+	"github.com/aead/ecdh"
+)
+
+// userPair is the server cipher of a user and the matching client cipher.
+type userPair struct {
+	server Cipher
+	client Cipher
+}
+
+func aeadUserPair(t *testing.T, method, password string) userPair {
+	ciph, err := PickCipher(method, nil, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aead, ok := ciph.(*aeadCipher); ok {
+		return userPair{ciph, &saltlessClient{aead.Cipher}}
+	}
+	return userPair{ciph, ciph}
+}
+
+// saltlessClient is a SIP004 client that leaves the salt filter alone. A real
+// client adds its salts to the filter of the process, which would make the
+// server in the same process reject them as replays.
+type saltlessClient struct{ shadowaead.Cipher }
+
+func (c *saltlessClient) seal(salt []byte, plaintexts ...[]byte) []byte {
+	aead, _ := c.Encrypter(salt)
+	nonce := make([]byte, aead.NonceSize())
+	out := append([]byte{}, salt...)
+	for _, plaintext := range plaintexts {
+		out = aead.Seal(out, nonce, plaintext, nil)
+		nonce[0]++ // little-endian counter, enough for a few chunks
+	}
+	return out
+}
+
+func (c *saltlessClient) newSalt() []byte {
+	salt := make([]byte, c.SaltSize())
+	rand.Read(salt)
+	return salt
+}
+
+// StreamConn sends every Write as a single chunk; reading is not supported.
+func (c *saltlessClient) StreamConn(conn net.Conn) (net.Conn, error) {
+	return &saltlessConn{Conn: conn, client: c}, nil
+}
+
+func (c *saltlessClient) PacketConn(conn net.PacketConn) net.PacketConn {
+	return &saltlessPacketConn{PacketConn: conn, client: c}
+}
+
+type saltlessConn struct {
+	net.Conn
+	client *saltlessClient
+}
+
+func (c *saltlessConn) Write(b []byte) (int, error) {
+	length := []byte{byte(len(b) >> 8), byte(len(b))}
+	return len(b), internal.WriteFully(c.Conn, c.client.seal(c.client.newSalt(), length, b))
+}
+
+type saltlessPacketConn struct {
+	net.PacketConn
+	client *saltlessClient
+}
+
+func (c *saltlessPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	_, err := c.PacketConn.WriteTo(c.client.seal(c.client.newSalt(), b), addr)
+	return len(b), err
+}
+
+func (c *saltlessPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+	salt := b[:c.client.SaltSize()]
+	aead, _ := c.client.Decrypter(salt)
+	plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), b[len(salt):n], nil)
+	return copy(b, plaintext), addr, err
+}
+
+func darkStarUserPair(t *testing.T) userPair {
+	keyExchange := ecdh.Generic(elliptic.P256())
+	privateKey, publicKey, err := keyExchange.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyBytes, err := darkstar.PublicKeyToKeychainFormatBytes(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := darkstar.NewDarkStarServer(base64.StdEncoding.EncodeToString(privateKey.([]byte)), "127.0.0.1", 1234)
+	client := darkstar.NewDarkStarClient(base64.StdEncoding.EncodeToString(publicKeyBytes), "127.0.0.1", 1234)
+	return userPair{server, client}
+}
+
+func userPairs(t *testing.T) map[string][]userPair {
+	return map[string][]userPair{
+		"AEAD": {
+			aeadUserPair(t, aeadAes256Gcm, "alice's password"),
+			aeadUserPair(t, aeadAes256Gcm, "bob's password"),
+			aeadUserPair(t, aeadAes256Gcm, "mallory's password"),
+		},
+		"2022": {
+			aeadUserPair(t, blake3Aes128Gcm, "YWxpY2UncyBrZXkgMTIzNA=="),
+			aeadUserPair(t, blake3Aes128Gcm, "Ym9iJ3Mga2V5IDEyMzQ1Ng=="),
+			aeadUserPair(t, blake3Aes128Gcm, "bWFsbG9yeSdzIGtleSAxMg=="),
+		},
+		"DarkStar": {darkStarUserPair(t), darkStarUserPair(t), darkStarUserPair(t)},
+	}
+}
+
+// serverUsers returns the alice and bob users of pairs; the third pair is
+// the client of somebody who is not a user.
+func serverUsers(t *testing.T, pairs []userPair) *Users {
+	users, err := NewUsers([]*User{{Name: "alice", Cipher: pairs[0].server}, {Name: "bob", Cipher: pairs[1].server}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return users
+}
+
+func TestUsersStreamConn(t *testing.T) {
+	for method, pairs := range userPairs(t) {
+		users := serverUsers(t, pairs)
+		for i, want := range []string{"alice", "bob", ""} {
+			left, right := net.Pipe()
+			go func() {
+				defer left.Close()
+				c, err := pairs[i].client.StreamConn(left)
+				if err != nil {
+					return
+				}
+				c.Write(append(socks.ParseAddr("127.0.0.1:80"), "hello"...))
+				io.Copy(io.Discard, c)
+			}()
+
+			right.SetDeadline(time.Now().Add(5 * time.Second))
+			sc, err := users.StreamConn(right)
+			if want == "" {
+				if err != ErrUnknownUser {
+					t.Errorf("%s: stranger: got %v, want %v", method, err, ErrUnknownUser)
+				}
+				right.Close()
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: %s: %v", method, want, err)
+			}
+			if got := sc.(*UserConn).User; got != want {
+				t.Errorf("%s: user = %q, want %q", method, got, want)
+			}
+			if _, err = socks.ReadAddr(sc); err != nil {
+				t.Fatalf("%s: %s: read address: %v", method, want, err)
+			}
+			payload := make([]byte, 5)
+			if _, err = io.ReadFull(sc, payload); err != nil || string(payload) != "hello" {
+				t.Errorf("%s: %s: payload = %q, %v", method, want, payload, err)
+			}
+			right.Close()
+		}
+	}
+}
+
+func listenUDP(t *testing.T) net.PacketConn {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c
+}
+
+func TestUsersPacketConn(t *testing.T) {
+	for method, pairs := range userPairs(t) {
+		users := serverUsers(t, pairs)
+		serverConn := listenUDP(t)
+		server := users.PacketConn(serverConn)
+
+		buf := make([]byte, 64*1024)
+		for i, want := range []string{"alice", "bob", ""} {
+			client := pairs[i].client.PacketConn(listenUDP(t))
+			request := append(socks.ParseAddr("8.8.8.8:53"), want...)
+			if _, err := client.WriteTo(request, serverConn.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+
+			n, addr, err := server.ReadFrom(buf)
+			if want == "" {
+				if err != ErrUnknownUser {
+					t.Errorf("%s: stranger: got %v, want %v", method, err, ErrUnknownUser)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: %s: %v", method, want, err)
+			}
+			if !bytes.Equal(buf[:n], request) {
+				t.Errorf("%s: %s: got %q, want %q", method, want, buf[:n], request)
+			}
+			if got := server.(UserPacketConn).User(addr); got != want {
+				t.Errorf("%s: user = %q, want %q", method, got, want)
+			}
+
+			response := append(socks.ParseAddr("8.8.8.8:53"), "answer"...)
+			if _, err = server.WriteTo(response, addr); err != nil {
+				t.Fatalf("%s: %s: write: %v", method, want, err)
+			}
+			if n, _, err = client.ReadFrom(buf); err != nil {
+				t.Fatalf("%s: %s: client read: %v", method, want, err)
+			}
+			if !bytes.Equal(buf[:n], response) {
+				t.Errorf("%s: %s: client got %q, want %q", method, want, buf[:n], response)
+			}
+		}
+	}
+}
+
+func TestUsersRemoval(t *testing.T) {
+	pairs := userPairs(t)["AEAD"]
+	users := serverUsers(t, pairs)
+	if err := users.SetUsers([]*User{{Name: "bob", Cipher: pairs[1].server}}); err != nil {
+		t.Fatal(err)
+	}
+
+	left, right := net.Pipe()
+	go func() {
+		c, _ := pairs[0].client.StreamConn(left)
+		c.Write(socks.ParseAddr("127.0.0.1:80"))
+	}()
+	defer left.Close()
+	defer right.Close()
+	if _, err := users.StreamConn(right); err != ErrUnknownUser {
+		t.Errorf("removed user: got %v, want %v", err, ErrUnknownUser)
+	}
+}
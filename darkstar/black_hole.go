@@ -7,19 +7,27 @@ import (
 	"time"
 )
 
+// ErrBadConfirmationCode means that the client confirmation code does not match
+// any active server key.
+var ErrBadConfirmationCode = errors.New("bad client confirmation code")
+
 type BlackHoleConn struct {
 	timer  *time.Timer
 	isOpen bool
+
+	// Reason is why the handshake was blackholed, for example ErrRepeatedKey,
+	// ErrBadPublicKey or ErrBadConfirmationCode.
+	Reason error
 }
 
-func NewBlackHoleConn() *BlackHoleConn {
+func NewBlackHoleConn(reason error) *BlackHoleConn {
 	duration, parseError := time.ParseDuration("30s")
 	if parseError != nil {
 		return nil
 	}
 	timer := time.NewTimer(duration)
 
-	conn := &BlackHoleConn{timer, true}
+	conn := &BlackHoleConn{timer: timer, isOpen: true, Reason: reason}
 
 	go func() {
 		<-timer.C
@@ -75,4 +83,4 @@ func (b2 *BlackHoleConn) SetWriteDeadline(_ time.Time) error {
 	return nil
 }
 
-var _ net.Conn = &BlackHoleConn{nil, true}
+var _ net.Conn = &BlackHoleConn{}
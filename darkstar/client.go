@@ -2,15 +2,14 @@ package darkstar
 
 import (
 	"bytes"
+	"context"
 	"crypto"
-	"crypto/aes"
 	"crypto/cipher"
 	"crypto/elliptic"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"github.com/OperatorFoundation/go-shadowsocks2/internal"
 	"net"
 
@@ -20,10 +19,20 @@ import (
 const keySize = 32
 const confirmationCodeSize = 32
 
+// DarkStarClient holds the configuration shared by all connections to one server.
+// It is safe for concurrent use; the handshake state of each connection lives in
+// a clientHandshake created by StreamConn.
 type DarkStarClient struct {
 	serverPersistentPublicKey crypto.PublicKey
-	serverEphemeralPublicKey  crypto.PublicKey
 	serverIdentifier          []byte
+}
+
+// clientHandshake is the state of a single client handshake.
+// Every connection gets fresh ephemeral keys so that the server's salt filter
+// does not mistake a second connection for a replay.
+type clientHandshake struct {
+	*DarkStarClient
+	serverEphemeralPublicKey  crypto.PublicKey
 	clientEphemeralPrivateKey crypto.PrivateKey
 	clientEphemeralPublicKey  crypto.PublicKey
 }
@@ -34,24 +43,53 @@ func NewDarkStarClient(serverPersistentPublicKey string, host string, port int)
 		return nil
 	}
 
-	serverPersistentPublicKeyPoint := KeychainFormatBytesToPublicKey(publicKeyBytes)
+	serverPersistentPublicKeyPoint := decodePublicKey(publicKeyBytes)
+	if serverPersistentPublicKeyPoint == nil {
+		return nil
+	}
 
 	serverIdentifier := getServerIdentifier(host, port)
 
+	return &DarkStarClient{serverPersistentPublicKey: serverPersistentPublicKeyPoint, serverIdentifier: serverIdentifier}
+}
+
+func (a *DarkStarClient) newHandshake() (*clientHandshake, error) {
 	clientEphemeralPrivateKey, clientEphemeralPublicKey, keyError := generateEvenKeys()
 	if keyError != nil {
-		return nil
+		return nil, keyError
 	}
 
-	return &DarkStarClient{serverPersistentPublicKey: serverPersistentPublicKeyPoint, serverIdentifier: serverIdentifier, clientEphemeralPrivateKey: clientEphemeralPrivateKey, clientEphemeralPublicKey: clientEphemeralPublicKey}
+	return &clientHandshake{DarkStarClient: a, clientEphemeralPrivateKey: clientEphemeralPrivateKey, clientEphemeralPublicKey: clientEphemeralPublicKey}, nil
 }
 
 func (a *DarkStarClient) StreamConn(conn net.Conn) (net.Conn, error) {
-	clientEphemeralPublicKeyBytes, keyError := PublicKeyToDarkstarFormatBytes(a.clientEphemeralPublicKey)
+	return a.StreamConnContext(context.Background(), conn)
+}
+
+// StreamConnContext is like StreamConn, but the handshake fails with ctx.Err()
+// if ctx is done before the server's ephemeral key and confirmation code
+// arrive.
+func (a *DarkStarClient) StreamConnContext(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	handshake, handshakeError := a.newHandshake()
+	if handshakeError != nil {
+		return nil, handshakeError
+	}
+
+	stop := internal.WatchContext(ctx, conn)
+	streamConn, streamError := handshake.streamConn(conn)
+	if contextError := stop(); streamError != nil && contextError != nil {
+		return nil, contextError
+	}
+
+	return streamConn, streamError
+}
+
+func (h *clientHandshake) streamConn(conn net.Conn) (net.Conn, error) {
+	clientEphemeralPublicKeyBytes, keyError := PublicKeyToDarkstarFormatBytes(h.clientEphemeralPublicKey)
 	if keyError != nil {
 		return nil, keyError
 	}
-	clientConfirmationCode, confirmationError := a.generateClientConfirmationCode()
+	clientConfirmationCode, confirmationError := h.generateClientConfirmationCode()
 	if confirmationError != nil {
 		return nil, confirmationError
 	}
@@ -71,7 +109,7 @@ func (a *DarkStarClient) StreamConn(conn net.Conn) (net.Conn, error) {
 		return nil, keyReadError
 	}
 
-	a.serverEphemeralPublicKey = DarkstarFormatBytesToPublicKey(serverEphemeralPublicKeyBuffer)
+	h.serverEphemeralPublicKey = DarkstarFormatBytesToPublicKey(serverEphemeralPublicKeyBuffer)
 
 	serverConfirmationCode := make([]byte, confirmationCodeSize)
 	confirmationReadError := internal.ReadFully(conn, serverConfirmationCode)
@@ -79,7 +117,7 @@ func (a *DarkStarClient) StreamConn(conn net.Conn) (net.Conn, error) {
 		return nil, confirmationReadError
 	}
 
-	clientCopyServerConfirmationCode, confirmationCodeError := a.generateServerConfirmationCode()
+	clientCopyServerConfirmationCode, confirmationCodeError := h.generateServerConfirmationCode()
 	if confirmationCodeError != nil {
 		return nil, confirmationCodeError
 	}
@@ -87,22 +125,22 @@ func (a *DarkStarClient) StreamConn(conn net.Conn) (net.Conn, error) {
 		return nil, errors.New("serverConfirmationCode and client copy are not equal")
 	}
 
-	sharedKeyClientToServer, sharedKeyClientError := a.createClientToServerSharedKey()
+	sharedKeyClientToServer, sharedKeyClientError := h.createClientToServerSharedKey()
 	if sharedKeyClientError != nil {
 		return nil, sharedKeyClientError
 	}
 
-	sharedKeyServerToClient, sharedKeyServerError := a.createServerToClientSharedKey()
+	sharedKeyServerToClient, sharedKeyServerError := h.createServerToClientSharedKey()
 	if sharedKeyServerError != nil {
 		return nil, sharedKeyServerError
 	}
 
-	encryptCipher, encryptKeyError := a.Encrypter(sharedKeyClientToServer)
+	encryptCipher, encryptKeyError := h.Encrypter(sharedKeyClientToServer)
 	if encryptKeyError != nil {
 		return nil, encryptKeyError
 	}
 
-	decryptCipher, decryptKeyError := a.Encrypter(sharedKeyServerToClient)
+	decryptCipher, decryptKeyError := h.Encrypter(sharedKeyServerToClient)
 	if decryptKeyError != nil {
 		return nil, decryptKeyError
 	}
@@ -111,7 +149,7 @@ func (a *DarkStarClient) StreamConn(conn net.Conn) (net.Conn, error) {
 }
 
 func (a *DarkStarClient) PacketConn(conn net.PacketConn) net.PacketConn {
-	return NewPacketConn(conn, a)
+	return newClientPacketConn(conn, a)
 }
 
 func (a *DarkStarClient) KeySize() int {
@@ -123,81 +161,73 @@ func (a *DarkStarClient) SaltSize() int {
 }
 
 func (a *DarkStarClient) Encrypter(salt []byte) (cipher.AEAD, error) {
-	return a.aesGCM(salt)
+	return aesGCM(salt)
 }
 
 func (a *DarkStarClient) Decrypter(salt []byte) (cipher.AEAD, error) {
-	return a.aesGCM(salt)
-}
-
-func (a *DarkStarClient) aesGCM(key []byte) (cipher.AEAD, error) {
-	blk, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-	return cipher.NewGCM(blk)
+	return aesGCM(salt)
 }
 
-func (a *DarkStarClient) createClientToServerSharedKey() ([]byte, error) {
-	clientEphemeralPublicKeyBytes, keyError := PublicKeyToDarkstarFormatBytes(a.clientEphemeralPublicKey)
+func (h *clientHandshake) createClientToServerSharedKey() ([]byte, error) {
+	clientEphemeralPublicKeyBytes, keyError := PublicKeyToDarkstarFormatBytes(h.clientEphemeralPublicKey)
 	if keyError != nil {
 		return nil, keyError
 	}
 
 	p256 := ecdh.Generic(elliptic.P256())
 
-	ecdh1 := p256.ComputeSecret(a.clientEphemeralPrivateKey, a.serverEphemeralPublicKey)
-	ecdh2 := p256.ComputeSecret(a.clientEphemeralPrivateKey, a.serverPersistentPublicKey)
+	ecdh1 := p256.ComputeSecret(h.clientEphemeralPrivateKey, h.serverEphemeralPublicKey)
+	ecdh2 := p256.ComputeSecret(h.clientEphemeralPrivateKey, h.serverPersistentPublicKey)
 
-	serverEphemeralPublicKeyData, keyToBytesError := PublicKeyToDarkstarFormatBytes(a.serverEphemeralPublicKey)
+	serverEphemeralPublicKeyData, keyToBytesError := PublicKeyToDarkstarFormatBytes(h.serverEphemeralPublicKey)
 	if keyToBytesError != nil {
 		return nil, keyToBytesError
 	}
 
-	h := sha256.New()
-	h.Write(ecdh1)
-	h.Write(ecdh2)
-	h.Write(a.serverIdentifier)
-	h.Write(clientEphemeralPublicKeyBytes)
-	h.Write(serverEphemeralPublicKeyData)
-	h.Write([]byte("DarkStar"))
-	h.Write([]byte("server"))
+	hash := sha256.New()
+	hash.Write(ecdh1)
+	hash.Write(ecdh2)
+	hash.Write(h.serverIdentifier)
+	hash.Write(clientEphemeralPublicKeyBytes)
+	hash.Write(serverEphemeralPublicKeyData)
+	hash.Write([]byte("DarkStar"))
+	hash.Write([]byte("server"))
 
-	return h.Sum(nil), nil
+	return hash.Sum(nil), nil
 }
 
-func (a *DarkStarClient) createServerToClientSharedKey() ([]byte, error) {
-	serverEphemeralPublicKeyBytes, keyError := PublicKeyToDarkstarFormatBytes(a.serverEphemeralPublicKey)
+func (h *clientHandshake) createServerToClientSharedKey() ([]byte, error) {
+	serverEphemeralPublicKeyBytes, keyError := PublicKeyToDarkstarFormatBytes(h.serverEphemeralPublicKey)
 	if keyError != nil {
 		return nil, keyError
 	}
 
 	p256 := ecdh.Generic(elliptic.P256())
 
-	ecdh1 := p256.ComputeSecret(a.clientEphemeralPrivateKey, a.serverEphemeralPublicKey)
-	ecdh2 := p256.ComputeSecret(a.clientEphemeralPrivateKey, a.serverPersistentPublicKey)
+	ecdh1 := p256.ComputeSecret(h.clientEphemeralPrivateKey, h.serverEphemeralPublicKey)
+	ecdh2 := p256.ComputeSecret(h.clientEphemeralPrivateKey, h.serverPersistentPublicKey)
 
-	clientEphemeralPublicKeyData, keyToBytesError := PublicKeyToDarkstarFormatBytes(a.clientEphemeralPublicKey)
+	clientEphemeralPublicKeyData, keyToBytesError := PublicKeyToDarkstarFormatBytes(h.clientEphemeralPublicKey)
 	if keyToBytesError != nil {
 		return nil, keyToBytesError
 	}
 
-	h := sha256.New()
-	h.Write(ecdh1)
-	h.Write(ecdh2)
-	h.Write(a.serverIdentifier)
-	h.Write(clientEphemeralPublicKeyData)
-	h.Write(serverEphemeralPublicKeyBytes)
-	h.Write([]byte("DarkStar"))
-	h.Write([]byte("client"))
+	hash := sha256.New()
+	hash.Write(ecdh1)
+	hash.Write(ecdh2)
+	hash.Write(h.serverIdentifier)
+	hash.Write(clientEphemeralPublicKeyData)
+	hash.Write(serverEphemeralPublicKeyBytes)
+	hash.Write([]byte("DarkStar"))
+	hash.Write([]byte("client"))
 
-	return h.Sum(nil), nil
+	return hash.Sum(nil), nil
 }
 
 func getServerIdentifier(host string, port int) []byte {
 	hostIP := net.ParseIP(host)
 	if hostIP == nil || len(hostIP) != 16 {
-		fmt.Println("server identifier host failed to parse")
+		logger.Error("server identifier host failed to parse", "host", host)
 		return nil
 	}
 	// we do the below part because host IP in bytes is 16 bytes with padding at the beginning
@@ -212,50 +242,51 @@ func getServerIdentifier(host string, port int) []byte {
 	return buffer
 }
 
-func (a *DarkStarClient) generateClientConfirmationCode() ([]byte, error) {
+func (h *clientHandshake) generateClientConfirmationCode() ([]byte, error) {
 	p256 := ecdh.Generic(elliptic.P256())
-	ecdhSecret := p256.ComputeSecret(a.clientEphemeralPrivateKey, a.serverPersistentPublicKey)
-	serverPersistentPublicKeyData, serverKeyError := PublicKeyToKeychainFormatBytes(a.serverPersistentPublicKey)
+	ecdhSecret := p256.ComputeSecret(h.clientEphemeralPrivateKey, h.serverPersistentPublicKey)
+	// The server hashes its persistent key in DarkStar format here, so we must too.
+	serverPersistentPublicKeyData, serverKeyError := PublicKeyToDarkstarFormatBytes(h.serverPersistentPublicKey)
 	if serverKeyError != nil {
 		return nil, serverKeyError
 	}
 
-	clientEphemeralPublicKeyData, clientKeyError := PublicKeyToDarkstarFormatBytes(a.clientEphemeralPublicKey)
+	clientEphemeralPublicKeyData, clientKeyError := PublicKeyToDarkstarFormatBytes(h.clientEphemeralPublicKey)
 	if clientKeyError != nil {
 		return nil, clientKeyError
 	}
 
-	h := sha256.New()
-	h.Write(ecdhSecret)
-	h.Write(a.serverIdentifier)
-	h.Write(serverPersistentPublicKeyData)
-	h.Write(clientEphemeralPublicKeyData)
-	h.Write([]byte("DarkStar"))
-	h.Write([]byte("client"))
+	hash := sha256.New()
+	hash.Write(ecdhSecret)
+	hash.Write(h.serverIdentifier)
+	hash.Write(serverPersistentPublicKeyData)
+	hash.Write(clientEphemeralPublicKeyData)
+	hash.Write([]byte("DarkStar"))
+	hash.Write([]byte("client"))
 
-	return h.Sum(nil), nil
+	return hash.Sum(nil), nil
 }
 
-func (a *DarkStarClient) generateServerConfirmationCode() ([]byte, error) {
+func (h *clientHandshake) generateServerConfirmationCode() ([]byte, error) {
 	p256 := ecdh.Generic(elliptic.P256())
-	ecdhSecret := p256.ComputeSecret(a.clientEphemeralPrivateKey, a.serverPersistentPublicKey)
-	serverPersistentPublicKeyData, serverKeyError := PublicKeyToKeychainFormatBytes(a.serverPersistentPublicKey)
+	ecdhSecret := p256.ComputeSecret(h.clientEphemeralPrivateKey, h.serverPersistentPublicKey)
+	serverPersistentPublicKeyData, serverKeyError := PublicKeyToKeychainFormatBytes(h.serverPersistentPublicKey)
 	if serverKeyError != nil {
 		return nil, serverKeyError
 	}
 
-	clientEphemeralPublicKeyData, clientKeyError := PublicKeyToDarkstarFormatBytes(a.clientEphemeralPublicKey)
+	clientEphemeralPublicKeyData, clientKeyError := PublicKeyToDarkstarFormatBytes(h.clientEphemeralPublicKey)
 	if clientKeyError != nil {
 		return nil, clientKeyError
 	}
 
-	h := sha256.New()
-	h.Write(ecdhSecret)
-	h.Write(a.serverIdentifier)
-	h.Write(serverPersistentPublicKeyData)
-	h.Write(clientEphemeralPublicKeyData)
-	h.Write([]byte("DarkStar"))
-	h.Write([]byte("server"))
+	hash := sha256.New()
+	hash.Write(ecdhSecret)
+	hash.Write(h.serverIdentifier)
+	hash.Write(serverPersistentPublicKeyData)
+	hash.Write(clientEphemeralPublicKeyData)
+	hash.Write([]byte("DarkStar"))
+	hash.Write([]byte("server"))
 
-	return h.Sum(nil), nil
+	return hash.Sum(nil), nil
 }
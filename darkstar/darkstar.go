@@ -12,7 +12,7 @@ import (
 
 func DarkstarFormatBytesToPublicKey(bytes []byte) crypto.PublicKey {
 	if len(bytes) != 32 {
-		fmt.Printf("Byte array length needs to be 32.  Length is currently %d\n", len(bytes))
+		logger.Warn("DarkStar format public key needs 32 bytes", "length", len(bytes))
 	}
 
 	keyBytes := make([]byte, 0)
@@ -25,13 +25,37 @@ func DarkstarFormatBytesToPublicKey(bytes []byte) crypto.PublicKey {
 
 func KeychainFormatBytesToPublicKey(bytes []byte) crypto.PublicKey {
 	if len(bytes) != 66 {
-		fmt.Printf("Byte array length needs to be 66.  Length is currently %d\n", len(bytes))
+		logger.Warn("keychain format public key needs 66 bytes", "length", len(bytes))
+		return nil
 	}
 
 	PublicKeyX, PublicKeyY := elliptic.Unmarshal(elliptic.P256(), bytes[1:])
 	return ecdh.Point{X: PublicKeyX, Y: PublicKeyY}
 }
 
+// decodePublicKey accepts a persistent public key in either DarkStar (32 byte)
+// or keychain (66 byte) format.
+func decodePublicKey(bytes []byte) crypto.PublicKey {
+	if len(bytes) == keySize {
+		return DarkstarFormatBytesToPublicKey(bytes)
+	}
+
+	return KeychainFormatBytesToPublicKey(bytes)
+}
+
+// decodePrivateKey accepts a persistent private key either as the raw 32 byte
+// scalar or in keychain format, which has a leading type byte.
+func decodePrivateKey(bytes []byte) (crypto.PrivateKey, error) {
+	switch len(bytes) {
+	case keySize:
+		return bytes, nil
+	case keySize + 1:
+		return bytes[1:], nil
+	default:
+		return nil, fmt.Errorf("private key must be %d or %d bytes, got %d", keySize, keySize+1, len(bytes))
+	}
+}
+
 // use this for handshake
 func PublicKeyToDarkstarFormatBytes(pubKey crypto.PublicKey) ([]byte, error) {
 	point, ok := pubKey.(ecdh.Point)
@@ -1,14 +1,19 @@
 package darkstar
 
 import (
+	"bytes"
 	"crypto/elliptic"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/OperatorFoundation/go-shadowsocks2/internal"
 
@@ -355,11 +360,426 @@ func TestDarkStarServerBadClientConfirmationCode(t *testing.T) {
 		internal.AddSalt(data)
 	}
 
-	server.clientEphemeralPublicKey = DarkstarFormatBytesToPublicKey(data)
+	handshake, handshakeError := server.newHandshake()
+	if handshakeError != nil {
+		t.Fail()
+		return
+	}
+	handshake.clientEphemeralPublicKey = DarkstarFormatBytesToPublicKey(data)
 
-	_, confirmationError := server.generateClientConfirmationCode()
+	_, confirmationError := handshake.generateClientConfirmationCode()
 	if confirmationError != nil {
 		fmt.Println("DarkStarServer: Error creating a DarkStar connection: ", confirmationError)
 		t.Fail()
 	}
 }
+
+// generateServerKey returns a fresh persistent private key and its public key,
+// both base64 encoded as NewDarkStarServer and NewDarkStarClient expect them.
+func generateServerKey(t *testing.T) (string, string) {
+	keyExchange := ecdh.Generic(elliptic.P256())
+	privateKey, publicKey, keyError := keyExchange.GenerateKey(rand.Reader)
+	if keyError != nil {
+		t.Fatal(keyError)
+	}
+	publicKeyBytes, keyError := PublicKeyToKeychainFormatBytes(publicKey)
+	if keyError != nil {
+		t.Fatal(keyError)
+	}
+
+	return base64.StdEncoding.EncodeToString(privateKey.([]byte)), base64.StdEncoding.EncodeToString(publicKeyBytes)
+}
+
+// listenEcho listens on a random local port and echoes every DarkStar
+// connection accepted by server back to its sender.
+func listenEcho(t *testing.T, newServer func(port int) *DarkStarServer) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	server := newServer(l.Addr().(*net.TCPAddr).Port)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+				darkStarConn, connError := server.StreamConn(c)
+				if connError != nil {
+					return
+				}
+				_, _ = io.Copy(darkStarConn, darkStarConn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// startEchoServer starts an echo server with a fresh key. It returns a client
+// for the server.
+func startEchoServer(t *testing.T) (*DarkStarClient, string) {
+	privateKeyString, publicKeyString := generateServerKey(t)
+
+	var port int
+	addr := listenEcho(t, func(p int) *DarkStarServer {
+		port = p
+		return NewDarkStarServer(privateKeyString, "127.0.0.1", port)
+	})
+
+	client := NewDarkStarClient(publicKeyString, "127.0.0.1", port)
+	if client == nil {
+		t.Fatal("could not create client")
+	}
+
+	return client, addr
+}
+
+// echo sends message over a new connection to addr and checks the reply.
+func echo(client *DarkStarClient, addr string, message []byte) error {
+	netConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer netConn.Close()
+	netConn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	darkStarConn, err := client.StreamConn(netConn)
+	if err != nil {
+		return err
+	}
+
+	if _, err = darkStarConn.Write(message); err != nil {
+		return err
+	}
+	reply := make([]byte, len(message))
+	if _, err = io.ReadFull(darkStarConn, reply); err != nil {
+		return err
+	}
+	if !bytes.Equal(message, reply) {
+		return fmt.Errorf("got %q, want %q", reply, message)
+	}
+
+	return nil
+}
+
+func TestDarkStarConcurrentConnections(t *testing.T) {
+	const connections = 500
+	client, addr := startEchoServer(t)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, connections)
+	for i := 0; i < connections; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := echo(client, addr, []byte(fmt.Sprintf("connection %d", i))); err != nil {
+				errs <- fmt.Errorf("connection %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestDarkStarHandshakesUseFreshEphemeralKeys(t *testing.T) {
+	client, _ := startEchoServer(t)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		handshake, err := client.newHandshake()
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicKeyBytes, err := PublicKeyToDarkstarFormatBytes(handshake.clientEphemeralPublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[string(publicKeyBytes)] {
+			t.Fatal("client reused an ephemeral key")
+		}
+		seen[string(publicKeyBytes)] = true
+	}
+}
+
+// newPacketPair returns a server and a client sharing a fresh persistent key.
+func newPacketPair(t *testing.T) (*DarkStarServer, *DarkStarClient) {
+	keyExchange := ecdh.Generic(elliptic.P256())
+	privateKey, publicKey, keyError := keyExchange.GenerateKey(rand.Reader)
+	if keyError != nil {
+		t.Fatal(keyError)
+	}
+	publicKeyBytes, keyError := PublicKeyToKeychainFormatBytes(publicKey)
+	if keyError != nil {
+		t.Fatal(keyError)
+	}
+
+	server := NewDarkStarServer(base64.StdEncoding.EncodeToString(privateKey.([]byte)), "127.0.0.1", 1234)
+	client := NewDarkStarClient(base64.StdEncoding.EncodeToString(publicKeyBytes), "127.0.0.1", 1234)
+	if server == nil || client == nil {
+		t.Fatal("could not create server and client")
+	}
+
+	return server, client
+}
+
+func listenUDP(t *testing.T) net.PacketConn {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c
+}
+
+func TestDarkStarPacketRoundTrip(t *testing.T) {
+	server, client := newPacketPair(t)
+	serverConn := listenUDP(t)
+	serverPacketConn := server.PacketConn(serverConn)
+
+	buf := make([]byte, maxPacketSize)
+	for i := 0; i < 2; i++ { // two associations, each with its own keys
+		clientPacketConn := client.PacketConn(listenUDP(t))
+
+		for j := 0; j < 3; j++ {
+			request := []byte(fmt.Sprintf("request %d.%d", i, j))
+			if _, err := clientPacketConn.WriteTo(request, serverConn.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			n, clientAddr, err := serverPacketConn.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("server read: %v", err)
+			}
+			if !bytes.Equal(buf[:n], request) {
+				t.Errorf("server got %q, want %q", buf[:n], request)
+			}
+
+			response := []byte(fmt.Sprintf("response %d.%d", i, j))
+			if _, err = serverPacketConn.WriteTo(response, clientAddr); err != nil {
+				t.Fatal(err)
+			}
+			n, _, err = clientPacketConn.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("client read: %v", err)
+			}
+			if !bytes.Equal(buf[:n], response) {
+				t.Errorf("client got %q, want %q", buf[:n], response)
+			}
+		}
+	}
+}
+
+func TestDarkStarPacketRejectsReplay(t *testing.T) {
+	server, client := newPacketPair(t)
+	serverConn := listenUDP(t)
+	serverPacketConn := server.PacketConn(serverConn)
+
+	// Encrypt one packet through a client, then send the same bytes again.
+	rawClient := listenUDP(t)
+	if _, err := client.PacketConn(listenUDP(t)).WriteTo([]byte("hello"), rawClient.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	packet := make([]byte, maxPacketSize)
+	n, _, err := rawClient.ReadFrom(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet = packet[:n]
+
+	buf := make([]byte, maxPacketSize)
+	for i, want := range []error{nil, ErrReplayedPacket} {
+		if _, err = rawClient.WriteTo(packet, serverConn.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = serverPacketConn.ReadFrom(buf); err != want {
+			t.Fatalf("packet %d: got %v, want %v", i, err, want)
+		}
+	}
+
+	// A restarted server must not accept the old association either.
+	restartedConn := listenUDP(t)
+	if _, err = rawClient.WriteTo(packet, restartedConn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = server.PacketConn(restartedConn).ReadFrom(buf); err != ErrRepeatedKey {
+		t.Fatalf("restarted server: got %v, want %v", err, ErrRepeatedKey)
+	}
+}
+
+func TestDarkStarPacketRejectsGarbage(t *testing.T) {
+	server, _ := newPacketPair(t)
+	serverConn := listenUDP(t)
+	serverPacketConn := server.PacketConn(serverConn)
+	rawClient := listenUDP(t)
+
+	buf := make([]byte, maxPacketSize)
+	for _, size := range []int{0, clientHeaderLen, 100} {
+		garbage := make([]byte, size)
+		if _, err := rand.Read(garbage); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rawClient.WriteTo(garbage, serverConn.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := serverPacketConn.ReadFrom(buf); err == nil {
+			t.Errorf("accepted %d bytes of garbage", size)
+		}
+	}
+	if _, err := serverPacketConn.WriteTo([]byte("hello"), rawClient.LocalAddr()); err != ErrUnknownPeer {
+		t.Errorf("write to unknown peer: got %v, want %v", err, ErrUnknownPeer)
+	}
+}
+
+// handshake runs a handshake between client and server over a pipe and returns
+// the connection the server made of it.
+func handshake(t *testing.T, server *DarkStarServer, client *DarkStarClient) net.Conn {
+	clientPipe, serverPipe := net.Pipe()
+	defer clientPipe.Close()
+	defer serverPipe.Close()
+
+	go client.StreamConn(clientPipe)
+	serverConn, err := server.StreamConn(serverPipe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return serverConn
+}
+
+func TestDarkStarKeyRotation(t *testing.T) {
+	oldPrivateKey, oldPublicKey := generateServerKey(t)
+	newPrivateKey, newPublicKey := generateServerKey(t)
+
+	server := NewDarkStarServer(oldPrivateKey, "127.0.0.1", 1234)
+	oldClient := NewDarkStarClient(oldPublicKey, "127.0.0.1", 1234)
+	newClient := NewDarkStarClient(newPublicKey, "127.0.0.1", 1234)
+
+	accepted := func(step string, client *DarkStarClient, want bool) {
+		_, blackholed := handshake(t, server, client).(*BlackHoleConn)
+		if blackholed == want {
+			t.Errorf("%s: accepted = %v, want %v", step, !blackholed, want)
+		}
+	}
+
+	accepted("old key", oldClient, true)
+	accepted("new key before adding it", newClient, false)
+
+	if err := server.AddKey(newPrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	accepted("new key", newClient, true)
+	accepted("old key after adding the new key", oldClient, true)
+
+	if err := server.RetireKey(oldPublicKey); err != nil {
+		t.Fatal(err)
+	}
+	accepted("retired key", oldClient, false)
+	accepted("new key after retiring the old key", newClient, true)
+
+	if err := server.RetireKey(newPublicKey); err == nil {
+		t.Error("retired the last key")
+	}
+}
+
+func TestDarkStarPacketKeyRotation(t *testing.T) {
+	oldPrivateKey, oldPublicKey := generateServerKey(t)
+	newPrivateKey, newPublicKey := generateServerKey(t)
+
+	server := NewDarkStarServer(oldPrivateKey, "127.0.0.1", 1234)
+	serverConn := listenUDP(t)
+	serverPacketConn := server.PacketConn(serverConn)
+	if err := server.AddKey(newPrivateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPacketConn := NewDarkStarClient(oldPublicKey, "127.0.0.1", 1234).PacketConn(listenUDP(t))
+	newPacketConn := NewDarkStarClient(newPublicKey, "127.0.0.1", 1234).PacketConn(listenUDP(t))
+
+	send := func(clientPacketConn net.PacketConn) error {
+		if _, err := clientPacketConn.WriteTo([]byte("hello"), serverConn.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := serverPacketConn.ReadFrom(make([]byte, maxPacketSize))
+		return err
+	}
+
+	if err := send(oldPacketConn); err != nil {
+		t.Errorf("old key: %v", err)
+	}
+	if err := send(newPacketConn); err != nil {
+		t.Errorf("new key: %v", err)
+	}
+
+	if err := server.RetireKey(oldPublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := send(oldPacketConn); err != ErrUnknownKey {
+		t.Errorf("retired key: got %v, want %v", err, ErrUnknownKey)
+	}
+	if err := send(newPacketConn); err != nil {
+		t.Errorf("new key after retiring the old key: %v", err)
+	}
+}
+
+func TestDarkStarBlackholeReasons(t *testing.T) {
+	privateKey, _ := generateServerKey(t)
+	server := NewDarkStarServer(privateKey, "127.0.0.1", 1234)
+
+	keyExchange := ecdh.Generic(elliptic.P256())
+	_, ephemeralPublicKey, err := keyExchange.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ephemeralKey, err := PublicKeyToDarkstarFormatBytes(ephemeralPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an x coordinate beyond the field of P-256 is not a point
+	badKey := make([]byte, keySize)
+	rand.Read(badKey)
+	copy(badKey, bytes.Repeat([]byte{0xff}, 8))
+
+	code := make([]byte, confirmationCodeSize)
+	rand.Read(code)
+
+	for _, test := range []struct {
+		name   string
+		key    []byte
+		reason error
+	}{
+		{"bad key", badKey, ErrBadPublicKey},
+		{"bad code", ephemeralKey, ErrBadConfirmationCode},
+		{"repeated key", ephemeralKey, ErrRepeatedKey},
+	} {
+		left, right := net.Pipe()
+		go func() {
+			left.Write(append(append([]byte{}, test.key...), code...))
+		}()
+
+		conn, err := server.StreamConn(right)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		blackHole, ok := conn.(*BlackHoleConn)
+		if !ok {
+			t.Fatalf("%s: got %T, want *BlackHoleConn", test.name, conn)
+		}
+		if blackHole.Reason != test.reason {
+			t.Errorf("%s: reason = %v, want %v", test.name, blackHole.Reason, test.reason)
+		}
+		blackHole.Close()
+		left.Close()
+		right.Close()
+	}
+}
@@ -0,0 +1,12 @@
+package darkstar
+
+import "github.com/OperatorFoundation/go-shadowsocks2/logging"
+
+// logger receives the log records of the package. The nil default discards them.
+var logger *logging.Logger
+
+// SetLogger makes the package log to l. Call it before creating clients and
+// servers. Records never contain key material.
+func SetLogger(l *logging.Logger) {
+	logger = l.With("component", "darkstar")
+}
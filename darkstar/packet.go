@@ -1,86 +1,386 @@
 package darkstar
 
 import (
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
-	"github.com/OperatorFoundation/go-shadowsocks2/shadowaead"
 	"io"
 	"net"
 	"sync"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/internal"
+	"github.com/aead/ecdh"
+)
+
+// A DarkStar datagram association is keyed by a fresh ephemeral key of the
+// client, so that no round trip is needed before the first packet. Packets
+// from the client are
+//
+//	[client ephemeral public key][counter][AES-GCM encrypted payload][tag]
+//
+// and packets from the server are
+//
+//	[counter][AES-GCM encrypted payload][tag]
+//
+// The counter is the nonce of the packet and is authenticated together with
+// the rest of the header. Each direction has its own key, derived from the
+// ECDH secret of the client ephemeral key and the server persistent key, so
+// only the holder of the server private key can read or answer the client.
+// Counters are checked against a sliding window to reject replays, and the
+// server keeps the ephemeral keys of past associations in the salt filter.
+//
+// So an association that the server forgot, after packetSessionTimeout
+// without a packet either way or after a restart, cannot resume: its packets
+// fail with ErrRepeatedKey, like replays, and the client must open a new
+// association. Clients do so once their own UDP timeout, shorter by default,
+// ends the idle association.
+
+const (
+	maxPacketSize   = 64 * 1024
+	counterSize     = 8
+	clientHeaderLen = keySize + counterSize
+	serverHeaderLen = counterSize
+
+	// packetSessionTimeout is how long a server remembers an idle association.
+	packetSessionTimeout = 10 * time.Minute
+)
+
+var (
+	// ErrShortPacket means that the packet is too short for a valid encrypted packet.
+	ErrShortPacket = errors.New("short packet")
+	// ErrReplayedPacket means that the packet counter was already seen.
+	ErrReplayedPacket = errors.New("replayed packet")
+	// ErrRepeatedKey means that the ephemeral key of a new association was
+	// already used: the packet is a replay, or belongs to an association that
+	// the server forgot.
+	ErrRepeatedKey = errors.New("repeated ephemeral key")
+	// ErrBadPublicKey means that the packet does not start with a valid public key.
+	ErrBadPublicKey = errors.New("bad ephemeral public key")
+	// ErrUnknownKey means that a new association is not for any active server key.
+	ErrUnknownKey = errors.New("no active server key for association")
+	// ErrUnknownPeer means that there is no association with the destination address.
+	ErrUnknownPeer = errors.New("no DarkStar association with peer")
 )
 
-// ErrShortPacket means that the packet is too short for a valid encrypted packet.
-var ErrShortPacket = errors.New("short packet")
+// generateDatagramKey derives the key of one direction of an association.
+// personalizationString names the receiving side, as for stream connections.
+func generateDatagramKey(ecdhSecret, serverIdentifier, clientEphemeralPublicKeyBytes []byte, personalizationString string) []byte {
+	hash := sha256.New()
+	hash.Write(ecdhSecret)
+	hash.Write(serverIdentifier)
+	hash.Write(clientEphemeralPublicKeyBytes)
+	hash.Write([]byte("DarkStar"))
+	hash.Write([]byte("udp"))
+	hash.Write([]byte(personalizationString))
+
+	return hash.Sum(nil)
+}
 
-var _zerononce [128]byte // read-only. 128 bytes is more than enough.
+// datagramCiphers holds the keys of one association.
+type datagramCiphers struct {
+	clientToServer cipher.AEAD
+	serverToClient cipher.AEAD
+}
 
-// Pack encrypts plaintext using Cipher with a randomly generated salt and
-// returns a slice of dst containing the encrypted packet and any error occurred.
-// Ensure len(dst) >= ciph.SaltSize() + len(plaintext) + aead.Overhead().
-func Pack(dst, plaintext []byte, ciph shadowaead.Cipher) ([]byte, error) {
-	aead, err := ciph.Encrypter(nil)
+func newDatagramCiphers(ecdhSecret, serverIdentifier, clientEphemeralPublicKeyBytes []byte) (*datagramCiphers, error) {
+	clientToServer, err := aesGCM(generateDatagramKey(ecdhSecret, serverIdentifier, clientEphemeralPublicKeyBytes, "server"))
+	if err != nil {
+		return nil, err
+	}
+	serverToClient, err := aesGCM(generateDatagramKey(ecdhSecret, serverIdentifier, clientEphemeralPublicKeyBytes, "client"))
 	if err != nil {
 		return nil, err
 	}
 
-	if len(dst) < len(plaintext)+aead.Overhead() {
+	return &datagramCiphers{clientToServer: clientToServer, serverToClient: serverToClient}, nil
+}
+
+// seal appends the counter and the encrypted payload to header.
+func seal(dst, header []byte, aead cipher.AEAD, counter uint64, payload []byte) ([]byte, error) {
+	if cap(dst) < len(header)+counterSize+len(payload)+aead.Overhead() {
 		return nil, io.ErrShortBuffer
 	}
-	b := aead.Seal(dst, _zerononce[:aead.NonceSize()], plaintext, nil)
-	return dst[:len(b)], nil
+
+	buf := append(dst[:0], header...)
+	buf = binary.BigEndian.AppendUint64(buf, counter)
+	return aead.Seal(buf, nonce(counter), payload, buf), nil
+}
+
+// open decrypts pkt, whose header of headerLen bytes ends with the counter.
+func open(dst, pkt []byte, headerLen int, aead cipher.AEAD) ([]byte, uint64, error) {
+	if len(pkt) < headerLen+aead.Overhead() {
+		return nil, 0, ErrShortPacket
+	}
+
+	header := pkt[:headerLen]
+	counter := binary.BigEndian.Uint64(header[headerLen-counterSize:])
+	payload, err := aead.Open(dst[:0], nonce(counter), pkt[headerLen:], header)
+	return payload, counter, err
+}
+
+// clientPacketConn is one association with a DarkStar server.
+type clientPacketConn struct {
+	net.PacketConn
+	*DarkStarClient
+
+	// mutex guards the sending side, which is set up on first use.
+	mutex                         sync.Mutex
+	clientEphemeralPublicKeyBytes []byte
+	ciphers                       *datagramCiphers
+	counter                       uint64
+	buf                           []byte
+
+	// readMutex guards the replay window.
+	readMutex sync.Mutex
+	window    internal.ReplayWindow
+}
+
+func newClientPacketConn(conn net.PacketConn, client *DarkStarClient) *clientPacketConn {
+	return &clientPacketConn{PacketConn: conn, DarkStarClient: client, buf: make([]byte, maxPacketSize)}
+}
+
+// setup generates the ephemeral key of the association and derives its keys.
+func (c *clientPacketConn) setup() error {
+	clientEphemeralPrivateKey, clientEphemeralPublicKey, keyError := generateEvenKeys()
+	if keyError != nil {
+		return keyError
+	}
+
+	clientEphemeralPublicKeyBytes, keyError := PublicKeyToDarkstarFormatBytes(clientEphemeralPublicKey)
+	if keyError != nil {
+		return keyError
+	}
+
+	p256 := ecdh.Generic(elliptic.P256())
+	ecdhSecret := p256.ComputeSecret(clientEphemeralPrivateKey, c.serverPersistentPublicKey)
+
+	ciphers, cipherError := newDatagramCiphers(ecdhSecret, c.serverIdentifier, clientEphemeralPublicKeyBytes)
+	if cipherError != nil {
+		return cipherError
+	}
+
+	c.clientEphemeralPublicKeyBytes = clientEphemeralPublicKeyBytes
+	c.ciphers = ciphers
+	return nil
 }
 
-// Unpack decrypts pkt using Cipher and returns a slice of dst containing the decrypted payload and any error occurred.
-// Ensure len(dst) >= len(pkt) - aead.SaltSize() - aead.Overhead().
-func Unpack(dst, pkt []byte, ciph shadowaead.Cipher) ([]byte, error) {
-	aead, err := ciph.Decrypter(nil)
+// WriteTo encrypts b and write to addr using the embedded PacketConn.
+func (c *clientPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.ciphers == nil {
+		if err := c.setup(); err != nil {
+			return 0, err
+		}
+	}
+
+	buf, err := seal(c.buf, c.clientEphemeralPublicKeyBytes, c.ciphers.clientToServer, c.counter, b)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	c.counter++
+
+	_, err = c.PacketConn.WriteTo(buf, addr)
+	return len(b), err
+}
+
+// ReadFrom reads from the embedded PacketConn and decrypts into b.
+func (c *clientPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
 	}
-	if len(pkt) < aead.Overhead() {
-		return nil, ErrShortPacket
+
+	c.mutex.Lock()
+	ciphers := c.ciphers
+	c.mutex.Unlock()
+	if ciphers == nil { // nothing sent yet, so nobody can answer
+		return n, addr, ErrUnknownPeer
 	}
-	if len(dst)+aead.Overhead() < len(pkt) {
-		return nil, io.ErrShortBuffer
+
+	payload, counter, err := open(b[serverHeaderLen:], b[:n], serverHeaderLen, ciphers.serverToClient)
+	if err != nil {
+		return n, addr, err
 	}
-	b, err := aead.Open(dst[:0], _zerononce[:aead.NonceSize()], pkt, nil)
-	return b, err
+
+	c.readMutex.Lock()
+	accepted := c.window.Accept(counter)
+	c.readMutex.Unlock()
+	if !accepted {
+		return n, addr, ErrReplayedPacket
+	}
+
+	copy(b, payload)
+	return len(payload), addr, nil
 }
 
-type packetConn struct {
+// serverSession is the server side of one association.
+type serverSession struct {
+	*datagramCiphers
+	persistentKey *persistentKey
+	counter       uint64
+	window        internal.ReplayWindow
+	addr          net.Addr
+	lastSeen      time.Time
+}
+
+// serverPacketConn answers the associations of any number of clients.
+type serverPacketConn struct {
 	net.PacketConn
-	shadowaead.Cipher
-	sync.Mutex
-	buf []byte // write lock
+	*DarkStarServer
+
+	mutex     sync.Mutex
+	sessions  map[string]*serverSession // by client ephemeral public key
+	byAddr    map[string]*serverSession // by client address
+	lastPrune time.Time
+	buf       []byte // write buffer
+	readBuf   []byte // decrypts the first packet of an association
+}
+
+func newServerPacketConn(conn net.PacketConn, server *DarkStarServer) *serverPacketConn {
+	return &serverPacketConn{
+		PacketConn:     conn,
+		DarkStarServer: server,
+		sessions:       make(map[string]*serverSession),
+		byAddr:         make(map[string]*serverSession),
+		lastPrune:      time.Now(),
+		buf:            make([]byte, maxPacketSize),
+		readBuf:        make([]byte, maxPacketSize),
+	}
 }
 
-// NewPacketConn wraps a net.PacketConn with cipher
-func NewPacketConn(c net.PacketConn, ciph shadowaead.Cipher) net.PacketConn {
-	const maxPacketSize = 64 * 1024
-	return &packetConn{PacketConn: c, Cipher: ciph, buf: make([]byte, maxPacketSize)}
+// newSession finds the active persistent key that the first packet pkt of an
+// association was sealed for, and returns the session with the decrypted payload.
+func (c *serverPacketConn) newSession(pkt []byte) (*serverSession, []byte, uint64, error) {
+	clientEphemeralPublicKeyBytes := pkt[:keySize]
+	clientEphemeralPublicKey := DarkstarFormatBytesToPublicKey(clientEphemeralPublicKeyBytes)
+	if point, ok := clientEphemeralPublicKey.(ecdh.Point); !ok || point.X == nil {
+		return nil, nil, 0, ErrBadPublicKey
+	}
+
+	p256 := ecdh.Generic(elliptic.P256())
+	for _, key := range c.activeKeys() {
+		ecdhSecret := p256.ComputeSecret(key.privateKey, clientEphemeralPublicKey)
+
+		ciphers, cipherError := newDatagramCiphers(ecdhSecret, c.serverIdentifier, clientEphemeralPublicKeyBytes)
+		if cipherError != nil {
+			return nil, nil, 0, cipherError
+		}
+
+		// Decrypt into readBuf, as a failed attempt clobbers the output.
+		payload, counter, openError := open(c.readBuf, pkt, clientHeaderLen, ciphers.clientToServer)
+		if openError == nil {
+			return &serverSession{datagramCiphers: ciphers, persistentKey: key}, payload, counter, nil
+		}
+		if openError == ErrShortPacket {
+			return nil, nil, 0, openError
+		}
+	}
+
+	return nil, nil, 0, ErrUnknownKey
 }
 
 // WriteTo encrypts b and write to addr using the embedded PacketConn.
-func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
-	c.Lock()
-	defer c.Unlock()
-	buf, err := Pack(c.buf, b, c)
+// addr must have sent a valid packet recently.
+func (c *serverPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	session, ok := c.byAddr[addr.String()]
+	if !ok {
+		return 0, ErrUnknownPeer
+	}
+
+	buf, err := seal(c.buf, nil, session.serverToClient, session.counter, b)
 	if err != nil {
 		return 0, err
 	}
+	session.counter++
+	session.lastSeen = time.Now()
+
 	_, err = c.PacketConn.WriteTo(buf, addr)
 	return len(b), err
 }
 
 // ReadFrom reads from the embedded PacketConn and decrypts into b.
-func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+func (c *serverPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
 	n, addr, err := c.PacketConn.ReadFrom(b)
 	if err != nil {
 		return n, addr, err
 	}
-	bb, err := Unpack(b[c.Cipher.SaltSize():], b[:n], c)
+	if n < clientHeaderLen {
+		return n, addr, ErrShortPacket
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.prune()
+
+	key := string(b[:keySize])
+	session, known := c.sessions[key]
+	if known && !c.isActive(session.persistentKey) {
+		c.forget(key, session)
+		known = false
+	}
+
+	var payload []byte
+	var counter uint64
+	if known {
+		payload, counter, err = open(b[clientHeaderLen:], b[:n], clientHeaderLen, session.clientToServer)
+	} else {
+		session, payload, counter, err = c.newSession(b[:n])
+	}
 	if err != nil {
 		return n, addr, err
 	}
-	copy(b, bb)
-	return len(bb), addr, err
+
+	// Only authentic packets may start an association, so that probes do not
+	// fill the salt filter.
+	if !known {
+		if internal.CheckAndAddSalt(b[:keySize]) {
+			return n, addr, ErrRepeatedKey
+		}
+		c.sessions[key] = session
+	}
+	if !session.window.Accept(counter) {
+		return n, addr, ErrReplayedPacket
+	}
+
+	if session.addr != nil && session.addr.String() != addr.String() {
+		delete(c.byAddr, session.addr.String())
+	}
+	session.addr = addr
+	session.lastSeen = time.Now()
+	c.byAddr[addr.String()] = session
+
+	copy(b, payload)
+	return len(payload), addr, nil
+}
+
+// prune forgets associations that have been idle for packetSessionTimeout.
+// It does the work at most once per packetSessionTimeout.
+func (c *serverPacketConn) prune() {
+	now := time.Now()
+	if now.Sub(c.lastPrune) < packetSessionTimeout {
+		return
+	}
+	c.lastPrune = now
+
+	for key, session := range c.sessions {
+		if now.Sub(session.lastSeen) > packetSessionTimeout {
+			c.forget(key, session)
+		}
+	}
+}
+
+// forget removes the association of the client ephemeral public key key.
+func (c *serverPacketConn) forget(key string, session *serverSession) {
+	delete(c.sessions, key)
+	if session.addr != nil && c.byAddr[session.addr.String()] == session {
+		delete(c.byAddr, session.addr.String())
+	}
 }
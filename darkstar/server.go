@@ -2,141 +2,347 @@ package darkstar
 
 import (
 	"bytes"
+	"context"
 	"crypto"
-	"crypto/aes"
 	"crypto/cipher"
 	"crypto/elliptic"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
-	"fmt"
 	"github.com/OperatorFoundation/go-shadowsocks2/internal"
 	"github.com/aead/ecdh"
 	"net"
+	"sync"
 )
 
+// DarkStarServer holds the persistent identities of a server.
+// It is safe for concurrent use; the handshake state of each connection lives in
+// a serverHandshake created by StreamConn.
+//
+// A server may accept several persistent keys at once, so that keys can be
+// rotated without cutting off clients that still know an old public key. Keys
+// are added and retired with AddKey, RetireKey and SetKeys while the server runs.
 type DarkStarServer struct {
+	keysMutex        sync.RWMutex
+	keys             []*persistentKey
+	serverIdentifier []byte
+}
+
+// persistentKey is one persistent identity of a server.
+type persistentKey struct {
+	privateKey     crypto.PrivateKey
+	publicKey      crypto.PublicKey
+	publicKeyBytes []byte // DarkStar format
+}
+
+// serverHandshake is the state of a single server handshake.
+// Every connection gets fresh ephemeral keys. The persistent key is the one
+// the client confirmation code was made for.
+type serverHandshake struct {
+	*DarkStarServer
 	serverPersistentPublicKey  crypto.PublicKey
 	serverPersistentPrivateKey crypto.PrivateKey
 	serverEphemeralPublicKey   crypto.PublicKey
 	serverEphemeralPrivateKey  crypto.PrivateKey
-	serverIdentifier           []byte
 	clientEphemeralPublicKey   crypto.PublicKey
 }
 
 func NewDarkStarServer(serverPersistentPrivateKey string, host string, port int) *DarkStarServer {
-	privateKey, decodeError := base64.StdEncoding.DecodeString(serverPersistentPrivateKey)
-	if decodeError != nil {
+	key, keyError := newPersistentKey(serverPersistentPrivateKey)
+	if keyError != nil {
 		return nil
 	}
 
-	trimmedPrivateKey := privateKey[1:]
-	keyExchange := ecdh.Generic(elliptic.P256())
 	serverIdentifier := getServerIdentifier(host, port)
 
+	return &DarkStarServer{
+		keys:             []*persistentKey{key},
+		serverIdentifier: serverIdentifier,
+	}
+}
+
+// newPersistentKey decodes a base64 private key in raw or keychain format.
+func newPersistentKey(serverPersistentPrivateKey string) (*persistentKey, error) {
+	privateKeyBytes, decodeError := base64.StdEncoding.DecodeString(serverPersistentPrivateKey)
+	if decodeError != nil {
+		return nil, decodeError
+	}
+
+	privateKey, keyError := decodePrivateKey(privateKeyBytes)
+	if keyError != nil {
+		return nil, keyError
+	}
+
+	keyExchange := ecdh.Generic(elliptic.P256())
+	publicKey := keyExchange.PublicKey(privateKey)
+	publicKeyBytes, keyError := PublicKeyToDarkstarFormatBytes(publicKey)
+	if keyError != nil {
+		return nil, keyError
+	}
+
+	return &persistentKey{privateKey: privateKey, publicKey: publicKey, publicKeyBytes: publicKeyBytes}, nil
+}
+
+// AddKey starts accepting clients that know the public key of
+// serverPersistentPrivateKey. Adding a key twice has no effect.
+func (a *DarkStarServer) AddKey(serverPersistentPrivateKey string) error {
+	key, keyError := newPersistentKey(serverPersistentPrivateKey)
+	if keyError != nil {
+		return keyError
+	}
+
+	a.keysMutex.Lock()
+	defer a.keysMutex.Unlock()
+
+	for _, activeKey := range a.keys {
+		if bytes.Equal(activeKey.publicKeyBytes, key.publicKeyBytes) {
+			return nil
+		}
+	}
+	a.keys = append(a.keys, key)
+
+	return nil
+}
+
+// RetireKey stops accepting new clients for serverPersistentPublicKey, given in
+// DarkStar or keychain format. Their handshakes are blackholed as if the client
+// confirmation code were wrong. Connections that are already established are
+// not affected. The last key of a server cannot be retired.
+func (a *DarkStarServer) RetireKey(serverPersistentPublicKey string) error {
+	publicKeyBytes, decodeError := base64.StdEncoding.DecodeString(serverPersistentPublicKey)
+	if decodeError != nil {
+		return decodeError
+	}
+
+	publicKey := decodePublicKey(publicKeyBytes)
+	if publicKey == nil {
+		return errors.New("could not decode the public key")
+	}
+	darkStarBytes, keyError := PublicKeyToDarkstarFormatBytes(publicKey)
+	if keyError != nil {
+		return keyError
+	}
+
+	a.keysMutex.Lock()
+	defer a.keysMutex.Unlock()
+
+	for index, activeKey := range a.keys {
+		if bytes.Equal(activeKey.publicKeyBytes, darkStarBytes) {
+			if len(a.keys) == 1 {
+				return errors.New("cannot retire the last key")
+			}
+
+			a.keys = append(a.keys[:index:index], a.keys[index+1:]...)
+			return nil
+		}
+	}
+
+	return errors.New("the key is not active")
+}
+
+// SetKeys replaces the active keys with serverPersistentPrivateKeys.
+// Keys that are left out are retired.
+func (a *DarkStarServer) SetKeys(serverPersistentPrivateKeys []string) error {
+	if len(serverPersistentPrivateKeys) == 0 {
+		return errors.New("at least one key is required")
+	}
+
+	keys := make([]*persistentKey, 0, len(serverPersistentPrivateKeys))
+	for _, serverPersistentPrivateKey := range serverPersistentPrivateKeys {
+		key, keyError := newPersistentKey(serverPersistentPrivateKey)
+		if keyError != nil {
+			return keyError
+		}
+		keys = append(keys, key)
+	}
+
+	a.keysMutex.Lock()
+	a.keys = keys
+	a.keysMutex.Unlock()
+
+	return nil
+}
+
+// activeKeys returns a snapshot of the accepted keys, the first one added first.
+func (a *DarkStarServer) activeKeys() []*persistentKey {
+	a.keysMutex.RLock()
+	defer a.keysMutex.RUnlock()
+
+	return a.keys
+}
+
+// isActive reports whether key has not been retired.
+func (a *DarkStarServer) isActive(key *persistentKey) bool {
+	for _, activeKey := range a.activeKeys() {
+		if activeKey == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *DarkStarServer) newHandshake() (*serverHandshake, error) {
 	serverEphemeralPrivateKey, serverEphemeralPublicKey, keyError := generateEvenKeys()
 	if keyError != nil {
-		return nil
+		return nil, keyError
 	}
 
-	return &DarkStarServer{
-		serverPersistentPublicKey:  keyExchange.PublicKey(trimmedPrivateKey),
-		serverPersistentPrivateKey: trimmedPrivateKey,
-		serverEphemeralPublicKey:   serverEphemeralPublicKey,
-		serverEphemeralPrivateKey:  serverEphemeralPrivateKey,
-		serverIdentifier:           serverIdentifier,
+	handshake := &serverHandshake{
+		DarkStarServer:            a,
+		serverEphemeralPublicKey:  serverEphemeralPublicKey,
+		serverEphemeralPrivateKey: serverEphemeralPrivateKey,
 	}
+	handshake.usePersistentKey(a.activeKeys()[0])
+
+	return handshake, nil
+}
+
+func (a *serverHandshake) usePersistentKey(key *persistentKey) {
+	a.serverPersistentPublicKey = key.publicKey
+	a.serverPersistentPrivateKey = key.privateKey
 }
 
 func (a *DarkStarServer) StreamConn(conn net.Conn) (net.Conn, error) {
+	return a.StreamConnContext(context.Background(), conn)
+}
+
+// StreamConnContext is like StreamConn, but the handshake fails with ctx.Err()
+// if ctx is done before the client's ephemeral key and confirmation code
+// arrive, so that a silent client cannot hold the connection open.
+func (a *DarkStarServer) StreamConnContext(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	handshake, handshakeError := a.newHandshake()
+	if handshakeError != nil {
+		return nil, handshakeError
+	}
+
+	stop := internal.WatchContext(ctx, conn)
+	streamConn, streamError := handshake.streamConn(conn)
+	if contextError := stop(); streamError != nil && contextError != nil {
+		return nil, contextError
+	}
+
+	return streamConn, streamError
+}
+
+func (a *serverHandshake) streamConn(conn net.Conn) (net.Conn, error) {
 	clientEphemeralPublicKeyBuffer := make([]byte, keySize)
 	keyReadError := internal.ReadFully(conn, clientEphemeralPublicKeyBuffer)
 	if keyReadError != nil {
-		print("DarkStarServer: Error creating a DarkStar connection: ")
-		println(keyReadError)
+		logger.Debug("failed to read the client ephemeral key", "remote", conn.RemoteAddr(), "err", keyReadError)
 		return nil, keyReadError // ERROR, this means they never send us anything, probably the connection is closed
 	}
 
-	if internal.CheckSalt(clientEphemeralPublicKeyBuffer) {
-		return NewBlackHoleConn(), nil
-	} else {
-		internal.AddSalt(clientEphemeralPublicKeyBuffer)
+	if internal.CheckAndAddSalt(clientEphemeralPublicKeyBuffer) {
+		return NewBlackHoleConn(ErrRepeatedKey), nil
 	}
 
 	a.clientEphemeralPublicKey = DarkstarFormatBytesToPublicKey(clientEphemeralPublicKeyBuffer)
+	if point, ok := a.clientEphemeralPublicKey.(ecdh.Point); !ok || point.X == nil {
+		return NewBlackHoleConn(ErrBadPublicKey), nil // BLACKHOLE, the bytes they sent us were not a public key, probably a probe
+	}
 
 	clientConfirmationCode := make([]byte, confirmationCodeSize)
 	confirmationReadError := internal.ReadFully(conn, clientConfirmationCode)
 	if confirmationReadError != nil {
-		fmt.Println("DarkStarServer: Error creating a DarkStar connection: ", confirmationReadError)
+		logger.Debug("failed to read the client confirmation code", "remote", conn.RemoteAddr(), "err", confirmationReadError)
 		return nil, confirmationReadError // ERROR, probably the connection is closed
 	}
 
-	serverCopyClientConfirmationCode, confirmationError := a.generateClientConfirmationCode()
-	if confirmationError != nil {
-		fmt.Println("DarkStarServer: BlackholeConnection: ", confirmationError)
-		return NewBlackHoleConn(), nil // BLACKHOLE, this means we could not generate the code potentially because we did not receive a valid key
-	}
-
-	fmt.Printf("client copy: %s\n", hex.EncodeToString(clientConfirmationCode))
-	fmt.Printf("server copy: %s\n", hex.EncodeToString(serverCopyClientConfirmationCode))
-
-	if !bytes.Equal(clientConfirmationCode, serverCopyClientConfirmationCode) {
-		fmt.Println("DarkStarServer : BlackholeConnection: The client confirmation code and the server copy of the client confirmation code are not equal")
-		return NewBlackHoleConn(), nil // BLACKHOLE
+	if !a.findPersistentKey(clientConfirmationCode) {
+		logger.Debug("blackholing connection", "remote", conn.RemoteAddr(), "reason", ErrBadConfirmationCode)
+		return NewBlackHoleConn(ErrBadConfirmationCode), nil // BLACKHOLE
 	}
 
 	serverEphemeralPublicKeyData, pubKeyToBytesError := PublicKeyToDarkstarFormatBytes(a.serverEphemeralPublicKey)
 	if pubKeyToBytesError != nil {
-		fmt.Println("DarkStarServer: BlackholeConnection: ", pubKeyToBytesError)
-		return NewBlackHoleConn(), nil // BLACKHOLE, this means the bytes they sent us were not a public key, probably a probe
+		logger.Warn("blackholing connection", "remote", conn.RemoteAddr(), "reason", pubKeyToBytesError)
+		return NewBlackHoleConn(pubKeyToBytesError), nil // BLACKHOLE, not sure why this would happen
 	}
 
 	serverConfirmationCode, _ := a.generateServerConfirmationCode()
 
 	keyWriteError := internal.WriteFully(conn, serverEphemeralPublicKeyData)
 	if keyWriteError != nil {
-		fmt.Println("DarkStarServer: Error creating a DarkStar connection: ", keyWriteError)
+		logger.Debug("failed to send the server ephemeral key", "remote", conn.RemoteAddr(), "err", keyWriteError)
 		return nil, keyWriteError // ERROR, the client closed the connection
 	}
 
 	confirmationWriteError := internal.WriteFully(conn, serverConfirmationCode)
 	if confirmationWriteError != nil {
-		fmt.Println("DarkStarServer: Error creating a DarkStar connection: ", confirmationWriteError)
+		logger.Debug("failed to send the server confirmation code", "remote", conn.RemoteAddr(), "err", confirmationWriteError)
 		return nil, confirmationWriteError // ERROR, the client closed the connection
 	}
 
 	sharedKeyServerToClient, sharedKeyServerError := a.createServerToClientSharedKey()
 	if sharedKeyServerError != nil {
-		fmt.Println("DarkStarServer: BlackholeConnection: ", sharedKeyServerError)
-		return NewBlackHoleConn(), nil // BLACKHOLE, not sure why this would happen
+		logger.Warn("blackholing connection", "remote", conn.RemoteAddr(), "reason", sharedKeyServerError)
+		return NewBlackHoleConn(sharedKeyServerError), nil // BLACKHOLE, not sure why this would happen
 	}
 
 	sharedKeyClientToServer, sharedKeyClientError := a.createClientToServerSharedKey()
 	if sharedKeyClientError != nil {
-		fmt.Println("DarkStarServer: BlackholeConnection: ", sharedKeyClientError)
-		return NewBlackHoleConn(), nil // BLACKHOLE, not sure why this would happen
+		logger.Warn("blackholing connection", "remote", conn.RemoteAddr(), "reason", sharedKeyClientError)
+		return NewBlackHoleConn(sharedKeyClientError), nil // BLACKHOLE, not sure why this would happen
 	}
 
 	encryptCipher, encryptKeyError := a.Encrypter(sharedKeyServerToClient)
 	if encryptKeyError != nil {
-		fmt.Println("DarkStarServer: Error creating a DarkStar connection: ", encryptKeyError)
-		return NewBlackHoleConn(), nil // BLACKHOLE, not sure why this would happen
+		logger.Warn("blackholing connection", "remote", conn.RemoteAddr(), "reason", encryptKeyError)
+		return NewBlackHoleConn(encryptKeyError), nil // BLACKHOLE, not sure why this would happen
 	}
 
 	decryptCipher, decryptKeyError := a.Decrypter(sharedKeyClientToServer)
 	if decryptKeyError != nil {
-		fmt.Println("DarkStarServer: Error creating a DarkStar connection: ", decryptKeyError)
-		return NewBlackHoleConn(), nil // BLACKHOLE, not sure why this would happen
+		logger.Warn("blackholing connection", "remote", conn.RemoteAddr(), "reason", decryptKeyError)
+		return NewBlackHoleConn(decryptKeyError), nil // BLACKHOLE, not sure why this would happen
 	}
 
 	return NewDarkStarConn(conn, encryptCipher, decryptCipher), nil
 }
 
+// StreamHeaderSize is the length of the client ephemeral key and the client
+// confirmation code that start a handshake.
+func (a *DarkStarServer) StreamHeaderSize() int {
+	return keySize + confirmationCodeSize
+}
+
+// MatchStream reports whether header, the first StreamHeaderSize bytes of a
+// stream, is a handshake for one of the active keys. It lets a multi-user
+// server, which gives each user a DarkStarServer of its own, find the user.
+func (a *DarkStarServer) MatchStream(header []byte) bool {
+	if len(header) != a.StreamHeaderSize() {
+		return false
+	}
+
+	handshake := &serverHandshake{DarkStarServer: a, clientEphemeralPublicKey: DarkstarFormatBytesToPublicKey(header[:keySize])}
+	return handshake.findPersistentKey(header[keySize:])
+}
+
+// findPersistentKey selects the active key that clientConfirmationCode was made
+// for. It returns false if there is none, for example because the client knows
+// a retired key.
+func (a *serverHandshake) findPersistentKey(clientConfirmationCode []byte) bool {
+	for _, key := range a.activeKeys() {
+		a.usePersistentKey(key)
+
+		serverCopyClientConfirmationCode, confirmationError := a.generateClientConfirmationCode()
+		if confirmationError != nil {
+			logger.Debug("failed to compute a client confirmation code", "err", confirmationError)
+			return false // we could not generate the code potentially because we did not receive a valid key
+		}
+
+		if bytes.Equal(clientConfirmationCode, serverCopyClientConfirmationCode) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (a *DarkStarServer) PacketConn(conn net.PacketConn) net.PacketConn {
-	return NewPacketConn(conn, a)
+	return newServerPacketConn(conn, a)
 }
 
 func (a *DarkStarServer) KeySize() int {
@@ -148,23 +354,14 @@ func (a *DarkStarServer) SaltSize() int {
 }
 
 func (a *DarkStarServer) Encrypter(sharedKey []byte) (cipher.AEAD, error) {
-	return a.aesGCM(sharedKey)
+	return aesGCM(sharedKey)
 }
 
 func (a *DarkStarServer) Decrypter(sharedKey []byte) (cipher.AEAD, error) {
-	return a.aesGCM(sharedKey)
-}
-
-func (a *DarkStarServer) aesGCM(key []byte) (cipher.AEAD, error) {
-	blk, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-
-	return cipher.NewGCM(blk)
+	return aesGCM(sharedKey)
 }
 
-func (a *DarkStarServer) generateSharedKey(personalizationString string) ([]byte, error) {
+func (a *serverHandshake) generateSharedKey(personalizationString string) ([]byte, error) {
 	p256 := ecdh.Generic(elliptic.P256())
 	ephemeralECDHBytes := p256.ComputeSecret(a.serverEphemeralPrivateKey, a.clientEphemeralPublicKey)
 	persistentECDHBytes := p256.ComputeSecret(a.serverPersistentPrivateKey, a.clientEphemeralPublicKey)
@@ -191,15 +388,15 @@ func (a *DarkStarServer) generateSharedKey(personalizationString string) ([]byte
 	return hash.Sum(nil), nil
 }
 
-func (a *DarkStarServer) createServerToClientSharedKey() ([]byte, error) {
+func (a *serverHandshake) createServerToClientSharedKey() ([]byte, error) {
 	return a.generateSharedKey("client")
 }
 
-func (a *DarkStarServer) createClientToServerSharedKey() ([]byte, error) {
+func (a *serverHandshake) createClientToServerSharedKey() ([]byte, error) {
 	return a.generateSharedKey("server")
 }
 
-func (a *DarkStarServer) generateServerConfirmationCode() ([]byte, error) {
+func (a *serverHandshake) generateServerConfirmationCode() ([]byte, error) {
 	p256 := ecdh.Generic(elliptic.P256())
 	ecdhSecret := p256.ComputeSecret(a.serverPersistentPrivateKey, a.clientEphemeralPublicKey)
 	serverPersistentPublicKeyData, serverKeyError := PublicKeyToKeychainFormatBytes(a.serverPersistentPublicKey)
@@ -223,10 +420,10 @@ func (a *DarkStarServer) generateServerConfirmationCode() ([]byte, error) {
 	return hash.Sum(nil), nil
 }
 
-func (a *DarkStarServer) generateClientConfirmationCode() (code []byte, codeError error) {
+func (a *serverHandshake) generateClientConfirmationCode() (code []byte, codeError error) {
 	defer func() {
 		if err := recover(); err != nil {
-			fmt.Println("Failed to create a ClientConfirmationCode:", err)
+			logger.Warn("failed to create a client confirmation code", "err", err)
 			code = nil
 			codeError = errors.New("failed to create a ClientConfirmationCode")
 		}
@@ -253,11 +450,6 @@ func (a *DarkStarServer) generateClientConfirmationCode() (code []byte, codeErro
 		return nil, clientKeyError
 	}
 
-	fmt.Printf("ecdhSecret: %s\n", hex.EncodeToString(ecdhSecret))
-	fmt.Printf("serveridentifier: %s\n", hex.EncodeToString(a.serverIdentifier))
-	fmt.Printf("serverPersistentPublicKey: %s\n", hex.EncodeToString(serverPersistentPublicKeyData))
-	fmt.Printf("clientEphemeralPublicKey: %s\n", hex.EncodeToString(clientEphemeralPublicKeyData))
-
 	hash := sha256.New()
 	hash.Write(ecdhSecret)
 	hash.Write(a.serverIdentifier)
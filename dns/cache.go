@@ -0,0 +1,110 @@
+package dns
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Cache holds the responses to queries until the first of their records
+// expires. A nil *Cache holds nothing. It is safe for concurrent use.
+type Cache struct {
+	size int
+
+	mutex   sync.Mutex
+	entries map[Question]*entry
+}
+
+type entry struct {
+	resp    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// NewCache returns a cache of up to size responses.
+func NewCache(size int) *Cache {
+	return &Cache{size: size, entries: make(map[Question]*entry)}
+}
+
+// Get returns the cached response to query, for its ID and with the TTLs of
+// its records lowered by its age, or nil.
+func (c *Cache) Get(query []byte) []byte {
+	if c == nil {
+		return nil
+	}
+	q, err := ParseQuestion(query)
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	c.mutex.Lock()
+	e := c.entries[q]
+	if e != nil && !now.Before(e.expires) {
+		delete(c.entries, q)
+		e = nil
+	}
+	c.mutex.Unlock()
+	if e == nil {
+		return nil
+	}
+
+	resp := append([]byte{}, e.resp...)
+	copy(resp, query[:2]) // ID
+	age := uint32(now.Sub(e.stored) / time.Second)
+	records(resp, func(typ, _ uint16, ttl int) {
+		if typ != typeOPT {
+			binary.BigEndian.PutUint32(resp[ttl:], binary.BigEndian.Uint32(resp[ttl:])-age)
+		}
+	})
+	return resp
+}
+
+// Put caches resp, the response to query, if it has an answer or names no
+// domain, for the lowest TTL of its records.
+func (c *Cache) Put(query, resp []byte) {
+	if c == nil || len(resp) < headerLen {
+		return
+	}
+	if rcode := resp[3] & 0x0F; rcode != rcodeSuccess && rcode != rcodeNXDomain || resp[2]&0x02 != 0 {
+		return // a failure, or truncated
+	}
+	q, err := ParseQuestion(query)
+	if err != nil {
+		return
+	}
+	ttl, ok := uint32(0), false
+	if err := records(resp, func(typ, _ uint16, off int) {
+		if t := binary.BigEndian.Uint32(resp[off:]); typ != typeOPT && (!ok || t < ttl) {
+			ttl, ok = t, true
+		}
+	}); err != nil || !ok || ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.entries[q]; !ok && len(c.entries) >= c.size {
+		c.evict(now)
+	}
+	c.entries[q] = &entry{resp: append([]byte{}, resp...), stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// evict removes the expired entries, or else the one that expires first.
+func (c *Cache) evict(now time.Time) {
+	var first *Question
+	var expires time.Time
+	for q, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, q)
+			continue
+		}
+		if first == nil || e.expires.Before(expires) {
+			q := q
+			first, expires = &q, e.expires
+		}
+	}
+	if len(c.entries) >= c.size && first != nil {
+		delete(c.entries, *first)
+	}
+}
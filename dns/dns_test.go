@@ -0,0 +1,130 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// query returns a query for name and typ with id.
+func query(id uint16, name string, typ uint16) []byte {
+	b := []byte{byte(id >> 8), byte(id), 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		b = append(append(b, byte(len(label))), label...)
+	}
+	return append(b, 0, byte(typ>>8), byte(typ), 0, ClassINET)
+}
+
+// withAnswer returns the response to q with the record of ip and ttl, and an
+// OPT record.
+func withAnswer(t *testing.T, q []byte, ip net.IP, ttl uint32) []byte {
+	t.Helper()
+	question, err := ParseQuestion(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := Answer(q, question, ip, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint16(resp[10:], 1)
+	return append(resp, 0, 0, typeOPT, 0x04, 0xD0, 0, 0, 0, 0, 0, 0) // size 1232
+}
+
+func TestMessage(t *testing.T) {
+	q := query(7, "WWW.Example.com", TypeA)
+	question, err := ParseQuestion(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Question{"www.example.com", TypeA, ClassINET}); question != want {
+		t.Errorf("got question %+v, want %+v", question, want)
+	}
+	if _, err := ParseQuestion(q[:len(q)-1]); err == nil {
+		t.Error("short question: no error")
+	}
+
+	resp := withAnswer(t, q, net.ParseIP("192.0.2.1"), 300)
+	if resp[0] != 0 || resp[1] != 7 || resp[2] != 0x81 || resp[3] != 0x80 {
+		t.Errorf("got header %v", resp[:4])
+	}
+	if !bytes.HasSuffix(resp[:len(resp)-11], []byte{0, 0, 1, 44, 0, 4, 192, 0, 2, 1}) {
+		t.Errorf("got answer %v", resp)
+	}
+	if got := UDPSize(q); got != 512 {
+		t.Errorf("UDP size without EDNS: got %d", got)
+	}
+	if got := UDPSize(resp); got != 1232 {
+		t.Errorf("UDP size with EDNS: got %d", got)
+	}
+	tc, err := Truncate(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tc) != len(q) || tc[2]&0x02 == 0 || tc[7] != 0 || tc[11] != 0 {
+		t.Errorf("truncated: got %v", tc)
+	}
+}
+
+func TestCache(t *testing.T) {
+	c := NewCache(2)
+	a, aaaa, other := query(1, "example.com", TypeA), query(2, "example.com", TypeAAAA), query(3, "example.net", TypeA)
+	c.Put(a, withAnswer(t, a, net.ParseIP("192.0.2.1"), 300))
+	c.Put(aaaa, withAnswer(t, aaaa, net.ParseIP("2001:db8::1"), 0)) // not cached
+	failure := append([]byte{}, other...)
+	failure[2], failure[3] = 0x81, 0x82 // SERVFAIL
+	c.Put(other, failure)
+
+	resp := c.Get(query(9, "EXAMPLE.com", TypeA))
+	if resp == nil || resp[1] != 9 {
+		t.Fatalf("got %v, want the response with ID 9", resp)
+	}
+	if c.Get(aaaa) != nil || c.Get(other) != nil {
+		t.Error("cached a response without TTL or a failure")
+	}
+
+	// A third response evicts the one that expires first.
+	c.Put(aaaa, withAnswer(t, aaaa, net.ParseIP("2001:db8::1"), 60))
+	c.Put(other, withAnswer(t, other, net.ParseIP("192.0.2.2"), 600))
+	if c.Get(aaaa) != nil || c.Get(a) == nil || c.Get(other) == nil {
+		t.Error("did not evict the response that expires first")
+	}
+	var nilCache *Cache
+	nilCache.Put(a, resp)
+	if nilCache.Get(a) != nil {
+		t.Error("nil cache returned a response")
+	}
+}
+
+func TestFakeIP(t *testing.T) {
+	if _, err := NewFakeIP("2001:db8::/64"); err == nil {
+		t.Error("IPv6 network accepted")
+	}
+	f, err := NewFakeIP("198.18.0.0/30") // 2 addresses
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := f.IP("a.example"), f.IP("b.example")
+	if !a.Equal(net.ParseIP("198.18.0.1")) || !b.Equal(net.ParseIP("198.18.0.2")) || !f.IP("a.example").Equal(a) {
+		t.Errorf("got %v and %v", a, b)
+	}
+	if name, ok := f.Name(b); !ok || name != "b.example" {
+		t.Errorf("name of %v: got %q, %v", b, name, ok)
+	}
+
+	// The third name takes the address of the first.
+	if c := f.IP("c.example"); !c.Equal(a) {
+		t.Errorf("got %v, want %v", c, a)
+	}
+	if name, _ := f.Name(a); name != "c.example" {
+		t.Errorf("name of %v: got %q", a, name)
+	}
+	if _, ok := f.Name(net.ParseIP("198.18.0.3")); ok {
+		t.Error("broadcast address has a name")
+	}
+	if _, ok := f.Name(net.ParseIP("192.0.2.1")); ok {
+		t.Error("address out of the network has a name")
+	}
+}
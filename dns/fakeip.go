@@ -0,0 +1,78 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// FakeIP gives names IPv4 addresses of a network that is not in use, such as
+// 198.18.0.0/15, so that the name of a target is known from the address that
+// a client connects to. Once the addresses run out, it takes back the one
+// given longest ago. It is safe for concurrent use.
+type FakeIP struct {
+	network *net.IPNet
+	first   uint32 // the first address
+	size    uint32 // the number of addresses
+
+	mutex  sync.Mutex
+	names  map[string]uint32 // offset by name
+	byAddr map[uint32]string // name by offset
+	next   uint32            // offset of the next address to give
+}
+
+// NewFakeIP returns the fake addresses of cidr, an IPv4 network, without its
+// network and broadcast addresses.
+func NewFakeIP(cidr string) (*FakeIP, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := network.Mask.Size()
+	if bits != 8*net.IPv4len || ones > 30 {
+		return nil, fmt.Errorf("fake IP network %s is not an IPv4 network of 4 addresses or more", cidr)
+	}
+	return &FakeIP{
+		network: network,
+		first:   binary.BigEndian.Uint32(network.IP.To4()) + 1,
+		size:    1<<(bits-ones) - 2,
+		names:   make(map[string]uint32),
+		byAddr:  make(map[uint32]string),
+	}, nil
+}
+
+// IP returns the fake address of name.
+func (f *FakeIP) IP(name string) net.IP {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	off, ok := f.names[name]
+	if !ok {
+		off = f.next
+		f.next = (f.next + 1) % f.size
+		if old, ok := f.byAddr[off]; ok {
+			delete(f.names, old)
+		}
+		f.names[name], f.byAddr[off] = off, name
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, f.first+off)
+	return ip
+}
+
+// Contains reports whether ip is in the network of f.
+func (f *FakeIP) Contains(ip net.IP) bool {
+	return f.network.Contains(ip)
+}
+
+// Name returns the name that ip stands for, if any.
+func (f *FakeIP) Name(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil || !f.network.Contains(ip4) {
+		return "", false
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name, ok := f.byAddr[binary.BigEndian.Uint32(ip4)-f.first]
+	return name, ok
+}
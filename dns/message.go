@@ -0,0 +1,196 @@
+// Package dns has what a client needs to answer DNS queries through its
+// server: a cache of responses, and fake addresses that stand for names. It
+// reads only the parts of the messages of RFC 1035 that it needs.
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Types of records.
+const (
+	TypeA    = 1
+	TypeAAAA = 28
+	typeOPT  = 41
+)
+
+// ClassINET is the class of Internet records.
+const ClassINET = 1
+
+// Response codes.
+const (
+	rcodeSuccess  = 0
+	rcodeNXDomain = 3
+)
+
+const headerLen = 12
+
+// minUDPSize is the largest response to a query over UDP without EDNS.
+const minUDPSize = 512
+
+var errMessage = errors.New("dns: malformed message")
+
+// Question is the question of a message.
+type Question struct {
+	Name  string // in lower case, without the final dot
+	Type  uint16
+	Class uint16
+}
+
+// ParseQuestion returns the question of query, which must have one.
+func ParseQuestion(query []byte) (Question, error) {
+	if len(query) < headerLen || binary.BigEndian.Uint16(query[4:]) != 1 {
+		return Question{}, errMessage
+	}
+	name, off, err := readName(query, headerLen)
+	if err != nil {
+		return Question{}, err
+	}
+	if len(query) < off+4 {
+		return Question{}, errMessage
+	}
+	return Question{
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(query[off:]),
+		Class: binary.BigEndian.Uint16(query[off+2:]),
+	}, nil
+}
+
+// readName returns the name at off, following compression pointers, and the
+// offset after it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1 // after the first pointer, if any
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errMessage
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), end, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errMessage
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		case n&0xC0 != 0:
+			return "", 0, errMessage
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errMessage
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// questionEnd returns the offset after the questions of msg.
+func questionEnd(msg []byte) (int, error) {
+	if len(msg) < headerLen {
+		return 0, errMessage
+	}
+	off := headerLen
+	for i := binary.BigEndian.Uint16(msg[4:]); i > 0; i-- {
+		_, end, err := readName(msg, off)
+		if err != nil {
+			return 0, err
+		}
+		if off = end + 4; off > len(msg) {
+			return 0, errMessage
+		}
+	}
+	return off, nil
+}
+
+// records calls f with the type, the class and the offset of the TTL of each
+// record of msg, after the questions.
+func records(msg []byte, f func(typ, class uint16, ttl int)) error {
+	off, err := questionEnd(msg)
+	if err != nil {
+		return err
+	}
+	count := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	for i := 0; i < count; i++ {
+		_, end, err := readName(msg, off)
+		if err != nil {
+			return err
+		}
+		// TYPE CLASS TTL RDLENGTH RDATA
+		if end+10 > len(msg) {
+			return errMessage
+		}
+		f(binary.BigEndian.Uint16(msg[end:]), binary.BigEndian.Uint16(msg[end+2:]), end+4)
+		if off = end + 10 + int(binary.BigEndian.Uint16(msg[end+8:])); off > len(msg) {
+			return errMessage
+		}
+	}
+	return nil
+}
+
+// UDPSize returns the size of the largest response over UDP that query
+// accepts: 512 bytes, or more with EDNS.
+func UDPSize(query []byte) int {
+	size := minUDPSize
+	records(query, func(typ, class uint16, _ int) {
+		if typ == typeOPT && int(class) > size {
+			size = int(class) // the class of OPT is the size
+		}
+	})
+	return size
+}
+
+// Truncate returns the header and the questions of resp with the TC bit, for
+// a client to ask again over TCP.
+func Truncate(resp []byte) ([]byte, error) {
+	end, err := questionEnd(resp)
+	if err != nil {
+		return nil, err
+	}
+	b := append([]byte{}, resp[:end]...)
+	b[2] |= 0x02 // TC
+	binary.BigEndian.PutUint16(b[6:], 0)
+	binary.BigEndian.PutUint16(b[8:], 0)
+	binary.BigEndian.PutUint16(b[10:], 0)
+	return b, nil
+}
+
+// Answer returns the response to query, of question q, with a record of ip
+// and ttl, or with none if ip is nil.
+func Answer(query []byte, q Question, ip net.IP, ttl uint32) ([]byte, error) {
+	end, err := questionEnd(query)
+	if err != nil {
+		return nil, err
+	}
+	b := append([]byte{}, query[:end]...)
+	b[2] = b[2]&0x79 | 0x80 // QR, with the opcode and RD of the query
+	b[3] = 0x80             // RA, no error
+	binary.BigEndian.PutUint16(b[6:], 0)
+	binary.BigEndian.PutUint16(b[8:], 0)
+	binary.BigEndian.PutUint16(b[10:], 0)
+	if ip == nil {
+		return b, nil
+	}
+	if q.Type == TypeA {
+		ip = ip.To4()
+	}
+	binary.BigEndian.PutUint16(b[6:], 1)
+	rr := make([]byte, 12, 12+len(ip))
+	binary.BigEndian.PutUint16(rr, 0xC000|headerLen) // the name of the question
+	binary.BigEndian.PutUint16(rr[2:], q.Type)
+	binary.BigEndian.PutUint16(rr[4:], q.Class)
+	binary.BigEndian.PutUint32(rr[6:], ttl)
+	binary.BigEndian.PutUint16(rr[10:], uint16(len(ip)))
+	return append(append(b, rr...), ip...), nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/proxy"
+)
+
+// relays are the TCP connections accepted by the listeners, so that shutdown
+// can wait for them to finish.
+var relays = &proxy.Conns{}
+
+// handleSignals calls reload on SIGHUP until SIGINT or SIGTERM. Then it
+// closes the listeners of running, which ends their UDP associations, and
+// gives the relays grace to finish before it closes them. A second SIGINT or
+// SIGTERM ends the grace period early.
+func handleSignals(sigCh <-chan os.Signal, running *services, reload func(), grace time.Duration) {
+	for sig := range sigCh {
+		if sig == syscall.SIGHUP {
+			reload()
+			continue
+		}
+		break
+	}
+
+	logger.Info("shutting down", "grace", grace)
+	running.closeListeners()
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	idle := relays.Idle()
+wait:
+	for {
+		select {
+		case <-idle:
+			break wait
+		case <-timer.C:
+			break wait
+		case sig := <-sigCh:
+			if sig != syscall.SIGHUP {
+				break wait
+			}
+		}
+	}
+	if n := relays.CloseAll(); n > 0 {
+		logger.Warn("closed relays that did not finish in time", "relays", n)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/proxy"
+)
+
+// slowServer sends chunks of size bytes every interval, and then closes.
+func slowServer(t *testing.T, chunks, size int, interval time.Duration) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				chunk := bytes.Repeat([]byte{'x'}, size)
+				for i := 0; i < chunks; i++ {
+					if _, err := c.Write(chunk); err != nil {
+						return
+					}
+					time.Sleep(interval)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startTunnel runs a server and a client with a TCP tunnel to target, and
+// returns the address of the tunnel.
+func startTunnel(t *testing.T, target string) (*services, string) {
+	// Relays of earlier tests would hold up the shutdown.
+	select {
+	case <-relays.Idle():
+	case <-time.After(10 * time.Second):
+		t.Fatal("relays of earlier tests still running")
+	}
+
+	server := ServerConfig{Listen: freeAddr(t), Cipher: "AEAD_CHACHA20_POLY1305", Password: "pw",
+		ACL: []string{"allow 127.0.0.1"}} // the targets of the tests are local
+	tun := freeAddr(t)
+	client := ClientConfig{Server: server.Listen, Cipher: server.Cipher, Password: server.Password,
+		TCPTun: []Tunnel{{Listen: tun, Target: target}}}
+
+	running := newServices(proxy.Options{Conns: relays})
+	t.Cleanup(func() { running.apply(&Config{}) })
+	if err := running.apply(&Config{Clients: []ClientConfig{client}, Servers: []ServerConfig{server}}); err != nil {
+		t.Fatal(err)
+	}
+	return running, tun
+}
+
+// shutdownOnSIGTERM sends SIGTERM to the process and returns a channel that
+// is closed when handleSignals has shut running down.
+func shutdownOnSIGTERM(t *testing.T, running *services, grace time.Duration) <-chan struct{} {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM)
+	t.Cleanup(func() { signal.Stop(sigCh) })
+
+	done := make(chan struct{})
+	go func() {
+		handleSignals(sigCh, running, func() {}, grace)
+		close(done)
+	}()
+
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	return done
+}
+
+func TestDownloadSurvivesSIGTERM(t *testing.T) {
+	const chunks, size = 10, 1000
+	running, tun := startTunnel(t, slowServer(t, chunks, size, 50*time.Millisecond))
+
+	c, err := net.Dial("tcp", tun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(20 * time.Second))
+	if _, err = io.ReadFull(c, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	grace := 15 * time.Second
+	done := shutdownOnSIGTERM(t, running, grace)
+
+	// The listener closes at once...
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		probe, err := net.Dial("tcp", tun)
+		if err != nil {
+			break
+		}
+		probe.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel still accepts after SIGTERM")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// ...and the download carries on to the end.
+	if _, err = io.ReadFull(c, make([]byte, (chunks-1)*size)); err != nil {
+		t.Fatalf("download after SIGTERM: %v", err)
+	}
+	c.Close()
+
+	select {
+	case <-done:
+	case <-time.After(grace):
+		t.Fatal("shutdown did not finish")
+	}
+	if elapsed := time.Since(start); elapsed >= grace {
+		t.Errorf("shutdown took the whole grace period, %v", elapsed)
+	}
+}
+
+func TestGracePeriodEnds(t *testing.T) {
+	running, tun := startTunnel(t, slowServer(t, 100, 1000, 50*time.Millisecond))
+
+	c, err := net.Dial("tcp", tun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(20 * time.Second))
+	if _, err = io.ReadFull(c, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	done := shutdownOnSIGTERM(t, running, 200*time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish after the grace period")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("shutdown after %v, before the grace period ended", elapsed)
+	}
+
+	// The relay was closed in the middle of the download.
+	rest, _ := io.ReadAll(c)
+	if len(rest) >= 99*1000 {
+		t.Errorf("download finished, %d bytes", len(rest))
+	}
+}
@@ -6,12 +6,14 @@ require (
 	github.com/OperatorFoundation/go-bloom v1.0.1
 	github.com/aead/ecdh v0.2.0
 	github.com/stretchr/testify v1.8.4
+	golang.org/x/crypto v0.13.0
+	gopkg.in/yaml.v3 v3.0.1
+	lukechampine.com/blake3 v1.2.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/objx v0.5.0 // indirect
-	golang.org/x/crypto v0.13.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	golang.org/x/sys v0.12.0 // indirect
 )
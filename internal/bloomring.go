@@ -84,9 +84,15 @@ func LoadOrCreateBloomRing(filePath string, slot int, capacity int, falsePositiv
 }
 
 func (r *BloomRing) Save(filePath string) error {
+	if r == nil {
+		return nil
+	}
+
 	var buffer bytes.Buffer
 	enc := gob.NewEncoder(&buffer)
+	r.mutex.RLock()
 	encodeError := enc.Encode(r)
+	r.mutex.RUnlock()
 	if encodeError != nil {
 		log.Fatal("encode:", encodeError)
 		return encodeError
@@ -142,12 +148,31 @@ func (r *BloomRing) test(b []byte) bool {
 	return false
 }
 
+// Check returns true if b is already in the ring, otherwise it adds b.
+// The test and the add happen atomically.
 func (r *BloomRing) Check(b []byte) bool {
+	if r == nil {
+		return false
+	}
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	if r.Test(b) {
+	if r.test(b) {
 		return true
 	}
-	r.Add(b)
+	r.add(b)
 	return false
 }
+
+// Fill returns how full the current slot is, from 0 to 1. When the slot is
+// full, the ring moves on and forgets the entries of its oldest slot.
+func (r *BloomRing) Fill() float64 {
+	if r == nil {
+		return 0
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.EntryCounter >= r.SlotCapacity {
+		return 1
+	}
+	return float64(r.EntryCounter) / float64(r.SlotCapacity)
+}
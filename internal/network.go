@@ -1,6 +1,51 @@
 package internal
 
-import "net"
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// aLongTimeAgo is a deadline in the past, to fail the pending reads and
+// writes of a connection at once.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// WatchContext makes the reads and writes on conn fail when ctx is done or
+// reaches its deadline, until stop is called. stop clears the deadline of conn
+// and returns ctx.Err(), so that an I/O error can be reported as the
+// cancellation that caused it. Past the deadline of ctx, stop returns
+// context.DeadlineExceeded even if ctx has not noticed yet: the deadline of
+// conn can fire first.
+func WatchContext(ctx context.Context, conn net.Conn) (stop func() error) {
+	if ctx.Done() == nil {
+		return func() error { return nil }
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+	return func() error {
+		close(done)
+		<-exited
+		conn.SetDeadline(time.Time{})
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+		return nil
+	}
+}
 
 func ReadFully(conn net.Conn, buffer []byte) error {
 	bytesRead, readError := conn.Read(buffer)
@@ -0,0 +1,51 @@
+package internal
+
+// ReplayWindowSize is the number of packet counters tracked by a ReplayWindow.
+const ReplayWindowSize = 1024
+
+// ReplayWindow rejects packet counters that were already seen or are too old.
+// The zero value is ready to use. It is not safe for concurrent use.
+type ReplayWindow struct {
+	started bool
+	last    uint64
+	bitmap  [ReplayWindowSize / 64]uint64
+}
+
+// Accept returns false if counter is a replay or falls behind the window,
+// otherwise it marks counter as seen.
+func (w *ReplayWindow) Accept(counter uint64) bool {
+	if !w.started || counter > w.last {
+		if !w.started || counter-w.last >= ReplayWindowSize {
+			w.bitmap = [ReplayWindowSize / 64]uint64{}
+		} else {
+			for i := w.last + 1; i < counter; i++ {
+				w.clear(i)
+			}
+		}
+		w.started = true
+		w.last = counter
+		w.set(counter)
+		return true
+	}
+
+	if w.last-counter >= ReplayWindowSize || w.isSet(counter) {
+		return false
+	}
+	w.set(counter)
+	return true
+}
+
+func (w *ReplayWindow) set(i uint64) {
+	i %= ReplayWindowSize
+	w.bitmap[i/64] |= 1 << (i % 64)
+}
+
+func (w *ReplayWindow) clear(i uint64) {
+	i %= ReplayWindowSize
+	w.bitmap[i/64] &^= 1 << (i % 64)
+}
+
+func (w *ReplayWindow) isSet(i uint64) bool {
+	i %= ReplayWindowSize
+	return w.bitmap[i/64]&(1<<(i%64)) != 0
+}
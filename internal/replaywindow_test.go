@@ -0,0 +1,28 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/internal"
+)
+
+func TestReplayWindow(t *testing.T) {
+	var w internal.ReplayWindow
+	for _, step := range []struct {
+		counter uint64
+		accept  bool
+	}{
+		{0, true},
+		{0, false},
+		{5, true},
+		{3, true},
+		{3, false},
+		{5 + internal.ReplayWindowSize, true},
+		{5, false}, // fell behind the window
+		{6 + internal.ReplayWindowSize, true},
+	} {
+		if got := w.Accept(step.counter); got != step.accept {
+			t.Errorf("accept(%d) = %v, want %v", step.counter, got, step.accept)
+		}
+	}
+}
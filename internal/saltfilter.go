@@ -5,6 +5,7 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"time"
 )
 
 // Those suggest value are all set according to
@@ -20,12 +21,20 @@ const (
 const EnvironmentPrefix = "SHADOWSOCKS_"
 const FilePath = "bloomfilter.gob"
 
+// saveDelay bounds how often the salt filter is written to FilePath.
+// Writes are coalesced so that a burst of new connections causes one save.
+const saveDelay = time.Second
+
 // A shared instance used for checking salt repeat
 var saltfilter *BloomRing
 
 // Used to initialize the saltfilter singleton only once.
 var initSaltfilterOnce sync.Once
 
+// Pending save of the saltfilter, nil when no save is scheduled.
+var saveTimer *time.Timer
+var saveMutex sync.Mutex
+
 // GetSaltFilterSingleton returns the BloomRing singleton,
 // initializing it on first call.
 func getSaltFilterSingleton() *BloomRing {
@@ -79,9 +88,40 @@ func TestSalt(b []byte) bool {
 // AddSalt salt to filter
 func AddSalt(b []byte) {
 	getSaltFilterSingleton().Add(b)
-	getSaltFilterSingleton().Save(FilePath)
+	scheduleSave()
 }
 
 func CheckSalt(b []byte) bool {
 	return getSaltFilterSingleton().Test(b)
 }
+
+// CheckAndAddSalt returns true if salt is repeated, otherwise it adds salt to
+// the filter. Unlike calling CheckSalt and then AddSalt, two concurrent callers
+// with the same salt cannot both see it as new.
+func CheckAndAddSalt(b []byte) bool {
+	if getSaltFilterSingleton().Check(b) {
+		return true
+	}
+	scheduleSave()
+	return false
+}
+
+// SaltFilterFill returns how full the current slot of the salt filter is, from
+// 0 to 1. It is 0 if the salt filter is disabled.
+func SaltFilterFill() float64 {
+	return getSaltFilterSingleton().Fill()
+}
+
+func scheduleSave() {
+	saveMutex.Lock()
+	defer saveMutex.Unlock()
+	if saveTimer != nil {
+		return
+	}
+	saveTimer = time.AfterFunc(saveDelay, func() {
+		saveMutex.Lock()
+		saveTimer = nil
+		saveMutex.Unlock()
+		_ = getSaltFilterSingleton().Save(FilePath)
+	})
+}
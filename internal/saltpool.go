@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// SaltPool remembers every salt it has seen for a fixed retention period.
+// Unlike the Bloom filter it has no false positives, and entries expire, which
+// is what the replay protection window of Shadowsocks 2022 requires.
+type SaltPool struct {
+	retention time.Duration
+	mutex     sync.Mutex
+	salts     map[string]time.Time
+	lastPrune time.Time
+}
+
+func NewSaltPool(retention time.Duration) *SaltPool {
+	return &SaltPool{
+		retention: retention,
+		salts:     make(map[string]time.Time),
+		lastPrune: time.Now(),
+	}
+}
+
+// Check returns true if salt was seen within the retention period, otherwise it
+// records salt.
+func (p *SaltPool) Check(salt []byte) bool {
+	now := time.Now()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if now.Sub(p.lastPrune) > p.retention {
+		for s, seen := range p.salts {
+			if now.Sub(seen) > p.retention {
+				delete(p.salts, s)
+			}
+		}
+		p.lastPrune = now
+	}
+
+	if seen, ok := p.salts[string(salt)]; ok && now.Sub(seen) <= p.retention {
+		return true
+	}
+	p.salts[string(salt)] = now
+	return false
+}
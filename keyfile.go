@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/darkstar"
+)
+
+// readServerKeys returns the DarkStar private keys in path. path is either a
+// single key file or a directory, where every *.priv file is a key.
+func readServerKeys(path string) ([][]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		files, err = filepath.Glob(filepath.Join(path, "*.priv"))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, errors.New("no *.priv key files in " + path)
+		}
+	}
+
+	keys := make([][]byte, 0, len(files))
+	for _, file := range files {
+		keyBytes, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, keyBytes)
+	}
+	return keys, nil
+}
+
+func encodeKeys(keys [][]byte) []string {
+	keyStrings := make([]string, 0, len(keys))
+	for _, key := range keys {
+		keyStrings = append(keyStrings, base64.StdEncoding.EncodeToString(key))
+	}
+	return keyStrings
+}
+
+// reloadServerKeys re-reads the keys in path, so that keys can be added to or
+// retired from a key directory while the server keeps running.
+func reloadServerKeys(server *darkstar.DarkStarServer, path string) error {
+	keys, err := readServerKeys(path)
+	if err != nil {
+		return err
+	}
+	if err = server.SetKeys(encodeKeys(keys)); err != nil {
+		return err
+	}
+	logger.Info("reloaded keys", "path", path, "keys", len(keys))
+	return nil
+}
@@ -1,31 +1,21 @@
 package main
 
 import (
-	"fmt"
-	"log"
 	"os"
-)
+	"strings"
 
-var logger = log.New(os.Stderr, "", log.Lshortfile|log.LstdFlags)
+	"github.com/OperatorFoundation/go-shadowsocks2/logging"
+)
 
-func logf(f string, v ...interface{}) {
-	if config.Verbose {
-		logger.Output(2, fmt.Sprintf(f, v...))
-	}
-}
+// logger is configured by -loglevel, -logformat and -verbose.
+var logger = logging.New(os.Stderr, logging.Info, logging.Logfmt)
 
-type logHelper struct {
-	prefix string
+// logWriter logs each write as one record, for the output of the plugin.
+type logWriter struct {
+	log *logging.Logger
 }
 
-func (l *logHelper) Write(p []byte) (n int, err error) {
-	if config.Verbose {
-		logger.Printf("%s%s\n", l.prefix, p)
-		return len(p), nil
-	}
+func (w *logWriter) Write(p []byte) (n int, err error) {
+	w.log.Debug("plugin output", "line", strings.TrimRight(string(p), "\n"))
 	return len(p), nil
 }
-
-func newLogHelper(prefix string) *logHelper {
-	return &logHelper{prefix}
-}
@@ -0,0 +1,210 @@
+// Package logging is a small leveled logger that writes one structured record
+// per line, in logfmt or JSON.
+//
+//	logger := logging.New(os.Stderr, logging.Info, logging.Logfmt)
+//	conn := logger.With("conn", 7)
+//	conn.Info("proxy", "from", "192.0.2.1:51234", "to", "example.com:443")
+//
+// writes
+//
+//	time=2024-05-01T12:00:00.000Z level=info msg=proxy conn=7 from=192.0.2.1:51234 to=example.com:443
+//
+// A nil *Logger discards everything, so packages can log unconditionally.
+// Never pass keys, passwords or shared secrets as values.
+package logging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Level is the severity of a record.
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named s: debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, errors.New("unknown log level " + strconv.Quote(s))
+}
+
+// Format is how records are written.
+type Format int
+
+const (
+	Logfmt Format = iota
+	JSON
+)
+
+// ParseFormat returns the format named s: logfmt or json.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "logfmt", "text":
+		return Logfmt, nil
+	case "json":
+		return JSON, nil
+	}
+	return 0, errors.New("unknown log format " + strconv.Quote(s))
+}
+
+// output is shared by a Logger and the Loggers derived from it with With.
+type output struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	level  Level
+	format Format
+}
+
+// Logger writes records at or above its level. It is safe for concurrent use.
+type Logger struct {
+	out    *output
+	fields []interface{} // key value pairs added to every record
+}
+
+// New returns a Logger that writes records of level and above to w.
+func New(w io.Writer, level Level, format Format) *Logger {
+	return &Logger{out: &output{w: w, level: level, format: format}}
+}
+
+// With returns a Logger that adds the key value pairs keyvals to every record.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(append(fields, l.fields...), keyvals...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Enabled reports whether records of level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && level >= l.out.level
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.log(Debug, msg, keyvals) }
+func (l *Logger) Info(msg string, keyvals ...interface{})  { l.log(Info, msg, keyvals) }
+func (l *Logger) Warn(msg string, keyvals ...interface{})  { l.log(Warn, msg, keyvals) }
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.log(Error, msg, keyvals) }
+
+// timeNow is the clock of records, replaceable in tests.
+var timeNow = time.Now
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	pairs := make([]interface{}, 0, 6+len(l.fields)+len(keyvals))
+	pairs = append(pairs, "time", timeNow().UTC().Format("2006-01-02T15:04:05.000Z07:00"), "level", level.String(), "msg", msg)
+	pairs = append(append(pairs, l.fields...), keyvals...)
+	if len(pairs)%2 != 0 {
+		pairs = append(pairs, "(missing)")
+	}
+
+	var b strings.Builder
+	if l.out.format == JSON {
+		writeJSON(&b, pairs)
+	} else {
+		writeLogfmt(&b, pairs)
+	}
+	b.WriteByte('\n')
+
+	l.out.mutex.Lock()
+	defer l.out.mutex.Unlock()
+	io.WriteString(l.out.w, b.String())
+}
+
+// value returns the text of a value: errors and Stringers by their text, and
+// everything else as fmt prints it.
+func value(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "<nil>"
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(v)
+}
+
+func writeLogfmt(b *strings.Builder, pairs []interface{}) {
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(value(pairs[i]))
+		b.WriteByte('=')
+		s := value(pairs[i+1])
+		if needsQuotes(s) {
+			s = strconv.Quote(s)
+		}
+		b.WriteString(s)
+	}
+}
+
+func needsQuotes(s string) bool {
+	if s == "" || !utf8.ValidString(s) {
+		return true
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(b *strings.Builder, pairs []interface{}) {
+	b.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(value(pairs[i]))
+		b.Write(key)
+		b.WriteByte(':')
+
+		var val []byte
+		var err error
+		switch v := pairs[i+1].(type) {
+		case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+			val, err = json.Marshal(v)
+		default:
+			err = errors.New("not a JSON scalar")
+		}
+		if err != nil { // NaN and infinities have no JSON number either
+			val, _ = json.Marshal(value(pairs[i+1]))
+		}
+		b.Write(val)
+	}
+	b.WriteByte('}')
+}
@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func fixTime(t *testing.T) {
+	timeNow = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+	t.Cleanup(func() { timeNow = time.Now })
+}
+
+func TestLogfmt(t *testing.T) {
+	fixTime(t)
+	var buf bytes.Buffer
+	logger := New(&buf, Info, Logfmt).With("conn", 7)
+
+	logger.Debug("hidden")
+	logger.Info("proxy", "to", "example.com:443", "err", errors.New("connection reset"), "empty", "")
+
+	want := `time=2024-05-01T12:00:00.000Z level=info msg=proxy conn=7 to=example.com:443 err="connection reset" empty=""` + "\n"
+	if buf.String() != want {
+		t.Errorf("got  %q\nwant %q", buf.String(), want)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	fixTime(t)
+	var buf bytes.Buffer
+	New(&buf, Debug, JSON).With("conn", 7).Warn("quota \"exceeded\"", "bytes", uint64(10), "odd")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("%v: %s", err, buf.Bytes())
+	}
+	for key, want := range map[string]interface{}{
+		"level": "warn", "msg": "quota \"exceeded\"", "conn": 7.0, "bytes": 10.0, "odd": "(missing)",
+	} {
+		if record[key] != want {
+			t.Errorf("%s = %v, want %v", key, record[key], want)
+		}
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var logger *Logger
+	logger.With("conn", 1).Error("discarded")
+	if logger.Enabled(Error) {
+		t.Error("nil logger is enabled")
+	}
+}
+
+func TestParse(t *testing.T) {
+	if level, err := ParseLevel("WARN"); err != nil || level != Warn {
+		t.Errorf("ParseLevel = %v, %v", level, err)
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("ParseLevel accepted an unknown level")
+	}
+	if format, err := ParseFormat("json"); err != nil || format != JSON {
+		t.Errorf("ParseFormat = %v, %v", format, err)
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -20,252 +19,251 @@ import (
 	"github.com/aead/ecdh"
 
 	"github.com/OperatorFoundation/go-shadowsocks2/core"
-	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+	"github.com/OperatorFoundation/go-shadowsocks2/logging"
+	"github.com/OperatorFoundation/go-shadowsocks2/proxy"
+	"github.com/OperatorFoundation/go-shadowsocks2/traffic"
 )
 
-var config struct {
-	Verbose    bool
-	UDPTimeout time.Duration
-	TCPCork    bool
+// flagValues are the command line flags.
+type flagValues struct {
+	Config           string
+	Client           string
+	Server           string
+	Cipher           string
+	Key              string
+	Password         string
+	Keygen           int
+	Socks            string
+	RedirTCP         string
+	RedirTCP6        string
+	TProxy           string
+	DNS              string
+	DNSUpstream      string
+	DNSOverUDP       bool
+	FakeIP           string
+	TCPTun           string
+	UDPTun           string
+	UDPSocks         bool
+	UDP              bool
+	TCP              bool
+	Plugin           string
+	PluginOpts       string
+	KeyFile          string
+	Users            string
+	Traffic          string
+	API              string
+	APIToken         string
+	Metrics          string
+	Verbose          bool
+	LogLevel         string
+	LogFormat        string
+	UDPTimeout       time.Duration
+	TCPCork          bool
+	Grace            time.Duration
+	HandshakeTimeout time.Duration
+
+	Outbound          string
+	OutboundIP        string
+	OutboundInterface string
+	ACL               string
+	Route             string
+	RouteFile         string
+	Balance           string
+	HealthCheck       time.Duration
+	Mux               int
+	UDPOverTCP        bool
+	SocksAuth         string
+	ServerReplies     bool
 }
 
 func main() {
 
-	var flags struct {
-		Client     string
-		Server     string
-		Cipher     string
-		Key        string
-		Password   string
-		Keygen     int
-		Socks      string
-		RedirTCP   string
-		RedirTCP6  string
-		TCPTun     string
-		UDPTun     string
-		UDPSocks   bool
-		UDP        bool
-		TCP        bool
-		Plugin     string
-		PluginOpts string
-		KeyFile    string
-	}
+	var flags flagValues
 
-	flag.BoolVar(&config.Verbose, "verbose", false, "verbose mode")
+	flag.StringVar(&flags.Config, "config", "", "JSON or YAML (*.yaml, *.yml) configuration file of clients and servers; flags override it")
+	flag.BoolVar(&flags.Verbose, "verbose", false, "verbose mode, the same as -loglevel debug")
+	flag.StringVar(&flags.LogLevel, "loglevel", "info", "log level: debug, info, warn or error")
+	flag.StringVar(&flags.LogFormat, "logformat", "logfmt", "log format: logfmt or json")
 	flag.StringVar(&flags.Cipher, "cipher", "DarkStar", "available ciphers: "+strings.Join(core.ListCipher(), " "))
 	flag.StringVar(&flags.Key, "key", "", "base64url-encoded key (derive from password if empty)")
 	flag.IntVar(&flags.Keygen, "keygen", 0, "generate a random key of given length in byte")
 	flag.StringVar(&flags.Password, "password", "", "password")
 	flag.StringVar(&flags.Server, "s", "", "server listen address or url")
-	flag.StringVar(&flags.Client, "c", "", "client connect address or url")
-	flag.StringVar(&flags.Socks, "socks", "", "(client-only) SOCKS listen address")
+	flag.StringVar(&flags.Client, "c", "", "client connect address or url, or a comma-separated list of them to balance TCP over")
+	flag.StringVar(&flags.Balance, "balance", "round-robin", "(client-only) how to pick the server of a TCP connection among several: round-robin, least-connections or latency")
+	flag.DurationVar(&flags.HealthCheck, "healthcheck", proxy.DefaultHealthCheck, "(client-only) interval of the health checks of several servers")
+	flag.IntVar(&flags.Mux, "mux", 0, "(client-only) carry the TCP connections to each server over this many multiplexed sessions, 0 for a connection each")
+	flag.StringVar(&flags.Socks, "socks", "", "(client-only) SOCKS (and HTTP proxy) listen address")
+	flag.StringVar(&flags.SocksAuth, "socksauth", "", "(client-only) username:password that the SOCKS clients must give")
+	flag.BoolVar(&flags.ServerReplies, "serverreplies", false, "(client-only) have the server report the outcome of each SOCKS request and relay BIND; the server must support it")
 	flag.BoolVar(&flags.UDPSocks, "u", false, "(client-only) Enable UDP support for SOCKS")
+	flag.BoolVar(&flags.UDPOverTCP, "udpovertcp", false, "(client-only) carry UDP in TCP connections to the server, for -u, -udptun and -tproxy")
 	flag.StringVar(&flags.RedirTCP, "redir", "", "(client-only) redirect TCP from this address")
 	flag.StringVar(&flags.RedirTCP6, "redir6", "", "(client-only) redirect TCP IPv6 from this address")
+	flag.StringVar(&flags.TProxy, "tproxy", "", "(client-only) relay the TCP and UDP diverted by Netfilter TPROXY to this address")
+	flag.StringVar(&flags.DNS, "dns", "", "(client-only) DNS listen address, for UDP and TCP, forwarding the queries through the server")
+	flag.StringVar(&flags.DNSUpstream, "dnsupstream", proxy.DefaultDNSUpstream, "(client-only) resolver that -dns forwards the queries to")
+	flag.BoolVar(&flags.DNSOverUDP, "dnsoverudp", false, "(client-only) forward the queries of -dns through the UDP relay instead of DNS over TCP")
+	flag.StringVar(&flags.FakeIP, "fakeip", "", "(client-only) answer the IPv4 queries of -dns with fake addresses of this network (e.g. 198.18.0.0/15), and connect to their names")
 	flag.StringVar(&flags.TCPTun, "tcptun", "", "(client-only) TCP tunnel (laddr1=raddr1,laddr2=raddr2,...)")
 	flag.StringVar(&flags.UDPTun, "udptun", "", "(client-only) UDP tunnel (laddr1=raddr1,laddr2=raddr2,...)")
+	flag.StringVar(&flags.Route, "route", "", "(client-only) routing rules on the TCP targets, separated by semicolons (e.g. \"direct 192.168.0.0/16,@cn.txt; block ads.example.com\"); the rest go through the server")
+	flag.StringVar(&flags.RouteFile, "routefile", "", "(client-only) file of routing rules, one per line, after those of -route, reloaded on SIGHUP")
 	flag.StringVar(&flags.Plugin, "plugin", "", "Enable SIP003 plugin. (e.g., v2ray-plugin)")
 	flag.StringVar(&flags.PluginOpts, "plugin-opts", "", "Set SIP003 plugin options. (e.g., \"server;tls;host=mydomain.me\")")
 	flag.BoolVar(&flags.UDP, "udp", false, "(server-only) enable UDP support")
 	flag.BoolVar(&flags.TCP, "tcp", true, "(server-only) enable TCP support")
-	flag.BoolVar(&config.TCPCork, "tcpcork", false, "coalesce writing first few packets")
-	flag.DurationVar(&config.UDPTimeout, "udptimeout", 5*time.Minute, "UDP tunnel timeout")
-	flag.StringVar(&flags.KeyFile, "keyfile", "", "Loads the server's persistent public key (client) or private key (server)")
+	flag.BoolVar(&flags.TCPCork, "tcpcork", false, "coalesce writing first few packets")
+	flag.DurationVar(&flags.UDPTimeout, "udptimeout", 5*time.Minute, "UDP tunnel timeout")
+	flag.DurationVar(&flags.HandshakeTimeout, "handshaketimeout", time.Minute, "time for a TCP connection to complete its handshake, 0 for no limit")
+	flag.DurationVar(&flags.Grace, "grace", 30*time.Second, "on SIGINT or SIGTERM, time for the relays to finish before they are closed")
+	flag.StringVar(&flags.KeyFile, "keyfile", "", "Loads the server's persistent public key (client) or private key (server). A server also accepts a directory of *.priv keys, reloaded on SIGHUP")
+	flag.StringVar(&flags.Users, "users", "", "(server-only) JSON file of users for a multi-user server, reloaded on SIGHUP")
+	flag.StringVar(&flags.ACL, "acl", "", "(server-only) rules on the targets, separated by semicolons (e.g. \"allow 127.0.0.1 8080; deny 10.0.0.0/8\"); loopback and link-local are denied after them")
+	flag.StringVar(&flags.Outbound, "outbound", "", "(server-only) connect to targets through this proxy: socks5://host:port, http://host:port or ss://cipher:password@host:port")
+	flag.StringVar(&flags.OutboundIP, "outbound-ip", "", "(server-only) source IP of the connections to targets")
+	flag.StringVar(&flags.OutboundInterface, "outbound-interface", "", "(server-only) network interface of the connections to targets (Linux)")
+	flag.StringVar(&flags.Traffic, "traffic", "", "(server-only) count the traffic of each user and keep the counters in this file")
+	flag.StringVar(&flags.API, "api", "", "(server-only) serve the traffic counters over HTTP on this address (e.g. 127.0.0.1:8080; a bare :port listens on 127.0.0.1)")
+	flag.StringVar(&flags.APIToken, "apitoken", "", "(server-only) bearer token that the API requires; without one the API does not reset counters")
+	flag.StringVar(&flags.Metrics, "metrics", "", "serve Prometheus metrics over HTTP on this address at /metrics (e.g. 127.0.0.1:9100)")
 	flag.Parse()
 
 	if flags.Keygen > 0 {
-		if flags.Cipher == "DarkStar" {
-			keyExchange := ecdh.Generic(elliptic.P256())
-			serverPersistentPrivateKey, serverPersistentPublicKey, keyError := keyExchange.GenerateKey(rand.Reader)
-			if keyError != nil {
-				return
-			}
-
-			serverPersistentPublicKeyBytes, byteError := darkstar.PublicKeyToKeychainFormatBytes(serverPersistentPublicKey)
-			if byteError != nil {
-				return
-			}
-			serverPersistentPrivateKeyBytes := serverPersistentPrivateKey.([]byte)
-
-			writeError := os.WriteFile("DarkStarServer.priv", serverPersistentPrivateKeyBytes, 0600)
-			if writeError != nil {
-				return
-			}
-			writeError = os.WriteFile("DarkStarServer.pub", []byte(serverPersistentPublicKeyBytes), 0644)
-			if writeError != nil {
-				return
-			}
-
-			fmt.Println("server private key written to DarkStarServer.priv")
-			fmt.Println("server public key written to DarkStarServer.pub")
-
-			return
-		} else {
-			key := make([]byte, flags.Keygen)
-			_, readError := io.ReadFull(rand.Reader, key)
-			if readError != nil {
-				return
-			}
-			fmt.Println(base64.URLEncoding.EncodeToString(key))
-			return
-		}
-	}
-
-	if flags.Client == "" && flags.Server == "" {
-		flag.Usage()
+		keygen(flags.Keygen, flags.Cipher)
 		return
 	}
 
-	var key []byte
-	if flags.Key != "" {
-		k, err := base64.URLEncoding.DecodeString(flags.Key)
+	cfg := defaultConfig()
+	if flags.Config != "" {
+		var err error
+		cfg, err = loadConfig(flags.Config)
 		if err != nil {
 			log.Fatal(err)
 		}
-		key = k
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if err := cfg.applyFlags(&flags, set); err != nil {
+		log.Fatal(err)
 	}
 
-	if flags.KeyFile != "" {
-		if flags.Client != "" {
-			publicKeyBytes, publicKeyReadError := os.ReadFile(flags.KeyFile)
-			if publicKeyReadError != nil {
-				return
-			}
-
-			key = publicKeyBytes
-		} else {
-			privateKeyBytes, privateKeyReadError := os.ReadFile(flags.KeyFile)
-			if privateKeyReadError != nil {
-				return
-			}
+	level, err := logging.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Verbose {
+		level = logging.Debug
+	}
+	format, err := logging.ParseFormat(cfg.LogFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger = logging.New(os.Stderr, level, format)
+	darkstar.SetLogger(logger)
 
-			key = privateKeyBytes
-		}
+	if len(cfg.Clients) == 0 && len(cfg.Servers) == 0 {
+		flag.Usage()
+		return
 	}
 
-	if flags.Client != "" { // client mode
-		addr := flags.Client
-		cipher := flags.Cipher
-		password := flags.Password
-		var cipherError error
+	if cfg.Metrics != "" {
+		go serveMetrics(cfg.Metrics)
+	}
 
-		if strings.HasPrefix(addr, "ss://") {
-			addr, cipher, password, cipherError = parseURL(addr)
-			if cipherError != nil {
-				log.Fatal(cipherError)
-			}
+	if len(cfg.Servers) > 0 && (cfg.Traffic != "" || cfg.API != "") {
+		accountant, err = traffic.Open(cfg.Traffic)
+		if err != nil {
+			log.Fatal(err)
 		}
+		accountant.Token = cfg.APIToken
+		if cfg.API != "" {
+			go serveAPI(cfg.API)
+		}
+	}
 
-		udpAddr := addr
-
-		var ciph core.Cipher
-
-		if cipher == "DarkStar" {
-			parts := strings.Split(addr, ":")
-			host := parts[0]
-			var port int
-			port, cipherError = strconv.Atoi(parts[1])
-			if cipherError != nil {
-				log.Fatal(cipherError)
-			}
+	running := newServices(proxy.Options{
+		Logger:           logger,
+		Metrics:          exportedMetrics{},
+		Conns:            relays,
+		UDPTimeout:       time.Duration(cfg.UDPTimeout),
+		TCPCork:          cfg.TCPCork,
+		HandshakeTimeout: time.Duration(cfg.HandshakeTimeout),
+	})
+	if err := running.apply(cfg); err != nil {
+		log.Fatal(err)
+	}
 
-			keyString := base64.StdEncoding.EncodeToString(key)
-			ciph = darkstar.NewDarkStarClient(keyString, host, port)
-		} else {
-			ciph, cipherError = core.PickCipher(cipher, key, password)
-			if cipherError != nil {
-				log.Fatal(cipherError)
-			}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	handleSignals(sigCh, running, func() { reload(running, &flags, set) }, time.Duration(cfg.Grace))
+	killPlugins()
+	if accountant != nil {
+		if err := accountant.Save(); err != nil {
+			logger.Error("failed to save traffic counters", "err", err)
 		}
+	}
+}
 
-		if flags.Plugin != "" {
-			addr, cipherError = startPlugin(flags.Plugin, flags.PluginOpts, addr, false)
-			if cipherError != nil {
-				log.Fatal(cipherError)
-			}
+// keygen writes a new DarkStar key pair to the current directory, or prints a
+// random key of length bytes for other ciphers.
+func keygen(length int, cipher string) {
+	if cipher == "DarkStar" {
+		keyExchange := ecdh.Generic(elliptic.P256())
+		serverPersistentPrivateKey, serverPersistentPublicKey, keyError := keyExchange.GenerateKey(rand.Reader)
+		if keyError != nil {
+			return
 		}
 
-		if flags.UDPTun != "" {
-			for _, tun := range strings.Split(flags.UDPTun, ",") {
-				p := strings.Split(tun, "=")
-				go udpLocal(p[0], udpAddr, p[1], ciph.PacketConn)
-			}
+		serverPersistentPublicKeyBytes, byteError := darkstar.PublicKeyToKeychainFormatBytes(serverPersistentPublicKey)
+		if byteError != nil {
+			return
 		}
+		serverPersistentPrivateKeyBytes := serverPersistentPrivateKey.([]byte)
 
-		if flags.TCPTun != "" {
-			for _, tun := range strings.Split(flags.TCPTun, ",") {
-				p := strings.Split(tun, "=")
-				go tcpTun(p[0], addr, p[1], ciph.StreamConn)
-			}
+		writeError := os.WriteFile("DarkStarServer.priv", serverPersistentPrivateKeyBytes, 0600)
+		if writeError != nil {
+			return
 		}
-
-		if flags.Socks != "" {
-			socks.UDPEnabled = flags.UDPSocks
-			go socksLocal(flags.Socks, addr, ciph.StreamConn)
-			if flags.UDPSocks {
-				go udpSocksLocal(flags.Socks, udpAddr, ciph.PacketConn)
-			}
+		writeError = os.WriteFile("DarkStarServer.pub", []byte(serverPersistentPublicKeyBytes), 0644)
+		if writeError != nil {
+			return
 		}
 
-		if flags.RedirTCP != "" {
-			go redirLocal(flags.RedirTCP, addr, ciph.StreamConn)
-		}
+		fmt.Println("server private key written to DarkStarServer.priv")
+		fmt.Println("server public key written to DarkStarServer.pub")
+		return
+	}
 
-		if flags.RedirTCP6 != "" {
-			go redir6Local(flags.RedirTCP6, addr, ciph.StreamConn)
-		}
+	key := make([]byte, length)
+	_, readError := io.ReadFull(rand.Reader, key)
+	if readError != nil {
+		return
 	}
+	fmt.Println(base64.URLEncoding.EncodeToString(key))
+}
 
-	if flags.Server != "" { // server mode
-		addr := flags.Server
-		cipher := flags.Cipher
-		password := flags.Password
+// reload re-reads the configuration file and the key and users files, and
+// applies them to running. The global settings, such as logging, metrics and
+// traffic accounting, keep their values until a restart.
+func reload(running *services, flags *flagValues, set map[string]bool) {
+	cfg := defaultConfig()
+	if flags.Config != "" {
 		var err error
-
-		if strings.HasPrefix(addr, "ss://") {
-			addr, cipher, password, err = parseURL(addr)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-
-		udpAddr := addr
-
-		if flags.Plugin != "" {
-			addr, err = startPlugin(flags.Plugin, flags.PluginOpts, addr, true)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-
-		var ciph core.Cipher
-		if cipher == "DarkStar" {
-			parts := strings.Split(addr, ":")
-			host := parts[0]
-			var port int
-			port, err = strconv.Atoi(parts[1])
-			keyString := base64.StdEncoding.EncodeToString(key)
-			ciph = darkstar.NewDarkStarServer(keyString, host, port)
-		} else {
-			ciph, err = core.PickCipher(cipher, key, password)
-		}
-
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if flags.UDP {
-			go udpRemote(udpAddr, ciph.PacketConn)
-		}
-		if flags.TCP {
-			go tcpRemote(addr, ciph.StreamConn)
+		if cfg, err = loadConfig(flags.Config); err != nil {
+			logger.Error("failed to reload the configuration", "err", err)
+			return
 		}
 	}
-
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
-	killPlugin()
+	if err := cfg.applyFlags(flags, set); err != nil {
+		logger.Error("failed to reload the configuration", "err", err)
+		return
+	}
+	if err := running.apply(cfg); err != nil {
+		logger.Error("failed to reload the configuration", "err", err)
+		return
+	}
+	logger.Info("reloaded the configuration", "clients", len(cfg.Clients), "servers", len(cfg.Servers))
 }
 
 func parseURL(s string) (addr, cipher, password string, err error) {
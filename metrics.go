@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+	"github.com/OperatorFoundation/go-shadowsocks2/darkstar"
+	"github.com/OperatorFoundation/go-shadowsocks2/internal"
+	"github.com/OperatorFoundation/go-shadowsocks2/shadowaead"
+)
+
+// The metrics are always counted and served in the Prometheus text format by -metrics.
+var (
+	tcpRelays = newGauge("shadowsocks_tcp_relays",
+		"TCP connections being relayed.")
+	udpNATEntries = newGauge("shadowsocks_udp_nat_entries",
+		"UDP associations in the NAT tables.")
+	relayedBytes = newCounterVec("shadowsocks_relayed_bytes_total",
+		"Payload bytes relayed, by protocol and direction. Upload is from the client to the target.",
+		"protocol", "direction")
+	handshakes = newCounterVec("shadowsocks_server_handshakes_total",
+		"TCP connections to the server, by handshake result.",
+		"result")
+	blackholes = newCounterVec("shadowsocks_blackholed_connections_total",
+		"TCP connections to the server that were held open and ignored, by reason.",
+		"reason")
+	aclDenials = newCounterVec("shadowsocks_acl_denied_total",
+		"TCP connections and UDP packets to targets that the ACL of the server denied, by protocol and rule.",
+		"protocol", "rule")
+	pluginRestarts = newCounter("shadowsocks_plugin_restarts_total",
+		"Restarts of the SIP003 plugin after it exited.")
+	_ = newGaugeFunc("shadowsocks_salt_filter_fill_ratio",
+		"How full the current slot of the salt filter is. When it is full the oldest slot is forgotten.",
+		internal.SaltFilterFill)
+)
+
+func init() {
+	for _, protocol := range []string{"tcp", "udp"} {
+		relayedBytes.Add(0, protocol, "upload")
+		relayedBytes.Add(0, protocol, "download")
+	}
+	handshakes.Add(0, "success")
+	handshakes.Add(0, "failure")
+	for _, reason := range []string{"salt_replay", "bad_confirmation_code", "key_decode", "unknown_user", "other"} {
+		blackholes.Add(0, reason)
+	}
+}
+
+// blackholeReason returns the reason label of a blackholed connection.
+func blackholeReason(err error) string {
+	switch {
+	case errors.Is(err, shadowaead.ErrRepeatedSalt), errors.Is(err, darkstar.ErrRepeatedKey):
+		return "salt_replay"
+	case errors.Is(err, darkstar.ErrBadConfirmationCode):
+		return "bad_confirmation_code"
+	case errors.Is(err, darkstar.ErrBadPublicKey):
+		return "key_decode"
+	case errors.Is(err, core.ErrUnknownUser):
+		return "unknown_user"
+	}
+	return "other"
+}
+
+// metric is a metric that can write itself in the Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+var metrics []metric
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+type counter struct {
+	name, help string
+	value      uint64
+}
+
+func newCounter(name, help string) *counter {
+	c := &counter{name: name, help: help}
+	metrics = append(metrics, c)
+	return c
+}
+
+func (c *counter) Add(n uint64) { atomic.AddUint64(&c.value, n) }
+
+func (c *counter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, atomic.LoadUint64(&c.value))
+}
+
+// counterVec is a counter for each combination of label values.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mutex  sync.Mutex
+	values map[string]*uint64 // by rendered labels
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	v := &counterVec{name: name, help: help, labels: labels, values: make(map[string]*uint64)}
+	metrics = append(metrics, v)
+	return v
+}
+
+// Add adds n to the counter of values, one for each label.
+func (v *counterVec) Add(n uint64, values ...string) {
+	pairs := make([]string, len(v.labels))
+	for i, label := range v.labels {
+		pairs[i] = label + "=" + strconv.Quote(values[i])
+	}
+	key := "{" + strings.Join(pairs, ",") + "}"
+
+	v.mutex.Lock()
+	value, ok := v.values[key]
+	if !ok {
+		value = new(uint64)
+		v.values[key] = value
+	}
+	v.mutex.Unlock()
+	atomic.AddUint64(value, n)
+}
+
+func (v *counterVec) write(w io.Writer) {
+	v.mutex.Lock()
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	v.mutex.Unlock()
+	sort.Strings(keys)
+
+	writeHeader(w, v.name, v.help, "counter")
+	for _, key := range keys {
+		v.mutex.Lock()
+		value := v.values[key]
+		v.mutex.Unlock()
+		fmt.Fprintf(w, "%s%s %d\n", v.name, key, atomic.LoadUint64(value))
+	}
+}
+
+type gauge struct {
+	name, help string
+	value      int64
+}
+
+func newGauge(name, help string) *gauge {
+	g := &gauge{name: name, help: help}
+	metrics = append(metrics, g)
+	return g
+}
+
+func (g *gauge) Add(delta int64) { atomic.AddInt64(&g.value, delta) }
+
+func (g *gauge) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.name, atomic.LoadInt64(&g.value))
+}
+
+// gaugeFunc is a gauge whose value is read when the metrics are served.
+type gaugeFunc struct {
+	name, help string
+	value      func() float64
+}
+
+func newGaugeFunc(name, help string, value func() float64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, value: value}
+	metrics = append(metrics, g)
+	return g
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, strconv.FormatFloat(g.value(), 'g', -1, 64))
+}
+
+// exportedMetrics counts what the clients and servers do in the metrics above.
+type exportedMetrics struct{}
+
+func (exportedMetrics) TCPRelays(delta int)  { tcpRelays.Add(int64(delta)) }
+func (exportedMetrics) NATEntries(delta int) { udpNATEntries.Add(int64(delta)) }
+
+func (exportedMetrics) Relayed(protocol string, upload bool, n int) {
+	direction := "download"
+	if upload {
+		direction = "upload"
+	}
+	relayedBytes.Add(uint64(n), protocol, direction)
+}
+
+func (exportedMetrics) Handshake(err error) {
+	if err != nil {
+		handshakes.Add(1, "failure")
+	} else {
+		handshakes.Add(1, "success")
+	}
+}
+
+func (exportedMetrics) Blackholed(reason error)      { blackholes.Add(1, blackholeReason(reason)) }
+func (exportedMetrics) Denied(protocol, rule string) { aclDenials.Add(1, protocol, rule) }
+
+// metricsHandler serves the metrics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// serveMetrics serves the metrics on addr at /metrics.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	logger.Info("metrics listening", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Error("failed to serve metrics", "addr", addr, "err", err)
+	}
+}
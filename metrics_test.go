@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/acl"
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+	"github.com/OperatorFoundation/go-shadowsocks2/proxy"
+)
+
+// scrape returns the lines served by metricsHandler.
+func scrape(t *testing.T) []string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if got := w.Header().Get("Content-Type"); got != "text/plain; version=0.0.4" {
+		t.Errorf("content type %q", got)
+	}
+	return strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+}
+
+// samples returns the values of the samples in lines, by name and labels.
+func samples(t *testing.T, lines []string) map[string]float64 {
+	t.Helper()
+	values := make(map[string]float64)
+	for _, line := range lines {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if i < 0 || err != nil {
+			t.Fatalf("bad sample %q", line)
+		}
+		values[line[:i]] = value
+	}
+	return values
+}
+
+func TestMetrics(t *testing.T) {
+	for _, want := range []string{
+		"# HELP shadowsocks_tcp_relays TCP connections being relayed.",
+		"# TYPE shadowsocks_tcp_relays gauge",
+		"# HELP shadowsocks_udp_nat_entries UDP associations in the NAT tables.",
+		"# TYPE shadowsocks_udp_nat_entries gauge",
+		"# HELP shadowsocks_relayed_bytes_total Payload bytes relayed, by protocol and direction. Upload is from the client to the target.",
+		"# TYPE shadowsocks_relayed_bytes_total counter",
+		"# HELP shadowsocks_server_handshakes_total TCP connections to the server, by handshake result.",
+		"# TYPE shadowsocks_server_handshakes_total counter",
+		"# HELP shadowsocks_blackholed_connections_total TCP connections to the server that were held open and ignored, by reason.",
+		"# TYPE shadowsocks_blackholed_connections_total counter",
+		"# HELP shadowsocks_acl_denied_total TCP connections and UDP packets to targets that the ACL of the server denied, by protocol and rule.",
+		"# TYPE shadowsocks_acl_denied_total counter",
+		"# HELP shadowsocks_plugin_restarts_total Restarts of the SIP003 plugin after it exited.",
+		"# TYPE shadowsocks_plugin_restarts_total counter",
+		"# HELP shadowsocks_salt_filter_fill_ratio How full the current slot of the salt filter is. When it is full the oldest slot is forgotten.",
+		"# TYPE shadowsocks_salt_filter_fill_ratio gauge",
+		"shadowsocks_salt_filter_fill_ratio 0", // disabled by TestMain
+		`shadowsocks_blackholed_connections_total{reason="salt_replay"} 0`,
+	} {
+		found := false
+		for _, line := range scrape(t) {
+			found = found || line == want
+		}
+		if !found {
+			t.Errorf("missing line %q", want)
+		}
+	}
+
+	before := samples(t, scrape(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := acl.New([]string{"allow 127.0.0.1", "deny 192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &proxy.Server{Cipher: ciph, ACL: list, Options: proxy.Options{Metrics: exportedMetrics{}, Conns: relays}}
+	go server.ServeTCP(ctx, sl)
+	client := &proxy.Client{Server: sl.Addr().String(), Cipher: ciph, Options: proxy.Options{Conns: relays}}
+	tunnel := func(target string) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go client.ServeTCPTunnel(ctx, l, target)
+		return l.Addr().String()
+	}
+	dialEcho(t, tunnel(echoServer(t)), "hello") // open until the end
+	if c, err := net.Dial("tcp", tunnel("192.0.2.1:80")); err == nil {
+		c.Write([]byte("denied"))
+		defer c.Close()
+	}
+
+	// A plugin that exits once is restarted once.
+	dir := t.TempDir()
+	script := filepath.Join(dir, "plugin")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n[ -e \"$0.ran\" ] && exec sleep 60\ntouch \"$0.ran\"\nexit 1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	p, _, err := startPlugin(script, "", "127.0.0.1:8488", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopPlugin(p)
+
+	want := map[string]float64{
+		"shadowsocks_tcp_relays": 1,
+		`shadowsocks_relayed_bytes_total{protocol="tcp",direction="upload"}`:   5,
+		`shadowsocks_relayed_bytes_total{protocol="tcp",direction="download"}`: 5,
+		`shadowsocks_server_handshakes_total{result="success"}`:                2,
+		`shadowsocks_acl_denied_total{protocol="tcp",rule="deny 192.0.2.1"}`:   1,
+		"shadowsocks_plugin_restarts_total":                                    1,
+	}
+	var got map[string]float64
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		got = make(map[string]float64)
+		after := samples(t, scrape(t))
+		for name := range want {
+			got[name] = after[name] - before[name]
+		}
+		if equalSamples(got, want) {
+			return
+		}
+	}
+	t.Errorf("got the changes %v, want %v", got, want)
+}
+
+func equalSamples(a, b map[string]float64) bool {
+	for name, value := range b {
+		if a[name] != value {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
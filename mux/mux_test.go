@@ -0,0 +1,159 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pair returns the client and server sessions of a connection.
+func pair(t *testing.T) (*Session, *Session) {
+	left, right := net.Pipe()
+	client, server := Client(left), Server(right)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// echo echoes the streams that server accepts.
+func echo(server *Session) {
+	for {
+		st, err := server.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer st.Close()
+			io.Copy(st, st)
+		}()
+	}
+}
+
+func TestStreams(t *testing.T) {
+	client, server := pair(t)
+	go echo(server)
+
+	// More than a window each, so that the streams wait for credit.
+	data := make([]byte, 3*Window+1234)
+	rand.Read(data)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer st.Close()
+			go st.Write(data)
+			got := make([]byte, len(data))
+			st.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if _, err := io.ReadFull(st, got); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("data changed")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSlowStream(t *testing.T) {
+	client, server := pair(t)
+	accepted := make(chan *Stream, 2)
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- st
+		}
+	}()
+
+	// Nobody reads the first stream: its writes stop at the window.
+	slow, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := slow.Write(make([]byte, 2*Window))
+	if n != Window || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("wrote %d, %v, want %d and a timeout", n, err, Window)
+	}
+
+	// The others go on.
+	fast, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-accepted
+	remote := <-accepted
+	go fast.Write([]byte("hello"))
+	got := make([]byte, 5)
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(remote, got); err != nil || string(got) != "hello" {
+		t.Errorf("read %q, %v", got, err)
+	}
+
+	// Closing a stream ends the reads on the other side, and frees it.
+	fast.Close()
+	if _, err := remote.Read(got); err != io.EOF {
+		t.Errorf("read after close: %v, want EOF", err)
+	}
+	remote.Close()
+	if _, err := fast.Write([]byte("x")); err == nil {
+		t.Error("write after close succeeded")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for client.NumStreams() != 1 || server.NumStreams() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d and %d streams, want 1 each", client.NumStreams(), server.NumStreams())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server := pair(t)
+	go echo(server)
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := st.Read(make([]byte, 1))
+		done <- err
+	}()
+	server.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("read succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read still blocked")
+	}
+	if !client.IsClosed() {
+		t.Error("client still open")
+	}
+	if _, err := client.Open(); err == nil {
+		t.Error("opened a stream on a closed session")
+	}
+	if _, err := server.Accept(); !errors.Is(err, ErrClosed) {
+		t.Errorf("accept: %v, want %v", err, ErrClosed)
+	}
+}
@@ -0,0 +1,279 @@
+// Package mux carries many streams over one connection, such as an encrypted
+// DarkStar connection, so that a client opens its connections to a server
+// without a new handshake and a new flow each.
+//
+// A frame is a header of 8 bytes, then a payload:
+//
+//	+-----+-----+--------+-----------+---------+
+//	| VER | CMD | LENGTH | STREAM ID | PAYLOAD |
+//	+-----+-----+--------+-----------+---------+
+//	|  1  |  1  |   2    |     4     | LENGTH  |
+//	+-----+-----+--------+-----------+---------+
+//
+// The commands open a stream (SYN), carry data (PSH), end the data of one
+// side (FIN), abort a stream (RST) and give credit to the sender (UPD, with
+// the number of bytes as a 4-byte payload). Each side of a stream sends at
+// most Window bytes that the other has not read yet, so that a slow stream
+// does not hold up the others. Clients open streams with odd IDs, servers
+// with even ones.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const version = 1
+
+const (
+	cmdSYN byte = iota
+	cmdPSH
+	cmdFIN
+	cmdRST
+	cmdUPD
+)
+
+const headerSize = 8
+
+// maxPayload fits a frame into a single chunk of the AEAD and DarkStar
+// ciphers.
+const maxPayload = 0x3FFF - headerSize
+
+// Window is how many bytes a stream buffers that its reader has not read.
+const Window = 256 * 1024
+
+// acceptBacklog is how many opened streams wait for Accept; the next ones
+// are reset.
+const acceptBacklog = 1024
+
+var (
+	// ErrClosed is the error of a closed session.
+	ErrClosed = errors.New("mux: session closed")
+	// ErrReset is the error of a stream that the other side aborted.
+	ErrReset = errors.New("mux: stream reset")
+)
+
+// Session is the multiplexed side of a connection. It is safe for concurrent
+// use.
+type Session struct {
+	conn net.Conn
+
+	mutex   sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error // why the session closed
+
+	writeMutex sync.Mutex
+	accepts    chan *Stream
+	die        chan struct{}
+	closeOnce  sync.Once
+}
+
+// Client returns the session of the client side of conn.
+func Client(conn net.Conn) *Session {
+	return newSession(conn, 1)
+}
+
+// Server returns the session of the server side of conn.
+func Server(conn net.Conn) *Session {
+	return newSession(conn, 2)
+}
+
+func newSession(conn net.Conn, firstID uint32) *Session {
+	s := &Session{
+		conn:    conn,
+		streams: make(map[uint32]*Stream),
+		nextID:  firstID,
+		accepts: make(chan *Stream, acceptBacklog),
+		die:     make(chan struct{}),
+	}
+	go s.recvLoop()
+	return s
+}
+
+// Open opens a stream to the other side. It does not wait for the other side
+// to accept it.
+func (s *Session) Open() (*Stream, error) {
+	s.mutex.Lock()
+	if s.err != nil {
+		s.mutex.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mutex.Unlock()
+
+	if err := s.writeFrame(cmdSYN, id, nil); err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the other side to open a stream.
+func (s *Session) Accept() (*Stream, error) {
+	if s.IsClosed() {
+		return nil, s.closeErr()
+	}
+	select {
+	case st := <-s.accepts:
+		return st, nil
+	case <-s.die:
+		return nil, s.closeErr()
+	}
+}
+
+// Close closes the connection and all its streams.
+func (s *Session) Close() error {
+	s.closeWithError(ErrClosed)
+	return nil
+}
+
+// IsClosed reports whether the session is closed, by Close or by an error
+// of the connection.
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.streams)
+}
+
+// LocalAddr returns the local address of the connection.
+func (s *Session) LocalAddr() net.Addr { return s.conn.LocalAddr() }
+
+// RemoteAddr returns the remote address of the connection.
+func (s *Session) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.mutex.Lock()
+		s.err = err
+		s.mutex.Unlock()
+		close(s.die)
+		s.conn.Close()
+	})
+}
+
+func (s *Session) closeErr() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+func (s *Session) remove(id uint32) {
+	s.mutex.Lock()
+	delete(s.streams, id)
+	s.mutex.Unlock()
+}
+
+// writeFrame writes a frame in a single write to the connection.
+func (s *Session) writeFrame(cmd byte, id uint32, payload []byte) error {
+	buf := make([]byte, headerSize+len(payload))
+	buf[0], buf[1] = version, cmd
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:], id)
+	copy(buf[headerSize:], payload)
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	if s.IsClosed() {
+		return s.closeErr()
+	}
+	if _, err := s.conn.Write(buf); err != nil {
+		s.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+// recvLoop reads the frames of the connection and hands them to their
+// streams until the connection fails. It never blocks on a stream: the
+// windows bound what the streams buffer.
+func (s *Session) recvLoop() {
+	header := make([]byte, headerSize)
+	payload := make([]byte, 1<<16)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		cmd, length, id := header[1], int(binary.BigEndian.Uint16(header[2:])), binary.BigEndian.Uint32(header[4:])
+		if header[0] != version {
+			s.closeWithError(fmt.Errorf("mux: unknown version %d", header[0]))
+			return
+		}
+		if _, err := io.ReadFull(s.conn, payload[:length]); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		if err := s.handle(cmd, id, payload[:length]); err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handle(cmd byte, id uint32, payload []byte) error {
+	s.mutex.Lock()
+	st := s.streams[id]
+	s.mutex.Unlock()
+
+	switch cmd {
+	case cmdSYN:
+		s.mutex.Lock()
+		invalid := st != nil || id%2 == s.nextID%2 // taken, or for this side to open
+		if !invalid {
+			st = newStream(s, id)
+			s.streams[id] = st
+		}
+		s.mutex.Unlock()
+		if invalid {
+			return fmt.Errorf("mux: invalid stream ID %d", id)
+		}
+		select {
+		case s.accepts <- st:
+		default:
+			s.remove(id)
+			go s.writeFrame(cmdRST, id, nil)
+		}
+	case cmdPSH:
+		if st == nil {
+			go s.writeFrame(cmdRST, id, nil)
+			return nil
+		}
+		return st.push(payload)
+	case cmdFIN:
+		if st != nil {
+			st.remoteClose()
+		}
+	case cmdRST:
+		if st != nil {
+			st.reset()
+		}
+	case cmdUPD:
+		if len(payload) != 4 {
+			return errors.New("mux: invalid window update")
+		}
+		if st != nil {
+			st.credit(int(binary.BigEndian.Uint32(payload)))
+		}
+	default:
+		return fmt.Errorf("mux: unknown command %d", cmd)
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a connection carried by a Session. Close ends the data of this
+// side and discards what the other side still sends.
+type Stream struct {
+	session *Session
+	id      uint32
+
+	mutex      sync.Mutex
+	buf        bytes.Buffer // received, not read
+	unacked    int          // read, not credited to the other side
+	sendWindow int
+	localFIN   bool // sent, by Close
+	remoteFIN  bool
+	wasReset   bool
+
+	readable      chan struct{}
+	writable      chan struct{}
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		session:       s,
+		id:            id,
+		sendWindow:    Window,
+		readable:      make(chan struct{}, 1),
+		writable:      make(chan struct{}, 1),
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+	}
+}
+
+// notify wakes up a goroutine waiting on ch.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Read reads the data of the stream; it returns io.EOF once the other side
+// closed the stream and its data is read.
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mutex.Lock()
+		switch {
+		case st.localFIN:
+			st.mutex.Unlock()
+			return 0, io.ErrClosedPipe
+		case st.buf.Len() > 0:
+			n, _ := st.buf.Read(b)
+			st.unacked += n
+			credit := 0
+			if st.unacked >= Window/2 && !st.remoteFIN {
+				credit, st.unacked = st.unacked, 0
+			}
+			st.mutex.Unlock()
+			if credit > 0 {
+				st.sendCredit(credit)
+			}
+			return n, nil
+		case st.wasReset:
+			st.mutex.Unlock()
+			return 0, ErrReset
+		case st.remoteFIN:
+			st.mutex.Unlock()
+			return 0, io.EOF
+		}
+		st.mutex.Unlock()
+
+		select {
+		case <-st.readable:
+		case <-st.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-st.session.die:
+			return 0, st.session.closeErr()
+		}
+	}
+}
+
+// Write writes b in frames, as the window of the other side allows.
+func (st *Stream) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		select {
+		case <-st.writeDeadline.wait():
+			return n, os.ErrDeadlineExceeded
+		default:
+		}
+
+		st.mutex.Lock()
+		switch {
+		case st.localFIN:
+			st.mutex.Unlock()
+			return n, io.ErrClosedPipe
+		case st.wasReset:
+			st.mutex.Unlock()
+			return n, ErrReset
+		case st.sendWindow == 0:
+			st.mutex.Unlock()
+			select {
+			case <-st.writable:
+			case <-st.writeDeadline.wait():
+				return n, os.ErrDeadlineExceeded
+			case <-st.session.die:
+				return n, st.session.closeErr()
+			}
+			continue
+		}
+		k := len(b)
+		if k > st.sendWindow {
+			k = st.sendWindow
+		}
+		if k > maxPayload {
+			k = maxPayload
+		}
+		st.sendWindow -= k
+		st.mutex.Unlock()
+
+		if err := st.session.writeFrame(cmdPSH, st.id, b[:k]); err != nil {
+			return n, err
+		}
+		n += k
+		b = b[k:]
+	}
+	return n, nil
+}
+
+// Close ends the stream on this side. Reads and writes fail after it.
+func (st *Stream) Close() error {
+	st.mutex.Lock()
+	if st.localFIN {
+		st.mutex.Unlock()
+		return nil
+	}
+	st.localFIN = true
+	sendFIN := !st.wasReset
+	done := st.remoteFIN || st.wasReset
+	credit := 0
+	if !done {
+		credit = st.buf.Len() + st.unacked // discarded or not credited yet
+	}
+	st.buf.Reset()
+	st.mutex.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+
+	if done {
+		st.session.remove(st.id)
+	}
+	if credit > 0 {
+		st.sendCredit(credit)
+	}
+	if sendFIN {
+		if err := st.session.writeFrame(cmdFIN, st.id, nil); err != nil && !errors.Is(err, ErrClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *Stream) sendCredit(n int) {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], uint32(n))
+	st.session.writeFrame(cmdUPD, st.id, payload[:])
+}
+
+// push buffers the data of a frame. It fails if the other side sent more than
+// its window.
+func (st *Stream) push(b []byte) error {
+	st.mutex.Lock()
+	if st.buf.Len()+len(b) > Window {
+		st.mutex.Unlock()
+		return errors.New("mux: window exceeded")
+	}
+	if st.localFIN {
+		// Nobody reads: give the window back so the other side is not stuck.
+		st.mutex.Unlock()
+		go st.sendCredit(len(b))
+		return nil
+	}
+	st.buf.Write(b)
+	st.mutex.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+func (st *Stream) remoteClose() {
+	st.mutex.Lock()
+	st.remoteFIN = true
+	done := st.localFIN
+	st.mutex.Unlock()
+	notify(st.readable)
+	if done {
+		st.session.remove(st.id)
+	}
+}
+
+func (st *Stream) reset() {
+	st.mutex.Lock()
+	st.wasReset = true
+	st.mutex.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+	st.session.remove(st.id)
+}
+
+func (st *Stream) credit(n int) {
+	st.mutex.Lock()
+	st.sendWindow += n
+	st.mutex.Unlock()
+	notify(st.writable)
+}
+
+// LocalAddr returns the local address of the session.
+func (st *Stream) LocalAddr() net.Addr { return st.session.LocalAddr() }
+
+// RemoteAddr returns the remote address of the session.
+func (st *Stream) RemoteAddr() net.Addr { return st.session.RemoteAddr() }
+
+// SetDeadline sets the read and write deadlines.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.readDeadline.set(t)
+	st.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline of Read.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of Write.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.writeDeadline.set(t)
+	return nil
+}
+
+// deadline is a channel closed at a time, like the deadlines of net.Pipe.
+type deadline struct {
+	mutex  sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed at the deadline
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline to t, none if zero.
+func (d *deadline) set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // the timer fired: wait for it to close cancel
+	}
+	d.timer = nil
+
+	closed := false
+	select {
+	case <-d.cancel:
+		closed = true
+	default:
+	}
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed at the deadline.
+func (d *deadline) wait() chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.cancel
+}
@@ -0,0 +1,87 @@
+package nfutil
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// from linux/include/uapi/linux/in6.h
+const (
+	_IPV6_TRANSPARENT     = 75
+	_IPV6_RECVORIGDSTADDR = 74
+	_IPV6_ORIGDSTADDR     = _IPV6_RECVORIGDSTADDR
+)
+
+// Transparent is the Control function of a socket for TPROXY: it accepts
+// connections and packets for any address, sends from any address and, for
+// UDP, gets the original destination of each packet, see ReadFromUDP. Setting
+// IP_TRANSPARENT takes CAP_NET_ADMIN.
+func Transparent(network, address string, c syscall.RawConn) error {
+	udp := network == "udp" || network == "udp4" || network == "udp6"
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = setTransparent(int(fd), udp)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func setTransparent(fd int, udp bool) error {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return err
+	}
+	// An IPv6 socket takes IPv4 packets too, with the options of both.
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+		return err
+	}
+	if udp {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); err != nil {
+			return err
+		}
+	}
+	if _, ok := sa.(*syscall.SockaddrInet6); !ok {
+		return nil
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, _IPV6_TRANSPARENT, 1); err != nil {
+		return err
+	}
+	if udp {
+		return syscall.SetsockoptInt(fd, syscall.SOL_IPV6, _IPV6_RECVORIGDSTADDR, 1)
+	}
+	return nil
+}
+
+// ReadFromUDP reads a packet from c, a socket with Transparent, and returns
+// its source and original destination.
+func ReadFromUDP(c *net.UDPConn, b []byte) (n int, src, dst *net.UDPAddr, err error) {
+	oob := make([]byte, 64)
+	n, oobn, _, src, err := c.ReadMsgUDP(b, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_ORIGDSTADDR && len(m.Data) >= syscall.SizeofSockaddrInet4:
+			// struct sockaddr_in: family, big-endian port, address
+			ip := make(net.IP, net.IPv4len)
+			copy(ip, m.Data[4:8])
+			return n, src, &net.UDPAddr{IP: ip, Port: int(m.Data[2])<<8 | int(m.Data[3])}, nil
+		case m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == _IPV6_ORIGDSTADDR && len(m.Data) >= syscall.SizeofSockaddrInet6:
+			// struct sockaddr_in6: family, big-endian port, flow info, address
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, m.Data[8:24])
+			return n, src, &net.UDPAddr{IP: ip, Port: int(m.Data[2])<<8 | int(m.Data[3])}, nil
+		}
+	}
+	return 0, nil, nil, errors.New("no original destination address")
+}
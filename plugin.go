@@ -1,77 +1,160 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 )
 
-var pluginCmd *exec.Cmd
+// A plugin is restarted when it exits, unless it exits more than
+// pluginMaxRestarts times within pluginRestartWindow.
+const (
+	pluginMaxRestarts   = 5
+	pluginRestartWindow = time.Minute
+	pluginRestartDelay  = time.Second
+)
+
+// pluginProcess is a running SIP003 plugin.
+type pluginProcess struct {
+	plugin, opts                                 string
+	remoteHost, remotePort, localHost, localPort string
+
+	mutex    sync.Mutex
+	cmd      *exec.Cmd
+	done     chan struct{} // closed once cmd exited
+	stopping bool          // set by kill, so that the plugin stays down
+	exits    []time.Time   // recent unexpected exits
+}
 
-func startPlugin(plugin, pluginOpts, ssAddr string, isServer bool) (newAddr string, err error) {
-	logf("starting plugin (%s) with option (%s)....", plugin, pluginOpts)
+// errPluginStopped is the error of exec once kill was called.
+var errPluginStopped = errors.New("plugin stopped")
+
+var (
+	pluginsMutex sync.Mutex
+	plugins      []*pluginProcess
+)
+
+func startPlugin(plugin, pluginOpts, ssAddr string, isServer bool) (p *pluginProcess, newAddr string, err error) {
+	// The options can hold passwords, so they are not logged.
+	logger.Info("starting plugin", "plugin", plugin)
 	freePort, err := getFreePort()
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch an unused port for plugin (%v)", err)
+		return nil, "", fmt.Errorf("failed to fetch an unused port for plugin (%v)", err)
 	}
 	localHost := "127.0.0.1"
 	ssHost, ssPort, err := net.SplitHostPort(ssAddr)
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
 	newAddr = localHost + ":" + freePort
 	if isServer {
 		if ssHost == "" {
 			ssHost = "0.0.0.0"
 		}
-		logf("plugin (%s) will listen on %s:%s", plugin, ssHost, ssPort)
+		logger.Info("plugin will listen", "plugin", plugin, "addr", net.JoinHostPort(ssHost, ssPort))
 	} else {
-		logf("plugin (%s) will listen on %s:%s", plugin, localHost, freePort)
+		logger.Info("plugin will listen", "plugin", plugin, "addr", net.JoinHostPort(localHost, freePort))
 	}
-	err = execPlugin(plugin, pluginOpts, ssHost, ssPort, localHost, freePort)
-	return
+
+	p = &pluginProcess{
+		plugin: plugin, opts: pluginOpts,
+		remoteHost: ssHost, remotePort: ssPort, localHost: localHost, localPort: freePort,
+	}
+	if err = p.exec(); err != nil {
+		return nil, "", err
+	}
+	pluginsMutex.Lock()
+	plugins = append(plugins, p)
+	pluginsMutex.Unlock()
+	return p, newAddr, nil
+}
+
+// stopPlugin stops p, whose client or server was removed by a reload.
+func stopPlugin(p *pluginProcess) {
+	pluginsMutex.Lock()
+	for i, q := range plugins {
+		if q == p {
+			plugins = append(plugins[:i], plugins[i+1:]...)
+			break
+		}
+	}
+	pluginsMutex.Unlock()
+	p.kill()
 }
 
-func killPlugin() {
-	if pluginCmd != nil {
-		pluginCmd.Process.Signal(syscall.SIGTERM)
-		waitCh := make(chan struct{})
-		go func() {
-			pluginCmd.Wait()
-			close(waitCh)
-		}()
-		timeout := time.After(3 * time.Second)
+// killPlugins stops all plugins.
+func killPlugins() {
+	pluginsMutex.Lock()
+	all := plugins
+	plugins = nil
+	pluginsMutex.Unlock()
+
+	for _, p := range all {
+		p.kill()
+	}
+}
+
+func (p *pluginProcess) kill() {
+	p.mutex.Lock()
+	p.stopping = true
+	cmd, done := p.cmd, p.done
+	p.mutex.Unlock()
+
+	if cmd != nil {
+		cmd.Process.Signal(syscall.SIGTERM)
 		select {
-		case <-waitCh:
-		case <-timeout:
-			pluginCmd.Process.Kill()
+		case <-done:
+		case <-time.After(3 * time.Second):
+			cmd.Process.Kill()
+			<-done
 		}
 	}
 }
 
-func execPlugin(plugin, pluginOpts, remoteHost, remotePort, localHost, localPort string) (err error) {
-	pluginFile := plugin
-	if fileExists(plugin) {
-		if !filepath.IsAbs(plugin) {
-			pluginFile = "./" + plugin
+// exited records that the plugin exited on its own. It reports whether the
+// plugin may be started again.
+func (p *pluginProcess) exited() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	recent := p.exits[:0]
+	for _, exit := range p.exits {
+		if now.Sub(exit) < pluginRestartWindow {
+			recent = append(recent, exit)
+		}
+	}
+	p.exits = append(recent, now)
+	return len(p.exits) <= pluginMaxRestarts
+}
+
+// exec starts the plugin, unless kill was called, and restarts it whenever it
+// exits on its own.
+func (p *pluginProcess) exec() (err error) {
+	pluginFile := p.plugin
+	if fileExists(p.plugin) {
+		if !filepath.IsAbs(p.plugin) {
+			pluginFile = "./" + p.plugin
 		}
 	} else {
-		pluginFile, err = exec.LookPath(plugin)
+		pluginFile, err = exec.LookPath(p.plugin)
 		if err != nil {
 			return err
 		}
 	}
-	logH := newLogHelper("[" + plugin + "]: ")
+	logH := &logWriter{logger.With("plugin", p.plugin)}
 	env := append(os.Environ(),
-		"SS_REMOTE_HOST="+remoteHost,
-		"SS_REMOTE_PORT="+remotePort,
-		"SS_LOCAL_HOST="+localHost,
-		"SS_LOCAL_PORT="+localPort,
-		"SS_PLUGIN_OPTIONS="+pluginOpts,
+		"SS_REMOTE_HOST="+p.remoteHost,
+		"SS_REMOTE_PORT="+p.remotePort,
+		"SS_LOCAL_HOST="+p.localHost,
+		"SS_LOCAL_PORT="+p.localPort,
+		"SS_PLUGIN_OPTIONS="+p.opts,
 	)
 	cmd := &exec.Cmd{
 		Path:   pluginFile,
@@ -79,17 +162,43 @@ func execPlugin(plugin, pluginOpts, remoteHost, remotePort, localHost, localPort
 		Stdout: logH,
 		Stderr: logH,
 	}
+	// Under the lock, kill either stops the plugin started here, or comes
+	// first and keeps it from starting.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stopping {
+		return errPluginStopped
+	}
 	if err = cmd.Start(); err != nil {
 		return err
 	}
-	pluginCmd = cmd
+	done := make(chan struct{})
+	p.cmd, p.done = cmd, done
 	go func() {
-		if err := cmd.Wait(); err != nil {
-			logf("plugin exited (%v)\n", err)
+		err := cmd.Wait()
+		close(done)
+		p.mutex.Lock()
+		stopping := p.stopping
+		p.mutex.Unlock()
+		if stopping {
+			return
+		}
+
+		logger.Warn("plugin exited", "plugin", p.plugin, "err", err)
+		if !p.exited() {
+			logger.Error("plugin keeps exiting, giving up", "plugin", p.plugin)
+			os.Exit(2)
+		}
+
+		time.Sleep(pluginRestartDelay)
+		switch err := p.exec(); {
+		case err == errPluginStopped:
+		case err != nil:
+			logger.Error("failed to restart plugin", "plugin", p.plugin, "err", err)
 			os.Exit(2)
+		default:
+			pluginRestarts.Add(1)
 		}
-		logf("plugin exited\n")
-		os.Exit(0)
 	}()
 	return nil
 }
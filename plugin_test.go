@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pluginScript returns the path of an executable shell script with body.
+func pluginScript(t *testing.T, body string) string {
+	path := filepath.Join(t.TempDir(), "plugin")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPluginKillWaitsForExit(t *testing.T) {
+	// The plugin takes a moment to exit on SIGTERM.
+	p, _, err := startPlugin(pluginScript(t, "trap 'sleep 0.2; exit 0' TERM\nwhile :; do sleep 0.05; done"), "", "127.0.0.1:8488", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond) // for the trap to be set
+	start := time.Now()
+	stopPlugin(p)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed >= 3*time.Second {
+		t.Errorf("kill returned after %v, want after the plugin exited on SIGTERM", elapsed)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.cmd.ProcessState == nil || !p.cmd.ProcessState.Exited() {
+		t.Errorf("plugin did not exit on its own: %v", p.cmd.ProcessState)
+	}
+}
+
+func TestPluginKillDuringRestart(t *testing.T) {
+	restarts := atomic.LoadUint64(&pluginRestarts.value)
+	p, _, err := startPlugin(pluginScript(t, "exit 1"), "", "127.0.0.1:8488", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mutex.Lock()
+	first := p.cmd
+	p.mutex.Unlock()
+
+	// Kill during the restart delay: the plugin stays down.
+	time.Sleep(pluginRestartDelay / 4)
+	stopPlugin(p)
+	time.Sleep(pluginRestartDelay * 3 / 2)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.cmd != first {
+		t.Error("plugin restarted after it was killed")
+	}
+	if got := atomic.LoadUint64(&pluginRestarts.value); got != restarts {
+		t.Errorf("counted %d restarts", got-restarts)
+	}
+}
@@ -0,0 +1,390 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+	"github.com/OperatorFoundation/go-shadowsocks2/dns"
+	"github.com/OperatorFoundation/go-shadowsocks2/internal"
+	"github.com/OperatorFoundation/go-shadowsocks2/route"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+)
+
+// Client relays local connections and packets through a Shadowsocks server.
+type Client struct {
+	// Server is the address of the server, or of its SIP003 plugin.
+	Server string
+	// UDPServer is the address of the server for UDP, if not Server.
+	UDPServer string
+	Cipher    core.Cipher
+	// Pool spreads the TCP connections over several servers instead of
+	// Server and Cipher, if not nil. UDP still goes to the server of
+	// UDPServer or Server.
+	Pool *Pool
+	// Routes decides which TCP targets go through the server, directly or
+	// nowhere. nil sends them all through the server.
+	Routes *route.Table
+	// SOCKSAuth, if not nil, checks the username and password that the
+	// clients of ServeSOCKS must give.
+	SOCKSAuth socks.Auth
+	// ServerReplies has the server tell whether it connected to each target
+	// of ServeSOCKS, so that the SOCKS replies carry its errors, and relay
+	// BIND. The server must support it, like the Server of this package.
+	ServerReplies bool
+	// UDPOverTCP carries each UDP association in a TCP connection to the
+	// server, like the TCP connections, instead of UDP packets.
+	UDPOverTCP bool
+	// Mux, if not 0, carries the TCP connections to each server as streams
+	// of up to Mux long-lived sessions, instead of a handshake each.
+	Mux int
+	// DNSOverUDP sends the queries of ServeDNS through the UDP relay instead
+	// of DNS over TCP.
+	DNSOverUDP bool
+	// FakeIP, if not nil, answers the queries of ServeDNS for IPv4
+	// addresses with fake ones, and turns the TCP targets at those back into
+	// their names, for the server to resolve.
+	FakeIP *dns.FakeIP
+	Options
+
+	muxMutex sync.Mutex
+	muxes    map[string]*muxSessions // by server
+
+	dnsOnce  sync.Once
+	dnsCache *dns.Cache
+
+	assocMutex sync.Mutex
+	assocs     map[string]int // UDP ASSOCIATE connections by client IP
+}
+
+// ServeSOCKS is a SOCKS5 proxy on l. It answers UDP ASSOCIATE if
+// socks.UDPEnabled is set, for ServeSOCKSUDP on the same address. It also
+// serves SOCKS4, SOCKS4a and HTTP proxy requests, told apart by their first
+// byte.
+func (cl *Client) ServeSOCKS(ctx context.Context, l net.Listener) error {
+	cl.Logger.Info("SOCKS proxy", "addr", l.Addr(), "server", cl.Server)
+	return cl.serveTCP(ctx, &localListener{l}, cl.localRequest, localReply)
+}
+
+// socksRequest returns the target of a SOCKS CONNECT or BIND, and leaves the
+// reply to serveTCP, with errBindRequest for a BIND. It answers UDP
+// ASSOCIATE and returns socks.InfoUDPAssociate.
+func (cl *Client) socksRequest(c net.Conn) (socks.Addr, error) {
+	cmd, tgt, err := socks.Request(c, cl.SOCKSAuth)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case cmd == socks.CmdConnect:
+		return tgt, nil
+	case cmd == socks.CmdBind:
+		return tgt, errBindRequest
+	case cmd == socks.CmdUDPAssociate && socks.UDPEnabled:
+		if err := socks.Reply(c, 0, socks.ParseAddr(c.LocalAddr().String())); err != nil {
+			return nil, err
+		}
+		return tgt, socks.InfoUDPAssociate
+	}
+	socks.Reply(c, socks.ErrCommandNotSupported, nil)
+	return nil, socks.ErrCommandNotSupported
+}
+
+// ServeTCPTunnel forwards the connections accepted on l to target.
+func (cl *Client) ServeTCPTunnel(ctx context.Context, l net.Listener, target string) error {
+	tgt := socks.ParseAddr(target)
+	if tgt == nil {
+		l.Close()
+		return errors.New("invalid target address " + target)
+	}
+	cl.Logger.Info("TCP tunnel", "addr", l.Addr(), "server", cl.Server, "target", target)
+	return cl.serveTCP(ctx, l, func(net.Conn) (socks.Addr, error) { return tgt, nil }, nil)
+}
+
+// serveTCP relays the connections accepted on l to the target from getAddr,
+// by the route of cl.Routes. reply, if not nil, answers the request for the
+// target once it is connected, or with the error that prevented it; with
+// ServerReplies, the server reports the connection to the target.
+func (cl *Client) serveTCP(ctx context.Context, l net.Listener, getAddr func(net.Conn) (socks.Addr, error), reply func(net.Conn, socks.Error, socks.Addr) error) error {
+	replies := reply != nil
+	if !replies {
+		reply = func(net.Conn, socks.Error, socks.Addr) error { return nil }
+	}
+	return cl.serve(ctx, l, func(c net.Conn) {
+		log := cl.connLogger("client", c.RemoteAddr())
+		tgt, err := getAddr(c)
+		bind := err == errBindRequest
+		if err != nil && !bind {
+
+			// UDP: keep the connection until disconnect then free the UDP socket
+			if err == socks.InfoUDPAssociate {
+				cl.Conns.ignore(c) // the association ends with its listener
+				defer cl.holdAssociation(c.RemoteAddr())()
+				buf := make([]byte, 1)
+				// block here
+				for {
+					err := internal.ReadFully(c, buf)
+					if err, ok := err.(net.Error); ok && err.Timeout() {
+						continue
+					}
+					log.Debug("UDP associate ended")
+					return
+				}
+			}
+
+			if errors.Is(err, socks.ErrAuthFailed) || errors.Is(err, socks.ErrNoAcceptableMethod) {
+				log.Info("SOCKS authentication failed", "err", err)
+				return
+			}
+			log.Debug("failed to get target address", "err", err)
+			return
+		}
+
+		tgt = cl.realTarget(tgt)
+		hsCtx, cancel := cl.handshakeContext()
+		defer cancel()
+		action, rule, err := cl.Routes.Route(hsCtx, tgt.String())
+		if err != nil {
+			log.Debug("route lookup failed", "target", tgt, "err", err)
+		}
+		if cl.Routes != nil {
+			log.Info("route", "target", tgt, "action", action, "rule", rule)
+		}
+		if action == route.Block {
+			reply(c, socks.ErrConnectionNotAllowed, nil)
+			return
+		}
+		if bind {
+			cl.bind(hsCtx, c, tgt, action, reply, log)
+			return
+		}
+
+		if action == route.Direct {
+			var d net.Dialer
+			rc, err := d.DialContext(hsCtx, "tcp", tgt.String())
+			if err != nil {
+				log.Debug("failed to connect to target", "target", tgt, "err", err)
+				reply(c, replyError(err), nil)
+				return
+			}
+			defer rc.Close()
+			if err = reply(c, 0, socks.ParseAddr(rc.LocalAddr().String())); err != nil {
+				log.Debug("failed to reply", "err", err)
+				return
+			}
+			log.Debug("direct", "target", tgt)
+			if err = cl.relay(c, rc); err != nil {
+				log.Debug("relay error", "err", err)
+			}
+			log.Debug("closed")
+			return
+		}
+
+		rc, server, release, err := cl.dialServer(log)
+		if err != nil {
+			log.Warn("failed to connect to server", "err", err)
+			reply(c, socks.ErrGeneralFailure, nil)
+			return
+		}
+		defer release()
+		defer rc.Close()
+
+		if replies && cl.ServerReplies {
+			rep, bnd, err := serverRequest(hsCtx, rc, connectTarget, tgt)
+			if !forwardReply(c, reply, rep, bnd, err, log) {
+				return
+			}
+		} else {
+			if _, err = rc.Write(tgt); err != nil {
+				log.Debug("failed to send target address", "err", err)
+				return
+			}
+			if err = reply(c, 0, nil); err != nil {
+				log.Debug("failed to reply", "err", err)
+				return
+			}
+		}
+
+		log.Debug("proxy", "server", server, "target", tgt)
+		if err = cl.relay(c, rc); err != nil {
+			log.Debug("relay error", "err", err)
+		}
+		log.Debug("closed")
+	})
+}
+
+// realTarget returns the name and port of tgt if it is at a fake address of
+// cl.FakeIP, or else tgt.
+func (cl *Client) realTarget(tgt socks.Addr) socks.Addr {
+	if cl.FakeIP == nil || tgt[0] != socks.AtypIPv4 {
+		return tgt
+	}
+	name, ok := cl.FakeIP.Name(net.IP(tgt[1 : 1+net.IPv4len]))
+	if !ok {
+		return tgt
+	}
+	port := binary.BigEndian.Uint16(tgt[1+net.IPv4len:])
+	return socks.ParseAddr(net.JoinHostPort(name, strconv.Itoa(int(port))))
+}
+
+// udpServer returns the address of the server for UDP, nil with UDPOverTCP.
+func (cl *Client) udpServer() (*net.UDPAddr, error) {
+	if cl.UDPOverTCP {
+		return nil, nil
+	}
+	if cl.UDPServer != "" {
+		return net.ResolveUDPAddr("udp", cl.UDPServer)
+	}
+	return net.ResolveUDPAddr("udp", cl.Server)
+}
+
+// ServeUDPTunnel forwards the packets that arrive on c to target, and the
+// replies back. The associations end when it returns.
+func (cl *Client) ServeUDPTunnel(ctx context.Context, c net.PacketConn, target string) error {
+	defer c.Close()
+	tgt := socks.ParseAddr(target)
+	if tgt == nil {
+		return errors.New("invalid target address " + target)
+	}
+	srvAddr, err := cl.udpServer()
+	if err != nil {
+		return err
+	}
+	defer closeOnDone(ctx, c)()
+
+	metrics := cl.metrics()
+	nm := newNATmap(cl.udpTimeout(), metrics)
+	defer nm.Flush()
+	buf := make([]byte, udpBufSize)
+	copy(buf, tgt)
+
+	cl.Logger.Info("UDP tunnel", "addr", c.LocalAddr(), "server", cl.udpServerName(srvAddr), "target", tgt)
+	for {
+		n, raddr, err := c.ReadFrom(buf[len(tgt):])
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			cl.Logger.Warn("UDP local read error", "addr", c.LocalAddr(), "err", err)
+			continue
+		}
+
+		pc := nm.Get(raddr.String())
+		if pc == nil {
+			log := cl.connLogger("client", raddr)
+			pc, err = cl.associate(log)
+			if err != nil {
+				log.Warn("failed to open UDP association", "err", err)
+				continue
+			}
+			log.Debug("UDP association", "server", cl.udpServerName(srvAddr), "target", tgt)
+			nm.Add(raddr, c, pc, relayClient, log)
+		}
+
+		_, err = pc.WriteTo(buf[:len(tgt)+n], srvAddr)
+		if err != nil {
+			cl.Logger.Debug("UDP local write error", "client", raddr, "err", err)
+			continue
+		}
+		metrics.Relayed("udp", true, n)
+	}
+}
+
+// holdAssociation records the UDP ASSOCIATE connection of a SOCKS client at
+// addr until the returned function is called.
+func (cl *Client) holdAssociation(addr net.Addr) func() {
+	host, _, _ := net.SplitHostPort(addr.String())
+	cl.assocMutex.Lock()
+	defer cl.assocMutex.Unlock()
+	if cl.assocs == nil {
+		cl.assocs = make(map[string]int)
+	}
+	cl.assocs[host]++
+	return func() {
+		cl.assocMutex.Lock()
+		defer cl.assocMutex.Unlock()
+		if cl.assocs[host]--; cl.assocs[host] == 0 {
+			delete(cl.assocs, host)
+		}
+	}
+}
+
+// associated reports whether the SOCKS client at addr has a UDP ASSOCIATE
+// connection open.
+func (cl *Client) associated(addr net.Addr) bool {
+	host, _, _ := net.SplitHostPort(addr.String())
+	cl.assocMutex.Lock()
+	defer cl.assocMutex.Unlock()
+	return cl.assocs[host] > 0
+}
+
+// ServeSOCKSUDP relays the SOCKS5 UDP packets that arrive on c, for the
+// clients that did UDP ASSOCIATE with ServeSOCKS. With SOCKSAuth, it drops
+// the packets of addresses without an open UDP ASSOCIATE connection, which
+// was authenticated. The associations end when it returns.
+func (cl *Client) ServeSOCKSUDP(ctx context.Context, c net.PacketConn) error {
+	defer c.Close()
+	srvAddr, err := cl.udpServer()
+	if err != nil {
+		return err
+	}
+	defer closeOnDone(ctx, c)()
+
+	metrics := cl.metrics()
+	nm := newNATmap(cl.udpTimeout(), metrics)
+	defer nm.Flush()
+	buf := make([]byte, udpBufSize)
+
+	for {
+		n, raddr, err := c.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			cl.Logger.Warn("UDP local read error", "addr", c.LocalAddr(), "err", err)
+			continue
+		}
+		// RSV, FRAG and the target address; fragments are not supported (RFC 1928, section 7).
+		if n < 3 || buf[2] != 0 {
+			cl.Logger.Debug("UDP packet without header or fragmented", "client", raddr)
+			continue
+		}
+		tgt := socks.SplitAddr(buf[3:n])
+		if tgt == nil {
+			cl.Logger.Debug("UDP packet with invalid target address", "client", raddr)
+			continue
+		}
+		if cl.SOCKSAuth != nil && !cl.associated(raddr) {
+			cl.Logger.Debug("UDP packet without association", "client", raddr)
+			continue
+		}
+
+		pc := nm.Get(raddr.String())
+		if pc == nil {
+			log := cl.connLogger("client", raddr)
+			pc, err = cl.associate(log)
+			if err != nil {
+				log.Warn("failed to open UDP association", "err", err)
+				continue
+			}
+			log.Debug("UDP association", "server", cl.udpServerName(srvAddr), "target", tgt)
+			nm.Add(raddr, c, pc, socksClient, log)
+		}
+
+		_, err = pc.WriteTo(buf[3:n], srvAddr)
+		if err != nil {
+			cl.Logger.Debug("UDP local write error", "client", raddr, "err", err)
+			continue
+		}
+		metrics.Relayed("udp", true, n-3-len(tgt))
+	}
+}
@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+	"github.com/OperatorFoundation/go-shadowsocks2/route"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+)
+
+func TestClientRoutes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &memoryDialer{}
+	sl := listen(t)
+	server := &Server{Cipher: ciph, Dialer: dialer}
+	serve(func() error { return server.ServeTCP(ctx, sl) })
+
+	target := echoServer(t)
+	host, _, _ := net.SplitHostPort(target)
+	routes, err := route.New([]string{"direct " + host, "block example.com"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := listen(t)
+	client := &Client{Server: sl.Addr().String(), Cipher: ciph, Routes: routes}
+	serve(func() error { return client.ServeSOCKS(ctx, pl) })
+	local := &SOCKS5Dialer{Addr: pl.Addr().String()}
+
+	for _, address := range []string{target, "example.net:80"} {
+		c, err := local.DialContext(ctx, "tcp", address)
+		if err != nil {
+			t.Fatalf("%s: %v", address, err)
+		}
+		echo(t, c, "hello "+address)
+		c.Close()
+	}
+	_, err = local.DialContext(ctx, "tcp", "www.example.com:443")
+	if err == nil || !strings.Contains(err.Error(), "reply 2") {
+		t.Errorf("blocked target: got %v, want reply 2, connection not allowed", err)
+	}
+
+	// Only the proxied target reached the server.
+	dialer.mutex.Lock()
+	defer dialer.mutex.Unlock()
+	if len(dialer.targets) != 1 || dialer.targets[0] != "example.net:80" {
+		t.Errorf("server dialed %q, want [example.net:80]", dialer.targets)
+	}
+}
+
+func TestClientSOCKSAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &memoryDialer{}
+	sl := listen(t)
+	server := &Server{Cipher: ciph, Dialer: dialer}
+	serve(func() error { return server.ServeTCP(ctx, sl) })
+	pl := listen(t)
+	client := &Client{Server: sl.Addr().String(), Cipher: ciph, SOCKSAuth: socks.Password("alice", "secret")}
+	serve(func() error { return client.ServeSOCKS(ctx, pl) })
+
+	c, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	request := []byte{5, 1, socks.MethodPassword, 1, 5}
+	request = append(append(request, "alice"...), 6)
+	request = append(append(request, "secret"...), 5, socks.CmdConnect, 0)
+	request = append(request, socks.ParseAddr("example.com:80")...)
+	if _, err := c.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2+2+10) // method, status, reply to CONNECT
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks.MethodPassword || reply[3] != 0 || reply[5] != 0 {
+		t.Fatalf("got reply %v", reply)
+	}
+	echo(t, c, "hello")
+
+	// A client without credentials does not get in.
+	local := &SOCKS5Dialer{Addr: pl.Addr().String()}
+	if _, err := local.DialContext(ctx, "tcp", "example.net:80"); err == nil {
+		t.Error("client without authentication got in")
+	}
+	dialer.mutex.Lock()
+	defer dialer.mutex.Unlock()
+	if len(dialer.targets) != 1 {
+		t.Errorf("server dialed %q, want [example.com:80]", dialer.targets)
+	}
+}
+
+func TestClientSOCKSAuthUDP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer func(enabled bool) { socks.UDPEnabled = enabled }(socks.UDPEnabled)
+	socks.UDPEnabled = true
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := listen(t)
+	server := &Server{Cipher: ciph}
+	serve(func() error { return server.ServeTCP(ctx, sl) })
+	pl := listen(t)
+	uc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{Server: sl.Addr().String(), Cipher: ciph, UDPOverTCP: true, SOCKSAuth: socks.Password("alice", "secret")}
+	serve(func() error { return client.ServeSOCKS(ctx, pl) })
+	serve(func() error { return client.ServeSOCKSUDP(ctx, uc) })
+
+	u, err := net.Dial("udp", uc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	target := socks.ParseAddr(udpEchoServer(t))
+	relayed := func(msg string, wait time.Duration) bool {
+		t.Helper()
+		if _, err := u.Write(append(append([]byte{0, 0, 0}, target...), msg...)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		u.SetReadDeadline(time.Now().Add(wait))
+		n, err := u.Read(buf)
+		return err == nil && strings.HasSuffix(string(buf[:n]), msg)
+	}
+	if relayed("before", 500*time.Millisecond) {
+		t.Error("relayed a packet without an association")
+	}
+
+	c, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := []byte{5, 1, socks.MethodPassword, 1, 5}
+	request = append(append(request, "alice"...), 6)
+	request = append(append(request, "secret"...), 5, socks.CmdUDPAssociate, 0)
+	request = append(request, socks.ParseAddr("0.0.0.0:0")...)
+	if _, err := c.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2+2+10) // method, status, reply to UDP ASSOCIATE
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != 0 || reply[5] != 0 {
+		t.Fatalf("got reply %v", reply)
+	}
+	if !relayed("during", 5*time.Second) {
+		t.Error("did not relay a packet of the association")
+	}
+
+	// The packets are dropped again once the association ends.
+	c.Close()
+	for deadline := time.Now().Add(5 * time.Second); client.associated(u.LocalAddr()); {
+		if time.Now().After(deadline) {
+			t.Fatal("association did not end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if relayed("after", 500*time.Millisecond) {
+		t.Error("relayed a packet after the association ended")
+	}
+}
+
+func TestClientSOCKSUDPMalformed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := listen(t)
+	server := &Server{Cipher: ciph}
+	serve(func() error { return server.ServeTCP(ctx, sl) })
+	uc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{Server: sl.Addr().String(), Cipher: ciph, UDPOverTCP: true}
+	errc := make(chan error, 1)
+	go func() { errc <- client.ServeSOCKSUDP(ctx, uc) }()
+
+	u, err := net.Dial("udp", uc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	target := socks.ParseAddr(udpEchoServer(t))
+	for _, packet := range [][]byte{
+		{0},                  // shorter than the header
+		{0, 0, 0},            // no target address
+		{0, 0, 0, 1, 127, 0}, // truncated target address
+		append([]byte{0, 0, 1}, append(target, "fragment"...)...),
+	} {
+		if _, err := u.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The malformed packets are dropped and the relay keeps working.
+	if _, err := u.Write(append(append([]byte{0, 0, 0}, target...), "hello"...)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	u.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := u.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); !strings.HasSuffix(got, "hello") {
+		t.Errorf("got %q", got)
+	}
+	select {
+	case err := <-errc:
+		t.Fatalf("ServeSOCKSUDP returned: %v", err)
+	default:
+	}
+}
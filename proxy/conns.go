@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+)
+
+// Conns is a set of the TCP connections accepted by Servers and Clients, so
+// that a shutdown can wait for the relays to finish and close the rest. The
+// zero value is ready to use, and a nil *Conns tracks nothing.
+type Conns struct {
+	mutex   sync.Mutex
+	conns   map[net.Conn]bool // whether Idle waits for the connection
+	waiting int
+	idle    chan struct{} // closed when waiting drops to 0
+}
+
+func (s *Conns) add(c net.Conn) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]bool)
+	}
+	if !s.conns[c] {
+		s.conns[c] = true
+		s.waiting++
+	}
+}
+
+// ignore keeps c in the set, but Idle does not wait for it. It is for
+// connections that are held open without relaying, like blackholed ones.
+func (s *Conns) ignore(c net.Conn) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if waited, ok := s.conns[c]; ok {
+		if waited {
+			s.done()
+		}
+		s.conns[c] = false
+	}
+}
+
+func (s *Conns) remove(c net.Conn) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conns[c] {
+		s.done()
+	}
+	delete(s.conns, c)
+}
+
+func (s *Conns) done() {
+	s.waiting--
+	if s.waiting == 0 && s.idle != nil {
+		close(s.idle)
+		s.idle = nil
+	}
+}
+
+// Idle returns a channel that is closed when no connection is being relayed.
+func (s *Conns) Idle() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.waiting == 0 {
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}
+	if s.idle == nil {
+		s.idle = make(chan struct{})
+	}
+	return s.idle
+}
+
+// CloseAll closes all connections and returns how many were being relayed.
+func (s *Conns) CloseAll() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+	return s.waiting
+}
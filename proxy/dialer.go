@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"context"
+	"net"
+)
+
+// Dialer makes the connections of a Server to targets. Implementations can
+// send the traffic from a given address or interface, through an upstream
+// proxy, or keep it in memory for tests. The methods are called concurrently.
+type Dialer interface {
+	// DialContext connects to address over TCP.
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	// ListenPacket opens the socket of a UDP association at the local
+	// address, "" for any. The Server sends the packets of the association
+	// with WriteTo and a *net.UDPAddr, and reads the replies with ReadFrom.
+	ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error)
+}
+
+// DirectDialer connects to targets directly. The zero value uses the routes
+// of the system, like net.Dial.
+type DirectDialer struct {
+	// LocalIP is the source address of the connections and packets, if not nil.
+	LocalIP net.IP
+	// Interface is the network interface to send from, if not "". It is only
+	// supported on Linux.
+	Interface string
+}
+
+// DialContext connects to address from d.LocalIP and d.Interface.
+func (d *DirectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	nd := net.Dialer{Control: bindToInterface(d.Interface)}
+	if d.LocalIP != nil {
+		nd.LocalAddr = &net.TCPAddr{IP: d.LocalIP}
+	}
+	return nd.DialContext(ctx, network, address)
+}
+
+// ListenPacket opens a UDP socket on d.LocalIP and d.Interface, unless address
+// is given.
+func (d *DirectDialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: bindToInterface(d.Interface)}
+	if address == "" && d.LocalIP != nil {
+		address = net.JoinHostPort(d.LocalIP.String(), "0")
+	}
+	return lc.ListenPacket(ctx, network, address)
+}
+
+var defaultDialer Dialer = &DirectDialer{}
+
+// dialer returns the Dialer of s, or a DirectDialer.
+func (s *Server) dialer() Dialer {
+	if s.Dialer == nil {
+		return defaultDialer
+	}
+	return s.Dialer
+}
@@ -0,0 +1,20 @@
+package proxy
+
+import "syscall"
+
+// bindToInterface returns the Control function of a socket that sends from
+// the network interface iface, or nil if iface is "".
+func bindToInterface(iface string) func(network, address string, c syscall.RawConn) error {
+	if iface == "" {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
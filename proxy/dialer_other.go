@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindToInterface returns the Control function of a socket that sends from
+// the network interface iface, or nil if iface is "".
+func bindToInterface(iface string) func(network, address string, c syscall.RawConn) error {
+	if iface == "" {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("binding to an interface is only supported on Linux")
+	}
+}
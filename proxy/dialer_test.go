@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/acl"
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+	"github.com/OperatorFoundation/go-shadowsocks2/dns"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+)
+
+// memoryDialer connects every target to an in-memory echo server.
+type memoryDialer struct {
+	mutex   sync.Mutex
+	targets []string
+}
+
+func (d *memoryDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mutex.Lock()
+	d.targets = append(d.targets, address)
+	d.mutex.Unlock()
+	left, right := net.Pipe()
+	go func() {
+		defer right.Close()
+		io.Copy(right, right)
+	}()
+	return left, nil
+}
+
+func (d *memoryDialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	return nil, errors.New("no UDP in memory")
+}
+
+// roundtrip sends msg through a TCP tunnel at addr and checks that it comes
+// back.
+func roundtrip(t *testing.T, addr string, msg string) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echo(t, c, msg)
+}
+
+// echo sends msg on c and checks that it comes back.
+func echo(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	if _, err := io.WriteString(c, msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != msg {
+		t.Errorf("got %q, want %q", got, msg)
+	}
+}
+
+// tunnel starts a server with dialer and a client tunnel to target through
+// it, and returns the address of the tunnel.
+func tunnel(t *testing.T, ctx context.Context, dialer Dialer, target string) string {
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := listen(t)
+	server := &Server{Cipher: ciph, Dialer: dialer}
+	serve(func() error { return server.ServeTCP(ctx, sl) })
+	tl := listen(t)
+	client := &Client{Server: sl.Addr().String(), Cipher: ciph}
+	serve(func() error { return client.ServeTCPTunnel(ctx, tl, target) })
+	return tl.Addr().String()
+}
+
+func TestServerDialer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dialer := &memoryDialer{}
+	roundtrip(t, tunnel(t, ctx, dialer, "example.com:80"), "hello")
+
+	dialer.mutex.Lock()
+	defer dialer.mutex.Unlock()
+	if len(dialer.targets) != 1 || dialer.targets[0] != "example.com:80" {
+		t.Errorf("dialed %q, want [example.com:80]", dialer.targets)
+	}
+}
+
+func TestShadowsocksDialer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ciph, err := core.PickCipher("AEAD_AES_256_GCM", nil, "hop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hl := listen(t)
+	hop := &Server{Cipher: ciph}
+	serve(func() error { return hop.ServeTCP(ctx, hl) })
+
+	dialer := &ShadowsocksDialer{Server: hl.Addr().String(), Cipher: ciph}
+	roundtrip(t, tunnel(t, ctx, dialer, echoServer(t)), "through two servers")
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pl := listen(t)
+	t.Cleanup(func() { pl.Close() })
+	go func() {
+		for {
+			c, err := pl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				tgt, err := socks.Handshake(c, nil)
+				if err != nil {
+					return
+				}
+				rc, err := net.Dial("tcp", tgt.String())
+				if err != nil {
+					return
+				}
+				defer rc.Close()
+				go io.Copy(rc, c)
+				io.Copy(c, rc)
+			}()
+		}
+	}()
+
+	dialer := &SOCKS5Dialer{Addr: pl.Addr().String()}
+	roundtrip(t, tunnel(t, ctx, dialer, echoServer(t)), "through SOCKS5")
+}
+
+func TestHTTPDialer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pl := listen(t)
+	t.Cleanup(func() { pl.Close() })
+	go func() {
+		for {
+			c, err := pl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				rc, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer rc.Close()
+				io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(rc, c)
+				io.Copy(c, rc)
+			}()
+		}
+	}()
+
+	dialer := &HTTPDialer{Addr: pl.Addr().String()}
+	roundtrip(t, tunnel(t, ctx, dialer, echoServer(t)), "through HTTP")
+
+	if _, err := dialer.DialContext(ctx, "tcp", "127.0.0.1:1"); err == nil {
+		t.Error("dialing a closed port through the proxy succeeded")
+	}
+}
+
+// deniedMetrics records the rules of Denied.
+type deniedMetrics struct {
+	nopMetrics
+	rules chan string
+}
+
+func (m *deniedMetrics) Denied(protocol, rule string) { m.rules <- rule }
+
+func TestServerACL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := acl.New([]string{"deny example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &memoryDialer{}
+	metrics := &deniedMetrics{rules: make(chan string, 1)}
+	sl := listen(t)
+	server := &Server{Cipher: ciph, Dialer: dialer, ACL: list, Options: Options{Metrics: metrics}}
+	serve(func() error { return server.ServeTCP(ctx, sl) })
+	tl := listen(t)
+	client := &Client{Server: sl.Addr().String(), Cipher: ciph}
+	serve(func() error { return client.ServeTCPTunnel(ctx, tl, "www.example.com:443") })
+
+	c, err := net.Dial("tcp", tl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("hello"))
+	select {
+	case rule := <-metrics.rules:
+		if rule != "deny example.com" {
+			t.Errorf("denied by %q", rule)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("denial not counted")
+	}
+	dialer.mutex.Lock()
+	defer dialer.mutex.Unlock()
+	if len(dialer.targets) != 0 {
+		t.Errorf("dialed %q", dialer.targets)
+	}
+}
+
+// rebindingResolver answers the first query for an IPv4 address with
+// 192.0.2.1 and the next ones with 127.0.0.1, like a name that is rebound to
+// loopback once it has been checked.
+func rebindingResolver() *net.Resolver {
+	var mutex sync.Mutex
+	answered := false
+	return &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		left, right := net.Pipe()
+		go func() {
+			defer right.Close()
+			query, err := readTCPMessage(right)
+			if err != nil {
+				return
+			}
+			q, err := dns.ParseQuestion(query)
+			if err != nil {
+				return
+			}
+			var ip net.IP
+			if q.Type == dns.TypeA {
+				mutex.Lock()
+				ip = net.ParseIP("127.0.0.1")
+				if !answered {
+					ip, answered = net.ParseIP("192.0.2.1"), true
+				}
+				mutex.Unlock()
+			}
+			resp, err := dns.Answer(query, q, ip, 0)
+			if err != nil {
+				return
+			}
+			writeTCPMessage(right, nil, resp)
+		}()
+		return left, nil
+	}}
+}
+
+// resolvingDialer is a memoryDialer that looks up domain names with resolver,
+// as a dialer to the network would.
+type resolvingDialer struct {
+	memoryDialer
+	resolver *net.Resolver
+}
+
+func (d *resolvingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) == nil {
+		ips, err := d.resolver.LookupIP(ctx, "ip4", host)
+		if err != nil {
+			return nil, err
+		}
+		address = net.JoinHostPort(ips[0].String(), port)
+	}
+	return d.memoryDialer.DialContext(ctx, network, address)
+}
+
+func TestServerACLRebinding(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := acl.New(nil) // denies loopback
+	if err != nil {
+		t.Fatal(err)
+	}
+	list.Resolver = rebindingResolver()
+	dialer := &resolvingDialer{resolver: list.Resolver}
+	sl := listen(t)
+	server := &Server{Cipher: ciph, Dialer: dialer, ACL: list}
+	serve(func() error { return server.ServeTCP(ctx, sl) })
+	tl := listen(t)
+	client := &Client{Server: sl.Addr().String(), Cipher: ciph}
+	serve(func() error { return client.ServeTCPTunnel(ctx, tl, "www.example.com:443") })
+
+	roundtrip(t, tl.Addr().String(), "hello")
+	dialer.mutex.Lock()
+	defer dialer.mutex.Unlock()
+	if len(dialer.targets) != 1 || dialer.targets[0] != "192.0.2.1:443" {
+		t.Errorf("dialed %q, want the checked address 192.0.2.1:443", dialer.targets)
+	}
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/dns"
+	"github.com/OperatorFoundation/go-shadowsocks2/logging"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+)
+
+// DefaultDNSUpstream is the resolver of a DNS server of a client that names
+// none.
+const DefaultDNSUpstream = "8.8.8.8:53"
+
+// dnsTimeout bounds a query to the upstream resolver, and how long a DNS over
+// TCP client waits between its queries.
+const dnsTimeout = 5 * time.Second
+
+// dnsCacheSize is how many responses a Client caches.
+const dnsCacheSize = 4096
+
+// fakeIPTTL is the TTL of the answers with fake addresses, short so that the
+// applications ask again rather than keep an address given to another name.
+const fakeIPTTL = 1
+
+// ServeDNS answers the DNS queries that arrive on c: with a fake address of
+// cl.FakeIP, from the cache, or with the response of the resolver at upstream
+// through the server.
+func (cl *Client) ServeDNS(ctx context.Context, c net.PacketConn, upstream string) error {
+	defer c.Close()
+	tgt := socks.ParseAddr(upstream)
+	if tgt == nil {
+		return errors.New("invalid upstream resolver " + upstream)
+	}
+	defer closeOnDone(ctx, c)()
+
+	cl.Logger.Info("DNS", "addr", c.LocalAddr(), "server", cl.Server, "upstream", upstream)
+	buf := make([]byte, udpBufSize)
+	for {
+		n, raddr, err := c.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			cl.Logger.Warn("UDP local read error", "addr", c.LocalAddr(), "err", err)
+			continue
+		}
+		query := append([]byte{}, buf[:n]...)
+		go func() {
+			log := cl.connLogger("client", raddr)
+			resp, err := cl.resolve(query, tgt, log)
+			if err != nil {
+				log.Debug("DNS query failed", "err", err)
+				return
+			}
+			if len(resp) > dns.UDPSize(query) {
+				if resp, err = dns.Truncate(resp); err != nil {
+					return
+				}
+			}
+			if _, err := c.WriteTo(resp, raddr); err != nil {
+				log.Debug("UDP local write error", "err", err)
+			}
+		}()
+	}
+}
+
+// ServeDNSTCP is ServeDNS for the DNS over TCP clients of l.
+func (cl *Client) ServeDNSTCP(ctx context.Context, l net.Listener, upstream string) error {
+	tgt := socks.ParseAddr(upstream)
+	if tgt == nil {
+		l.Close()
+		return errors.New("invalid upstream resolver " + upstream)
+	}
+	cl.Logger.Info("DNS over TCP", "addr", l.Addr(), "server", cl.Server, "upstream", upstream)
+	return cl.serve(ctx, l, func(c net.Conn) {
+		log := cl.connLogger("client", c.RemoteAddr())
+		for {
+			c.SetReadDeadline(time.Now().Add(dnsTimeout))
+			query, err := readTCPMessage(c)
+			if err != nil {
+				return
+			}
+			resp, err := cl.resolve(query, tgt, log)
+			if err != nil {
+				log.Debug("DNS query failed", "err", err)
+				return
+			}
+			if err := writeTCPMessage(c, nil, resp); err != nil {
+				log.Debug("failed to reply", "err", err)
+				return
+			}
+		}
+	})
+}
+
+// resolve returns the response to query.
+func (cl *Client) resolve(query []byte, upstream socks.Addr, log *logging.Logger) ([]byte, error) {
+	q, err := dns.ParseQuestion(query)
+	if err != nil {
+		return nil, err
+	}
+	if cl.FakeIP != nil && q.Name != "" && q.Class == dns.ClassINET && (q.Type == dns.TypeA || q.Type == dns.TypeAAAA) {
+		var ip net.IP // no IPv6 address, so that applications take the IPv4 one
+		if q.Type == dns.TypeA {
+			ip = cl.FakeIP.IP(q.Name)
+		}
+		log.Debug("DNS fake IP", "name", q.Name, "type", q.Type, "ip", ip)
+		return dns.Answer(query, q, ip, fakeIPTTL)
+	}
+
+	cl.dnsOnce.Do(func() { cl.dnsCache = dns.NewCache(dnsCacheSize) })
+	if resp := cl.dnsCache.Get(query); resp != nil {
+		log.Debug("DNS cached", "name", q.Name, "type", q.Type)
+		return resp, nil
+	}
+	resp, err := cl.exchange(query, upstream, log)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 2 || resp[0] != query[0] || resp[1] != query[1] {
+		return nil, errors.New("DNS response to another query")
+	}
+	log.Debug("DNS", "name", q.Name, "type", q.Type, "upstream", upstream)
+	cl.dnsCache.Put(query, resp)
+	return resp, nil
+}
+
+// exchange sends query to the resolver at upstream through the server, over
+// TCP or with DNSOverUDP through the UDP relay, and returns its response.
+func (cl *Client) exchange(query []byte, upstream socks.Addr, log *logging.Logger) ([]byte, error) {
+	deadline := time.Now().Add(dnsTimeout)
+	if cl.DNSOverUDP {
+		srvAddr, err := cl.udpServer()
+		if err != nil {
+			return nil, err
+		}
+		pc, err := cl.associate(log)
+		if err != nil {
+			return nil, err
+		}
+		defer pc.Close()
+		pc.SetDeadline(deadline)
+		if _, err := pc.WriteTo(append(append([]byte{}, upstream...), query...), srvAddr); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, udpBufSize)
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		src := socks.SplitAddr(buf[:n])
+		if src == nil {
+			return nil, errors.New("invalid source address")
+		}
+		return buf[len(src):n], nil
+	}
+
+	rc, _, release, err := cl.dialServer(log)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	defer rc.Close()
+	rc.SetDeadline(deadline)
+	if err := writeTCPMessage(rc, upstream, query); err != nil {
+		return nil, err
+	}
+	return readTCPMessage(rc)
+}
+
+// readTCPMessage reads a DNS message after its 2-byte length.
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeTCPMessage writes prefix, then msg after its 2-byte length, in a
+// single write.
+func writeTCPMessage(w io.Writer, prefix, msg []byte) error {
+	if len(msg) > 0xFFFF {
+		return errors.New("DNS message too large")
+	}
+	b := make([]byte, 0, len(prefix)+2+len(msg))
+	b = append(append(b, prefix...), byte(len(msg)>>8), byte(len(msg)))
+	_, err := w.Write(append(b, msg...))
+	return err
+}
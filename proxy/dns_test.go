@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+	"github.com/OperatorFoundation/go-shadowsocks2/dns"
+)
+
+// resolverDialer connects to an in-memory DNS over TCP resolver that answers
+// every query for an IPv4 address with 192.0.2.1, and counts the queries.
+type resolverDialer struct {
+	memoryDialer
+	queries int
+}
+
+func (d *resolverDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	left, right := net.Pipe()
+	go func() {
+		defer right.Close()
+		query, err := readTCPMessage(right)
+		if err != nil {
+			return
+		}
+		d.mutex.Lock()
+		d.targets = append(d.targets, address)
+		d.queries++
+		d.mutex.Unlock()
+		q, err := dns.ParseQuestion(query)
+		if err != nil {
+			return
+		}
+		resp, err := dns.Answer(query, q, net.ParseIP("192.0.2.1"), 300)
+		if err != nil {
+			return
+		}
+		writeTCPMessage(right, nil, resp)
+	}()
+	return left, nil
+}
+
+// dnsQuery returns a query for an IPv4 address of name.
+func dnsQuery(id uint16, name string) []byte {
+	b := []byte{byte(id >> 8), byte(id), 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	b = append(append(b, byte(len(name))), name...)
+	return append(b, 0, 0, dns.TypeA, 0, dns.ClassINET)
+}
+
+// lookup sends a query for name to the DNS server at addr over UDP, and
+// returns the address in the answer.
+func lookup(t *testing.T, addr, name string) net.IP {
+	t.Helper()
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write(dnsQuery(42, name)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 4 || buf[0] != 0 || buf[1] != 42 || buf[7] != 1 {
+		t.Fatalf("got response %v", buf[:n])
+	}
+	return net.IP(buf[n-4 : n])
+}
+
+func TestDNS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &resolverDialer{}
+	sl := listen(t)
+	server := &Server{Cipher: ciph, Dialer: dialer}
+	serve(func() error { return server.ServeTCP(ctx, sl) })
+
+	client := &Client{Server: sl.Addr().String(), Cipher: ciph}
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(func() error { return client.ServeDNS(ctx, c, "192.0.2.53:53") })
+	l := listen(t)
+	serve(func() error { return client.ServeDNSTCP(ctx, l, "192.0.2.53:53") })
+
+	for i := 0; i < 2; i++ {
+		if ip := lookup(t, c.LocalAddr().String(), "example"); !ip.Equal(net.ParseIP("192.0.2.1")) {
+			t.Errorf("got %v, want 192.0.2.1", ip)
+		}
+	}
+	tc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	if err := writeTCPMessage(tc, nil, dnsQuery(43, "example")); err != nil {
+		t.Fatal(err)
+	}
+	tc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if resp, err := readTCPMessage(tc); err != nil || resp[1] != 43 {
+		t.Fatalf("over TCP: got %v, %v", resp, err)
+	}
+	dialer.mutex.Lock()
+	if dialer.queries != 1 || dialer.targets[0] != "192.0.2.53:53" {
+		t.Errorf("resolver got %d queries, at %q; want 1, the others from the cache", dialer.queries, dialer.targets)
+	}
+	dialer.mutex.Unlock()
+}
+
+func TestFakeIP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &memoryDialer{}
+	sl := listen(t)
+	server := &Server{Cipher: ciph, Dialer: dialer}
+	serve(func() error { return server.ServeTCP(ctx, sl) })
+
+	fake, err := dns.NewFakeIP("198.18.0.0/15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{Server: sl.Addr().String(), Cipher: ciph, FakeIP: fake}
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(func() error { return client.ServeDNS(ctx, c, "192.0.2.53:53") })
+	ip := lookup(t, c.LocalAddr().String(), "example")
+	if !ip.Equal(net.ParseIP("198.18.0.1")) {
+		t.Fatalf("got %v, want 198.18.0.1", ip)
+	}
+
+	// A connection to the fake address goes to the name.
+	l := listen(t)
+	serve(func() error { return client.ServeTCPTunnel(ctx, l, net.JoinHostPort(ip.String(), "80")) })
+	roundtrip(t, l.Addr().String(), "hello")
+	dialer.mutex.Lock()
+	defer dialer.mutex.Unlock()
+	if len(dialer.targets) != 1 || dialer.targets[0] != "example:80" {
+		t.Errorf("server dialed %q, want [example:80]", dialer.targets)
+	}
+}
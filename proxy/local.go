@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+)
+
+// The protocols of the local proxy of ServeSOCKS.
+const (
+	protoSOCKS5 = iota
+	protoSOCKS4
+	protoHTTPConnect
+	protoHTTP
+)
+
+// localListener accepts the connections of ServeSOCKS as localConns.
+type localListener struct {
+	net.Listener
+}
+
+func (l *localListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	return &localConn{Conn: c, br: br, r: br}, nil
+}
+
+// localConn is a connection of ServeSOCKS, read through a buffer to tell its
+// protocol by its first byte.
+type localConn struct {
+	net.Conn
+	br    *bufio.Reader
+	r     io.Reader // br, after the rewritten head of a plain HTTP request
+	proto int
+}
+
+func (c *localConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// localRequest returns the target of a SOCKS5, SOCKS4, SOCKS4a or HTTP proxy
+// request, and leaves the reply to serveTCP, like socksRequest.
+func (cl *Client) localRequest(c net.Conn) (socks.Addr, error) {
+	lc := c.(*localConn)
+	b, err := lc.br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case 5:
+		lc.proto = protoSOCKS5
+		return cl.socksRequest(lc)
+	case 4:
+		lc.proto = protoSOCKS4
+		return cl.socks4Request(lc)
+	}
+	return cl.httpRequest(lc)
+}
+
+// localReply answers the request on c in its protocol.
+func localReply(c net.Conn, rep socks.Error, bnd socks.Addr) error {
+	lc := c.(*localConn)
+	switch lc.proto {
+	case protoSOCKS4:
+		return socks.Reply4(lc, rep, bnd)
+	case protoHTTPConnect:
+		if rep == 0 {
+			_, err := io.WriteString(lc, "HTTP/1.1 200 Connection established\r\n\r\n")
+			return err
+		}
+		return httpError(lc, httpStatus(rep), "")
+	case protoHTTP:
+		if rep == 0 {
+			return nil // the target responds
+		}
+		return httpError(lc, httpStatus(rep), "")
+	}
+	return socks.Reply(lc, rep, bnd)
+}
+
+// socks4Request returns the target of a SOCKS4 or SOCKS4a CONNECT or BIND,
+// with errBindRequest for a BIND. SOCKS4 has no password, so it is refused
+// when cl.SOCKSAuth is set.
+func (cl *Client) socks4Request(c *localConn) (socks.Addr, error) {
+	cmd, tgt, _, err := socks.Request4(c)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case cl.SOCKSAuth != nil:
+		socks.Reply4(c, socks.ErrConnectionNotAllowed, nil)
+		return nil, socks.ErrNoAcceptableMethod
+	case cmd == socks.CmdConnect:
+		return tgt, nil
+	case cmd == socks.CmdBind:
+		return tgt, errBindRequest
+	}
+	socks.Reply4(c, socks.ErrCommandNotSupported, nil)
+	return nil, socks.ErrCommandNotSupported
+}
+
+// httpRequest returns the target of an HTTP CONNECT, or of a plain HTTP
+// proxy request. The target gets the latter in origin form, with
+// "Connection: close" so that the next request comes on a new connection,
+// to its own target.
+func (cl *Client) httpRequest(c *localConn) (socks.Addr, error) {
+	req, err := http.ReadRequest(c.br)
+	if err != nil {
+		return nil, err
+	}
+	if cl.SOCKSAuth != nil && !proxyAuthorized(req, cl.SOCKSAuth) {
+		httpError(c, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"proxy\"\r\n")
+		return nil, socks.ErrAuthFailed
+	}
+
+	if req.Method == http.MethodConnect {
+		c.proto = protoHTTPConnect
+		tgt := socks.ParseAddr(req.Host)
+		if tgt == nil {
+			httpError(c, http.StatusBadRequest, "")
+			return nil, errors.New("invalid CONNECT target " + req.Host)
+		}
+		return tgt, nil
+	}
+
+	c.proto = protoHTTP
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		httpError(c, http.StatusBadRequest, "")
+		return nil, errors.New("not a proxy request: " + req.URL.String())
+	}
+	host := req.URL.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "80")
+	}
+	tgt := socks.ParseAddr(host)
+	if tgt == nil {
+		httpError(c, http.StatusBadRequest, "")
+		return nil, errors.New("invalid target " + req.URL.Host)
+	}
+
+	// The body, if any, stays in c.br, after the head.
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Set("Connection", "close")
+	if len(req.TransferEncoding) > 0 {
+		req.Header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	}
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "%s %s HTTP/%d.%d\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.ProtoMajor, req.ProtoMinor, req.Host)
+	req.Header.Write(&head)
+	head.WriteString("\r\n")
+	c.r = io.MultiReader(&head, c.br)
+	return tgt, nil
+}
+
+// proxyAuthorized reports whether req has the Basic credentials that auth
+// accepts.
+func proxyAuthorized(req *http.Request, auth socks.Auth) bool {
+	const prefix = "Basic "
+	h := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return false
+	}
+	credentials, err := base64.StdEncoding.DecodeString(h[len(prefix):])
+	if err != nil {
+		return false
+	}
+	username, password, ok := strings.Cut(string(credentials), ":")
+	return ok && auth(username, password)
+}
+
+// httpStatus returns the HTTP status for the SOCKS error rep.
+func httpStatus(rep socks.Error) int {
+	switch rep {
+	case socks.ErrConnectionNotAllowed:
+		return http.StatusForbidden
+	case socks.ErrTTLExpired:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// httpError writes a response of status with the extra header lines.
+func httpError(w io.Writer, status int, header string) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status), header)
+	return err
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+)
+
+func TestLocalProtocols(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &memoryDialer{}
+	sl := listen(t)
+	server := &Server{Cipher: ciph, Dialer: dialer}
+	serve(func() error { return server.ServeTCP(ctx, sl) })
+	pl := listen(t)
+	client := &Client{Server: sl.Addr().String(), Cipher: ciph}
+	serve(func() error { return client.ServeSOCKS(ctx, pl) })
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	// SOCKS4a
+	c := dial()
+	if _, err := io.WriteString(c, "\x04\x01\x00\x50\x00\x00\x00\x01\x00example.com\x00"); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 90 {
+		t.Fatalf("SOCKS4a: got reply %v", reply)
+	}
+	echo(t, c, "hello")
+
+	// HTTP CONNECT
+	c = dial()
+	if _, err := io.WriteString(c, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || br.Buffered() != 0 {
+		t.Fatalf("CONNECT: got %s, %d bytes more", resp.Status, br.Buffered())
+	}
+	echo(t, c, "hello")
+
+	// The target of a plain HTTP request gets it in origin form.
+	c = dial()
+	if _, err := io.WriteString(c, "GET http://example.com/path HTTP/1.1\r\nHost: example.com\r\nProxy-Connection: keep-alive\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	want := "GET /path HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	dialer.mutex.Lock()
+	defer dialer.mutex.Unlock()
+	if got, want := strings.Join(dialer.targets, " "), "example.com:80 example.com:443 example.com:80"; got != want {
+		t.Errorf("server dialed %q, want %q", dialer.targets, want)
+	}
+}
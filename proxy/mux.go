@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/internal"
+	"github.com/OperatorFoundation/go-shadowsocks2/logging"
+	"github.com/OperatorFoundation/go-shadowsocks2/mux"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+)
+
+// muxTarget is the target address that starts a mux session instead of a
+// connection. Names under .invalid are never real targets.
+var muxTarget = socks.ParseAddr("mux.invalid:0")
+
+// muxIdleTimeout is how long a mux session of a Client lasts without streams.
+const muxIdleTimeout = 5 * time.Minute
+
+// serveMux relays the streams of the mux session on sc, each to the target
+// address it starts with, until the session ends. The streams of user count
+// as connections of their own.
+func (s *Server) serveMux(sc net.Conn, user string, log *logging.Logger) {
+	session := mux.Server(sc)
+	defer session.Close()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	log.Debug("mux session")
+	for {
+		st, err := session.Accept()
+		if err != nil {
+			log.Debug("mux session ended", "err", err)
+			return
+		}
+		if s.Accountant != nil {
+			if err := s.Accountant.Allowed(accountName(user)); err != nil {
+				log.Info("refused", "err", err)
+				st.Close()
+				continue
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer st.Close()
+			ctx, cancel := s.handshakeContext()
+			defer cancel()
+			stop := internal.WatchContext(ctx, st)
+			tgt, err := socks.ReadAddr(st)
+			stop()
+			if err != nil {
+				log.Debug("failed to get target address", "err", err)
+				return
+			}
+			log.Debug("stream", "target", tgt)
+			s.serveTarget(ctx, st, tgt, user, log)
+		}()
+	}
+}
+
+// muxSessions are the mux sessions of a Client to a server.
+type muxSessions struct {
+	mutex    sync.Mutex
+	sessions []*muxSession
+}
+
+// muxSession is a mux session and its streams, under muxSessions.mutex.
+type muxSession struct {
+	*mux.Session
+	streams int
+	idle    *time.Timer
+}
+
+// muxStream opens a stream to server, over the session with the fewest
+// streams. It starts a session with dial while there are fewer than cl.Mux,
+// and reports whether it did.
+func (cl *Client) muxStream(server string, dial func() (net.Conn, error)) (net.Conn, bool, error) {
+	cl.muxMutex.Lock()
+	if cl.muxes == nil {
+		cl.muxes = make(map[string]*muxSessions)
+	}
+	ms := cl.muxes[server]
+	if ms == nil {
+		ms = &muxSessions{}
+		cl.muxes[server] = ms
+	}
+	cl.muxMutex.Unlock()
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	live := ms.sessions[:0]
+	for _, s := range ms.sessions {
+		if !s.IsClosed() {
+			live = append(live, s)
+		}
+	}
+	ms.sessions = live
+
+	var session *muxSession
+	fresh := len(ms.sessions) < cl.Mux
+	if fresh {
+		rc, err := dial()
+		if err != nil {
+			return nil, false, err
+		}
+		if _, err := rc.Write(muxTarget); err != nil {
+			rc.Close()
+			return nil, false, err
+		}
+		session = &muxSession{Session: mux.Client(rc)}
+		ms.sessions = append(ms.sessions, session)
+	} else {
+		for _, s := range ms.sessions {
+			if session == nil || s.streams < session.streams {
+				session = s
+			}
+		}
+	}
+
+	st, err := session.Open()
+	if err != nil {
+		return nil, fresh, err
+	}
+	session.streams++
+	if session.idle != nil {
+		session.idle.Stop()
+		session.idle = nil
+	}
+	return &muxConn{Stream: st, close: func() { ms.release(session) }}, fresh, nil
+}
+
+// release counts a stream of session as closed, and closes the session once it
+// has been idle for muxIdleTimeout.
+func (ms *muxSessions) release(session *muxSession) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	session.streams--
+	if session.streams > 0 {
+		return
+	}
+	var idle *time.Timer
+	idle = time.AfterFunc(muxIdleTimeout, func() {
+		ms.mutex.Lock()
+		defer ms.mutex.Unlock()
+		if session.idle == idle {
+			session.Close()
+		}
+	})
+	session.idle = idle
+}
+
+// muxConn is a stream of a Client that releases its session when closed.
+type muxConn struct {
+	*mux.Stream
+	once  sync.Once
+	close func()
+}
+
+func (c *muxConn) Close() error {
+	err := c.Stream.Close()
+	c.once.Do(c.close)
+	return err
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+)
+
+// countListener counts the connections it accepts.
+type countListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return c, err
+}
+
+func TestMuxTunnel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &memoryDialer{}
+	sl := &countListener{Listener: listen(t)}
+	server := &Server{Cipher: ciph, Dialer: dialer}
+	serve(func() error { return server.ServeTCP(ctx, sl) })
+	tl := listen(t)
+	client := &Client{Server: sl.Addr().String(), Cipher: ciph, Mux: 2}
+	serve(func() error { return client.ServeTCPTunnel(ctx, tl, "example.com:80") })
+
+	// The connections are open at the same time, over the two sessions.
+	var conns []net.Conn
+	for i := 0; i < 5; i++ {
+		c, err := net.Dial("tcp", tl.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+	for i, c := range conns {
+		echo(t, c, string(rune('a'+i))+" hello")
+	}
+
+	if n := atomic.LoadInt32(&sl.accepted); n != 2 {
+		t.Errorf("%d connections to the server, want 2", n)
+	}
+	dialer.mutex.Lock()
+	defer dialer.mutex.Unlock()
+	if len(dialer.targets) != 5 {
+		t.Errorf("dialed %q, want 5 times example.com:80", dialer.targets)
+	}
+	for _, target := range dialer.targets {
+		if target != "example.com:80" {
+			t.Errorf("dialed %q, want example.com:80", target)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/logging"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+)
+
+type mode int
+
+const (
+	remoteServer mode = iota
+	relayClient
+	socksClient
+	transparentClient
+)
+
+// Packet NAT table
+type natmap struct {
+	sync.RWMutex
+	m       map[string]net.PacketConn
+	timeout time.Duration
+	metrics Metrics
+}
+
+func newNATmap(timeout time.Duration, metrics Metrics) *natmap {
+	m := &natmap{}
+	m.m = make(map[string]net.PacketConn)
+	m.timeout = timeout
+	m.metrics = metrics
+	return m
+}
+
+func (m *natmap) Get(key string) net.PacketConn {
+	m.RLock()
+	defer m.RUnlock()
+	return m.m[key]
+}
+
+func (m *natmap) Set(key string, pc net.PacketConn) {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.m[key]; !ok {
+		m.metrics.NATEntries(1)
+	}
+	m.m[key] = pc
+}
+
+func (m *natmap) Del(key string) net.PacketConn {
+	m.Lock()
+	defer m.Unlock()
+
+	pc, ok := m.m[key]
+	if ok {
+		delete(m.m, key)
+		m.metrics.NATEntries(-1)
+		return pc
+	}
+	return nil
+}
+
+// Flush closes all associations, when their listener is closed.
+func (m *natmap) Flush() {
+	m.Lock()
+	defer m.Unlock()
+
+	for key, pc := range m.m {
+		pc.Close()
+		delete(m.m, key)
+		m.metrics.NATEntries(-1)
+	}
+}
+
+func (m *natmap) Add(peer net.Addr, dst, src net.PacketConn, role mode, log *logging.Logger) {
+	m.Set(peer.String(), src)
+
+	go func() {
+		err := timedCopy(dst, peer, src, m.timeout, role, m.metrics)
+		log.Debug("UDP association closed", "err", err)
+		if pc := m.Del(peer.String()); pc != nil {
+			pc.Close()
+		}
+	}()
+}
+
+// copy from src to dst at target with read timeout
+func timedCopy(dst net.PacketConn, target net.Addr, src net.PacketConn, timeout time.Duration, role mode, metrics Metrics) error {
+	buf := make([]byte, udpBufSize)
+
+	for {
+		src.SetReadDeadline(time.Now().Add(timeout))
+		n, raddr, err := src.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		payload := n
+		switch role {
+		case remoteServer: // server -> client: add original packet source
+			srcAddr := socks.ParseAddr(raddr.String())
+			copy(buf[len(srcAddr):], buf[:n])
+			copy(buf, srcAddr)
+			_, err = dst.WriteTo(buf[:len(srcAddr)+n], target)
+		case relayClient: // client -> user: strip original packet source
+			srcAddr := socks.SplitAddr(buf[:n])
+			payload -= len(srcAddr)
+			_, err = dst.WriteTo(buf[len(srcAddr):n], target)
+		case socksClient: // client -> socks5 program: just set RSV and FRAG = 0
+			payload -= len(socks.SplitAddr(buf[:n]))
+			_, err = dst.WriteTo(append([]byte{0, 0, 0}, buf[:n]...), target)
+		case transparentClient: // client -> user: keep the source, to send from it
+			payload -= len(socks.SplitAddr(buf[:n]))
+			_, err = dst.WriteTo(buf[:n], target)
+		}
+
+		if err != nil {
+			return err
+		}
+		metrics.Relayed("udp", false, payload)
+	}
+}
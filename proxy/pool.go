@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+	"github.com/OperatorFoundation/go-shadowsocks2/logging"
+)
+
+// Strategy is how a Pool picks the server of a connection among the healthy
+// ones.
+type Strategy string
+
+const (
+	// RoundRobin takes the servers in turn.
+	RoundRobin Strategy = "round-robin"
+	// LeastConnections takes the server with the fewest open connections.
+	LeastConnections Strategy = "least-connections"
+	// Latency takes the server with the fastest connections and handshakes.
+	Latency Strategy = "latency"
+)
+
+// DefaultHealthCheck is the interval of the health checks of a Pool if
+// Pool.HealthCheck is 0.
+const DefaultHealthCheck = 30 * time.Second
+
+// The backoff of a failed server doubles with each failure in a row.
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// Upstream is a server of a Pool.
+type Upstream struct {
+	// Server is the address of the server.
+	Server string
+	Cipher core.Cipher
+}
+
+// Pool spreads the TCP connections of a Client over several servers. A
+// server that fails to connect or to handshake is taken out of the pool for a
+// backoff that doubles with each failure in a row, and comes back when a
+// health check or a connection succeeds. When every server is out, the
+// connections try them all anyway, the soonest back first.
+type Pool struct {
+	// HealthCheck is the interval of the health checks, see Client.CheckPool.
+	HealthCheck time.Duration
+
+	strategy  Strategy
+	upstreams []*upstream
+	next      uint64 // of RoundRobin
+}
+
+// upstream is a server of a Pool and its health.
+type upstream struct {
+	Upstream
+	conns int64 // open, atomic
+
+	mutex    sync.Mutex
+	failures int // in a row
+	retryAt  time.Time
+	latency  time.Duration // moving average, 0 until measured
+}
+
+// NewPool returns a pool of upstreams picked with strategy, RoundRobin if "".
+func NewPool(strategy Strategy, upstreams ...Upstream) (*Pool, error) {
+	switch strategy {
+	case "":
+		strategy = RoundRobin
+	case RoundRobin, LeastConnections, Latency:
+	default:
+		return nil, fmt.Errorf("unknown balancing strategy %s", strategy)
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream servers")
+	}
+	p := &Pool{strategy: strategy}
+	for _, u := range upstreams {
+		p.upstreams = append(p.upstreams, &upstream{Upstream: u})
+	}
+	return p, nil
+}
+
+func (p *Pool) healthCheck() time.Duration {
+	if p.HealthCheck == 0 {
+		return DefaultHealthCheck
+	}
+	return p.HealthCheck
+}
+
+// order returns the upstreams in the order to try them: the healthy ones by
+// the strategy, then the others by when they come back.
+func (p *Pool) order() []*upstream {
+	now := time.Now()
+	var healthy, failed []*upstream
+	retryAt := make(map[*upstream]time.Time)
+	latency := make(map[*upstream]time.Duration)
+	for _, u := range p.upstreams {
+		u.mutex.Lock()
+		retryAt[u], latency[u] = u.retryAt, u.latency
+		u.mutex.Unlock()
+		if now.Before(retryAt[u]) {
+			failed = append(failed, u)
+		} else {
+			healthy = append(healthy, u)
+		}
+	}
+
+	if n := len(healthy); n > 1 {
+		// Rotate first, so that the ties of the other strategies take turns.
+		i := int(atomic.AddUint64(&p.next, 1) % uint64(n))
+		healthy = append(healthy[i:], healthy[:i]...)
+	}
+	switch p.strategy {
+	case LeastConnections:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return atomic.LoadInt64(&healthy[i].conns) < atomic.LoadInt64(&healthy[j].conns)
+		})
+	case Latency:
+		sort.SliceStable(healthy, func(i, j int) bool { return latency[healthy[i]] < latency[healthy[j]] })
+	}
+	sort.SliceStable(failed, func(i, j int) bool { return retryAt[failed[i]].Before(retryAt[failed[j]]) })
+	return append(healthy, failed...)
+}
+
+// succeeded records a connection to u that took latency, 0 if not measured,
+// and logs u coming back.
+func (p *Pool) succeeded(u *upstream, latency time.Duration, log *logging.Logger) {
+	u.mutex.Lock()
+	wasDown := u.failures > 0
+	u.failures, u.retryAt = 0, time.Time{}
+	if u.latency == 0 {
+		u.latency = latency
+	} else if latency > 0 {
+		u.latency = (7*u.latency + latency) / 8
+	}
+	u.mutex.Unlock()
+	if wasDown {
+		log.Info("server back", "server", u.Server, "latency", latency)
+	}
+}
+
+// failed records a failed connection to u, and takes u out for its backoff.
+func (p *Pool) failed(u *upstream, err error, log *logging.Logger) {
+	u.mutex.Lock()
+	u.failures++
+	backoff := maxBackoff
+	if u.failures < 10 {
+		backoff = minBackoff << (u.failures - 1)
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	u.retryAt = time.Now().Add(backoff)
+	failures := u.failures
+	u.mutex.Unlock()
+	log.Warn("server failed", "server", u.Server, "err", err, "failures", failures, "retry", backoff)
+}
+
+// acquire counts a connection to u until the returned function is called.
+func (u *upstream) acquire() (release func()) {
+	atomic.AddInt64(&u.conns, 1)
+	return func() { atomic.AddInt64(&u.conns, -1) }
+}
+
+// dialServer connects to a server of cl and runs the handshake, each attempt
+// within the handshake timeout, or opens a stream of a mux session. With a
+// Pool, it tries the servers in the order of the strategy until one succeeds.
+// release is called when the connection ends.
+func (cl *Client) dialServer(log *logging.Logger) (rc net.Conn, server string, release func(), err error) {
+	if cl.Pool == nil {
+		rc, _, err = cl.connect(cl.Server, cl.Cipher)
+		return rc, cl.Server, func() {}, err
+	}
+	for _, u := range cl.Pool.order() {
+		start := time.Now()
+		var fresh bool
+		rc, fresh, err = cl.connect(u.Server, u.Cipher)
+		if err == nil {
+			var latency time.Duration // none for a stream of a running session
+			if fresh {
+				latency = time.Since(start)
+			}
+			cl.Pool.succeeded(u, latency, cl.Logger)
+			return rc, u.Server, u.acquire(), nil
+		}
+		cl.Pool.failed(u, err, cl.Logger)
+		log.Debug("trying the next server", "server", u.Server, "err", err)
+	}
+	return nil, "", nil, err
+}
+
+// connect returns a connection to server: a new one after the handshake of
+// ciph, or a stream if cl.Mux is set. fresh reports whether it ran a
+// handshake.
+func (cl *Client) connect(server string, ciph core.Cipher) (rc net.Conn, fresh bool, err error) {
+	dial := func() (net.Conn, error) {
+		ctx, cancel := cl.handshakeContext()
+		defer cancel()
+		return cl.handshake(ctx, server, ciph)
+	}
+	if cl.Mux > 0 {
+		return cl.muxStream(server, dial)
+	}
+	rc, err = dial()
+	return rc, true, err
+}
+
+// handshake connects to server and runs the handshake of ciph, within ctx.
+func (cl *Client) handshake(ctx context.Context, server string, ciph core.Cipher) (net.Conn, error) {
+	var d net.Dialer
+	rc, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	if cl.TCPCork {
+		rc = timedCork(rc, 10*time.Millisecond, 1280)
+	}
+	sc, err := core.StreamConnContext(ctx, ciph, rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// CheckPool runs the health checks of cl.Pool until ctx is done. Every
+// HealthCheck, it connects to each server that is not waiting out a backoff
+// and runs the handshake: a full key exchange for DarkStar, a connection for
+// the ciphers whose handshake waits for data. It returns nil without a Pool.
+func (cl *Client) CheckPool(ctx context.Context) error {
+	p := cl.Pool
+	if p == nil {
+		return nil
+	}
+	interval := p.healthCheck()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		now := time.Now()
+		var wg sync.WaitGroup
+		for _, u := range p.upstreams {
+			u.mutex.Lock()
+			waiting := now.Before(u.retryAt)
+			u.mutex.Unlock()
+			if waiting {
+				continue
+			}
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+				checkCtx, cancel := context.WithTimeout(ctx, interval)
+				defer cancel()
+				start := time.Now()
+				rc, err := cl.handshake(checkCtx, u.Server, u.Cipher)
+				if err != nil {
+					if ctx.Err() == nil {
+						p.failed(u, err, cl.Logger)
+					}
+					return
+				}
+				rc.Close()
+				p.succeeded(u, time.Since(start), cl.Logger)
+			}(u)
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+)
+
+// deadAddr returns the address of a closed listener.
+func deadAddr(t *testing.T) string {
+	l := listen(t)
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestPoolFailover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := listen(t)
+	server := &Server{Cipher: ciph, Dialer: &memoryDialer{}}
+	serve(func() error { return server.ServeTCP(ctx, sl) })
+
+	dead := deadAddr(t)
+	pool, err := NewPool(RoundRobin, Upstream{dead, ciph}, Upstream{sl.Addr().String(), ciph})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := listen(t)
+	client := &Client{Pool: pool}
+	serve(func() error { return client.ServeTCPTunnel(ctx, tl, "example.com:80") })
+
+	// Whichever server comes first, every connection gets through.
+	for i := 0; i < 3; i++ {
+		roundtrip(t, tl.Addr().String(), "hello")
+	}
+	if order := pool.order(); order[0].Server != sl.Addr().String() {
+		t.Errorf("%s first after it failed", order[0].Server)
+	}
+	u := pool.upstreams[0]
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.failures != 1 || !time.Now().Before(u.retryAt) {
+		t.Errorf("dead server: %d failures, retry at %v", u.failures, u.retryAt)
+	}
+}
+
+func TestPoolOrder(t *testing.T) {
+	upstreams := []Upstream{{Server: "a"}, {Server: "b"}, {Server: "c"}}
+	servers := func(p *Pool) string {
+		var s string
+		for _, u := range p.order() {
+			s += u.Server
+		}
+		return s
+	}
+
+	p, err := NewPool("", upstreams...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		seen[servers(p)[:1]] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("round robin took %v first", seen)
+	}
+	p.failed(p.upstreams[1], context.DeadlineExceeded, nil)
+	for i := 0; i < 3; i++ {
+		if order := servers(p); order[2] != 'b' {
+			t.Errorf("round robin with b failed: %s", order)
+		}
+	}
+
+	p, _ = NewPool(LeastConnections, upstreams...)
+	release := p.upstreams[0].acquire()
+	p.upstreams[2].acquire()
+	p.upstreams[2].acquire()
+	if order := servers(p); order != "bac" {
+		t.Errorf("least connections: %s, want bac", order)
+	}
+	release()
+	if order := servers(p)[2]; order != 'c' {
+		t.Errorf("least connections: %c last, want c", order)
+	}
+
+	p, _ = NewPool(Latency, upstreams...)
+	p.succeeded(p.upstreams[0], 30*time.Millisecond, nil)
+	p.succeeded(p.upstreams[1], 10*time.Millisecond, nil)
+	p.succeeded(p.upstreams[2], 20*time.Millisecond, nil)
+	if order := servers(p); order != "bca" {
+		t.Errorf("latency: %s, want bca", order)
+	}
+
+	if _, err := NewPool("random", upstreams...); err == nil {
+		t.Error("unknown strategy accepted")
+	}
+	if _, err := NewPool(RoundRobin); err == nil {
+		t.Error("empty pool accepted")
+	}
+}
+
+func TestCheckPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := listen(t)
+	t.Cleanup(func() { up.Close() })
+	go func() {
+		for {
+			c, err := up.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	pool, err := NewPool(Latency, Upstream{deadAddr(t), ciph}, Upstream{up.Addr().String(), ciph})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.HealthCheck = 10 * time.Millisecond
+	client := &Client{Pool: pool}
+	done := serve(func() error { return client.CheckPool(ctx) })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dead, live := pool.upstreams[0], pool.upstreams[1]
+		dead.mutex.Lock()
+		live.mutex.Lock()
+		ok := dead.failures > 0 && live.failures == 0 && live.latency > 0
+		dead.mutex.Unlock()
+		live.mutex.Unlock()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("health checks did not tell the servers apart")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("CheckPool did not return")
+	}
+	var nilPool Client
+	if err := nilPool.CheckPool(ctx); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,157 @@
+// Package proxy runs Shadowsocks servers and clients over listeners that the
+// caller opens, so that they can be embedded in other programs.
+//
+//	ciph, _ := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+//	server := &proxy.Server{Cipher: ciph}
+//	l, _ := net.Listen("tcp", ":8488")
+//	err := server.ServeTCP(ctx, l)
+//
+// The Serve methods return when ctx is done, with nil, or when the listener
+// fails. They close the listener when they return; the connections they
+// accepted keep being relayed until they end on their own.
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/logging"
+)
+
+// DefaultUDPTimeout is how long an idle UDP association lasts if
+// Options.UDPTimeout is 0.
+const DefaultUDPTimeout = 5 * time.Minute
+
+const udpBufSize = 64 * 1024
+
+// Options are the settings common to Servers and Clients.
+type Options struct {
+	// Logger logs listeners, connections and errors. nil discards them.
+	Logger *logging.Logger
+	// Metrics is told about relays, bytes and handshakes, if not nil.
+	Metrics Metrics
+	// Conns tracks the accepted TCP connections, if not nil.
+	Conns *Conns
+	// UDPTimeout is how long an idle UDP association lasts.
+	UDPTimeout time.Duration
+	// TCPCork coalesces the first few writes to the server.
+	TCPCork bool
+	// HandshakeTimeout limits the handshake of a TCP connection: on a Server,
+	// until the target address is read, after which the connection is
+	// dropped; on a Client, dialing the server and its handshake. 0 is no
+	// limit.
+	HandshakeTimeout time.Duration
+}
+
+// Metrics is told what Servers and Clients do, for example to export
+// counters. Its methods are called concurrently.
+type Metrics interface {
+	// TCPRelays is called with 1 when a TCP relay starts and -1 when it ends.
+	TCPRelays(delta int)
+	// NATEntries is called with 1 when a UDP association starts and -1 when it ends.
+	NATEntries(delta int)
+	// Relayed is called with the payload bytes relayed over protocol, tcp or
+	// udp. Upload is from the client to the target.
+	Relayed(protocol string, upload bool, n int)
+	// Handshake is called with the result of the handshake of every TCP
+	// connection to a Server: nil on success.
+	Handshake(err error)
+	// Blackholed is called when a Server holds a connection open and ignores
+	// it, with the reason.
+	Blackholed(reason error)
+	// Denied is called when the ACL of a Server denies a TCP connection or a
+	// UDP packet, with the rule.
+	Denied(protocol, rule string)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) TCPRelays(int)             {}
+func (nopMetrics) NATEntries(int)            {}
+func (nopMetrics) Relayed(string, bool, int) {}
+func (nopMetrics) Handshake(error)           {}
+func (nopMetrics) Blackholed(error)          {}
+func (nopMetrics) Denied(string, string)     {}
+
+func (o *Options) metrics() Metrics {
+	if o.Metrics == nil {
+		return nopMetrics{}
+	}
+	return o.Metrics
+}
+
+func (o *Options) udpTimeout() time.Duration {
+	if o.UDPTimeout == 0 {
+		return DefaultUDPTimeout
+	}
+	return o.UDPTimeout
+}
+
+// handshakeContext returns the context that bounds a handshake.
+func (o *Options) handshakeContext() (context.Context, context.CancelFunc) {
+	if o.HandshakeTimeout == 0 {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), o.HandshakeTimeout)
+}
+
+var lastConnID uint64
+
+// connLogger returns the logger of a new connection or UDP association,
+// which adds a process-wide ID and keyvals to every record.
+func (o *Options) connLogger(keyvals ...interface{}) *logging.Logger {
+	return o.Logger.With(append([]interface{}{"conn", atomic.AddUint64(&lastConnID, 1)}, keyvals...)...)
+}
+
+// closeOnDone closes c when ctx is done, until stop is called.
+func closeOnDone(ctx context.Context, c io.Closer) (stop func()) {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stopped:
+		}
+	}()
+	return func() { close(stopped) }
+}
+
+// serve accepts connections on l and handles each in its own goroutine,
+// until ctx is done or l fails.
+func (o *Options) serve(ctx context.Context, l net.Listener, handle func(net.Conn)) error {
+	defer l.Close()
+	defer closeOnDone(ctx, l)()
+
+	var delay time.Duration
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// Like net/http, retry when out of file descriptors and the like.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				o.Logger.Warn("failed to accept", "addr", l.Addr(), "err", err)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		o.Conns.add(c)
+		go func() {
+			defer c.Close()
+			defer o.Conns.remove(c)
+			handle(c)
+		}()
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+)
+
+func TestMain(m *testing.M) {
+	// The client and the server of a test share the salt filter of the
+	// process, where the salts of the client would look like replays.
+	os.Setenv("SHADOWSOCKS_SF_CAPACITY", "0")
+	os.Exit(m.Run())
+}
+
+func listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// serve runs serve in the background and returns a channel of its result.
+func serve(serve func() error) <-chan error {
+	ch := make(chan error, 1)
+	go func() { ch <- serve() }()
+	return ch
+}
+
+func echoServer(t *testing.T) string {
+	l := listen(t)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestTCPTunnel(t *testing.T) {
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sl := listen(t)
+	server := &Server{Cipher: ciph}
+	serverDone := serve(func() error { return server.ServeTCP(ctx, sl) })
+
+	tl := listen(t)
+	client := &Client{Server: sl.Addr().String(), Cipher: ciph}
+	clientDone := serve(func() error { return client.ServeTCPTunnel(ctx, tl, echoServer(t)) })
+
+	c, err := net.Dial("tcp", tl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("hello through the tunnel")
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(msg) {
+		t.Errorf("got %q, want %q", got, msg)
+	}
+	c.Close()
+
+	cancel()
+	for _, done := range []<-chan error{serverDone, clientDone} {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Serve returned %v after cancel, want nil", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Serve did not return after cancel")
+		}
+	}
+	if _, err := net.Dial("tcp", tl.Addr().String()); err == nil {
+		t.Error("listener still open after Serve returned")
+	}
+}
+
+func TestTCPTunnelInvalidTarget(t *testing.T) {
+	client := &Client{Server: "127.0.0.1:1"}
+	l := listen(t)
+	if err := client.ServeTCPTunnel(context.Background(), l, "no port"); err == nil {
+		t.Error("ServeTCPTunnel accepted an invalid target")
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("listener still open")
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := listen(t)
+	server := &Server{Cipher: ciph, Options: Options{HandshakeTimeout: 100 * time.Millisecond}}
+	serve(func() error { return server.ServeTCP(ctx, l) })
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte{1, 2, 3}) // less than a salt, then nothing
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v, want the server to close the connection", err)
+	}
+}
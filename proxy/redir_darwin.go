@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/pfutil"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+)
+
+// ServeRedir relays the TCP connections redirected by Packet Filter and accepted on l.
+func (cl *Client) ServeRedir(ctx context.Context, l net.Listener) error {
+	return cl.serveTCP(ctx, l, natLookup, nil)
+}
+
+func (cl *Client) ServeRedir6(ctx context.Context, l net.Listener) error {
+	l.Close()
+	return errors.New("TCP6 redirect not supported")
+}
+
+func natLookup(c net.Conn) (socks.Addr, error) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		addr, err := pfutil.NatLookup(tc)
+		return socks.ParseAddr(addr.String()), err
+	}
+	panic("not TCP connection")
+}
@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"context"
+	"net"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/nfutil"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+)
+
+func getOrigDst(c net.Conn, ipv6 bool) (socks.Addr, error) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		addr, err := nfutil.GetOrigDst(tc, ipv6)
+		return socks.ParseAddr(addr.String()), err
+	}
+	panic("not a TCP connection")
+}
+
+// ServeRedir relays the netfilter redirected TCP connections accepted on l.
+func (cl *Client) ServeRedir(ctx context.Context, l net.Listener) error {
+	cl.Logger.Info("TCP redirect", "addr", l.Addr(), "server", cl.Server)
+	return cl.serveTCP(ctx, l, func(c net.Conn) (socks.Addr, error) { return getOrigDst(c, false) }, nil)
+}
+
+// ServeRedir6 relays the netfilter redirected TCP IPv6 connections accepted on l.
+func (cl *Client) ServeRedir6(ctx context.Context, l net.Listener) error {
+	cl.Logger.Info("TCP6 redirect", "addr", l.Addr(), "server", cl.Server)
+	return cl.serveTCP(ctx, l, func(c net.Conn) (socks.Addr, error) { return getOrigDst(c, true) }, nil)
+}
@@ -0,0 +1,19 @@
+// +build !linux,!darwin
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+func (cl *Client) ServeRedir(ctx context.Context, l net.Listener) error {
+	l.Close()
+	return errors.New("TCP redirect not supported")
+}
+
+func (cl *Client) ServeRedir6(ctx context.Context, l net.Listener) error {
+	l.Close()
+	return errors.New("TCP6 redirect not supported")
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// relay copies between left and right bidirectionally. left is the side of the
+// client, so that bytes from left to right are the upload.
+func (o *Options) relay(left, right net.Conn) error {
+	var err, err1 error
+	var wg sync.WaitGroup
+	var wait = 5 * time.Second
+	metrics := o.metrics()
+	metrics.TCPRelays(1)
+	defer metrics.TCPRelays(-1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err1 = io.Copy(&meteredWriter{right, metrics, true}, left)
+		right.SetReadDeadline(time.Now().Add(wait)) // unblock read on right
+	}()
+	_, err = io.Copy(&meteredWriter{left, metrics, false}, right)
+	left.SetReadDeadline(time.Now().Add(wait)) // unblock read on left
+	wg.Wait()
+	if err1 != nil && !errors.Is(err1, os.ErrDeadlineExceeded) { // requires Go 1.15+
+		return err1
+	}
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	return nil
+}
+
+// meteredWriter counts the bytes of a TCP relay written through it.
+type meteredWriter struct {
+	io.Writer
+	metrics Metrics
+	upload  bool
+}
+
+func (m *meteredWriter) Write(b []byte) (int, error) {
+	n, err := m.Writer.Write(b)
+	m.metrics.Relayed("tcp", m.upload, n)
+	return n, err
+}
+
+type corkedConn struct {
+	net.Conn
+	bufw   *bufio.Writer
+	corked bool
+	delay  time.Duration
+	err    error
+	lock   sync.Mutex
+	once   sync.Once
+}
+
+func timedCork(c net.Conn, d time.Duration, bufSize int) net.Conn {
+	return &corkedConn{
+		Conn:   c,
+		bufw:   bufio.NewWriterSize(c, bufSize),
+		corked: true,
+		delay:  d,
+	}
+}
+
+func (w *corkedConn) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.corked {
+		w.once.Do(func() {
+			time.AfterFunc(w.delay, func() {
+				w.lock.Lock()
+				defer w.lock.Unlock()
+				w.corked = false
+				w.err = w.bufw.Flush()
+			})
+		})
+		return w.bufw.Write(p)
+	}
+	return w.Conn.Write(p)
+}
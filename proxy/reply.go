@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/acl"
+	"github.com/OperatorFoundation/go-shadowsocks2/internal"
+	"github.com/OperatorFoundation/go-shadowsocks2/logging"
+	"github.com/OperatorFoundation/go-shadowsocks2/route"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+)
+
+// connectTarget and bindTarget are the target addresses that start a CONNECT
+// or a BIND with replies: the real target follows, and the server answers
+// with SOCKS replies before the relay.
+var (
+	connectTarget = socks.ParseAddr("connect.invalid:0")
+	bindTarget    = socks.ParseAddr("bind.invalid:0")
+)
+
+// bindTimeout is how long a BIND waits for its peer to connect.
+const bindTimeout = 2 * time.Minute
+
+// errBindRequest is returned by socksRequest for a BIND, which serveTCP
+// answers.
+var errBindRequest = errors.New("SOCKS BIND")
+
+// replyError returns the SOCKS reply for err, the error of a connection to a
+// target.
+func replyError(err error) socks.Error {
+	var denied *acl.DeniedError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &denied):
+		return socks.ErrConnectionNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks.ErrConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks.ErrNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socks.ErrHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socks.ErrTTLExpired
+	}
+	return socks.ErrGeneralFailure
+}
+
+// serverRequest sends marker and tgt to the server on rc, and reads its reply
+// within ctx.
+func serverRequest(ctx context.Context, rc net.Conn, marker, tgt socks.Addr) (socks.Error, socks.Addr, error) {
+	if _, err := rc.Write(append(append([]byte{}, marker...), tgt...)); err != nil {
+		return 0, nil, err
+	}
+	stop := internal.WatchContext(ctx, rc)
+	rep, bnd, err := socks.ReadReply(rc)
+	if ctxErr := stop(); err != nil && ctxErr != nil {
+		err = ctxErr
+	}
+	return rep, bnd, err
+}
+
+// forwardReply answers the request on c with the reply rep and bnd of the
+// server, or a failure if reading it failed with err. It reports whether the
+// reply is a success.
+func forwardReply(c net.Conn, reply func(net.Conn, socks.Error, socks.Addr) error, rep socks.Error, bnd socks.Addr, err error, log *logging.Logger) bool {
+	if err != nil {
+		log.Debug("failed to get the reply of the server", "err", err)
+		reply(c, socks.ErrGeneralFailure, nil)
+		return false
+	}
+	if err = reply(c, rep, bnd); err != nil {
+		log.Debug("failed to reply", "err", err)
+		return false
+	}
+	if rep != 0 {
+		log.Debug("refused by the server", "reply", rep)
+		return false
+	}
+	return true
+}
+
+// acceptPeer listens for the peer at tgt to connect, the second connection
+// of a protocol like FTP, for the client on c. It replies with the address it
+// listens on, then with the address of the peer, and returns the connection
+// of the peer.
+func acceptPeer(c net.Conn, tgt socks.Addr, reply func(socks.Error, socks.Addr) error) (net.Conn, error) {
+	peer, err := net.ResolveTCPAddr("tcp", tgt.String())
+	if err != nil {
+		reply(socks.ErrHostUnreachable, nil)
+		return nil, err
+	}
+	l, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		reply(socks.ErrGeneralFailure, nil)
+		return nil, err
+	}
+	defer l.Close()
+	if err = reply(0, boundAddr(l, peer, c)); err != nil {
+		return nil, err
+	}
+
+	l.SetDeadline(time.Now().Add(bindTimeout))
+	for {
+		pc, err := l.AcceptTCP()
+		if err != nil {
+			reply(replyError(err), nil)
+			return nil, err
+		}
+		raddr := pc.RemoteAddr().(*net.TCPAddr)
+		if !peer.IP.IsUnspecified() && !raddr.IP.Equal(peer.IP) {
+			pc.Close() // not the peer
+			continue
+		}
+		if err = reply(0, socks.ParseAddr(raddr.String())); err != nil {
+			pc.Close()
+			return nil, err
+		}
+		return pc, nil
+	}
+}
+
+// boundAddr returns the address of l for the peer: its port, on the address
+// that routes to the peer, or else the local address of c.
+func boundAddr(l *net.TCPListener, peer *net.TCPAddr, c net.Conn) socks.Addr {
+	var ip net.IP
+	if !peer.IP.IsUnspecified() {
+		// connecting a UDP socket sends nothing, but picks the route
+		if uc, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: peer.IP, Port: 9}); err == nil {
+			ip = uc.LocalAddr().(*net.UDPAddr).IP
+			uc.Close()
+		}
+	}
+	if a, ok := c.LocalAddr().(*net.TCPAddr); ip == nil && ok {
+		ip = a.IP
+	}
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	return socks.ParseAddr(net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+}
+
+// bind relays c to the peer at tgt once it connects, if the ACL allows it.
+func (s *Server) bind(c net.Conn, tgt socks.Addr, log *logging.Logger) {
+	if _, err := s.checkTarget(tgt, log); err != nil {
+		socks.Reply(c, replyError(err), nil)
+		return
+	}
+	rc, err := acceptPeer(c, tgt, func(rep socks.Error, bnd socks.Addr) error { return socks.Reply(c, rep, bnd) })
+	if err != nil {
+		log.Debug("failed to bind", "target", tgt, "err", err)
+		return
+	}
+	defer rc.Close()
+
+	log.Debug("bind", "target", tgt, "peer", rc.RemoteAddr())
+	if err = s.relay(c, rc); err != nil {
+		log.Debug("relay error", "err", err)
+	}
+	log.Debug("closed")
+}
+
+// bind answers a SOCKS BIND on c for the peer at tgt: directly, or through
+// a server with ServerReplies. ctx bounds the first reply of the server.
+func (cl *Client) bind(ctx context.Context, c net.Conn, tgt socks.Addr, action route.Action, reply func(net.Conn, socks.Error, socks.Addr) error, log *logging.Logger) {
+	replyTo := func(rep socks.Error, bnd socks.Addr) error { return reply(c, rep, bnd) }
+	if action == route.Direct {
+		rc, err := acceptPeer(c, tgt, replyTo)
+		if err != nil {
+			log.Debug("failed to bind", "target", tgt, "err", err)
+			return
+		}
+		defer rc.Close()
+		log.Debug("direct bind", "target", tgt, "peer", rc.RemoteAddr())
+		if err = cl.relay(c, rc); err != nil {
+			log.Debug("relay error", "err", err)
+		}
+		log.Debug("closed")
+		return
+	}
+
+	if !cl.ServerReplies {
+		replyTo(socks.ErrCommandNotSupported, nil)
+		return
+	}
+	rc, server, release, err := cl.dialServer(log)
+	if err != nil {
+		log.Warn("failed to connect to server", "err", err)
+		replyTo(socks.ErrGeneralFailure, nil)
+		return
+	}
+	defer release()
+	defer rc.Close()
+
+	// one reply once the server listens, one once the peer connects
+	rep, bnd, err := serverRequest(ctx, rc, bindTarget, tgt)
+	if !forwardReply(c, reply, rep, bnd, err, log) {
+		return
+	}
+	rep, bnd, err = socks.ReadReply(rc)
+	if !forwardReply(c, reply, rep, bnd, err, log) {
+		return
+	}
+
+	log.Debug("bind", "server", server, "target", tgt, "peer", bnd)
+	if err = cl.relay(c, rc); err != nil {
+		log.Debug("relay error", "err", err)
+	}
+	log.Debug("closed")
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+)
+
+// replyingClient serves a SOCKS proxy for a client with ServerReplies, of a
+// server that connects to the targets directly.
+func replyingClient(t *testing.T, ctx context.Context) string {
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := listen(t)
+	server := &Server{Cipher: ciph}
+	serve(func() error { return server.ServeTCP(ctx, sl) })
+	pl := listen(t)
+	client := &Client{Server: sl.Addr().String(), Cipher: ciph, ServerReplies: true}
+	serve(func() error { return client.ServeSOCKS(ctx, pl) })
+	return pl.Addr().String()
+}
+
+func TestServerReplies(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	local := &SOCKS5Dialer{Addr: replyingClient(t, ctx)}
+
+	target := echoServer(t)
+	c, err := local.DialContext(ctx, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echo(t, c, "hello")
+
+	_, err = local.DialContext(ctx, "tcp", deadAddr(t))
+	if err == nil || !strings.Contains(err.Error(), "reply 5") {
+		t.Errorf("closed port: got %v, want reply 5, connection refused", err)
+	}
+}
+
+func TestBind(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := net.Dial("tcp", replyingClient(t, ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	request := append([]byte{5, 1, socks.MethodNoAuth, 5, socks.CmdBind, 0}, socks.ParseAddr("127.0.0.1:0")...)
+	if _, err := c.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(c, method); err != nil {
+		t.Fatal(err)
+	}
+	rep, bnd, err := socks.ReadReply(c)
+	if err != nil || rep != 0 {
+		t.Fatalf("first reply: %v, %v", rep, err)
+	}
+
+	// The peer connects to the address of the first reply.
+	peer, err := net.Dial("tcp", bnd.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	rep, addr, err := socks.ReadReply(c)
+	if err != nil || rep != 0 {
+		t.Fatalf("second reply: %v, %v", rep, err)
+	}
+	if addr.String() != peer.LocalAddr().String() {
+		t.Errorf("second reply: got %s, want the peer at %s", addr, peer.LocalAddr())
+	}
+
+	if _, err := io.WriteString(peer, "from the peer"); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len("from the peer"))
+	if _, err := io.ReadFull(c, got); err != nil || string(got) != "from the peer" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if _, err := io.WriteString(c, "to the peer"); err != nil {
+		t.Fatal(err)
+	}
+	got = make([]byte, len("to the peer"))
+	if _, err := io.ReadFull(peer, got); err != nil || string(got) != "to the peer" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
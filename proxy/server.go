@@ -0,0 +1,372 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/acl"
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+	"github.com/OperatorFoundation/go-shadowsocks2/darkstar"
+	"github.com/OperatorFoundation/go-shadowsocks2/internal"
+	"github.com/OperatorFoundation/go-shadowsocks2/logging"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+	"github.com/OperatorFoundation/go-shadowsocks2/traffic"
+)
+
+// DefaultUser is the name the traffic of a single-user server is counted under.
+const DefaultUser = "default"
+
+// Server relays the connections and packets of Shadowsocks clients to their
+// targets.
+type Server struct {
+	// Cipher is the cipher of the clients, a *core.Users for a multi-user server.
+	Cipher core.Cipher
+	// Accountant counts the traffic of each user and enforces their quotas, if not nil.
+	Accountant *traffic.Accountant
+	// Dialer connects to the targets, directly if nil.
+	Dialer Dialer
+	// ACL decides which targets the clients may reach. nil allows all.
+	ACL *acl.List
+	Options
+}
+
+// ServeTCP relays the connections accepted on l.
+func (s *Server) ServeTCP(ctx context.Context, l net.Listener) error {
+	s.Logger.Info("listening TCP", "addr", l.Addr())
+	return s.serve(ctx, l, s.handleConn)
+}
+
+func (s *Server) handleConn(c net.Conn) {
+	metrics := s.metrics()
+	log := s.connLogger("client", c.RemoteAddr())
+	conn := c
+	if s.TCPCork {
+		conn = timedCork(c, 10*time.Millisecond, 1280)
+	}
+	ctx, cancel := s.handshakeContext()
+	defer cancel()
+	sc, err := core.StreamConnContext(ctx, s.Cipher, conn)
+	if err != nil {
+		metrics.Handshake(err)
+		if ctx.Err() != nil {
+			log.Info("handshake timed out")
+			return
+		}
+		log.Debug("handshake failed", "err", err)
+		if errors.Is(err, core.ErrUnknownUser) {
+			log.Info("unknown user")
+			// drain c like below, so that probes cannot tell a bad key
+			s.blackhole(c, err)
+		}
+		return
+	}
+	user := connUser(sc)
+	log = withUser(log, user)
+	if err = blackholed(sc); err != nil {
+		metrics.Handshake(err)
+		log.Info("blackholed", "reason", err)
+		s.blackhole(c, err)
+		return
+	}
+	if s.Accountant != nil {
+		if err = s.Accountant.Allowed(accountName(user)); err != nil {
+			log.Info("refused", "err", err)
+			return
+		}
+	}
+
+	stop := internal.WatchContext(ctx, c)
+	tgt, err := socks.ReadAddr(sc)
+	if ctxErr := stop(); err != nil && ctxErr != nil {
+		metrics.Handshake(ctxErr)
+		log.Info("handshake timed out")
+		return
+	}
+	if err == io.EOF {
+		// closed right after the handshake, like the health checks of a Pool
+		log.Debug("closed before the target address")
+		return
+	}
+	if err != nil {
+		metrics.Handshake(err)
+		log.Info("failed to get target address", "err", err)
+		// drain c to avoid leaking server behavioral features
+		// see https://www.ndss-symposium.org/ndss-paper/detecting-probe-resistant-proxies/
+		if err = s.blackhole(c, err); err != nil {
+			log.Debug("discard error", "err", err)
+		}
+		return
+	}
+	metrics.Handshake(nil)
+	log.Debug("handshake", "target", tgt)
+	s.serveTarget(ctx, sc, tgt, user, log)
+}
+
+// serveTarget serves the connection c of user, which asked for tgt: a mux
+// session, UDP over TCP, a CONNECT or a BIND with replies, or else a
+// connection to tgt. It reads the target of a CONNECT or a BIND within ctx.
+func (s *Server) serveTarget(ctx context.Context, c net.Conn, tgt socks.Addr, user string, log *logging.Logger) {
+	switch {
+	case bytes.Equal(tgt, muxTarget):
+		s.serveMux(c, user, log)
+		return
+	case bytes.Equal(tgt, udpTarget):
+		s.servePacketStream(&packetStream{Conn: c, user: user}, log)
+		return
+	}
+	// mux sessions and UDP over TCP count their streams and packets instead
+	if s.Accountant != nil {
+		c = s.Accountant.Conn(c, accountName(user))
+	}
+
+	var cmd byte
+	switch {
+	case bytes.Equal(tgt, connectTarget):
+		cmd = socks.CmdConnect
+	case bytes.Equal(tgt, bindTarget):
+		cmd = socks.CmdBind
+	}
+	if cmd != 0 {
+		stop := internal.WatchContext(ctx, c)
+		var err error
+		tgt, err = socks.ReadAddr(c)
+		stop()
+		if err != nil {
+			log.Debug("failed to get target address", "err", err)
+			return
+		}
+	}
+	if cmd == socks.CmdBind {
+		s.bind(c, tgt, log)
+		return
+	}
+	s.connect(c, tgt, cmd == socks.CmdConnect, log)
+}
+
+// checkTarget checks tgt against the ACL, and logs why it is denied. It
+// returns the addresses to connect to, see acl.List.Resolve.
+func (s *Server) checkTarget(tgt socks.Addr, log *logging.Logger) ([]string, error) {
+	addrs, err := s.ACL.Resolve(context.Background(), tgt.String())
+	if err != nil {
+		var denied *acl.DeniedError
+		if errors.As(err, &denied) {
+			s.metrics().Denied("tcp", denied.Rule)
+			log.Info("denied", "target", tgt, "rule", denied.Rule)
+		} else {
+			log.Debug("failed to check target", "target", tgt, "err", err)
+		}
+	}
+	return addrs, err
+}
+
+// dialTarget connects to the first of addrs that it can.
+func (s *Server) dialTarget(addrs []string) (rc net.Conn, err error) {
+	for _, addr := range addrs {
+		if rc, err = s.dialer().DialContext(context.Background(), "tcp", addr); err == nil {
+			return rc, nil
+		}
+	}
+	return nil, err
+}
+
+// connect relays c to tgt, if the ACL allows it. With replies, it tells the
+// client first whether it connected, in a SOCKS reply.
+func (s *Server) connect(c net.Conn, tgt socks.Addr, replies bool, log *logging.Logger) {
+	addrs, err := s.checkTarget(tgt, log)
+	if err != nil {
+		if replies {
+			socks.Reply(c, replyError(err), nil)
+		}
+		return
+	}
+
+	rc, err := s.dialTarget(addrs)
+	if err != nil {
+		log.Debug("failed to connect to target", "target", tgt, "err", err)
+		if replies {
+			socks.Reply(c, replyError(err), nil)
+		}
+		return
+	}
+	defer rc.Close()
+	if replies {
+		if err = socks.Reply(c, 0, socks.ParseAddr(rc.LocalAddr().String())); err != nil {
+			log.Debug("failed to reply", "err", err)
+			return
+		}
+	}
+
+	log.Debug("proxy", "target", tgt)
+	if err = s.relay(c, rc); err != nil {
+		log.Debug("relay error", "err", err)
+	}
+	log.Debug("closed")
+}
+
+// blackholed returns the reason if sc is a DarkStar connection that ignores a
+// failed handshake.
+func blackholed(sc net.Conn) error {
+	if uc, ok := sc.(*core.UserConn); ok {
+		sc = uc.Conn
+	}
+	if bh, ok := sc.(*darkstar.BlackHoleConn); ok {
+		return bh.Reason
+	}
+	return nil
+}
+
+// blackhole reads and discards c until the peer closes it, and reports it as
+// blackholed for reason.
+func (s *Server) blackhole(c net.Conn, reason error) error {
+	s.metrics().Blackholed(reason)
+	s.Conns.ignore(c)
+	_, err := io.Copy(ioutil.Discard, c)
+	return err
+}
+
+// ServeUDP relays the packets of clients that arrive on c, basically doing
+// UDP NAT. The associations end when it returns.
+func (s *Server) ServeUDP(ctx context.Context, c net.PacketConn) error {
+	defer c.Close()
+	defer closeOnDone(ctx, c)()
+	s.Logger.Info("listening UDP", "addr", c.LocalAddr())
+	c = core.ServerPacketConn(s.Cipher, c)
+
+	metrics := s.metrics()
+	nm := newNATmap(s.udpTimeout(), metrics)
+	defer nm.Flush()
+	buf := make([]byte, udpBufSize)
+
+	for {
+		n, raddr, err := c.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			if errors.Is(err, darkstar.ErrRepeatedKey) {
+				// The client must open a new association, see darkstar.
+				s.Logger.Info("UDP packet of an ended or replayed association", "client", raddr)
+				continue
+			}
+			s.Logger.Debug("UDP remote read error", "client", raddr, "err", err)
+			continue
+		}
+
+		s.forward(ctx, nm, c, raddr, buf[:n])
+	}
+}
+
+// forward sends pkt, a target address and a payload from the client at raddr
+// of c, to its target, over the association of raddr in nm. It opens the
+// association if needed.
+func (s *Server) forward(ctx context.Context, nm *natmap, c net.PacketConn, raddr net.Addr, pkt []byte) {
+	tgtAddr := socks.SplitAddr(pkt)
+	if tgtAddr == nil {
+		s.packetLogger(c, raddr).Debug("failed to split target address from packet", "length", len(pkt))
+		return
+	}
+
+	tgtUDPAddr, err := net.ResolveUDPAddr("udp", tgtAddr.String())
+	if err != nil {
+		s.packetLogger(c, raddr).Debug("failed to resolve target UDP address", "target", tgtAddr, "err", err)
+		return
+	}
+
+	metrics := s.metrics()
+	if err = s.checkPacket(tgtAddr, tgtUDPAddr); err != nil {
+		var denied *acl.DeniedError
+		if errors.As(err, &denied) {
+			metrics.Denied("udp", denied.Rule)
+		}
+		s.packetLogger(c, raddr).Debug("denied", "target", tgtAddr, "err", err)
+		return
+	}
+
+	payload := pkt[len(tgtAddr):]
+
+	pc := nm.Get(raddr.String())
+	if pc == nil {
+		pc, err = s.dialer().ListenPacket(ctx, "udp", "")
+		if err != nil {
+			s.Logger.Warn("failed to open UDP socket", "err", err)
+			return
+		}
+
+		if s.Accountant != nil {
+			pc = s.Accountant.PacketConn(pc, accountName(packetUser(c, raddr)))
+		}
+
+		log := s.connLogger("client", raddr)
+		log = withUser(log, packetUser(c, raddr))
+		log.Debug("UDP association", "target", tgtAddr)
+		nm.Add(raddr, c, pc, remoteServer, log)
+	}
+
+	_, err = pc.WriteTo(payload, tgtUDPAddr) // accept only UDPAddr despite the signature
+	if err != nil {
+		s.packetLogger(c, raddr).Debug("UDP remote write error", "target", tgtAddr, "err", err)
+		return
+	}
+	metrics.Relayed("udp", true, len(payload))
+}
+
+// checkPacket checks the target of a UDP packet, tgt resolved to addr,
+// against the ACL.
+func (s *Server) checkPacket(tgt socks.Addr, addr *net.UDPAddr) error {
+	if s.ACL == nil {
+		return nil
+	}
+	name, _, err := net.SplitHostPort(tgt.String())
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(name) != nil {
+		name = ""
+	}
+	return s.ACL.CheckResolved(tgt.String(), name, addr.IP, addr.Port)
+}
+
+// packetLogger returns the logger for packets of the peer at addr of c.
+func (s *Server) packetLogger(c net.PacketConn, addr net.Addr) *logging.Logger {
+	return withUser(s.Logger.With("client", addr), packetUser(c, addr))
+}
+
+// withUser adds the user of a multi-user server to the records of log.
+func withUser(log *logging.Logger, user string) *logging.Logger {
+	if user == "" {
+		return log
+	}
+	return log.With("user", user)
+}
+
+// connUser returns the user of c on a multi-user server, or "".
+func connUser(c net.Conn) string {
+	if uc, ok := c.(*core.UserConn); ok {
+		return uc.User
+	}
+	return ""
+}
+
+// packetUser returns the user of the peer at addr on a multi-user server, or "".
+func packetUser(c net.PacketConn, addr net.Addr) string {
+	if uc, ok := c.(core.UserPacketConn); ok {
+		return uc.User(addr)
+	}
+	return ""
+}
+
+// accountName returns the name to count the traffic of user under.
+func accountName(user string) string {
+	if user == "" {
+		return DefaultUser
+	}
+	return user
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/nfutil"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+)
+
+// ListenTProxy listens on address for the TCP connections that a netfilter
+// TPROXY rule diverts there.
+func ListenTProxy(address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: nfutil.Transparent}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// ListenTProxyPacket listens on address for the UDP packets that a netfilter
+// TPROXY rule diverts there.
+func ListenTProxyPacket(address string) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: nfutil.Transparent}
+	return lc.ListenPacket(context.Background(), "udp", address)
+}
+
+// ServeTProxy relays the TCP connections diverted by TPROXY and accepted on
+// l, from ListenTProxy, to their original destination: their local address.
+func (cl *Client) ServeTProxy(ctx context.Context, l net.Listener) error {
+	cl.Logger.Info("TCP TPROXY", "addr", l.Addr(), "server", cl.Server)
+	return cl.serveTCP(ctx, l, func(c net.Conn) (socks.Addr, error) { return socks.ParseAddr(c.LocalAddr().String()), nil }, nil)
+}
+
+// ServeTProxyUDP relays the UDP packets diverted by TPROXY that arrive on c,
+// from ListenTProxyPacket, to their original destinations, and sends the
+// replies from the addresses of their sources. The associations end when it
+// returns.
+func (cl *Client) ServeTProxyUDP(ctx context.Context, c net.PacketConn) error {
+	defer c.Close()
+	uc, ok := c.(*net.UDPConn)
+	if !ok {
+		return errors.New("TPROXY needs a UDP socket")
+	}
+	srvAddr, err := cl.udpServer()
+	if err != nil {
+		return err
+	}
+	defer closeOnDone(ctx, c)()
+
+	metrics := cl.metrics()
+	nm := newNATmap(cl.udpTimeout(), metrics)
+	defer nm.Flush()
+	buf := make([]byte, socks.MaxAddrLen+udpBufSize)
+
+	cl.Logger.Info("UDP TPROXY", "addr", c.LocalAddr(), "server", cl.udpServerName(srvAddr))
+	for {
+		n, raddr, dst, err := nfutil.ReadFromUDP(uc, buf[socks.MaxAddrLen:])
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			cl.Logger.Warn("UDP local read error", "addr", c.LocalAddr(), "err", err)
+			continue
+		}
+		if cl.FakeIP != nil && cl.FakeIP.Contains(dst.IP) {
+			// the server would send to the fake address
+			cl.Logger.Debug("UDP to a fake IP dropped", "client", raddr, "target", dst)
+			continue
+		}
+		tgt := socks.ParseAddr(dst.String())
+		start := socks.MaxAddrLen - len(tgt)
+		copy(buf[start:], tgt)
+
+		pc := nm.Get(raddr.String())
+		if pc == nil {
+			log := cl.connLogger("client", raddr)
+			spc, err := cl.associate(log)
+			if err != nil {
+				log.Warn("failed to open UDP association", "err", err)
+				continue
+			}
+			replies := &spoofer{PacketConn: c, conns: make(map[string]net.PacketConn)}
+			pc = &spoofedAssociation{PacketConn: spc, replies: replies}
+			log.Debug("UDP association", "server", cl.udpServerName(srvAddr), "target", tgt)
+			nm.Add(raddr, replies, pc, transparentClient, log)
+		}
+
+		_, err = pc.WriteTo(buf[start:socks.MaxAddrLen+n], srvAddr)
+		if err != nil {
+			cl.Logger.Debug("UDP local write error", "client", raddr, "err", err)
+			continue
+		}
+		metrics.Relayed("udp", true, n)
+	}
+}
+
+// spoofer sends the replies of a UDP association from the addresses of their
+// sources, the targets of the client, through transparent sockets bound to
+// them. It only writes; the listener it embeds reads.
+type spoofer struct {
+	net.PacketConn
+	mutex sync.Mutex
+	conns map[string]net.PacketConn // by source, nil once closed
+}
+
+// WriteTo sends the payload of b, after the address of its source, to addr.
+func (s *spoofer) WriteTo(b []byte, addr net.Addr) (int, error) {
+	src := socks.SplitAddr(b)
+	if src == nil {
+		return 0, errors.New("invalid source address")
+	}
+	c, err := s.conn(src)
+	if err != nil {
+		return 0, err
+	}
+	return c.WriteTo(b[len(src):], addr)
+}
+
+func (s *spoofer) conn(src socks.Addr) (net.PacketConn, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conns == nil {
+		return nil, net.ErrClosed
+	}
+	if c := s.conns[src.String()]; c != nil {
+		return c, nil
+	}
+	laddr, err := net.ResolveUDPAddr("udp", src.String())
+	if err != nil {
+		return nil, err
+	}
+	network := "udp6"
+	if laddr.IP.To4() != nil {
+		network = "udp4"
+	}
+	lc := net.ListenConfig{Control: nfutil.Transparent}
+	c, err := lc.ListenPacket(context.Background(), network, laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	s.conns[src.String()] = c
+	return c, nil
+}
+
+// Close closes the sockets of the sources, and leaves the listener open.
+func (s *spoofer) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+	return nil
+}
+
+// spoofedAssociation is a UDP association to the server that closes the
+// sockets of its replies with it.
+type spoofedAssociation struct {
+	net.PacketConn
+	replies *spoofer
+}
+
+func (a *spoofedAssociation) Close() error {
+	a.replies.Close()
+	return a.PacketConn.Close()
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+)
+
+// redirectDialer is a memoryDialer whose UDP associations send every packet
+// to one address, and report the replies as coming from the target.
+type redirectDialer struct {
+	memoryDialer
+	to *net.UDPAddr
+}
+
+func (d *redirectDialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return &redirectPacketConn{PacketConn: pc, to: d.to}, nil
+}
+
+type redirectPacketConn struct {
+	net.PacketConn
+	to     net.Addr
+	mutex  sync.Mutex
+	target net.Addr
+}
+
+func (c *redirectPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	c.target = addr
+	c.mutex.Unlock()
+	return c.PacketConn.WriteTo(b, c.to)
+}
+
+func (c *redirectPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, _, err := c.PacketConn.ReadFrom(b)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return n, c.target, err
+}
+
+// TestTProxy stands in for a TPROXY rule with a listener on all addresses:
+// connections and packets to 127.0.0.2 reach it with their destination.
+func TestTProxy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := ListenTProxy("0.0.0.0:0")
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("no permission for IP_TRANSPARENT")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	pc, err := ListenTProxyPacket("0.0.0.0:" + port)
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo, err := net.ResolveUDPAddr("udp", udpEchoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &redirectDialer{to: echo}
+	sl := listen(t)
+	server := &Server{Cipher: ciph, Dialer: dialer}
+	serve(func() error { return server.ServeTCP(ctx, sl) })
+	client := &Client{Server: sl.Addr().String(), Cipher: ciph, UDPOverTCP: true}
+	serve(func() error { return client.ServeTProxy(ctx, l) })
+	serve(func() error { return client.ServeTProxyUDP(ctx, pc) })
+
+	roundtrip(t, "127.0.0.2:"+port, "hello")
+	dialer.mutex.Lock()
+	if len(dialer.targets) != 1 || dialer.targets[0] != "127.0.0.2:"+port {
+		t.Errorf("server dialed %q, want [127.0.0.2:%s]", dialer.targets, port)
+	}
+	dialer.mutex.Unlock()
+
+	// The reply comes from the original destination, or the connected
+	// socket drops it.
+	c, err := net.Dial("udp", "127.0.0.2:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Errorf("got %q, want %q", buf[:n], "hello")
+	}
+}
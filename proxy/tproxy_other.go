@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errTProxy = errors.New("TPROXY is only supported on Linux")
+
+func ListenTProxy(address string) (net.Listener, error) {
+	return nil, errTProxy
+}
+
+func ListenTProxyPacket(address string) (net.PacketConn, error) {
+	return nil, errTProxy
+}
+
+func (cl *Client) ServeTProxy(ctx context.Context, l net.Listener) error {
+	l.Close()
+	return errTProxy
+}
+
+func (cl *Client) ServeTProxyUDP(ctx context.Context, c net.PacketConn) error {
+	c.Close()
+	return errTProxy
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/logging"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+)
+
+// udpTarget is the target address that starts UDP over TCP instead of a
+// connection.
+var udpTarget = socks.ParseAddr("udp.invalid:0")
+
+// packetStream carries the packets of a UDP association over a stream
+// connection, each as a 2-byte length and then the packet: a target or source
+// address and a payload, like the packets of a Shadowsocks PacketConn. The
+// packets come from and go to the peer of the connection, whatever their
+// address.
+type packetStream struct {
+	net.Conn
+	user    string // of a multi-user server
+	release func() // called by Close, if not nil
+	once    sync.Once
+}
+
+var errPacketTooLarge = errors.New("packet too large for UDP over TCP")
+
+// ReadFrom reads a packet into b, truncated if b is too short.
+func (ps *packetStream) ReadFrom(b []byte) (int, net.Addr, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ps.Conn, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[:]))
+	n := length
+	if n > len(b) {
+		n = len(b)
+	}
+	if _, err := io.ReadFull(ps.Conn, b[:n]); err != nil {
+		return 0, nil, err
+	}
+	if _, err := io.CopyN(io.Discard, ps.Conn, int64(length-n)); err != nil {
+		return 0, nil, err
+	}
+	return n, ps.RemoteAddr(), nil
+}
+
+// WriteTo writes the packet b to the peer in a single write.
+func (ps *packetStream) WriteTo(b []byte, _ net.Addr) (int, error) {
+	if len(b) > 0xFFFF {
+		return 0, errPacketTooLarge
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	if _, err := ps.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// User returns the user of the connection on a multi-user server.
+func (ps *packetStream) User(net.Addr) string { return ps.user }
+
+func (ps *packetStream) Close() error {
+	err := ps.Conn.Close()
+	if ps.release != nil {
+		ps.once.Do(ps.release)
+	}
+	return err
+}
+
+// servePacketStream relays the packets of a client over ps, like ServeUDP,
+// until ps ends.
+func (s *Server) servePacketStream(ps *packetStream, log *logging.Logger) {
+	nm := newNATmap(s.udpTimeout(), s.metrics())
+	defer nm.Flush()
+	buf := make([]byte, udpBufSize)
+
+	log.Debug("UDP over TCP")
+	for {
+		n, raddr, err := ps.ReadFrom(buf)
+		if err != nil {
+			log.Debug("UDP over TCP ended", "err", err)
+			return
+		}
+		s.forward(context.Background(), nm, ps, raddr, buf[:n])
+	}
+}
+
+// udpServerName returns the server of the UDP associations for the logs:
+// srvAddr, or the server of TCP with UDPOverTCP.
+func (cl *Client) udpServerName(srvAddr *net.UDPAddr) string {
+	if cl.UDPOverTCP {
+		return cl.Server
+	}
+	return srvAddr.String()
+}
+
+// associate opens the packet connection of a UDP association to the server:
+// a UDP socket, or a stream connection with UDPOverTCP.
+func (cl *Client) associate(log *logging.Logger) (net.PacketConn, error) {
+	if !cl.UDPOverTCP {
+		pc, err := net.ListenPacket("udp", "")
+		if err != nil {
+			return nil, err
+		}
+		return cl.Cipher.PacketConn(pc), nil
+	}
+	rc, server, release, err := cl.dialServer(log)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("UDP over TCP", "server", server)
+	if _, err := rc.Write(udpTarget); err != nil {
+		rc.Close()
+		release()
+		return nil, err
+	}
+	return &packetStream{Conn: rc, release: release}, nil
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+)
+
+// udpEchoServer returns the address of a UDP server that sends back every
+// packet.
+func udpEchoServer(t *testing.T) string {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	go func() {
+		buf := make([]byte, udpBufSize)
+		for {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			c.WriteTo(buf[:n], addr)
+		}
+	}()
+	return c.LocalAddr().String()
+}
+
+func TestUDPOverTCP(t *testing.T) {
+	for _, mux := range []int{0, 1} {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ciph, err := core.PickCipher("AEAD_CHACHA20_POLY1305", nil, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sl := listen(t)
+		server := &Server{Cipher: ciph}
+		serve(func() error { return server.ServeTCP(ctx, sl) })
+
+		tc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &Client{Server: sl.Addr().String(), Cipher: ciph, UDPOverTCP: true, Mux: mux}
+		serve(func() error { return client.ServeUDPTunnel(ctx, tc, udpEchoServer(t)) })
+
+		c, err := net.Dial("udp", tc.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		for _, msg := range []string{"hello", "world"} {
+			if _, err := c.Write([]byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 64)
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := c.Read(buf)
+			if err != nil {
+				t.Fatalf("mux %d: %v", mux, err)
+			}
+			if string(buf[:n]) != msg {
+				t.Errorf("mux %d: got %q, want %q", mux, buf[:n], msg)
+			}
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+	"github.com/OperatorFoundation/go-shadowsocks2/internal"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+)
+
+// forward returns d, or a DirectDialer if d is nil.
+func forward(d Dialer) Dialer {
+	if d == nil {
+		return defaultDialer
+	}
+	return d
+}
+
+// dialHandshake connects to server with d and runs handshake on the
+// connection, both within ctx.
+func dialHandshake(ctx context.Context, d Dialer, server string, handshake func(net.Conn) (net.Conn, error)) (net.Conn, error) {
+	c, err := forward(d).DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	stop := internal.WatchContext(ctx, c)
+	hc, err := handshake(c)
+	if ctxErr := stop(); err != nil && ctxErr != nil {
+		err = ctxErr
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return hc, nil
+}
+
+// SOCKS5Dialer connects to targets through a SOCKS5 proxy without
+// authentication. It does not relay UDP.
+type SOCKS5Dialer struct {
+	// Addr is the address of the proxy.
+	Addr string
+	// Forward connects to the proxy, directly if nil.
+	Forward Dialer
+}
+
+// DialContext connects to address with a SOCKS5 CONNECT.
+func (d *SOCKS5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	tgt := socks.ParseAddr(address)
+	if tgt == nil {
+		return nil, errors.New("invalid target address " + address)
+	}
+	return dialHandshake(ctx, d.Forward, d.Addr, func(c net.Conn) (net.Conn, error) {
+		if _, err := c.Write([]byte{5, 1, 0}); err != nil { // VER, NMETHODS, NO AUTHENTICATION
+			return nil, err
+		}
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			return nil, err
+		}
+		if buf[0] != 5 || buf[1] != 0 {
+			return nil, errors.New("SOCKS5 proxy requires authentication")
+		}
+		if _, err := c.Write(append([]byte{5, socks.CmdConnect, 0}, tgt...)); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(c, buf); err != nil { // VER, REP, RSV
+			return nil, err
+		}
+		if buf[1] != 0 {
+			return nil, fmt.Errorf("SOCKS5 proxy refused %s: reply %d", address, buf[1])
+		}
+		if _, err := socks.ReadAddr(c); err != nil { // BND.ADDR and BND.PORT
+			return nil, err
+		}
+		return c, nil
+	})
+}
+
+// ListenPacket fails: SOCKS5 UDP ASSOCIATE is not supported.
+func (d *SOCKS5Dialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	return nil, errors.New("SOCKS5 upstream does not relay UDP")
+}
+
+// HTTPDialer connects to targets through an HTTP proxy with CONNECT. It does
+// not relay UDP.
+type HTTPDialer struct {
+	// Addr is the address of the proxy.
+	Addr string
+	// Forward connects to the proxy, directly if nil.
+	Forward Dialer
+}
+
+// DialContext connects to address with an HTTP CONNECT.
+func (d *HTTPDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return dialHandshake(ctx, d.Forward, d.Addr, func(c net.Conn) (net.Conn, error) {
+		req := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n\r\n"
+		if _, err := io.WriteString(c, req); err != nil {
+			return nil, err
+		}
+		br := bufio.NewReader(c)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("HTTP proxy refused %s: %s", address, resp.Status)
+		}
+		if br.Buffered() > 0 { // the target spoke first
+			return &bufferedConn{c, br}, nil
+		}
+		return c, nil
+	})
+}
+
+// ListenPacket fails: HTTP proxies do not relay UDP.
+func (d *HTTPDialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	return nil, errors.New("HTTP upstream does not relay UDP")
+}
+
+// bufferedConn reads what r buffered from Conn first.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// ShadowsocksDialer connects to targets through another Shadowsocks server,
+// over TCP and UDP.
+type ShadowsocksDialer struct {
+	// Server is the address of the server.
+	Server string
+	Cipher core.Cipher
+	// Forward connects to the server, directly if nil.
+	Forward Dialer
+}
+
+// DialContext connects to address through the server.
+func (d *ShadowsocksDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	tgt := socks.ParseAddr(address)
+	if tgt == nil {
+		return nil, errors.New("invalid target address " + address)
+	}
+	return dialHandshake(ctx, d.Forward, d.Server, func(c net.Conn) (net.Conn, error) {
+		sc, err := d.Cipher.StreamConn(c)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = sc.Write(tgt); err != nil {
+			return nil, err
+		}
+		return sc, nil
+	})
+}
+
+// ListenPacket opens a socket whose packets go through the server.
+func (d *ShadowsocksDialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	server, err := net.ResolveUDPAddr("udp", d.Server)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := forward(d.Forward).ListenPacket(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &hopPacketConn{PacketConn: d.Cipher.PacketConn(pc), server: server, buf: make([]byte, udpBufSize)}, nil
+}
+
+// hopPacketConn sends packets to their targets through a Shadowsocks server,
+// and returns the replies with the address of the target they came from.
+type hopPacketConn struct {
+	net.PacketConn
+	server *net.UDPAddr
+	buf    []byte // for ReadFrom, which only the NAT entry of the conn calls
+}
+
+func (c *hopPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	tgt := socks.ParseAddr(addr.String())
+	if tgt == nil {
+		return 0, errors.New("invalid target address " + addr.String())
+	}
+	if _, err := c.PacketConn.WriteTo(append(tgt, b...), c.server); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *hopPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := c.buf
+	for {
+		n, _, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		src := socks.SplitAddr(buf[:n])
+		if src == nil {
+			continue // not from the server
+		}
+		addr, err := net.ResolveUDPAddr("udp", src.String())
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[len(src):n]), addr, nil
+	}
+}
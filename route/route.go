@@ -0,0 +1,106 @@
+// Package route decides how a client reaches each target: directly, through
+// its server, or not at all.
+package route
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/acl"
+)
+
+// Action is how a client reaches a target.
+type Action string
+
+const (
+	// Proxy connects through the server.
+	Proxy Action = "proxy"
+	// Direct connects without the server.
+	Direct Action = "direct"
+	// Block refuses the connection.
+	Block Action = "block"
+)
+
+// Table is an ordered list of routing rules like
+//
+//	direct 10.0.0.0/8,192.168.0.0/16,@cn.txt
+//	block ads.example.com
+//	proxy * 443
+//
+// with the syntax of acl.ParseRule and the actions proxy, direct and block.
+// The first rule that matches a target decides; targets that match no rule go
+// through the proxy. A nil *Table sends everything through the proxy. It is
+// safe for concurrent use.
+type Table struct {
+	rules []string
+	file  string
+
+	mutex sync.RWMutex
+	list  *acl.List
+}
+
+// New returns the table of rules followed by the rules of file, one per line,
+// if file is not "". Empty lines and lines that start with # are skipped.
+func New(rules []string, file string) (*Table, error) {
+	t := &Table{rules: rules, file: file}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload reads the rule file and the list files of the rules again. The table
+// keeps its rules if they fail to load. Reloading a nil *Table does nothing.
+func (t *Table) Reload() error {
+	if t == nil {
+		return nil
+	}
+	rules := append([]string(nil), t.rules...)
+	if t.file != "" {
+		data, err := os.ReadFile(t.file)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				rules = append(rules, line)
+			}
+		}
+	}
+
+	l := &acl.List{}
+	for _, s := range rules {
+		r, err := acl.Parse(s, string(Proxy), string(Direct), string(Block))
+		if err != nil {
+			return fmt.Errorf("route %v", err)
+		}
+		l.Rules = append(l.Rules, r)
+	}
+	t.mutex.Lock()
+	t.list = l
+	t.mutex.Unlock()
+	return nil
+}
+
+// Route returns the action for address, a host and port, and the rule that
+// decided it, "" if none did. The addresses of a domain name are looked up
+// for the rules on networks; if the lookup fails, those rules do not match and
+// Route returns the error with the action.
+func (t *Table) Route(ctx context.Context, address string) (Action, string, error) {
+	if t == nil {
+		return Proxy, "", nil
+	}
+	t.mutex.RLock()
+	l := t.list
+	t.mutex.RUnlock()
+
+	r, err := l.Match(ctx, address)
+	if r == nil {
+		return Proxy, "", err
+	}
+	return Action(r.Action), r.String(), err
+}
@@ -0,0 +1,58 @@
+package route
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "lan.txt")
+	if err := os.WriteFile(list, []byte("# LAN\n192.168.0.0/16\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "routes.txt")
+	if err := os.WriteFile(file, []byte("direct @"+list+"\n\n# everything else\nproxy *\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	table, err := New([]string{"block 198.51.100.0/24 25", "direct 10.0.0.0/8"}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(address string, want Action, wantRule string) {
+		t.Helper()
+		action, rule, err := table.Route(context.Background(), address)
+		if err != nil || action != want || rule != wantRule {
+			t.Errorf("%s: %s by %q, %v, want %s by %q", address, action, rule, err, want, wantRule)
+		}
+	}
+	check("198.51.100.1:25", Block, "block 198.51.100.0/24 25")
+	check("198.51.100.1:443", Proxy, "proxy *")
+	check("10.1.2.3:80", Direct, "direct 10.0.0.0/8")
+	check("192.168.1.1:80", Direct, "direct @"+list)
+
+	// Reload reads the files again, and keeps the table if they fail.
+	if err := os.WriteFile(list, []byte("192.168.1.0/24\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	check("192.168.2.1:80", Proxy, "proxy *")
+	check("192.168.1.1:80", Direct, "direct @"+list)
+	if err := os.WriteFile(file, []byte("forward *\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Reload(); err == nil {
+		t.Error("unknown action accepted")
+	}
+	check("192.168.1.1:80", Direct, "direct @"+list)
+
+	var nilTable *Table
+	if action, _, _ := nilTable.Route(context.Background(), "10.1.2.3:80"); action != Proxy {
+		t.Errorf("nil table: %s", action)
+	}
+}
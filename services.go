@@ -0,0 +1,668 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/acl"
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+	"github.com/OperatorFoundation/go-shadowsocks2/darkstar"
+	"github.com/OperatorFoundation/go-shadowsocks2/dns"
+	"github.com/OperatorFoundation/go-shadowsocks2/proxy"
+	"github.com/OperatorFoundation/go-shadowsocks2/route"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+)
+
+// services are the clients and servers started from the configuration. apply
+// changes them to a new configuration on SIGHUP: what did not change keeps
+// running, and closing a listener leaves the relays it accepted running.
+type services struct {
+	options proxy.Options
+
+	mutex   sync.Mutex
+	clients map[string]*clientService // by clientKey
+	servers map[string]*serverService // by serverKey
+}
+
+// newServices returns services that run clients and servers with options.
+func newServices(options proxy.Options) *services {
+	return &services{
+		options: options,
+		clients: make(map[string]*clientService),
+		servers: make(map[string]*serverService),
+	}
+}
+
+// clientService is the connection of a client to its server, shared by the
+// listeners of the client.
+type clientService struct {
+	client     *proxy.Client
+	plugin     *pluginProcess
+	stopChecks context.CancelFunc // of the health checks of a pool
+	listeners  map[listener]io.Closer
+}
+
+// listener is a listener of a client.
+type listener struct {
+	kind   string // socks, udpsocks, tcptun, udptun, redir, redir6, tproxy, udptproxy, dns or tcpdns
+	addr   string
+	target string // of tunnels
+}
+
+// serverService is a server and its listeners.
+type serverService struct {
+	server    *proxy.Server
+	listeners []io.Closer
+	plugin    *pluginProcess
+	reload    func() error // re-reads the keys or users, if any
+}
+
+// listeners returns the listeners of c.
+func (c *ClientConfig) listeners() []listener {
+	var ls []listener
+	if c.Socks != "" {
+		ls = append(ls, listener{kind: "socks", addr: c.Socks})
+		if c.UDPSocks {
+			ls = append(ls, listener{kind: "udpsocks", addr: c.Socks})
+		}
+	}
+	for _, tun := range c.TCPTun {
+		ls = append(ls, listener{kind: "tcptun", addr: tun.Listen, target: tun.Target})
+	}
+	for _, tun := range c.UDPTun {
+		ls = append(ls, listener{kind: "udptun", addr: tun.Listen, target: tun.Target})
+	}
+	if c.Redir != "" {
+		ls = append(ls, listener{kind: "redir", addr: c.Redir})
+	}
+	if c.Redir6 != "" {
+		ls = append(ls, listener{kind: "redir6", addr: c.Redir6})
+	}
+	if c.TProxy != "" {
+		ls = append(ls, listener{kind: "tproxy", addr: c.TProxy}, listener{kind: "udptproxy", addr: c.TProxy})
+	}
+	if c.DNS != "" {
+		upstream := c.DNSUpstream
+		if upstream == "" {
+			upstream = proxy.DefaultDNSUpstream
+		}
+		ls = append(ls, listener{kind: "dns", addr: c.DNS, target: upstream}, listener{kind: "tcpdns", addr: c.DNS, target: upstream})
+	}
+	return ls
+}
+
+// clientKey identifies the connection of c to its servers: clients with the
+// same key can share it. It covers the contents of the key files, so that a
+// reload picks up a new key.
+func clientKey(c ClientConfig) (string, error) {
+	c.Socks, c.UDPSocks, c.Redir, c.Redir6, c.TProxy, c.TCPTun, c.UDPTun = "", false, "", "", "", nil, nil
+	c.DNS, c.DNSUpstream = "", ""
+	keyFiles := []string{c.KeyFile}
+	for _, u := range c.Upstreams {
+		keyFiles = append(keyFiles, u.client(c).KeyFile)
+	}
+	return configKey(c, keyFiles...)
+}
+
+// serverKey identifies a server: a server whose key did not change keeps
+// running across reloads. DarkStar servers and multi-user servers re-read
+// their keys or users instead, so their key file is not part of the key.
+func serverKey(s ServerConfig) (string, error) {
+	_, cipher, _, err := serverAddr(s)
+	if err != nil {
+		return "", err
+	}
+	if cipher == "DarkStar" || s.Users != "" {
+		return configKey(s, "")
+	}
+	return configKey(s, s.KeyFile)
+}
+
+func configKey(v interface{}, keyFiles ...string) (string, error) {
+	key, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	for _, keyFile := range keyFiles {
+		if keyFile == "" {
+			continue
+		}
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return "", err
+		}
+		key = append(key, fmt.Sprintf(" %x", sha256.Sum256(data))...)
+	}
+	return string(key), nil
+}
+
+// apply starts and stops clients, servers and listeners to match cfg. It
+// carries on past errors, so that one bad entry does not stop the others,
+// and returns them all.
+func (s *services) apply(cfg *Config) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var errs []string
+	fail := func(err error) { errs = append(errs, err.Error()) }
+
+	wantClients := make(map[string][]ClientConfig)
+	for _, c := range cfg.Clients {
+		key, err := clientKey(c)
+		if err != nil {
+			fail(fmt.Errorf("client %s: %v", c.Server, err))
+			continue
+		}
+		wantClients[key] = append(wantClients[key], c)
+	}
+	wantServers := make(map[string]ServerConfig)
+	for _, srv := range cfg.Servers {
+		key, err := serverKey(srv)
+		if err != nil {
+			fail(fmt.Errorf("server %s: %v", srv.Listen, err))
+			continue
+		}
+		wantServers[key] = srv
+	}
+
+	// Close first, so that a listener that moved can bind its address again.
+	for key, cs := range s.clients {
+		configs, ok := wantClients[key]
+		if !ok {
+			cs.close()
+			delete(s.clients, key)
+			continue
+		}
+		want := make(map[listener]bool)
+		for _, c := range configs {
+			for _, l := range c.listeners() {
+				want[l] = true
+			}
+		}
+		for l, closer := range cs.listeners {
+			if !want[l] {
+				closer.Close()
+				delete(cs.listeners, l)
+			}
+		}
+	}
+	for key, ss := range s.servers {
+		if _, ok := wantServers[key]; !ok {
+			ss.close()
+			delete(s.servers, key)
+		}
+	}
+
+	for _, configs := range wantClients {
+		for _, c := range configs {
+			if c.Socks != "" && c.UDPSocks && !socks.UDPEnabled {
+				socks.UDPEnabled = true // before the listener opens; it is never turned off
+			}
+		}
+	}
+	for key, configs := range wantClients {
+		cs, ok := s.clients[key]
+		if ok {
+			if err := cs.client.Routes.Reload(); err != nil {
+				fail(fmt.Errorf("client %s: %v", configs[0].Server, err))
+			}
+		} else {
+			var err error
+			if cs, err = newClientService(configs[0], s.options); err != nil {
+				fail(fmt.Errorf("client %s: %v", configs[0].Server, err))
+				continue
+			}
+			s.clients[key] = cs
+		}
+		for _, c := range configs {
+			for _, l := range c.listeners() {
+				if _, ok := cs.listeners[l]; ok {
+					continue
+				}
+				closer, err := cs.listen(l)
+				if err != nil {
+					fail(fmt.Errorf("%s %s: %v", l.kind, l.addr, err))
+					continue
+				}
+				cs.listeners[l] = closer
+			}
+		}
+	}
+	for key, srv := range wantServers {
+		if ss, ok := s.servers[key]; ok {
+			if ss.reload != nil {
+				if err := ss.reload(); err != nil {
+					fail(fmt.Errorf("server %s: %v", srv.Listen, err))
+				}
+			}
+			continue
+		}
+		ss, err := startServer(srv, s.options)
+		if err != nil {
+			fail(fmt.Errorf("server %s: %v", srv.Listen, err))
+			continue
+		}
+		s.servers[key] = ss
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// closeListeners closes the listeners of all clients and servers, and leaves
+// their relays and plugins running. It stops the health checks of the pools,
+// which no new connection needs.
+func (s *services) closeListeners() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, cs := range s.clients {
+		for l, closer := range cs.listeners {
+			closer.Close()
+			delete(cs.listeners, l)
+		}
+		if cs.stopChecks != nil {
+			cs.stopChecks()
+		}
+	}
+	for _, ss := range s.servers {
+		for _, closer := range ss.listeners {
+			closer.Close()
+		}
+		ss.listeners = nil
+	}
+}
+
+// decodeKey decodes a base64url key; an empty key is nil.
+func decodeKey(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return base64.URLEncoding.DecodeString(s)
+}
+
+// darkStarAddr splits the address a DarkStar key is bound to.
+func darkStarAddr(addr string) (host string, port int, err error) {
+	parts := strings.Split(addr, ":")
+	if len(parts) != 2 {
+		return "", 0, fmt.Errorf("invalid DarkStar server address %s", addr)
+	}
+	port, err = strconv.Atoi(parts[1])
+	return parts[0], port, err
+}
+
+// readKey returns the key of a client, from keyFile if there is one.
+func readKey(key, keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		return os.ReadFile(keyFile)
+	}
+	return decodeKey(key)
+}
+
+// clientCipher returns the cipher of a client of the server at addr. An empty
+// cipher is DarkStar.
+func clientCipher(addr, cipher string, key []byte, password string) (core.Cipher, error) {
+	if cipher == "" || cipher == "DarkStar" {
+		host, port, err := darkStarAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		keyString := base64.StdEncoding.EncodeToString(key)
+		client := darkstar.NewDarkStarClient(keyString, host, port)
+		if client == nil {
+			return nil, errors.New("invalid DarkStar server public key")
+		}
+		return client, nil
+	}
+	return core.PickCipher(cipher, key, password)
+}
+
+// newClientService makes the connection of c to its server, without listeners.
+func newClientService(c ClientConfig, options proxy.Options) (*clientService, error) {
+	addr, ciph, err := clientServer(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Mux < 0 {
+		return nil, fmt.Errorf("invalid mux %d", c.Mux)
+	}
+	if c.SocksUser != "" || c.SocksPassword != "" {
+		// RFC 1929 sends each as a length byte and at least one byte
+		if len(c.SocksUser) == 0 || len(c.SocksUser) > 255 || len(c.SocksPassword) == 0 || len(c.SocksPassword) > 255 {
+			return nil, errors.New("SOCKS username and password must be 1 to 255 bytes")
+		}
+	}
+	client := &proxy.Client{Server: addr, UDPServer: addr, Cipher: ciph, Mux: c.Mux, UDPOverTCP: c.UDPOverTCP, ServerReplies: c.ServerReplies, DNSOverUDP: c.DNSOverUDP, Options: options}
+	if c.FakeIP != "" {
+		if client.FakeIP, err = dns.NewFakeIP(c.FakeIP); err != nil {
+			return nil, err
+		}
+	}
+	if c.SocksUser != "" {
+		client.SOCKSAuth = socks.Password(c.SocksUser, c.SocksPassword)
+	}
+	if len(c.Route) > 0 || c.RouteFile != "" {
+		if client.Routes, err = route.New(c.Route, c.RouteFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.Upstreams) > 0 {
+		if c.Plugin != "" {
+			return nil, errors.New("plugins do not support upstreams")
+		}
+		upstreams := []proxy.Upstream{{Server: addr, Cipher: ciph}}
+		for _, u := range c.Upstreams {
+			addr, ciph, err := clientServer(u.client(c))
+			if err != nil {
+				return nil, fmt.Errorf("upstream %s: %v", u.Server, err)
+			}
+			upstreams = append(upstreams, proxy.Upstream{Server: addr, Cipher: ciph})
+		}
+		if client.Pool, err = proxy.NewPool(proxy.Strategy(c.Balance), upstreams...); err != nil {
+			return nil, err
+		}
+		client.Pool.HealthCheck = time.Duration(c.HealthCheck)
+	}
+
+	cs := &clientService{client: client, listeners: make(map[listener]io.Closer)}
+	if c.Plugin != "" {
+		cs.plugin, client.Server, err = startPlugin(c.Plugin, c.PluginOpts, addr, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if client.Pool != nil {
+		var ctx context.Context
+		ctx, cs.stopChecks = context.WithCancel(context.Background())
+		go client.CheckPool(ctx)
+	}
+	return cs, nil
+}
+
+// clientServer returns the address and cipher of the server of c.
+func clientServer(c ClientConfig) (string, core.Cipher, error) {
+	key, err := readKey(c.Key, c.KeyFile)
+	if err != nil {
+		return "", nil, err
+	}
+
+	addr := c.Server
+	cipher := c.Cipher
+	password := c.Password
+	if strings.HasPrefix(addr, "ss://") {
+		addr, cipher, password, err = parseURL(addr)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	ciph, err := clientCipher(addr, cipher, key, password)
+	return addr, ciph, err
+}
+
+// serving is a listener being served in the background.
+type serving struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// serve runs serve until the returned serving is closed, and logs the error
+// if it fails before.
+func serve(kind string, addr net.Addr, serve func(context.Context) error) *serving {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &serving{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		if err := serve(ctx); err != nil {
+			logger.Error("listener failed", "kind", kind, "addr", addr, "err", err)
+		}
+	}()
+	return s
+}
+
+// Close stops the listener and waits until it is closed.
+func (s *serving) Close() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+// listen opens l and serves it in the background.
+func (cs *clientService) listen(l listener) (io.Closer, error) {
+	client := cs.client
+	if l.target != "" && socks.ParseAddr(l.target) == nil {
+		return nil, errors.New("invalid target address " + l.target)
+	}
+
+	switch l.kind {
+	case "tproxy":
+		ln, err := proxy.ListenTProxy(l.addr)
+		if err != nil {
+			return nil, err
+		}
+		return serve(l.kind, ln.Addr(), func(ctx context.Context) error { return client.ServeTProxy(ctx, ln) }), nil
+	case "udptproxy":
+		c, err := proxy.ListenTProxyPacket(l.addr)
+		if err != nil {
+			return nil, err
+		}
+		return serve(l.kind, c.LocalAddr(), func(ctx context.Context) error { return client.ServeTProxyUDP(ctx, c) }), nil
+	case "udpsocks", "udptun", "dns":
+		c, err := net.ListenPacket("udp", l.addr)
+		if err != nil {
+			return nil, err
+		}
+		if l.kind == "dns" {
+			return serve(l.kind, c.LocalAddr(), func(ctx context.Context) error { return client.ServeDNS(ctx, c, l.target) }), nil
+		}
+		if l.kind == "udpsocks" {
+			return serve(l.kind, c.LocalAddr(), func(ctx context.Context) error { return client.ServeSOCKSUDP(ctx, c) }), nil
+		}
+		return serve(l.kind, c.LocalAddr(), func(ctx context.Context) error { return client.ServeUDPTunnel(ctx, c, l.target) }), nil
+	}
+
+	ln, err := net.Listen("tcp", l.addr)
+	if err != nil {
+		return nil, err
+	}
+	var run func(context.Context) error
+	switch l.kind {
+	case "socks":
+		run = func(ctx context.Context) error { return client.ServeSOCKS(ctx, ln) }
+	case "tcptun":
+		run = func(ctx context.Context) error { return client.ServeTCPTunnel(ctx, ln, l.target) }
+	case "redir":
+		run = func(ctx context.Context) error { return client.ServeRedir(ctx, ln) }
+	case "redir6":
+		run = func(ctx context.Context) error { return client.ServeRedir6(ctx, ln) }
+	case "tcpdns":
+		run = func(ctx context.Context) error { return client.ServeDNSTCP(ctx, ln, l.target) }
+	}
+	return serve(l.kind, ln.Addr(), run), nil
+}
+
+func (cs *clientService) close() {
+	for _, closer := range cs.listeners {
+		closer.Close()
+	}
+	if cs.plugin != nil {
+		stopPlugin(cs.plugin)
+	}
+	if cs.stopChecks != nil {
+		cs.stopChecks()
+	}
+}
+
+// serverAddr returns the listen address, cipher and password of s.
+func serverAddr(s ServerConfig) (addr, cipher, password string, err error) {
+	addr, cipher, password = s.Listen, s.Cipher, s.Password
+	if strings.HasPrefix(addr, "ss://") {
+		addr, cipher, password, err = parseURL(addr)
+	}
+	if cipher == "" {
+		cipher = "DarkStar"
+	}
+	return
+}
+
+// outboundDialer returns the dialer of a server that connects to targets
+// through o, or nil to connect directly.
+func outboundDialer(o *Outbound) (proxy.Dialer, error) {
+	if o == nil {
+		return nil, nil
+	}
+	direct := &proxy.DirectDialer{Interface: o.Interface}
+	if o.SourceIP != "" {
+		if direct.LocalIP = net.ParseIP(o.SourceIP); direct.LocalIP == nil {
+			return nil, fmt.Errorf("invalid outbound source IP %s", o.SourceIP)
+		}
+	}
+	if o.Proxy == "" {
+		return direct, nil
+	}
+
+	u, err := url.Parse(o.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5":
+		return &proxy.SOCKS5Dialer{Addr: u.Host, Forward: direct}, nil
+	case "http":
+		return &proxy.HTTPDialer{Addr: u.Host, Forward: direct}, nil
+	case "ss":
+		key, err := readKey(o.Key, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		addr, cipher, password, err := parseURL(o.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		ciph, err := clientCipher(addr, cipher, key, password)
+		if err != nil {
+			return nil, err
+		}
+		return &proxy.ShadowsocksDialer{Server: addr, Cipher: ciph, Forward: direct}, nil
+	}
+	return nil, fmt.Errorf("unsupported outbound proxy %s", o.Proxy)
+}
+
+// startServer starts the listeners of s.
+func startServer(s ServerConfig, options proxy.Options) (*serverService, error) {
+	key, err := decodeKey(s.Key)
+	if err != nil {
+		return nil, err
+	}
+	var serverKeys [][]byte // every DarkStar key from the key file, if it is a directory
+	if s.KeyFile != "" {
+		serverKeys, err = readServerKeys(s.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = serverKeys[0]
+	}
+
+	addr, cipher, password, err := serverAddr(s)
+	if err != nil {
+		return nil, err
+	}
+
+	udpAddr := addr
+	ss := &serverService{}
+
+	if s.Plugin != "" {
+		ss.plugin, addr, err = startPlugin(s.Plugin, s.PluginOpts, addr, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	server := &proxy.Server{Accountant: accountant, Options: options}
+	ss.server = server
+	server.Dialer, err = outboundDialer(s.Outbound)
+	if err == nil {
+		server.ACL, err = acl.New(s.ACL)
+	}
+	if err == nil {
+		server.Cipher, err = ss.cipher(s, cipher, addr, key, password, serverKeys)
+	}
+	if err == nil && s.UDP {
+		var c net.PacketConn
+		if c, err = net.ListenPacket("udp", udpAddr); err == nil {
+			ss.listeners = append(ss.listeners, serve("udp", c.LocalAddr(), func(ctx context.Context) error { return server.ServeUDP(ctx, c) }))
+		}
+	}
+	if err == nil && s.TCPEnabled() {
+		var l net.Listener
+		if l, err = net.Listen("tcp", addr); err == nil {
+			ss.listeners = append(ss.listeners, serve("tcp", l.Addr(), func(ctx context.Context) error { return server.ServeTCP(ctx, l) }))
+		}
+	}
+	if err != nil {
+		ss.close()
+		return nil, err
+	}
+	return ss, nil
+}
+
+// cipher makes the cipher of s, which listens on addr after the plugin.
+func (ss *serverService) cipher(s ServerConfig, cipher, addr string, key []byte, password string, serverKeys [][]byte) (core.Cipher, error) {
+	// DarkStar keys are bound to the address of the server.
+	var host string
+	var port int
+	if cipher == "DarkStar" {
+		var err error
+		if host, port, err = darkStarAddr(addr); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Users != "" {
+		table, err := newUserTable(s.Users, cipher, host, port)
+		if err != nil {
+			return nil, err
+		}
+		ss.reload = table.reload
+		return table.users, nil
+	}
+
+	if cipher == "DarkStar" {
+		keyString := base64.StdEncoding.EncodeToString(key)
+		server := darkstar.NewDarkStarServer(keyString, host, port)
+		if server == nil {
+			return nil, errors.New("invalid DarkStar server key")
+		}
+		if len(serverKeys) > 1 {
+			if err := server.SetKeys(encodeKeys(serverKeys)); err != nil {
+				return nil, err
+			}
+		}
+		if s.KeyFile != "" {
+			ss.reload = func() error { return reloadServerKeys(server, s.KeyFile) }
+		}
+		return server, nil
+	}
+
+	return core.PickCipher(cipher, key, password)
+}
+
+func (ss *serverService) close() {
+	for _, closer := range ss.listeners {
+		closer.Close()
+	}
+	if ss.plugin != nil {
+		stopPlugin(ss.plugin)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/proxy"
+)
+
+func TestMain(m *testing.M) {
+	// Clients and servers of the tests share the salt filter of the process,
+	// where the salts of the client would look like replays to the server.
+	os.Setenv("SHADOWSOCKS_SF_CAPACITY", "0")
+	os.Exit(m.Run())
+}
+
+func freeAddr(t *testing.T) string {
+	port, err := getFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "127.0.0.1:" + port
+}
+
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func echo(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q, want %q", buf, msg)
+	}
+}
+
+func dialEcho(t *testing.T, addr, msg string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	echo(t, c, msg)
+	return c
+}
+
+func TestServicesApply(t *testing.T) {
+	target := echoServer(t)
+	server := ServerConfig{Listen: freeAddr(t), Cipher: "AEAD_CHACHA20_POLY1305", Password: "pw",
+		ACL: []string{"allow 127.0.0.1"}} // the targets of the tests are local
+	client := ClientConfig{Server: server.Listen, Cipher: server.Cipher, Password: server.Password}
+	tun1, tun2 := freeAddr(t), freeAddr(t)
+
+	running := newServices(proxy.Options{Conns: relays})
+	t.Cleanup(func() { running.apply(&Config{}) })
+
+	client.TCPTun = []Tunnel{{Listen: tun1, Target: target}}
+	if err := running.apply(&Config{Clients: []ClientConfig{client}, Servers: []ServerConfig{server}}); err != nil {
+		t.Fatal(err)
+	}
+	relay := dialEcho(t, tun1, "first")
+
+	// Adding a tunnel keeps the server, the client and the first tunnel.
+	client.TCPTun = append(client.TCPTun, Tunnel{Listen: tun2, Target: target})
+	if err := running.apply(&Config{Clients: []ClientConfig{client}, Servers: []ServerConfig{server}}); err != nil {
+		t.Fatal(err)
+	}
+	dialEcho(t, tun1, "second")
+	dialEcho(t, tun2, "third")
+	echo(t, relay, "fourth")
+
+	// Removing the first tunnel closes its listener, but not its relay.
+	client.TCPTun = client.TCPTun[1:]
+	if err := running.apply(&Config{Clients: []ClientConfig{client}, Servers: []ServerConfig{server}}); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := net.Dial("tcp", tun1); err == nil {
+		c.Close()
+		t.Error("removed tunnel still accepts")
+	}
+	echo(t, relay, "fifth")
+	dialEcho(t, tun2, "sixth")
+
+	// A bad entry is reported, and does not stop the others.
+	bad := ClientConfig{Server: server.Listen, Cipher: "no such cipher", Socks: freeAddr(t)}
+	if err := running.apply(&Config{Clients: []ClientConfig{client, bad}, Servers: []ServerConfig{server}}); err == nil {
+		t.Error("bad cipher accepted")
+	}
+	dialEcho(t, tun2, "seventh")
+
+	if err := running.apply(&Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(running.clients) != 0 || len(running.servers) != 0 {
+		t.Errorf("still running: %d clients, %d servers", len(running.clients), len(running.servers))
+	}
+	echo(t, relay, "eighth")
+}
+
+func TestServicesInvalidDarkStarKey(t *testing.T) {
+	for name, key := range map[string]string{"missing": "", "invalid": "AAAA"} {
+		client := ClientConfig{Server: freeAddr(t), Cipher: "DarkStar", Key: key, Socks: freeAddr(t)}
+		running := newServices(proxy.Options{Conns: relays})
+		if err := running.apply(&Config{Clients: []ClientConfig{client}}); err == nil {
+			t.Errorf("%s key accepted", name)
+		}
+		running.apply(&Config{})
+	}
+}
+
+func TestServicesUpstreams(t *testing.T) {
+	target := echoServer(t)
+	server := ServerConfig{Listen: freeAddr(t), Cipher: "AEAD_CHACHA20_POLY1305", Password: "pw",
+		ACL: []string{"allow 127.0.0.1"}} // the targets of the tests are local
+	tun := freeAddr(t)
+	// The first server is down; the upstream takes its cipher and password.
+	client := ClientConfig{Server: freeAddr(t), Cipher: server.Cipher, Password: server.Password,
+		Upstreams: []Upstream{{Server: server.Listen}}, Balance: "latency",
+		TCPTun: []Tunnel{{Listen: tun, Target: target}}}
+
+	running := newServices(proxy.Options{Conns: relays})
+	t.Cleanup(func() { running.apply(&Config{}) })
+	if err := running.apply(&Config{Clients: []ClientConfig{client}, Servers: []ServerConfig{server}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"first", "second", "third"} {
+		dialEcho(t, tun, msg)
+	}
+
+	client.Plugin = "v2ray-plugin"
+	if err := running.apply(&Config{Clients: []ClientConfig{client}}); err == nil {
+		t.Error("plugin with upstreams accepted")
+	}
+}
@@ -0,0 +1,155 @@
+package shadowaead2022
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/internal"
+	"github.com/OperatorFoundation/go-shadowsocks2/shadowaead"
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/blake3"
+)
+
+// Header types
+const (
+	HeaderTypeClient = 0
+	HeaderTypeServer = 1
+)
+
+const (
+	// MaxPaddingLength is the largest padding a client adds to a request header.
+	MaxPaddingLength = 900
+	// MaxPayloadSize is the largest payload of a single stream chunk.
+	MaxPayloadSize = 0xFFFF
+
+	sessionSubkeyContext = "shadowsocks 2022 session subkey"
+	tagSize              = 16 // of every supported AEAD
+	timestampTolerance   = 30 * time.Second
+	saltRetention        = 60 * time.Second
+)
+
+var (
+	ErrBadHeaderType  = errors.New("bad header type")
+	ErrBadTimestamp   = errors.New("timestamp outside of the allowed window")
+	ErrBadRequestSalt = errors.New("request salt mismatch")
+	ErrBadHeader      = errors.New("malformed header")
+	ErrMissingAddress = errors.New("first write must start with the target address")
+	ErrReplayedPacket = errors.New("replayed packet")
+	ErrBadSession     = errors.New("packet for unknown session")
+	ErrNoSession      = errors.New("no session with the address")
+)
+
+// Request salts seen by servers in this process, kept for the replay window.
+var saltPool = internal.NewSaltPool(saltRetention)
+
+// timeNow is the clock used for timestamps, replaceable in tests.
+var timeNow = time.Now
+
+// Cipher is a Shadowsocks 2022 method with its pre-shared key.
+type Cipher struct {
+	psk      []byte
+	makeAEAD func(key []byte) (cipher.AEAD, error)
+
+	// Exactly one of these protects UDP packets, depending on the method.
+	udpBlock cipher.Block // AES: encrypts the separate header
+	udpAEAD  cipher.AEAD  // ChaCha20: XChaCha20-Poly1305 over the whole packet
+}
+
+// AESGCM creates a 2022-blake3-aes-128-gcm or 2022-blake3-aes-256-gcm Cipher.
+// len(psk) must be 16 or 32.
+func AESGCM(psk []byte) (*Cipher, error) {
+	switch l := len(psk); l {
+	case 16, 32:
+	default:
+		return nil, aes.KeySizeError(l)
+	}
+	blk, err := aes.NewCipher(psk)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{psk: psk, makeAEAD: aesGCM, udpBlock: blk}, nil
+}
+
+// Chacha20Poly1305 creates a 2022-blake3-chacha20-poly1305 Cipher.
+// len(psk) must be 32.
+func Chacha20Poly1305(psk []byte) (*Cipher, error) {
+	if len(psk) != chacha20poly1305.KeySize {
+		return nil, shadowaead.KeySizeError(chacha20poly1305.KeySize)
+	}
+	aead, err := chacha20poly1305.NewX(psk)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{psk: psk, makeAEAD: chacha20poly1305.New, udpAEAD: aead}, nil
+}
+
+func (c *Cipher) KeySize() int  { return len(c.psk) }
+func (c *Cipher) SaltSize() int { return len(c.psk) }
+
+// sessionAEAD returns the AEAD keyed with the session subkey for material,
+// which is the salt for streams and the session ID for AES packets.
+func (c *Cipher) sessionAEAD(material []byte) (cipher.AEAD, error) {
+	keyMaterial := make([]byte, 0, len(c.psk)+len(material))
+	keyMaterial = append(keyMaterial, c.psk...)
+	keyMaterial = append(keyMaterial, material...)
+
+	subkey := make([]byte, c.KeySize())
+	blake3.DeriveKey(subkey, sessionSubkeyContext, keyMaterial)
+	return c.makeAEAD(subkey)
+}
+
+// StreamHeaderSize is the length of the salt and the fixed-length request header.
+func (c *Cipher) StreamHeaderSize() int { return c.SaltSize() + 1 + 8 + 2 + tagSize }
+
+// MatchStream reports whether header, the first StreamHeaderSize bytes of a
+// stream, is a request made with this key. It lets a server with several
+// keys find the right one.
+func (c *Cipher) MatchStream(header []byte) bool {
+	if len(header) != c.StreamHeaderSize() {
+		return false
+	}
+	salt := header[:c.SaltSize()]
+	aead, err := c.sessionAEAD(salt)
+	if err != nil {
+		return false
+	}
+	fixed, err := aead.Open(nil, make([]byte, aead.NonceSize()), header[len(salt):], nil)
+	return err == nil && fixed[0] == HeaderTypeClient
+}
+
+func (c *Cipher) StreamConn(conn net.Conn) (net.Conn, error) { return NewConn(conn, c), nil }
+
+func (c *Cipher) PacketConn(conn net.PacketConn) net.PacketConn { return NewPacketConn(conn, c) }
+
+func (c *Cipher) ServerPacketConn(conn net.PacketConn) net.PacketConn {
+	return NewServerPacketConn(conn, c)
+}
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blk)
+}
+
+func validTimestamp(timestamp uint64) bool {
+	diff := timeNow().Unix() - int64(timestamp)
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= int64(timestampTolerance/time.Second)
+}
+
+// increment little-endian encoded unsigned integer b. Wrap around on overflow.
+func increment(b []byte) {
+	for i := range b {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
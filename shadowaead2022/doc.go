@@ -0,0 +1,44 @@
+/*
+Package shadowaead2022 implements the Shadowsocks 2022 Edition protocol (SIP022)
+with the 2022-blake3-aes-128-gcm, 2022-blake3-aes-256-gcm and
+2022-blake3-chacha20-poly1305 methods.
+
+The pre-shared key is used as is; it is not derived from a password. Session
+subkeys are derived with BLAKE3 in key derivation mode:
+
+	subkey = BLAKE3-derive-key("shadowsocks 2022 session subkey", psk || salt)
+
+A stream request from the client starts with a salt, followed by two header
+chunks and then ordinary encrypted records:
+
+	[salt]
+	[fixed-length header: type 0, timestamp, length of variable header][tag]
+	[variable-length header: target address, padding length, padding, initial payload][tag]
+	[encrypted payload length][tag][encrypted payload][tag]...
+
+The response from the server has the same layout, except that the fixed-length
+header carries type 1, the timestamp, the request salt and the length of the
+first payload chunk, and the variable-length header is that payload chunk. All
+chunks of one direction share a counting nonce, as in package shadowaead.
+
+Servers reject a stream whose timestamp differs from the local clock by more than
+30 seconds, and keep every request salt for 60 seconds to reject replays.
+
+Each packet carries a session ID and a packet ID. With AES the packet is
+
+	[AES block encrypted session ID, packet ID][AEAD encrypted body][tag]
+
+where the AEAD uses the session subkey of the session ID and bytes 4 to 15 of the
+plaintext session and packet IDs as nonce. With ChaCha20 the packet is
+
+	[random 24-byte nonce][XChaCha20-Poly1305 encrypted session ID, packet ID, body][tag]
+
+The body is the header type, the timestamp, the client session ID (server
+packets only), the padding length, the padding, the address and the payload.
+Packet IDs are checked against a sliding window to reject replays.
+
+The same connection types serve both roles: a stream that is written first acts
+as a client, and one that is read first acts as a server. A packet connection
+answers as a server to the peers it has received client packets from.
+*/
+package shadowaead2022
@@ -0,0 +1,317 @@
+package shadowaead2022
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/internal"
+	"github.com/OperatorFoundation/go-shadowsocks2/shadowaead"
+)
+
+const (
+	maxPacketSize = 64 * 1024
+	// separateHeaderSize is the session ID followed by the packet ID.
+	separateHeaderSize = 8 + 8
+	xNonceSize         = 24
+	// sessionTimeout is how long an idle session is remembered.
+	sessionTimeout = 5 * time.Minute
+)
+
+// session is one direction of a UDP association as identified by a session ID.
+type session struct {
+	id       uint64
+	aead     cipher.AEAD // session subkey AEAD, AES methods only
+	packetID uint64      // next packet ID to send
+	window   internal.ReplayWindow
+	lastSeen time.Time
+}
+
+// peerSession pairs a client session with the server session answering it.
+type peerSession struct {
+	client     *session
+	server     *session
+	lastActive time.Time // of the last packet in either direction
+}
+
+type packetConn struct {
+	net.PacketConn
+	*Cipher
+	sync.Mutex
+	buf    []byte // write buffer
+	server bool
+
+	// Client role: our own session and the server sessions answering it.
+	local  *session
+	remote map[uint64]*session
+
+	// Server role: the sessions of every client, by client session ID and by address.
+	peers      map[uint64]*peerSession
+	peerByAddr map[string]*peerSession
+	lastPrune  time.Time
+}
+
+// NewPacketConn wraps a net.PacketConn with cipher for a client, which sends
+// its packets to servers.
+func NewPacketConn(c net.PacketConn, ciph *Cipher) net.PacketConn {
+	return newPacketConn(c, ciph, false)
+}
+
+// NewServerPacketConn wraps a net.PacketConn with cipher for a server, which
+// only answers the clients that it has heard from.
+func NewServerPacketConn(c net.PacketConn, ciph *Cipher) net.PacketConn {
+	return newPacketConn(c, ciph, true)
+}
+
+func newPacketConn(c net.PacketConn, ciph *Cipher, server bool) *packetConn {
+	return &packetConn{
+		PacketConn: c,
+		Cipher:     ciph,
+		buf:        make([]byte, maxPacketSize),
+		server:     server,
+		remote:     make(map[uint64]*session),
+		peers:      make(map[uint64]*peerSession),
+		peerByAddr: make(map[string]*peerSession),
+		lastPrune:  timeNow(),
+	}
+}
+
+func (c *packetConn) newSession(id uint64) (*session, error) {
+	s := &session{id: id, lastSeen: timeNow()}
+	if c.udpBlock != nil {
+		idBytes := binary.BigEndian.AppendUint64(nil, id)
+		aead, err := c.sessionAEAD(idBytes)
+		if err != nil {
+			return nil, err
+		}
+		s.aead = aead
+	}
+	return s, nil
+}
+
+func (c *packetConn) newRandomSession() (*session, error) {
+	var id [8]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return nil, err
+	}
+	return c.newSession(binary.BigEndian.Uint64(id[:]))
+}
+
+// WriteTo encrypts b and write to addr using the embedded PacketConn.
+// b is a SOCKS address followed by the payload. A server can only write to
+// the address of a client that it has a session with.
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	var (
+		s             *session
+		headerType    byte = HeaderTypeClient
+		clientSession *session
+	)
+	if c.server {
+		peer, ok := c.peerByAddr[addr.String()]
+		if !ok {
+			return 0, ErrNoSession
+		}
+		peer.lastActive = timeNow()
+		s = peer.server
+		headerType = HeaderTypeServer
+		clientSession = peer.client
+	} else {
+		if c.local == nil {
+			local, err := c.newRandomSession()
+			if err != nil {
+				return 0, err
+			}
+			c.local = local
+		}
+		s = c.local
+	}
+
+	header := make([]byte, 0, separateHeaderSize)
+	header = binary.BigEndian.AppendUint64(header, s.id)
+	header = binary.BigEndian.AppendUint64(header, s.packetID)
+	s.packetID++
+
+	body := make([]byte, 0, 1+8+8+2+len(b))
+	body = append(body, headerType)
+	body = binary.BigEndian.AppendUint64(body, uint64(timeNow().Unix()))
+	if clientSession != nil {
+		body = binary.BigEndian.AppendUint64(body, clientSession.id)
+	}
+	body = binary.BigEndian.AppendUint16(body, 0) // no padding
+	body = append(body, b...)
+
+	var buf []byte
+	if c.udpBlock != nil {
+		if len(c.buf) < separateHeaderSize+len(body)+s.aead.Overhead() {
+			return 0, io.ErrShortBuffer
+		}
+		buf = c.buf[:separateHeaderSize]
+		c.udpBlock.Encrypt(buf, header)
+		buf = s.aead.Seal(buf, header[4:16], body, nil)
+	} else {
+		if len(c.buf) < xNonceSize+separateHeaderSize+len(body)+c.udpAEAD.Overhead() {
+			return 0, io.ErrShortBuffer
+		}
+		buf = c.buf[:xNonceSize]
+		if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+			return 0, err
+		}
+		buf = c.udpAEAD.Seal(buf, buf[:xNonceSize], append(header, body...), nil)
+	}
+
+	_, err := c.PacketConn.WriteTo(buf, addr)
+	return len(b), err
+}
+
+// ReadFrom reads from the embedded PacketConn and decrypts into b.
+// On success b starts with the SOCKS address followed by the payload.
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.prune()
+
+	var header, body []byte
+	var s *session
+	if c.udpBlock != nil {
+		if n < separateHeaderSize {
+			return n, addr, shadowaead.ErrShortPacket
+		}
+		header = make([]byte, separateHeaderSize)
+		c.udpBlock.Decrypt(header, b[:separateHeaderSize])
+		s, err = c.sessionFor(binary.BigEndian.Uint64(header))
+		if err != nil {
+			return n, addr, err
+		}
+		body, err = s.aead.Open(b[separateHeaderSize:separateHeaderSize], header[4:16], b[separateHeaderSize:n], nil)
+		if err != nil {
+			return n, addr, err
+		}
+	} else {
+		if n < xNonceSize+separateHeaderSize+c.udpAEAD.Overhead() {
+			return n, addr, shadowaead.ErrShortPacket
+		}
+		plaintext, err := c.udpAEAD.Open(b[xNonceSize:xNonceSize], b[:xNonceSize], b[xNonceSize:n], nil)
+		if err != nil {
+			return n, addr, err
+		}
+		header, body = plaintext[:separateHeaderSize], plaintext[separateHeaderSize:]
+		s, err = c.sessionFor(binary.BigEndian.Uint64(header))
+		if err != nil {
+			return n, addr, err
+		}
+	}
+
+	if len(body) < 1+8 {
+		return n, addr, ErrBadHeader
+	}
+	headerType := body[0]
+	if !validTimestamp(binary.BigEndian.Uint64(body[1:9])) {
+		return n, addr, ErrBadTimestamp
+	}
+	body = body[9:]
+
+	switch {
+	case headerType == HeaderTypeClient && c.server:
+	case headerType == HeaderTypeServer && !c.server:
+		if c.local == nil || len(body) < 8 || binary.BigEndian.Uint64(body) != c.local.id {
+			return n, addr, ErrBadSession
+		}
+		body = body[8:]
+	default:
+		return n, addr, ErrBadHeaderType
+	}
+
+	if len(body) < 2 || len(body) < 2+int(binary.BigEndian.Uint16(body)) {
+		return n, addr, ErrBadHeader
+	}
+	body = body[2+int(binary.BigEndian.Uint16(body)):]
+
+	if !s.window.Accept(binary.BigEndian.Uint64(header[8:])) {
+		return n, addr, ErrReplayedPacket
+	}
+	s.lastSeen = timeNow()
+	if headerType == HeaderTypeClient {
+		if err = c.rememberPeer(s, addr); err != nil {
+			return n, addr, err
+		}
+	}
+
+	copy(b, body)
+	return len(body), addr, nil
+}
+
+// sessionFor returns the state of the peer session id, creating it on first use.
+func (c *packetConn) sessionFor(id uint64) (*session, error) {
+	if !c.server { // packets come from server sessions
+		if s, ok := c.remote[id]; ok {
+			return s, nil
+		}
+		s, err := c.newSession(id)
+		if err != nil {
+			return nil, err
+		}
+		c.remote[id] = s
+		return s, nil
+	}
+
+	if peer, ok := c.peers[id]; ok {
+		return peer.client, nil
+	}
+	return c.newSession(id)
+}
+
+// rememberPeer records the client session s at addr so that replies to addr
+// are sent as server packets.
+func (c *packetConn) rememberPeer(s *session, addr net.Addr) error {
+	peer, ok := c.peers[s.id]
+	if !ok {
+		server, err := c.newRandomSession()
+		if err != nil {
+			return err
+		}
+		peer = &peerSession{client: s, server: server}
+		c.peers[s.id] = peer
+	}
+	peer.lastActive = timeNow()
+	c.peerByAddr[addr.String()] = peer
+	return nil
+}
+
+// prune forgets sessions that have been idle for sessionTimeout. A client
+// session is not idle while replies go to it.
+// It does the work at most once per sessionTimeout.
+func (c *packetConn) prune() {
+	now := timeNow()
+	if now.Sub(c.lastPrune) < sessionTimeout {
+		return
+	}
+	c.lastPrune = now
+
+	for id, s := range c.remote {
+		if now.Sub(s.lastSeen) > sessionTimeout {
+			delete(c.remote, id)
+		}
+	}
+	for id, peer := range c.peers {
+		if now.Sub(peer.lastActive) > sessionTimeout {
+			delete(c.peers, id)
+		}
+	}
+	for a, peer := range c.peerByAddr {
+		if now.Sub(peer.lastActive) > sessionTimeout {
+			delete(c.peerByAddr, a)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package shadowaead2022
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/shadowaead"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+)
+
+func testCiphers(t *testing.T) map[string]*Cipher {
+	ciphers := make(map[string]*Cipher)
+	for name, size := range map[string]int{"aes-128-gcm": 16, "aes-256-gcm": 32, "chacha20-poly1305": 32} {
+		psk := make([]byte, size)
+		if _, err := rand.Read(psk); err != nil {
+			t.Fatal(err)
+		}
+		var ciph *Cipher
+		var err error
+		if name == "chacha20-poly1305" {
+			ciph, err = Chacha20Poly1305(psk)
+		} else {
+			ciph, err = AESGCM(psk)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphers[name] = ciph
+	}
+	return ciphers
+}
+
+// recordingConn keeps a copy of everything written to it.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.written.Write(b)
+	return c.Conn.Write(b)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	for name, ciph := range testCiphers(t) {
+		left, right := net.Pipe()
+		client, server := NewConn(left, ciph), NewConn(right, ciph)
+
+		target := socks.ParseAddr("example.com:443")
+		request := bytes.Repeat([]byte("request "), 10000) // spans several chunks
+		response := []byte("response")
+
+		go func() {
+			client.Write(target)
+			client.Write(request)
+		}()
+
+		addr, err := socks.ReadAddr(server)
+		if err != nil {
+			t.Fatalf("%s: read address: %v", name, err)
+		}
+		if !bytes.Equal(addr, target) {
+			t.Errorf("%s: address = %v, want %v", name, addr, target)
+		}
+		got := make([]byte, len(request))
+		if _, err = io.ReadFull(server, got); err != nil {
+			t.Fatalf("%s: read request: %v", name, err)
+		}
+		if !bytes.Equal(got, request) {
+			t.Errorf("%s: request mismatch", name)
+		}
+
+		go server.Write(response)
+		got = make([]byte, len(response))
+		if _, err = io.ReadFull(client, got); err != nil {
+			t.Fatalf("%s: read response: %v", name, err)
+		}
+		if !bytes.Equal(got, response) {
+			t.Errorf("%s: response = %q, want %q", name, got, response)
+		}
+
+		left.Close()
+		right.Close()
+	}
+}
+
+// captureRequest returns the bytes a client sends for one request.
+func captureRequest(t *testing.T, ciph *Cipher) []byte {
+	left, right := net.Pipe()
+	defer right.Close()
+	recorder := &recordingConn{Conn: left}
+	go func() {
+		NewConn(recorder, ciph).Write(append(socks.ParseAddr("127.0.0.1:80"), "hello"...))
+		left.Close()
+	}()
+	io.Copy(io.Discard, right)
+	return recorder.written.Bytes()
+}
+
+// replayRequest feeds a captured request to a fresh server connection.
+func replayRequest(request []byte, ciph *Cipher) error {
+	left, right := net.Pipe()
+	defer right.Close()
+	go func() {
+		left.Write(request)
+		left.Close()
+	}()
+	_, err := socks.ReadAddr(NewConn(right, ciph))
+	return err
+}
+
+func TestStreamRejectsReplayedRequest(t *testing.T) {
+	ciph := testCiphers(t)["aes-256-gcm"]
+	request := captureRequest(t, ciph)
+
+	if err := replayRequest(request, ciph); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if err := replayRequest(request, ciph); !errors.Is(err, shadowaead.ErrRepeatedSalt) {
+		t.Fatalf("replayed request: got %v, want %v", err, shadowaead.ErrRepeatedSalt)
+	}
+}
+
+func TestStreamRejectsOldTimestamp(t *testing.T) {
+	ciph := testCiphers(t)["chacha20-poly1305"]
+
+	timeNow = func() time.Time { return time.Now().Add(-time.Minute) }
+	request := captureRequest(t, ciph)
+	timeNow = time.Now
+
+	if err := replayRequest(request, ciph); !errors.Is(err, ErrBadTimestamp) {
+		t.Fatalf("got %v, want %v", err, ErrBadTimestamp)
+	}
+}
+
+func listenUDP(t *testing.T) net.PacketConn {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	for name, ciph := range testCiphers(t) {
+		serverConn := listenUDP(t)
+		server := NewServerPacketConn(serverConn, ciph)
+		client := NewPacketConn(listenUDP(t), ciph)
+
+		request := append(socks.ParseAddr("8.8.8.8:53"), "query"...)
+		if _, err := client.WriteTo(request, serverConn.LocalAddr()); err != nil {
+			t.Fatalf("%s: client write: %v", name, err)
+		}
+
+		buf := make([]byte, maxPacketSize)
+		n, clientAddr, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("%s: server read: %v", name, err)
+		}
+		if !bytes.Equal(buf[:n], request) {
+			t.Errorf("%s: server got %q, want %q", name, buf[:n], request)
+		}
+
+		response := append(socks.ParseAddr("8.8.8.8:53"), "answer"...)
+		if _, err = server.WriteTo(response, clientAddr); err != nil {
+			t.Fatalf("%s: server write: %v", name, err)
+		}
+		n, _, err = client.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("%s: client read: %v", name, err)
+		}
+		if !bytes.Equal(buf[:n], response) {
+			t.Errorf("%s: client got %q, want %q", name, buf[:n], response)
+		}
+	}
+}
+
+func TestPacketRejectsReplay(t *testing.T) {
+	ciph := testCiphers(t)["aes-128-gcm"]
+	serverConn := listenUDP(t)
+	server := NewServerPacketConn(serverConn, ciph)
+	rawClient := listenUDP(t)
+
+	// Encrypt one packet through a client, then send the same bytes twice.
+	sealer := listenUDP(t)
+	client := NewPacketConn(sealer, ciph)
+	if _, err := client.WriteTo(append(socks.ParseAddr("1.1.1.1:53"), "x"...), rawClient.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	packet := make([]byte, maxPacketSize)
+	n, _, err := rawClient.ReadFrom(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet = packet[:n]
+
+	buf := make([]byte, maxPacketSize)
+	for i, want := range []error{nil, ErrReplayedPacket} {
+		if _, err = rawClient.WriteTo(packet, serverConn.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = server.ReadFrom(buf); err != want {
+			t.Fatalf("packet %d: got %v, want %v", i, err, want)
+		}
+	}
+}
+
+func TestPacketServerKeepsRole(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	ciph := testCiphers(t)["aes-128-gcm"]
+	serverConn := listenUDP(t)
+	server := NewServerPacketConn(serverConn, ciph)
+	buf := make([]byte, maxPacketSize)
+	request := append(socks.ParseAddr("8.8.8.8:53"), "query"...)
+	send := func(name string) (net.PacketConn, net.Addr) {
+		client := NewPacketConn(listenUDP(t), ciph)
+		if _, err := client.WriteTo(request, serverConn.LocalAddr()); err != nil {
+			t.Fatalf("client %s: %v", name, err)
+		}
+		_, addr, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("server read from %s: %v", name, err)
+		}
+		return client, addr
+	}
+	reply := func(name string, client net.PacketConn, addr net.Addr) {
+		if _, err := server.WriteTo(request, addr); err != nil {
+			t.Fatalf("server write to %s: %v", name, err)
+		}
+		if _, _, err := client.ReadFrom(buf); err != nil {
+			t.Fatalf("client %s read: %v", name, err)
+		}
+	}
+
+	// Replies keep a client session alive.
+	a, addrA := send("A")
+	now = now.Add(4 * time.Minute)
+	reply("A", a, addrA)
+	now = now.Add(4 * time.Minute)
+	send("B")
+	reply("A", a, addrA)
+
+	// Once forgotten, a client gets no reply and the server stays a server.
+	now = now.Add(6 * time.Minute)
+	send("B")
+	if _, err := server.WriteTo(request, addrA); err != ErrNoSession {
+		t.Fatalf("write to forgotten client: got %v, want %v", err, ErrNoSession)
+	}
+	c, addrC := send("C")
+	reply("C", c, addrC)
+}
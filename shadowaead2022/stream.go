@@ -0,0 +1,389 @@
+package shadowaead2022
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/internal"
+	"github.com/OperatorFoundation/go-shadowsocks2/shadowaead"
+	"github.com/OperatorFoundation/go-shadowsocks2/socks"
+)
+
+type writer struct {
+	io.Writer
+	cipher.AEAD
+	nonce []byte
+	buf   []byte
+}
+
+// newWriter wraps an io.Writer with AEAD encryption, continuing from nonce.
+func newWriter(w io.Writer, aead cipher.AEAD, nonce []byte) *writer {
+	return &writer{
+		Writer: w,
+		AEAD:   aead,
+		buf:    make([]byte, 2+aead.Overhead()+MaxPayloadSize+aead.Overhead()),
+		nonce:  nonce,
+	}
+}
+
+// Write encrypts b and writes to the embedded io.Writer.
+func (w *writer) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > MaxPayloadSize {
+			chunk = chunk[:MaxPayloadSize]
+		}
+
+		buf := w.buf[:2+w.Overhead()+len(chunk)+w.Overhead()]
+		binary.BigEndian.PutUint16(buf, uint16(len(chunk)))
+		w.Seal(buf[:0], w.nonce, buf[:2], nil)
+		increment(w.nonce)
+
+		w.Seal(buf[2+w.Overhead():2+w.Overhead()], w.nonce, chunk, nil)
+		increment(w.nonce)
+
+		if _, err := w.Writer.Write(buf); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+type reader struct {
+	io.Reader
+	cipher.AEAD
+	nonce    []byte
+	buf      []byte
+	leftover []byte
+}
+
+// newReader wraps an io.Reader with AEAD decryption, continuing from nonce.
+func newReader(r io.Reader, aead cipher.AEAD, nonce []byte) *reader {
+	return &reader{
+		Reader: r,
+		AEAD:   aead,
+		buf:    make([]byte, MaxPayloadSize+aead.Overhead()),
+		nonce:  nonce,
+	}
+}
+
+// read and decrypt a record into the internal buffer. Return decrypted payload length and any error encountered.
+func (r *reader) read() (int, error) {
+	// decrypt payload size
+	buf := r.buf[:2+r.Overhead()]
+	_, err := io.ReadFull(r.Reader, buf)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = r.Open(buf[:0], r.nonce, buf, nil)
+	increment(r.nonce)
+	if err != nil {
+		return 0, err
+	}
+
+	size := int(binary.BigEndian.Uint16(buf))
+
+	// decrypt payload
+	buf = r.buf[:size+r.Overhead()]
+	_, err = io.ReadFull(r.Reader, buf)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = r.Open(buf[:0], r.nonce, buf, nil)
+	increment(r.nonce)
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// Read reads from the embedded io.Reader, decrypts and writes to b.
+func (r *reader) Read(b []byte) (int, error) {
+	// copy decrypted bytes (if any) from the header or the previous record first
+	if len(r.leftover) > 0 {
+		n := copy(b, r.leftover)
+		r.leftover = r.leftover[n:]
+		return n, nil
+	}
+
+	n, err := r.read()
+	m := copy(b, r.buf[:n])
+	if m < n { // insufficient len(b), keep leftover for next read
+		r.leftover = r.buf[m:n]
+	}
+	return m, err
+}
+
+type streamConn struct {
+	net.Conn
+	*Cipher
+
+	// mutex guards the role, which is decided by whichever header comes first.
+	mutex       sync.Mutex
+	isServer    bool
+	requestSalt []byte // sent by the client, echoed back by the server
+
+	r *reader
+	w *writer
+}
+
+// NewConn wraps a stream-oriented net.Conn with cipher.
+func NewConn(c net.Conn, ciph *Cipher) net.Conn { return &streamConn{Conn: c, Cipher: ciph} }
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	if c.r == nil {
+		c.mutex.Lock()
+		isClient := c.requestSalt != nil
+		c.mutex.Unlock()
+
+		var err error
+		if isClient {
+			err = c.readResponseHeader()
+		} else {
+			err = c.readRequestHeader()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return c.r.Read(b)
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	if c.w == nil {
+		if len(b) == 0 {
+			return 0, nil
+		}
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.isServer {
+			return c.writeResponseHeader(b)
+		}
+		return c.writeRequestHeader(b)
+	}
+	return c.w.Write(b)
+}
+
+// readRequestHeader reads the request of a client, making this the server side.
+// The target address and the initial payload are kept for the next reads.
+func (c *streamConn) readRequestHeader() error {
+	salt := make([]byte, c.SaltSize())
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	aead, err := c.sessionAEAD(salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+
+	fixed := make([]byte, 1+8+2+aead.Overhead())
+	if _, err = io.ReadFull(c.Conn, fixed); err != nil {
+		return err
+	}
+	if _, err = aead.Open(fixed[:0], nonce, fixed, nil); err != nil {
+		return err
+	}
+	increment(nonce)
+
+	if fixed[0] != HeaderTypeClient {
+		return ErrBadHeaderType
+	}
+	if !validTimestamp(binary.BigEndian.Uint64(fixed[1:9])) {
+		return ErrBadTimestamp
+	}
+	if saltPool.Check(salt) {
+		return shadowaead.ErrRepeatedSalt
+	}
+
+	variable := make([]byte, int(binary.BigEndian.Uint16(fixed[9:11]))+aead.Overhead())
+	if _, err = io.ReadFull(c.Conn, variable); err != nil {
+		return err
+	}
+	if _, err = aead.Open(variable[:0], nonce, variable, nil); err != nil {
+		return err
+	}
+	increment(nonce)
+	variable = variable[:len(variable)-aead.Overhead()]
+
+	addr := socks.SplitAddr(variable)
+	if addr == nil || len(variable) < len(addr)+2 {
+		return ErrBadHeader
+	}
+	paddingLength := int(binary.BigEndian.Uint16(variable[len(addr):]))
+	if len(variable) < len(addr)+2+paddingLength {
+		return ErrBadHeader
+	}
+	payload := variable[len(addr)+2+paddingLength:]
+
+	c.mutex.Lock()
+	c.isServer = true
+	c.requestSalt = salt
+	c.mutex.Unlock()
+
+	c.r = newReader(c.Conn, aead, nonce)
+	c.r.leftover = append(append([]byte{}, addr...), payload...)
+	return nil
+}
+
+// readResponseHeader reads the response of the server to our request.
+func (c *streamConn) readResponseHeader() error {
+	salt := make([]byte, c.SaltSize())
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	aead, err := c.sessionAEAD(salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+
+	c.mutex.Lock()
+	requestSalt := c.requestSalt
+	c.mutex.Unlock()
+
+	fixed := make([]byte, 1+8+len(requestSalt)+2+aead.Overhead())
+	if _, err = io.ReadFull(c.Conn, fixed); err != nil {
+		return err
+	}
+	if _, err = aead.Open(fixed[:0], nonce, fixed, nil); err != nil {
+		return err
+	}
+	increment(nonce)
+
+	if fixed[0] != HeaderTypeServer {
+		return ErrBadHeaderType
+	}
+	if !validTimestamp(binary.BigEndian.Uint64(fixed[1:9])) {
+		return ErrBadTimestamp
+	}
+	if !bytes.Equal(fixed[9:9+len(requestSalt)], requestSalt) {
+		return ErrBadRequestSalt
+	}
+
+	length := int(binary.BigEndian.Uint16(fixed[9+len(requestSalt):]))
+	payload := make([]byte, length+aead.Overhead())
+	if _, err = io.ReadFull(c.Conn, payload); err != nil {
+		return err
+	}
+	if _, err = aead.Open(payload[:0], nonce, payload, nil); err != nil {
+		return err
+	}
+	increment(nonce)
+
+	c.r = newReader(c.Conn, aead, nonce)
+	c.r.leftover = payload[:length]
+	return nil
+}
+
+// writeRequestHeader sends the request, making this the client side.
+// b must start with the target address; the rest is sent as initial payload.
+func (c *streamConn) writeRequestHeader(b []byte) (int, error) {
+	addr := socks.SplitAddr(b)
+	if addr == nil {
+		return 0, ErrMissingAddress
+	}
+	payload := b[len(addr):]
+
+	paddingLength := 0
+	if len(payload) == 0 {
+		n, err := rand.Int(rand.Reader, big.NewInt(MaxPaddingLength))
+		if err != nil {
+			return 0, err
+		}
+		paddingLength = int(n.Int64()) + 1
+	}
+	initial := payload
+	if maxInitial := MaxPayloadSize - len(addr) - 2 - paddingLength; len(initial) > maxInitial {
+		initial = initial[:maxInitial]
+	}
+
+	variable := make([]byte, 0, len(addr)+2+paddingLength+len(initial))
+	variable = append(variable, addr...)
+	variable = binary.BigEndian.AppendUint16(variable, uint16(paddingLength))
+	variable = append(variable, make([]byte, paddingLength)...)
+	variable = append(variable, initial...)
+
+	fixed := make([]byte, 0, 1+8+2)
+	fixed = append(fixed, HeaderTypeClient)
+	fixed = binary.BigEndian.AppendUint64(fixed, uint64(timeNow().Unix()))
+	fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(variable)))
+
+	salt, err := c.writeHeader(fixed, variable)
+	if err != nil {
+		return 0, err
+	}
+	c.requestSalt = salt
+
+	if rest := payload[len(initial):]; len(rest) > 0 {
+		if _, err = c.w.Write(rest); err != nil {
+			return len(b) - len(rest), err
+		}
+	}
+	return len(b), nil
+}
+
+// writeResponseHeader answers the request read earlier, sending b as the first chunk.
+func (c *streamConn) writeResponseHeader(b []byte) (int, error) {
+	chunk := b
+	if len(chunk) > MaxPayloadSize {
+		chunk = chunk[:MaxPayloadSize]
+	}
+
+	fixed := make([]byte, 0, 1+8+len(c.requestSalt)+2)
+	fixed = append(fixed, HeaderTypeServer)
+	fixed = binary.BigEndian.AppendUint64(fixed, uint64(timeNow().Unix()))
+	fixed = append(fixed, c.requestSalt...)
+	fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(chunk)))
+
+	if _, err := c.writeHeader(fixed, chunk); err != nil {
+		return 0, err
+	}
+
+	if rest := b[len(chunk):]; len(rest) > 0 {
+		if _, err := c.w.Write(rest); err != nil {
+			return len(chunk), err
+		}
+	}
+	return len(b), nil
+}
+
+// writeHeader sends a fresh salt and the two header chunks, then sets up the
+// writer for the following records. It returns the salt.
+func (c *streamConn) writeHeader(fixed, variable []byte) ([]byte, error) {
+	salt := make([]byte, c.SaltSize())
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := c.sessionAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+
+	buf := make([]byte, 0, len(salt)+len(fixed)+len(variable)+2*aead.Overhead())
+	buf = append(buf, salt...)
+	buf = aead.Seal(buf, nonce, fixed, nil)
+	increment(nonce)
+	buf = aead.Seal(buf, nonce, variable, nil)
+	increment(nonce)
+
+	if err = internal.WriteFully(c.Conn, buf); err != nil {
+		return nil, err
+	}
+	c.w = newWriter(c.Conn, aead, nonce)
+	return salt, nil
+}
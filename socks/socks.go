@@ -2,6 +2,8 @@
 package socks
 
 import (
+	"crypto/subtle"
+	"errors"
 	"io"
 	"net"
 	"strconv"
@@ -44,6 +46,36 @@ const (
 	InfoUDPAssociate        = Error(9)
 )
 
+// SOCKS authentication methods as defined in RFC 1928 section 3.
+const (
+	MethodNoAuth       = 0
+	MethodPassword     = 2
+	MethodNoAcceptable = 0xFF
+)
+
+var (
+	// ErrNoAcceptableMethod is the error of a client that does not offer the
+	// authentication method of the server.
+	ErrNoAcceptableMethod = errors.New("SOCKS: no acceptable authentication method")
+	// ErrAuthFailed is the error of a client whose username and password were
+	// not accepted.
+	ErrAuthFailed = errors.New("SOCKS: authentication failed")
+)
+
+// Auth checks the username and password of a client (RFC 1929). A nil Auth
+// lets the clients in without authentication.
+type Auth func(username, password string) bool
+
+// Password returns the Auth that accepts username and password.
+func Password(username, password string) Auth {
+	return func(u, p string) bool {
+		// check both, in constant time
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(username))
+		passwordOK := subtle.ConstantTimeCompare([]byte(p), []byte(password))
+		return userOK&passwordOK == 1
+	}
+}
+
 // MaxAddrLen is the maximum size of SOCKS address in bytes.
 const MaxAddrLen = 1 + 1 + 255 + 2
 
@@ -169,39 +201,21 @@ func ParseAddr(s string) Addr {
 }
 
 // Handshake fast-tracks SOCKS initialization to get target address to connect.
-func Handshake(rw io.ReadWriter) (Addr, error) {
-	// Read RFC 1928 for request and reply structure and sizes.
-	buf := make([]byte, MaxAddrLen)
-	// read VER, NMETHODS, METHODS
-	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
-		return nil, err
-	}
-	nmethods := buf[1]
-	if _, err := io.ReadFull(rw, buf[:nmethods]); err != nil {
-		return nil, err
-	}
-	// write VER METHOD
-	if _, err := rw.Write([]byte{5, 0}); err != nil {
-		return nil, err
-	}
-	// read VER CMD RSV ATYP DST.ADDR DST.PORT
-	if _, err := io.ReadFull(rw, buf[:3]); err != nil {
-		return nil, err
-	}
-	cmd := buf[1]
-	addr, err := readAddr(rw, buf)
+// The client must authenticate if auth is not nil.
+func Handshake(rw io.ReadWriter, auth Auth) (Addr, error) {
+	cmd, addr, err := Request(rw, auth)
 	if err != nil {
 		return nil, err
 	}
 	switch cmd {
 	case CmdConnect:
-		_, err = rw.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}) // SOCKS v5, reply succeeded
+		err = Reply(rw, 0, nil)
 	case CmdUDPAssociate:
 		if !UDPEnabled {
 			return nil, ErrCommandNotSupported
 		}
 		listenAddr := ParseAddr(rw.(net.Conn).LocalAddr().String())
-		_, err = rw.Write(append([]byte{5, 0, 0}, listenAddr...)) // SOCKS v5, reply succeeded
+		err = Reply(rw, 0, listenAddr)
 		if err != nil {
 			return nil, ErrCommandNotSupported
 		}
@@ -210,5 +224,111 @@ func Handshake(rw io.ReadWriter) (Addr, error) {
 		return nil, ErrCommandNotSupported
 	}
 
-	return addr, err // skip VER, CMD, RSV fields
+	return addr, err
+}
+
+// Request reads the method negotiation and the request of a SOCKS client,
+// and returns the command and the target address. It answers the
+// negotiation, but leaves the reply to the request to the caller, see Reply.
+// If auth is not nil, the client must authenticate with a username and
+// password that auth accepts, or Request rejects it and fails.
+func Request(rw io.ReadWriter, auth Auth) (cmd byte, addr Addr, err error) {
+	// Read RFC 1928 for request and reply structure and sizes.
+	buf := make([]byte, MaxAddrLen)
+	// read VER, NMETHODS, METHODS
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return 0, nil, err
+	}
+	nmethods := buf[1]
+	if _, err := io.ReadFull(rw, buf[:nmethods]); err != nil {
+		return 0, nil, err
+	}
+	method := byte(MethodNoAuth)
+	if auth != nil {
+		method = MethodNoAcceptable
+		for _, m := range buf[:nmethods] {
+			if m == MethodPassword {
+				method = MethodPassword
+			}
+		}
+	}
+	// write VER METHOD
+	if _, err := rw.Write([]byte{5, method}); err != nil {
+		return 0, nil, err
+	}
+	switch method {
+	case MethodNoAcceptable:
+		return 0, nil, ErrNoAcceptableMethod
+	case MethodPassword:
+		if err := authenticate(rw, auth, buf); err != nil {
+			return 0, nil, err
+		}
+	}
+	// read VER CMD RSV ATYP DST.ADDR DST.PORT
+	if _, err := io.ReadFull(rw, buf[:3]); err != nil {
+		return 0, nil, err
+	}
+	cmd = buf[1]
+	addr, err = readAddr(rw, buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	return cmd, addr, nil // skip VER, CMD, RSV fields
+}
+
+// authenticate runs the username/password sub-negotiation of RFC 1929 in buf.
+func authenticate(rw io.ReadWriter, auth Auth, buf []byte) error {
+	// read VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != 1 {
+		return errors.New("SOCKS: unknown authentication version " + strconv.Itoa(int(buf[0])))
+	}
+	ulen := int(buf[1])
+	if _, err := io.ReadFull(rw, buf[:ulen+1]); err != nil {
+		return err
+	}
+	username := string(buf[:ulen])
+	plen := int(buf[ulen])
+	if _, err := io.ReadFull(rw, buf[:plen]); err != nil {
+		return err
+	}
+	password := string(buf[:plen])
+
+	// write VER STATUS
+	if !auth(username, password) {
+		rw.Write([]byte{1, 1})
+		return ErrAuthFailed
+	}
+	_, err := rw.Write([]byte{1, 0})
+	return err
+}
+
+// Reply writes the reply to a request: rep is 0 for success or the error,
+// and bnd the bound address, 0.0.0.0:0 if nil.
+func Reply(w io.Writer, rep Error, bnd Addr) error {
+	if bnd == nil {
+		bnd = Addr{AtypIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	_, err := w.Write(append([]byte{5, byte(rep), 0}, bnd...)) // SOCKS v5
+	return err
+}
+
+// ReadReply reads a reply to a request, as written by Reply.
+func ReadReply(r io.Reader) (rep Error, bnd Addr, err error) {
+	buf := make([]byte, MaxAddrLen)
+	// read VER REP RSV
+	if _, err := io.ReadFull(r, buf[:3]); err != nil {
+		return 0, nil, err
+	}
+	if buf[0] != 5 {
+		return 0, nil, errors.New("SOCKS: unknown version " + strconv.Itoa(int(buf[0])))
+	}
+	rep = Error(buf[1])
+	bnd, err = readAddr(r, buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	return rep, bnd, nil
 }
@@ -0,0 +1,81 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// SOCKS4 replies.
+const (
+	granted  = 90
+	rejected = 91
+)
+
+// Request4 reads the request of a SOCKS4 or SOCKS4a client, and returns the
+// command, the target address and the user ID. It leaves the reply to the
+// caller, see Reply4.
+func Request4(r io.Reader) (cmd byte, addr Addr, userID string, err error) {
+	// read VN CD DSTPORT DSTIP
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, "", err
+	}
+	if buf[0] != 4 {
+		return 0, nil, "", errors.New("SOCKS4: unknown version")
+	}
+	cmd = buf[1]
+	port, ip := buf[2:4], buf[4:8]
+	if userID, err = readString(r); err != nil {
+		return 0, nil, "", err
+	}
+
+	// SOCKS4a: DSTIP 0.0.0.x with x not 0, and the host name after the user ID
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err := readString(r)
+		if err != nil {
+			return 0, nil, "", err
+		}
+		if len(host) == 0 {
+			return 0, nil, "", errors.New("SOCKS4a: empty host name")
+		}
+		addr = append(Addr{AtypDomainName, byte(len(host))}, host...)
+		return cmd, append(addr, port...), userID, nil
+	}
+	addr = append(Addr{AtypIPv4}, ip...)
+	return cmd, append(addr, port...), userID, nil
+}
+
+// readString reads a string terminated by a NUL byte, of up to 255 bytes.
+func readString(r io.Reader) (string, error) {
+	var s []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(s), nil
+		}
+		if len(s) == 255 {
+			return "", errors.New("SOCKS4: string too long")
+		}
+		s = append(s, b[0])
+	}
+}
+
+// Reply4 writes the reply to a SOCKS4 request: granted if rep is 0, or else
+// rejected. It carries bnd if it is an IPv4 address.
+func Reply4(w io.Writer, rep Error, bnd Addr) error {
+	// VN CD DSTPORT DSTIP
+	b := []byte{0, granted, 0, 0, 0, 0, 0, 0}
+	if rep != 0 {
+		b[1] = rejected
+	}
+	if len(bnd) == 1+net.IPv4len+2 && bnd[0] == AtypIPv4 {
+		copy(b[2:4], bnd[1+net.IPv4len:])
+		copy(b[4:8], bnd[1:1+net.IPv4len])
+	}
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,114 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// handshake runs Handshake with auth on one end of a pipe, while the client
+// sends its requests and checks the replies of the server on the other.
+func handshake(t *testing.T, auth Auth, client func(c net.Conn)) (Addr, error) {
+	t.Helper()
+	c, s := net.Pipe()
+	defer s.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer c.Close()
+		client(c)
+	}()
+	addr, err := Handshake(s, auth)
+	s.Close()
+	<-done
+	return addr, err
+}
+
+// exchange writes request on c and checks that the reply follows.
+func exchange(t *testing.T, c net.Conn, request, reply []byte) {
+	t.Helper()
+	if _, err := c.Write(request); err != nil {
+		t.Errorf("write %v: %v", request, err)
+		return
+	}
+	got := make([]byte, len(reply))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Errorf("read reply to %v: %v", request, err)
+		return
+	}
+	if !bytes.Equal(got, reply) {
+		t.Errorf("reply to %v: got %v, want %v", request, got, reply)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	tgt := ParseAddr("example.com:80")
+	connect := append([]byte{5, CmdConnect, 0}, tgt...)
+	success := []byte{5, 0, 0, AtypIPv4, 0, 0, 0, 0, 0, 0}
+	auth := Password("alice", "secret")
+	credentials := func(username, password string) []byte {
+		b := append([]byte{1, byte(len(username))}, username...)
+		return append(append(b, byte(len(password))), password...)
+	}
+
+	addr, err := handshake(t, nil, func(c net.Conn) {
+		exchange(t, c, []byte{5, 1, MethodNoAuth}, []byte{5, MethodNoAuth})
+		exchange(t, c, connect, success)
+	})
+	if err != nil || !bytes.Equal(addr, tgt) {
+		t.Errorf("no authentication: got %v, %v", addr, err)
+	}
+
+	addr, err = handshake(t, auth, func(c net.Conn) {
+		exchange(t, c, []byte{5, 2, MethodNoAuth, MethodPassword}, []byte{5, MethodPassword})
+		exchange(t, c, credentials("alice", "secret"), []byte{1, 0})
+		exchange(t, c, connect, success)
+	})
+	if err != nil || !bytes.Equal(addr, tgt) {
+		t.Errorf("password: got %v, %v", addr, err)
+	}
+
+	_, err = handshake(t, auth, func(c net.Conn) {
+		exchange(t, c, []byte{5, 1, MethodNoAuth}, []byte{5, MethodNoAcceptable})
+	})
+	if err != ErrNoAcceptableMethod {
+		t.Errorf("no authentication offered: got %v, want %v", err, ErrNoAcceptableMethod)
+	}
+
+	for _, bad := range [][2]string{{"alice", "wrong"}, {"bob", "secret"}, {"", ""}} {
+		_, err = handshake(t, auth, func(c net.Conn) {
+			exchange(t, c, []byte{5, 1, MethodPassword}, []byte{5, MethodPassword})
+			exchange(t, c, credentials(bad[0], bad[1]), []byte{1, 1})
+		})
+		if err != ErrAuthFailed {
+			t.Errorf("%s:%s: got %v, want %v", bad[0], bad[1], err, ErrAuthFailed)
+		}
+	}
+}
+
+func TestRequest4(t *testing.T) {
+	for _, tc := range []struct {
+		request []byte
+		addr    Addr
+	}{
+		{append([]byte{4, CmdConnect, 0, 80, 192, 0, 2, 1}, "user\x00"...), ParseAddr("192.0.2.1:80")},
+		{append([]byte{4, CmdConnect, 0, 80, 0, 0, 0, 1}, "\x00example.com\x00"...), ParseAddr("example.com:80")},
+	} {
+		cmd, addr, _, err := Request4(bytes.NewReader(tc.request))
+		if err != nil || cmd != CmdConnect || !bytes.Equal(addr, tc.addr) {
+			t.Errorf("%q: got %d, %v, %v, want %v", tc.request, cmd, addr, err, tc.addr)
+		}
+	}
+	if _, _, _, err := Request4(bytes.NewReader([]byte{4, CmdConnect, 0, 80, 0, 0, 0, 1, 0, 0})); err == nil {
+		t.Error("SOCKS4a request without host name: no error")
+	}
+
+	var b bytes.Buffer
+	Reply4(&b, 0, ParseAddr("192.0.2.1:1080"))
+	Reply4(&b, ErrConnectionRefused, nil)
+	want := []byte{0, 90, 4, 56, 192, 0, 2, 1, 0, 91, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("replies: got %v, want %v", b.Bytes(), want)
+	}
+}
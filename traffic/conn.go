@@ -0,0 +1,78 @@
+package traffic
+
+import "net"
+
+type conn struct {
+	net.Conn
+	*Accountant
+	user string
+}
+
+// Conn counts the bytes read from c as upload and the bytes written to c as
+// download of user. Once the user exceeds a quota, c is closed and Read and
+// Write fail with ErrQuotaExceeded.
+func (a *Accountant) Conn(c net.Conn, user string) net.Conn {
+	return &conn{Conn: c, Accountant: a, user: user}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if quotaErr := c.Add(c.user, uint64(n), 0); quotaErr != nil {
+			c.Conn.Close()
+			return n, quotaErr
+		}
+	}
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	if err := c.Allowed(c.user); err != nil {
+		c.Conn.Close()
+		return 0, err
+	}
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		if quotaErr := c.Add(c.user, 0, uint64(n)); quotaErr != nil && err == nil {
+			c.Conn.Close()
+			return n, quotaErr
+		}
+	}
+	return n, err
+}
+
+type packetConn struct {
+	net.PacketConn
+	*Accountant
+	user string
+}
+
+// PacketConn counts the bytes written to c as upload and the bytes read from c
+// as download of user. c is the socket that relays the packets of a client to
+// their targets. Once the user exceeds a quota, WriteTo and ReadFrom fail with
+// ErrQuotaExceeded.
+func (a *Accountant) PacketConn(c net.PacketConn, user string) net.PacketConn {
+	return &packetConn{PacketConn: c, Accountant: a, user: user}
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if err := c.Allowed(c.user); err != nil {
+		return 0, err
+	}
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if n > 0 {
+		c.Add(c.user, uint64(n), 0)
+	}
+	return n, err
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+	if quotaErr := c.Add(c.user, 0, uint64(n)); quotaErr != nil {
+		return n, addr, quotaErr
+	}
+	return n, addr, nil
+}
@@ -0,0 +1,74 @@
+package traffic
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Report is the usage and quota of a user as served by the HTTP API.
+type Report struct {
+	Usage
+	Quota Quota `json:"quota"`
+}
+
+// report returns the report of user, and whether the user has counters or a
+// quota.
+func (a *Accountant) report(user string) (Report, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	u, counted := a.lookup(user)
+	quota, limited := a.quotas[user]
+	return Report{Usage: u, Quota: quota}, counted || limited
+}
+
+// ServeHTTP serves the counters under /traffic:
+//
+//	GET /traffic          the reports of all users, by name
+//	GET /traffic/name     the report of one user, 404 without counters or quota
+//	DELETE /traffic/name  resets the counters of one user
+//
+// With a Token, every request must carry it in an "Authorization: Bearer"
+// header. Without one, resets are forbidden.
+func (a *Accountant) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/traffic" && !strings.HasPrefix(r.URL.Path, "/traffic/") {
+		http.NotFound(w, r)
+		return
+	}
+	if a.Token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+a.Token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	user := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/traffic"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && user == "":
+		reports := make(map[string]Report)
+		for _, user := range a.Users() {
+			reports[user], _ = a.report(user)
+		}
+		writeJSON(w, reports)
+	case r.Method == http.MethodGet:
+		report, ok := a.report(user)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, report)
+	case r.Method == http.MethodDelete && user != "" && a.Token == "":
+		http.Error(w, "resetting counters takes an API token", http.StatusForbidden)
+	case r.Method == http.MethodDelete && user != "":
+		a.Reset(user)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,252 @@
+// Package traffic counts the bytes proxied for each user and enforces daily and
+// monthly quotas.
+package traffic
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded means that the user has used up a quota.
+var ErrQuotaExceeded = errors.New("traffic quota exceeded")
+
+// saveDelay bounds how often the counters are written to disk.
+// Writes are coalesced so that busy connections cause one save per delay.
+const saveDelay = 10 * time.Second
+
+const (
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+)
+
+// Counter is a number of bytes in each direction. Upload is sent by the
+// client, download is sent to the client.
+type Counter struct {
+	Upload   uint64 `json:"upload"`
+	Download uint64 `json:"download"`
+}
+
+// Total is the sum of both directions.
+func (c Counter) Total() uint64 { return c.Upload + c.Download }
+
+func (c *Counter) add(upload, download uint64) {
+	c.Upload += upload
+	c.Download += download
+}
+
+// Usage is the traffic of one user.
+type Usage struct {
+	Total   Counter `json:"total"`
+	Day     string  `json:"day"`   // the day of Daily, in the local time zone
+	Daily   Counter `json:"daily"` // traffic of Day
+	Month   string  `json:"month"`
+	Monthly Counter `json:"monthly"` // traffic of Month
+}
+
+// roll starts new daily and monthly counters when now is past Day or Month.
+func (u *Usage) roll(now time.Time) {
+	if day := now.Format(dayLayout); u.Day != day {
+		u.Day, u.Daily = day, Counter{}
+	}
+	if month := now.Format(monthLayout); u.Month != month {
+		u.Month, u.Monthly = month, Counter{}
+	}
+}
+
+// Quota limits the bytes a user may transfer in both directions together.
+// Zero means no limit.
+type Quota struct {
+	Daily   uint64 `json:"daily"`
+	Monthly uint64 `json:"monthly"`
+}
+
+func (q Quota) exceeded(u *Usage) bool {
+	return (q.Daily != 0 && u.Daily.Total() >= q.Daily) ||
+		(q.Monthly != 0 && u.Monthly.Total() >= q.Monthly)
+}
+
+// Accountant keeps the traffic counters of all users and saves them to a file.
+// It is safe for concurrent use.
+type Accountant struct {
+	// Token, if set, is the bearer token that the HTTP API requires. The API
+	// does not reset counters without one. Set it before serving.
+	Token string
+
+	path string
+
+	mutex  sync.Mutex
+	usage  map[string]*Usage
+	quotas map[string]Quota
+
+	saveMutex sync.Mutex // guards saveTimer
+	saveTimer *time.Timer
+	fileMutex sync.Mutex // serializes writing the file
+}
+
+// timeNow is the clock of accountants, replaceable in tests.
+var timeNow = time.Now
+
+// Open returns an Accountant that keeps its counters in the JSON file at path,
+// loading the counters saved there earlier. An empty path keeps them in memory.
+func Open(path string) (*Accountant, error) {
+	a := &Accountant{path: path, usage: make(map[string]*Usage), quotas: make(map[string]Quota)}
+	if path == "" {
+		return a, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &a.usage); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SetQuota sets the quota of user. Pass a zero Quota to remove the limits.
+func (a *Accountant) SetQuota(user string, quota Quota) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if quota == (Quota{}) {
+		delete(a.quotas, user)
+		return
+	}
+	a.quotas[user] = quota
+}
+
+// Quota returns the quota of user.
+func (a *Accountant) Quota(user string) Quota {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.quotas[user]
+}
+
+// usageOf returns the usage of user, creating it on first use.
+// a.mutex must be held.
+func (a *Accountant) usageOf(user string) *Usage {
+	u, ok := a.usage[user]
+	if !ok {
+		u = &Usage{}
+		a.usage[user] = u
+	}
+	u.roll(timeNow())
+	return u
+}
+
+// lookup returns the usage of user, without adding the user, and whether the
+// user has counters. a.mutex must be held.
+func (a *Accountant) lookup(user string) (Usage, bool) {
+	var u Usage
+	stored, ok := a.usage[user]
+	if ok {
+		u = *stored
+	}
+	u.roll(timeNow())
+	return u, ok
+}
+
+// Add counts traffic of user. It returns ErrQuotaExceeded once the user has
+// used up a quota, including with this traffic.
+func (a *Accountant) Add(user string, upload, download uint64) error {
+	a.mutex.Lock()
+	u := a.usageOf(user)
+	u.Total.add(upload, download)
+	u.Daily.add(upload, download)
+	u.Monthly.add(upload, download)
+	exceeded := a.quotas[user].exceeded(u)
+	a.mutex.Unlock()
+
+	a.scheduleSave()
+	if exceeded {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Allowed returns ErrQuotaExceeded if user may not open new connections.
+func (a *Accountant) Allowed(user string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	u, _ := a.lookup(user)
+	if a.quotas[user].exceeded(&u) {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Usage returns the traffic of user.
+func (a *Accountant) Usage(user string) Usage {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	u, _ := a.lookup(user)
+	return u
+}
+
+// Users returns the names of all users with counters, sorted.
+func (a *Accountant) Users() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	users := make([]string, 0, len(a.usage))
+	for user := range a.usage {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Reset sets all counters of user to zero.
+func (a *Accountant) Reset(user string) {
+	a.mutex.Lock()
+	delete(a.usage, user)
+	a.mutex.Unlock()
+	a.scheduleSave()
+}
+
+// Save writes the counters to the file of the Accountant.
+func (a *Accountant) Save() error {
+	if a.path == "" {
+		return nil
+	}
+
+	a.mutex.Lock()
+	data, err := json.MarshalIndent(a.usage, "", "\t")
+	a.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Write a new file first, so that a crash cannot leave half a file.
+	a.fileMutex.Lock()
+	defer a.fileMutex.Unlock()
+	tmp := a.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+func (a *Accountant) scheduleSave() {
+	if a.path == "" {
+		return
+	}
+
+	a.saveMutex.Lock()
+	defer a.saveMutex.Unlock()
+	if a.saveTimer != nil {
+		return
+	}
+	a.saveTimer = time.AfterFunc(saveDelay, func() {
+		a.saveMutex.Lock()
+		a.saveTimer = nil
+		a.saveMutex.Unlock()
+		_ = a.Save()
+	})
+}
@@ -0,0 +1,179 @@
+package traffic
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setTime(t *testing.T, now string) {
+	when, err := time.Parse(dayLayout, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeNow = func() time.Time { return when }
+	t.Cleanup(func() { timeNow = time.Now })
+}
+
+func TestQuotaRollover(t *testing.T) {
+	setTime(t, "2024-01-31")
+	a, _ := Open("")
+	a.SetQuota("alice", Quota{Daily: 100, Monthly: 150})
+
+	if err := a.Add("alice", 60, 39); err != nil {
+		t.Fatalf("under quota: %v", err)
+	}
+	if err := a.Add("alice", 0, 1); err != ErrQuotaExceeded {
+		t.Fatalf("daily quota: got %v, want %v", err, ErrQuotaExceeded)
+	}
+	if err := a.Allowed("bob"); err != nil {
+		t.Errorf("bob has no quota: %v", err)
+	}
+
+	setTime(t, "2024-02-01")
+	if err := a.Allowed("alice"); err != nil {
+		t.Errorf("new day and month: %v", err)
+	}
+
+	setTime(t, "2024-02-02")
+	a.Add("alice", 100, 0)
+	setTime(t, "2024-02-03")
+	if err := a.Add("alice", 50, 0); err != ErrQuotaExceeded {
+		t.Errorf("monthly quota: got %v, want %v", err, ErrQuotaExceeded)
+	}
+
+	u := a.Usage("alice")
+	if u.Total != (Counter{Upload: 210, Download: 40}) || u.Daily.Total() != 50 || u.Monthly.Total() != 150 {
+		t.Errorf("usage = %+v", u)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.json")
+	a, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Add("alice", 1, 2)
+	if err = a.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Usage("alice").Total; got != (Counter{Upload: 1, Download: 2}) {
+		t.Errorf("loaded %+v", got)
+	}
+
+	b.Reset("alice")
+	if got := b.Usage("alice").Total; got != (Counter{}) {
+		t.Errorf("after reset %+v", got)
+	}
+}
+
+func TestConnQuota(t *testing.T) {
+	a, _ := Open("")
+	a.SetQuota("alice", Quota{Daily: 10})
+
+	left, right := net.Pipe()
+	defer right.Close()
+	c := a.Conn(left, "alice")
+	go right.Write([]byte("0123456789abc"))
+
+	buf := make([]byte, 64)
+	n, err := c.Read(buf)
+	if n != 13 || err != ErrQuotaExceeded {
+		t.Fatalf("Read = %d, %v; want 13, %v", n, err, ErrQuotaExceeded)
+	}
+	if _, err = c.Write([]byte("x")); err != ErrQuotaExceeded {
+		t.Errorf("Write over quota: got %v, want %v", err, ErrQuotaExceeded)
+	}
+	if _, err = right.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("connection not closed: %v", err)
+	}
+	if got := a.Usage("alice").Total; got != (Counter{Upload: 13}) {
+		t.Errorf("usage = %+v", got)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	a, _ := Open("")
+	a.SetQuota("alice", Quota{Monthly: 1000})
+	a.Add("alice", 3, 4)
+	server := httptest.NewServer(a)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/traffic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reports map[string]Report
+	err = json.NewDecoder(resp.Body).Decode(&reports)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := reports["alice"]; r.Total.Total() != 7 || r.Quota.Monthly != 1000 {
+		t.Errorf("report = %+v", reports)
+	}
+
+	// Looking up an unknown user does not add it.
+	if resp, err = http.Get(server.URL + "/traffic/typo"); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown user: status = %d", resp.StatusCode)
+	}
+	a.Usage("typo")
+	a.Allowed("typo")
+	if users := a.Users(); len(users) != 1 || users[0] != "alice" {
+		t.Errorf("users = %q", users)
+	}
+
+	status := func(method, token string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+"/traffic/alice", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := status(http.MethodDelete, ""); got != http.StatusForbidden {
+		t.Errorf("reset without a token: status = %d", got)
+	}
+	if got := a.Usage("alice").Total; got.Total() != 7 {
+		t.Errorf("after refused reset %+v", got)
+	}
+
+	a.Token = "secret"
+	for _, token := range []string{"", "wrong"} {
+		if got := status(http.MethodGet, token); got != http.StatusUnauthorized {
+			t.Errorf("get with token %q: status = %d", token, got)
+		}
+		if got := status(http.MethodDelete, token); got != http.StatusUnauthorized {
+			t.Errorf("reset with token %q: status = %d", token, got)
+		}
+	}
+	if got := a.Usage("alice").Total; got.Total() != 7 {
+		t.Errorf("after unauthorized reset %+v", got)
+	}
+	if got := status(http.MethodDelete, "secret"); got != http.StatusNoContent {
+		t.Errorf("reset status = %d", got)
+	}
+	if got := a.Usage("alice").Total; got != (Counter{}) {
+		t.Errorf("after reset %+v", got)
+	}
+}
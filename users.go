@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/OperatorFoundation/go-shadowsocks2/core"
+	"github.com/OperatorFoundation/go-shadowsocks2/darkstar"
+	"github.com/OperatorFoundation/go-shadowsocks2/traffic"
+)
+
+// usersFile is the format of the -users file, for example
+//
+//	{"users": [
+//		{"name": "alice", "password": "correct horse"},
+//		{"name": "bob", "key": "base64 DarkStar private key",
+//		 "quota": {"daily": 1000000000, "monthly": 20000000000}}
+//	]}
+//
+// With DarkStar every user has a server key pair of their own; the client of
+// the user connects with the public key. Other ciphers use the password, which
+// for Shadowsocks 2022 is the base64 encoded key. Quotas are in bytes of both
+// directions together and take effect with -traffic or -api.
+type usersFile struct {
+	Users []userEntry `json:"users"`
+}
+
+type userEntry struct {
+	Name     string        `json:"name"`
+	Password string        `json:"password,omitempty"`
+	Key      string        `json:"key,omitempty"`
+	Quota    traffic.Quota `json:"quota"`
+}
+
+// userTable loads the users of a multi-user server from a file.
+type userTable struct {
+	path   string
+	cipher string
+	host   string
+	port   int
+
+	users *core.Users
+	// known keeps the users of the last load, so that users whose entry did
+	// not change keep their sessions across reloads.
+	known map[userEntry]*core.User
+}
+
+func newUserTable(path, cipher, host string, port int) (*userTable, error) {
+	t := &userTable{path: path, cipher: cipher, host: host, port: port, users: &core.Users{}}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// load reads the users file and replaces the users of the table.
+func (t *userTable) load() error {
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+	var file usersFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	if len(file.Users) == 0 {
+		return errors.New("no users in " + t.path)
+	}
+
+	users := make([]*core.User, 0, len(file.Users))
+	known := make(map[userEntry]*core.User, len(file.Users))
+	names := make(map[string]bool, len(file.Users))
+	quotas := make(map[string]traffic.Quota, len(file.Users))
+	for _, entry := range file.Users {
+		if entry.Name == "" || names[entry.Name] {
+			return errors.New("every user needs a unique name")
+		}
+		names[entry.Name] = true
+
+		// The quota does not change the cipher of the user.
+		quota := entry.Quota
+		entry.Quota = traffic.Quota{}
+		quotas[entry.Name] = quota
+
+		user, ok := t.known[entry]
+		if !ok {
+			ciph, err := t.newCipher(entry)
+			if err != nil {
+				return errors.New("user " + entry.Name + ": " + err.Error())
+			}
+			user = &core.User{Name: entry.Name, Cipher: ciph}
+		}
+		users = append(users, user)
+		known[entry] = user
+	}
+
+	if err = t.users.SetUsers(users); err != nil {
+		return err
+	}
+	if accountant != nil {
+		for _, user := range t.known {
+			if _, ok := quotas[user.Name]; !ok {
+				accountant.SetQuota(user.Name, traffic.Quota{})
+			}
+		}
+		for name, quota := range quotas {
+			accountant.SetQuota(name, quota)
+		}
+	}
+	t.known = known
+	return nil
+}
+
+func (t *userTable) newCipher(entry userEntry) (core.Cipher, error) {
+	if t.cipher == "DarkStar" {
+		server := darkstar.NewDarkStarServer(entry.Key, t.host, t.port)
+		if server == nil {
+			return nil, errors.New("invalid DarkStar key")
+		}
+		return server, nil
+	}
+
+	return core.PickCipher(t.cipher, nil, entry.Password)
+}
+
+// reload re-reads the users file.
+func (t *userTable) reload() error {
+	if err := t.load(); err != nil {
+		return err
+	}
+	logger.Info("reloaded users", "path", t.path, "users", len(t.known))
+	return nil
+}